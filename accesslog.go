@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// accessWriter records the status and size of a response.
+type accessWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *accessWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *accessWriter) Write(data []byte) (int, error) {
+	if w.status == 0 {
+		w.status = 200
+	}
+	n, err := w.ResponseWriter.Write(data)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *accessWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		if w.status == 0 {
+			w.status = 200
+		}
+		f.Flush()
+	}
+}
+
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// accessLogHandler logs every request handled by h to stderr, either in
+// Apache combined format, with the latency in microseconds appended, or as
+// JSON, with the request identifier. The "none" format returns h unchanged.
+func accessLogHandler(h http.Handler, format string) http.Handler {
+	var logFn func(req *http.Request, w *accessWriter, start time.Time,
+		latency time.Duration)
+
+	switch format {
+	case "combined":
+		logger := log.New(os.Stderr, "", 0)
+		logFn = func(req *http.Request, w *accessWriter, start time.Time,
+			latency time.Duration) {
+
+			size := "-"
+			if w.bytes > 0 {
+				size = fmt.Sprintf("%d", w.bytes)
+			}
+			logger.Printf("%s - - [%s] \"%s %s %s\" %d %s %q %q %d\n",
+				clientIP(req), start.Format("02/Jan/2006:15:04:05 -0700"),
+				req.Method, req.RequestURI, req.Proto, w.status, size,
+				req.Referer(), req.UserAgent(), latency.Microseconds())
+		}
+	case "json":
+		logger := slog.New(slog.NewJSONHandler(os.Stderr, nil))
+		logFn = func(req *http.Request, w *accessWriter, start time.Time,
+			latency time.Duration) {
+
+			logger.Info("request",
+				slog.String("method", req.Method),
+				slog.String("path", req.URL.Path),
+				slog.Int("status", w.status),
+				slog.Duration("latency", latency),
+				slog.Int64("bytes", w.bytes),
+				slog.String("client", clientIP(req)),
+				slog.String("request_id", requestID(req.Context())),
+			)
+		}
+	default:
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		aw := &accessWriter{ResponseWriter: w}
+		defer func() {
+			if aw.status == 0 {
+				aw.status = 200
+			}
+			logFn(req, aw, start, time.Since(start))
+		}()
+		h.ServeHTTP(aw, req)
+	})
+}
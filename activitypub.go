@@ -0,0 +1,685 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Every area is exposed as a minimal ActivityPub actor named zoneAREA,
+// publishing a note per archived bulletin revision to its followers.
+
+const (
+	activityContentType = "application/activity+json"
+	activityContext     = "https://www.w3.org/ns/activitystreams"
+	activityPublic      = "https://www.w3.org/ns/activitystreams#Public"
+	// Number of revisions listed in outboxes
+	outboxSize = 20
+	// Maximum difference between the Date of signed requests and now
+	maxSignatureAge = 5 * time.Minute
+)
+
+// ActivityPub holds the actors key and their followers, persisted in a
+// directory.
+type ActivityPub struct {
+	lock      sync.Mutex
+	dir       string
+	publicURL string
+	host      string
+	archive   *Archive
+	key       *rsa.PrivateKey
+	keyPem    string
+	// Follower actor URL to inbox URL, per area
+	followers map[string]map[string]string
+	client    *http.Client
+	// Retired area identifiers, resolved by WebFinger
+	areaMap AreaMap
+}
+
+// OpenActivityPub loads or creates actors state in dir. publicURL is the
+// public URL of the server, including its prefix.
+func OpenActivityPub(dir, publicURL string, archive *Archive) (*ActivityPub, error) {
+	u, err := url.Parse(publicURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid public URL: %q", publicURL)
+	}
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	ap := &ActivityPub{
+		dir:       dir,
+		publicURL: publicURL,
+		host:      u.Host,
+		archive:   archive,
+		followers: map[string]map[string]string{},
+		client:    &http.Client{Timeout: 30 * time.Second},
+	}
+	err = ap.loadKey()
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "followers.json"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &ap.followers)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ap, nil
+}
+
+func (ap *ActivityPub) loadKey() error {
+	path := filepath.Join(ap.dir, "key.pem")
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err != nil {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return err
+		}
+		data = pem.EncodeToMemory(&pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(key),
+		})
+		err = ioutil.WriteFile(path, data, 0600)
+		if err != nil {
+			return err
+		}
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return fmt.Errorf("invalid key in %s", path)
+	}
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return err
+	}
+	ap.key = key
+	ap.keyPem = string(pem.EncodeToMemory(&pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: pub,
+	}))
+	return nil
+}
+
+// saveFollowers must be called with the lock held.
+func (ap *ActivityPub) saveFollowers() error {
+	data, err := json.Marshal(ap.followers)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(ap.dir, "followers.json")
+	err = ioutil.WriteFile(path+".tmp", data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (ap *ActivityPub) actorURL(area string) string {
+	return ap.publicURL + "/ap/areas/" + area
+}
+
+func actorName(area string) string {
+	return "zone" + area
+}
+
+func writeActivity(w http.ResponseWriter, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "error: %s\n", err)
+		return
+	}
+	w.Header().Set("Content-Type", activityContentType)
+	w.Write(data)
+}
+
+// knownArea returns true if area has archived revisions.
+func (ap *ActivityPub) knownArea(area string) bool {
+	_, ok := ap.archive.Latest(area)
+	return ok
+}
+
+var (
+	reAcct = regexp.MustCompile(`^(?:acct:)?@?zone([^@]+)@(.+)$`)
+)
+
+// ServeWebFinger resolves acct:zoneAREA@host resources to area actors. It
+// must be served at the root of the host.
+func (ap *ActivityPub) ServeWebFinger(w http.ResponseWriter, req *http.Request) {
+	m := reAcct.FindStringSubmatch(req.URL.Query().Get("resource"))
+	if m == nil || !strings.EqualFold(m[2], ap.host) {
+		writeNotFound(w, "resource")
+		return
+	}
+	ap.lock.Lock()
+	area := ap.areaMap.Resolve(m[1])
+	ap.lock.Unlock()
+	if !ap.knownArea(area) {
+		writeNotFound(w, "resource")
+		return
+	}
+	w.Header().Set("Content-Type", "application/jrd+json")
+	data, _ := json.Marshal(map[string]interface{}{
+		"subject": "acct:" + actorName(area) + "@" + ap.host,
+		"links": []map[string]string{{
+			"rel":  "self",
+			"type": activityContentType,
+			"href": ap.actorURL(area),
+		}},
+	})
+	w.Write(data)
+}
+
+func (ap *ActivityPub) serveActor(area string, w http.ResponseWriter) {
+	title := "Bulletin côte zone " + area
+	if rev, ok := ap.archive.Latest(area); ok {
+		if content, err := ap.archive.Read(rev); err == nil {
+			title = bulletinTitle(content)
+		}
+	}
+	actor := ap.actorURL(area)
+	writeActivity(w, map[string]interface{}{
+		"@context":          []string{activityContext, "https://w3id.org/security/v1"},
+		"id":                actor,
+		"type":              "Service",
+		"preferredUsername": actorName(area),
+		"name":              title,
+		"summary":           "Météo-France coastal bulletin, zone " + area,
+		"url":               ap.publicURL + "/areas/" + area,
+		"inbox":             actor + "/inbox",
+		"outbox":            actor + "/outbox",
+		"followers":         actor + "/followers",
+		"publicKey": map[string]string{
+			"id":           actor + "#main-key",
+			"owner":        actor,
+			"publicKeyPem": ap.keyPem,
+		},
+	})
+}
+
+// note returns the Create activity publishing rev.
+func (ap *ActivityPub) note(rev Revision) (map[string]interface{}, error) {
+	content, err := ap.archive.Read(rev)
+	if err != nil {
+		return nil, err
+	}
+	actor := ap.actorURL(rev.Area)
+	id := ap.publicURL + revisionPath("", rev)
+	paragraphs := []string{}
+	for _, p := range strings.Split(strings.TrimSpace(content), "\n\n") {
+		p = strings.Replace(html.EscapeString(strings.TrimSpace(p)), "\n", "<br>", -1)
+		if p != "" {
+			paragraphs = append(paragraphs, "<p>"+p+"</p>")
+		}
+	}
+	published := rev.Time.Format(time.RFC3339)
+	note := map[string]interface{}{
+		"id":           id,
+		"type":         "Note",
+		"attributedTo": actor,
+		"content":      strings.Join(paragraphs, ""),
+		"published":    published,
+		"url":          id,
+		"to":           []string{activityPublic},
+		"cc":           []string{actor + "/followers"},
+	}
+	return map[string]interface{}{
+		"@context":  activityContext,
+		"id":        id + "#create",
+		"type":      "Create",
+		"actor":     actor,
+		"published": published,
+		"to":        note["to"],
+		"cc":        note["cc"],
+		"object":    note,
+	}, nil
+}
+
+func (ap *ActivityPub) serveOutbox(area string, w http.ResponseWriter) {
+	revisions := ap.archive.Editions(area)
+	items := []interface{}{}
+	for i := len(revisions) - 1; i >= 0 && len(items) < outboxSize; i-- {
+		create, err := ap.note(revisions[i])
+		if err != nil {
+			slog.Error("activitypub outbox", "error", err)
+			continue
+		}
+		items = append(items, create)
+	}
+	writeActivity(w, map[string]interface{}{
+		"@context":     activityContext,
+		"id":           ap.actorURL(area) + "/outbox",
+		"type":         "OrderedCollection",
+		"totalItems":   len(revisions),
+		"orderedItems": items,
+	})
+}
+
+func (ap *ActivityPub) serveFollowers(area string, w http.ResponseWriter) {
+	ap.lock.Lock()
+	n := len(ap.followers[area])
+	ap.lock.Unlock()
+	writeActivity(w, map[string]interface{}{
+		"@context":   activityContext,
+		"id":         ap.actorURL(area) + "/followers",
+		"type":       "OrderedCollection",
+		"totalItems": n,
+	})
+}
+
+// ServeActor handles requests below /ap/areas/.
+func (ap *ActivityPub) ServeActor(w http.ResponseWriter, req *http.Request) {
+	p := strings.TrimPrefix(req.URL.Path, "/ap/areas/")
+	parts := strings.Split(strings.Trim(p, "/"), "/")
+	area := parts[0]
+	if !ap.knownArea(area) || len(parts) > 2 {
+		writeNotFound(w, req.URL.Path)
+		return
+	}
+	if len(parts) == 1 {
+		ap.serveActor(area, w)
+		return
+	}
+	switch parts[1] {
+	case "outbox":
+		ap.serveOutbox(area, w)
+	case "followers":
+		ap.serveFollowers(area, w)
+	case "inbox":
+		if req.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		err := ap.receive(area, req)
+		if err != nil {
+			ctxLogger(req.Context()).Error("activitypub inbox", "area", area,
+				"error", err)
+			w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "error: %s\n", err)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		writeNotFound(w, req.URL.Path)
+	}
+}
+
+type activity struct {
+	Id     string          `json:"id"`
+	Type   string          `json:"type"`
+	Actor  string          `json:"actor"`
+	Object json.RawMessage `json:"object"`
+}
+
+// objectId returns the identifier of an embedded object or link.
+func objectId(raw json.RawMessage) string {
+	s := ""
+	if json.Unmarshal(raw, &s) == nil {
+		return s
+	}
+	obj := struct {
+		Id string `json:"id"`
+	}{}
+	json.Unmarshal(raw, &obj)
+	return obj.Id
+}
+
+func (ap *ActivityPub) receive(area string, req *http.Request) error {
+	body, err := ioutil.ReadAll(io.LimitReader(req.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	signer, err := ap.verify(area, req, body)
+	if err != nil {
+		return err
+	}
+	act := activity{}
+	err = json.Unmarshal(body, &act)
+	if err != nil {
+		return err
+	}
+	if act.Actor != signer.Id {
+		return fmt.Errorf("activity actor %s does not match signer %s",
+			act.Actor, signer.Id)
+	}
+	actor := ap.actorURL(area)
+	switch act.Type {
+	case "Follow":
+		if objectId(act.Object) != actor {
+			return fmt.Errorf("cannot follow %s", objectId(act.Object))
+		}
+		ap.lock.Lock()
+		if ap.followers[area] == nil {
+			ap.followers[area] = map[string]string{}
+		}
+		ap.followers[area][signer.Id] = signer.Inbox
+		err = ap.saveFollowers()
+		ap.lock.Unlock()
+		if err != nil {
+			return err
+		}
+		accept := map[string]interface{}{
+			"@context": activityContext,
+			"id":       actor + "#accept-" + newRequestId(),
+			"type":     "Accept",
+			"actor":    actor,
+			"object":   json.RawMessage(body),
+		}
+		go func() {
+			err := ap.deliver(area, signer.Inbox, accept)
+			if err != nil {
+				slog.Error("activitypub accept", "actor", signer.Id,
+					"error", err)
+			}
+		}()
+	case "Undo":
+		inner := activity{}
+		json.Unmarshal(act.Object, &inner)
+		if inner.Type != "Follow" {
+			return nil
+		}
+		ap.lock.Lock()
+		delete(ap.followers[area], signer.Id)
+		err = ap.saveFollowers()
+		ap.lock.Unlock()
+		return err
+	}
+	return nil
+}
+
+type remoteActor struct {
+	Id        string `json:"id"`
+	Inbox     string `json:"inbox"`
+	PublicKey struct {
+		Id           string `json:"id"`
+		Owner        string `json:"owner"`
+		PublicKeyPem string `json:"publicKeyPem"`
+	} `json:"publicKey"`
+}
+
+// checkSigner checks the actor document fetched from keyId is the one of the
+// key, whose owner it is, and lives on the same host. Otherwise, any server
+// could serve a document claiming the identifier of someone else's actor,
+// and follow or unfollow on their behalf.
+func checkSigner(keyId string, actor *remoteActor) error {
+	keyURL, err := url.Parse(keyId)
+	if err != nil {
+		return err
+	}
+	actorURL, err := url.Parse(actor.Id)
+	if err != nil {
+		return err
+	}
+	if actor.PublicKey.Id != keyId {
+		return fmt.Errorf("actor %s key is %s, not %s", actor.Id,
+			actor.PublicKey.Id, keyId)
+	}
+	if actor.PublicKey.Owner != actor.Id {
+		return fmt.Errorf("key %s is owned by %s, not %s", keyId,
+			actor.PublicKey.Owner, actor.Id)
+	}
+	if actorURL.Host == "" || actorURL.Host != keyURL.Host {
+		return fmt.Errorf("actor %s is not hosted with key %s", actor.Id,
+			keyId)
+	}
+	return nil
+}
+
+// checkSignatureDate checks the Date of a signed request is close to now, so
+// captured requests cannot be replayed later.
+func checkSignatureDate(date string, now time.Time) error {
+	t, err := http.ParseTime(date)
+	if err != nil {
+		return fmt.Errorf("invalid signature date: %q", date)
+	}
+	if d := now.Sub(t); d > maxSignatureAge || d < -maxSignatureAge {
+		return fmt.Errorf("signature date %s is too far from now", date)
+	}
+	return nil
+}
+
+// fetchActor retrieves a remote actor document, signing the request with the
+// key of area actor since some servers require it.
+func (ap *ActivityPub) fetchActor(area, actorURL string) (*remoteActor, error) {
+	rq, err := http.NewRequest("GET", actorURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	rq.Header.Set("Accept", activityContentType)
+	err = ap.sign(area, rq, nil)
+	if err != nil {
+		return nil, err
+	}
+	rsp, err := ap.client.Do(rq)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("got %d fetching %s", rsp.StatusCode, actorURL)
+	}
+	actor := &remoteActor{}
+	err = json.NewDecoder(io.LimitReader(rsp.Body, 1<<20)).Decode(actor)
+	if err != nil {
+		return nil, err
+	}
+	if actor.Inbox == "" || actor.PublicKey.PublicKeyPem == "" {
+		return nil, fmt.Errorf("incomplete actor %s", actorURL)
+	}
+	return actor, nil
+}
+
+var (
+	reSignatureParam = regexp.MustCompile(`(\w+)="([^"]*)"`)
+)
+
+// verify checks the HTTP signature of an inbox request of area actor and
+// returns the signing actor.
+func (ap *ActivityPub) verify(area string, req *http.Request,
+	body []byte) (*remoteActor, error) {
+
+	params := map[string]string{}
+	for _, m := range reSignatureParam.FindAllStringSubmatch(req.Header.Get("Signature"), -1) {
+		params[m[1]] = m[2]
+	}
+	if params["keyId"] == "" || params["signature"] == "" {
+		return nil, fmt.Errorf("missing HTTP signature")
+	}
+	headers := strings.Fields(params["headers"])
+	if len(headers) == 0 {
+		headers = []string{"date"}
+	}
+	covered := map[string]bool{}
+	for _, h := range headers {
+		covered[h] = true
+	}
+	for _, h := range []string{"(request-target)", "date", "digest"} {
+		if !covered[h] {
+			return nil, fmt.Errorf("signature does not cover %s", h)
+		}
+	}
+	err := checkSignatureDate(req.Header.Get("Date"), time.Now())
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(body)
+	if req.Header.Get("Digest") != "SHA-256="+base64.StdEncoding.EncodeToString(sum[:]) {
+		return nil, fmt.Errorf("invalid body digest")
+	}
+	keyURL, err := url.Parse(params["keyId"])
+	if err != nil {
+		return nil, err
+	}
+	keyURL.Fragment = ""
+	actor, err := ap.fetchActor(area, keyURL.String())
+	if err != nil {
+		return nil, err
+	}
+	err = checkSigner(params["keyId"], actor)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode([]byte(actor.PublicKey.PublicKeyPem))
+	if block == nil {
+		return nil, fmt.Errorf("invalid public key of %s", actor.Id)
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaPub, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported public key of %s", actor.Id)
+	}
+	sig, err := base64.StdEncoding.DecodeString(params["signature"])
+	if err != nil {
+		return nil, err
+	}
+	signed := sha256.Sum256([]byte(signingString(req, headers)))
+	err = rsa.VerifyPKCS1v15(rsaPub, crypto.SHA256, signed[:], sig)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature: %s", err)
+	}
+	return actor, nil
+}
+
+// signingString returns the string signed by HTTP signatures of req covering
+// headers. Received requests are signed with their original request URI,
+// including the --prefix stripped by prefixHandler.
+func signingString(req *http.Request, headers []string) string {
+	lines := []string{}
+	for _, h := range headers {
+		v := ""
+		switch h {
+		case "(request-target)":
+			target := req.RequestURI
+			if target == "" {
+				target = req.URL.RequestURI()
+			}
+			v = strings.ToLower(req.Method) + " " + target
+		case "host":
+			v = req.Host
+			if v == "" {
+				v = req.URL.Host
+			}
+		default:
+			v = req.Header.Get(h)
+		}
+		lines = append(lines, h+": "+v)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// sign adds an HTTP signature made with area actor key to rq.
+func (ap *ActivityPub) sign(area string, rq *http.Request, body []byte) error {
+	rq.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	headers := []string{"(request-target)", "host", "date"}
+	if body != nil {
+		sum := sha256.Sum256(body)
+		rq.Header.Set("Digest", "SHA-256="+base64.StdEncoding.EncodeToString(sum[:]))
+		headers = append(headers, "digest")
+	}
+	rq.Host = rq.URL.Host
+	signed := sha256.Sum256([]byte(signingString(rq, headers)))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, ap.key, crypto.SHA256, signed[:])
+	if err != nil {
+		return err
+	}
+	rq.Header.Set("Signature", fmt.Sprintf(
+		`keyId="%s#main-key",algorithm="rsa-sha256",headers="%s",signature="%s"`,
+		ap.actorURL(area), strings.Join(headers, " "),
+		base64.StdEncoding.EncodeToString(sig)))
+	return nil
+}
+
+// deliver posts a signed activity of area actor to inbox.
+func (ap *ActivityPub) deliver(area, inbox string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	rq, err := http.NewRequest("POST", inbox, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	rq.Header.Set("Content-Type", activityContentType)
+	err = ap.sign(area, rq, body)
+	if err != nil {
+		return err
+	}
+	rsp, err := ap.client.Do(rq)
+	if err != nil {
+		return err
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode < 200 || rsp.StatusCode >= 300 {
+		return fmt.Errorf("got %d delivering to %s", rsp.StatusCode, inbox)
+	}
+	return nil
+}
+
+func (ap *ActivityPub) Name() string {
+	return "activitypub"
+}
+
+// Notify delivers a note for the new revision to area followers. Delivery
+// failures are logged, not retried, to avoid duplicates on other followers.
+func (ap *ActivityPub) Notify(notif Notification) error {
+	if notif.Revision == nil || notif.Forecast.Drill {
+		return nil
+	}
+	area := notif.Revision.Area
+	create, err := ap.note(*notif.Revision)
+	if err != nil {
+		return err
+	}
+	ap.lock.Lock()
+	inboxes := map[string]bool{}
+	for _, inbox := range ap.followers[area] {
+		inboxes[inbox] = true
+	}
+	ap.lock.Unlock()
+	for inbox := range inboxes {
+		err := ap.deliver(area, inbox, create)
+		if err != nil {
+			slog.Error("activitypub delivery", "error", err)
+		}
+	}
+	return nil
+}
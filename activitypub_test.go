@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignatureUnderPrefix(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ap := &ActivityPub{
+		publicURL: "https://example.org/metmar",
+		key:       key,
+	}
+	body := []byte(`{"type":"Follow"}`)
+	inbox := "https://example.org/metmar/ap/areas/3/inbox"
+	rq, err := http.NewRequest("POST", inbox, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ap.sign("3", rq, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Replay the signed request to a server stripping the prefix
+	req := httptest.NewRequest("POST", "/metmar/ap/areas/3/inbox",
+		bytes.NewReader(body))
+	req.Host = "example.org"
+	req.Header = rq.Header.Clone()
+	verified := false
+	h := prefixHandler(http.HandlerFunc(func(w http.ResponseWriter,
+		req *http.Request) {
+
+		if req.URL.Path != "/ap/areas/3/inbox" {
+			t.Fatalf("prefix not stripped: %s", req.URL.Path)
+		}
+		params := map[string]string{}
+		re := regexp.MustCompile(`(\w+)="([^"]*)"`)
+		for _, m := range re.FindAllStringSubmatch(req.Header.Get("Signature"), -1) {
+			params[m[1]] = m[2]
+		}
+		sig, err := base64.StdEncoding.DecodeString(params["signature"])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signed := sha256.Sum256([]byte(signingString(req,
+			strings.Fields(params["headers"]))))
+		err = rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, signed[:], sig)
+		if err != nil {
+			t.Fatalf("signature does not verify under prefix: %s", err)
+		}
+		verified = true
+	}), "/metmar", false)
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if !verified {
+		t.Fatal("handler was not called")
+	}
+}
+
+func TestCheckSigner(t *testing.T) {
+	actor := func(id, keyId, owner string) *remoteActor {
+		a := &remoteActor{Id: id}
+		a.PublicKey.Id = keyId
+		a.PublicKey.Owner = owner
+		return a
+	}
+	const (
+		id    = "https://social.example/users/alice"
+		keyId = "https://social.example/users/alice#main-key"
+		other = "https://other.example/users/bob"
+	)
+	tests := []struct {
+		actor *remoteActor
+		ok    bool
+	}{
+		{actor(id, keyId, id), true},
+		// Document served by the signer, claiming another actor
+		{actor(other, keyId, other), false},
+		{actor(id, keyId, other), false},
+		{actor(id, "https://social.example/users/eve#main-key", id), false},
+	}
+	for i, test := range tests {
+		err := checkSigner(keyId, test.actor)
+		if (err == nil) != test.ok {
+			t.Errorf("%d: unexpected result: %v", i, err)
+		}
+	}
+}
+
+func TestCheckSignatureDate(t *testing.T) {
+	now := time.Date(2024, 10, 16, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		date time.Time
+		ok   bool
+	}{
+		{now, true},
+		{now.Add(-2 * time.Minute), true},
+		{now.Add(-time.Hour), false},
+		{now.Add(time.Hour), false},
+	}
+	for i, test := range tests {
+		err := checkSignatureDate(test.date.Format(http.TimeFormat), now)
+		if (err == nil) != test.ok {
+			t.Errorf("%d: unexpected result: %v", i, err)
+		}
+	}
+	if checkSignatureDate("", now) == nil {
+		t.Errorf("missing date accepted")
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	adminTemplate = `<html>
+<head>
+	<meta charset="utf-8"/>
+	<title>metmar dashboard</title>
+	<style>
+		table { border-collapse: collapse; }
+		td, th { border: 1px solid #ccc; padding: 2px 6px; text-align: left; }
+		.error { color: #b00; }
+	</style>
+	<script src="{{.Prefix}}/admin/dashboard.js" defer></script>
+	<noscript><meta http-equiv="refresh" content="30"/></noscript>
+</head>
+<body>
+	<h1>Dashboard</h1>
+	<p>Last fetch: <span id="fetched">{{.Fetched}}</span>, connection: <span id="connection">snapshot</span></p>
+	<form method="post" action="{{.Prefix}}/admin/refresh"><button>Refresh bulletins</button></form>
+	<h2>Fetches in flight</h2>
+	<table><tbody id="inflight">{{range .InFlight}}
+		<tr><td>{{index . 0}}</td><td>{{index . 1}}</td></tr>{{end}}
+	</tbody></table>
+	<h2>Notifications</h2>
+	<p>Queue depth: <span id="depth">{{.QueueDepth}}</span></p>
+	<table><tbody id="backlogs">{{range .Backlogs}}
+		<tr><td>{{index . 0}}</td><td>{{index . 1}}</td></tr>{{end}}
+	</tbody></table>
+	<h2>Areas</h2>
+	<table><tbody id="areas">{{range .Areas}}
+		<tr><td>{{.Area}}</td><td>{{.Title}}</td><td>{{formatAge .Issued}}</td></tr>{{end}}
+	</tbody></table>
+	<h2>Drill</h2>
+	<form method="post" action="{{.Prefix}}/admin/drill">
+		Area <input name="area" size="3"/>
+		<select name="level">{{range .Levels}}<option>{{.}}</option>{{end}}</select>
+		for <input name="duration" value="1h" size="4"/>
+		<input name="text" placeholder="forecast text" size="40"/>
+		<button>Start drill</button>
+		<button formaction="{{.Prefix}}/admin/drill/end">End drill</button>
+	</form>
+	<h2>Recent events</h2>
+	<table><tbody id="events">{{range .Events}}
+		<tr{{if .Error}} class="error"{{end}}><td>{{.Time.Format "2006-01-02 15:04:05"}}</td><td>{{.Source}}</td><td>{{.Message}}</td></tr>{{end}}
+	</tbody></table>
+</body>
+</html>
+`
+	adminScript = `'use strict';
+function fill(id, rows) {
+	var body = document.getElementById(id);
+	while (body.firstChild) {
+		body.removeChild(body.firstChild);
+	}
+	rows.forEach(function(row) {
+		var tr = document.createElement('tr');
+		if (row.error) {
+			tr.className = 'error';
+		}
+		row.cells.forEach(function(cell) {
+			var td = document.createElement('td');
+			td.textContent = cell;
+			tr.appendChild(td);
+		});
+		body.appendChild(tr);
+	});
+}
+function age(t) {
+	var d = new Date(t);
+	if (d.getFullYear() < 1970) {
+		return 'unknown';
+	}
+	var mins = Math.round((Date.now() - d.getTime()) / 60000);
+	return d.toLocaleString() + ' (' + mins + ' min ago)';
+}
+function render(st) {
+	document.getElementById('fetched').textContent = age(st.fetched);
+	document.getElementById('depth').textContent = st.queue_depth;
+	fill('inflight', Object.keys(st.in_flight).sort().map(function(k) {
+		return {cells: [k, age(st.in_flight[k])]};
+	}));
+	fill('backlogs', Object.keys(st.backlogs).sort().map(function(k) {
+		return {cells: [k, st.backlogs[k]]};
+	}));
+	fill('areas', (st.areas || []).map(function(a) {
+		return {cells: [a.area, a.title, age(a.issued)]};
+	}));
+	fill('events', (st.events || []).map(function(e) {
+		return {cells: [new Date(e.time).toLocaleString(), e.source, e.message],
+			error: e.error};
+	}));
+}
+var source = new EventSource('admin/events');
+source.addEventListener('status', function(e) {
+	render(JSON.parse(e.data));
+});
+source.onopen = function() {
+	document.getElementById('connection').textContent = 'live';
+};
+source.onerror = function() {
+	document.getElementById('connection').textContent = 'reconnecting';
+};
+`
+)
+
+var (
+	adminTmpl = template.Must(template.New("admin").Funcs(template.FuncMap{
+		"formatAge": formatAge,
+	}).Parse(adminTemplate))
+)
+
+// formatAge formats t with its age, like the dashboard script.
+func formatAge(t time.Time) string {
+	if t.IsZero() {
+		return "unknown"
+	}
+	return fmt.Sprintf("%s (%d min ago)", t.Format("2006-01-02 15:04:05"),
+		int(time.Since(t).Minutes()+0.5))
+}
+
+// renderAdmin renders the dashboard with a snapshot of the monitor status,
+// updated live by the dashboard script. Without JavaScript, the page reloads
+// itself. Links start with prefix.
+func renderAdmin(st MonitorStatus, prefix string) ([]byte, error) {
+	data := struct {
+		MonitorStatus
+		Prefix   string
+		Fetched  string
+		InFlight [][2]string
+		Backlogs [][2]string
+		Levels   []string
+	}{
+		MonitorStatus: st,
+		Prefix:        prefix,
+		Fetched:       formatAge(st.Fetched),
+		Levels:        bmsLevels,
+	}
+	fetches := []string{}
+	for name := range st.InFlight {
+		fetches = append(fetches, name)
+	}
+	sort.Strings(fetches)
+	for _, name := range fetches {
+		data.InFlight = append(data.InFlight,
+			[2]string{name, formatAge(st.InFlight[name])})
+	}
+	backlogs := []string{}
+	for name := range st.Backlogs {
+		backlogs = append(backlogs, name)
+	}
+	sort.Strings(backlogs)
+	for _, name := range backlogs {
+		data.Backlogs = append(data.Backlogs,
+			[2]string{name, strconv.Itoa(st.Backlogs[name])})
+	}
+	w := &bytes.Buffer{}
+	err := adminTmpl.Execute(w, &data)
+	return w.Bytes(), err
+}
+
+// serveAdminEvents streams the monitor status as server-sent events, at most
+// every throttle and at least every heartbeat.
+func serveAdminEvents(cache *ForecastCache, w http.ResponseWriter,
+	req *http.Request) {
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "error: streaming is not supported\n")
+		return
+	}
+	const (
+		throttle  = 250 * time.Millisecond
+		heartbeat = 15 * time.Second
+	)
+	changes, release := monitor.Subscribe()
+	defer release()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	for {
+		data, err := json.Marshal(monitor.Status(cache))
+		if err != nil {
+			return
+		}
+		_, err = fmt.Fprintf(w, "event: status\ndata: %s\n\n", data)
+		if err != nil {
+			return
+		}
+		flusher.Flush()
+		select {
+		case <-req.Context().Done():
+			return
+		case <-shuttingDown(req.Context()):
+			return
+		case <-changes:
+		case <-time.After(heartbeat):
+		}
+		time.Sleep(throttle)
+	}
+}
+
+// serveAdminRefresh fetches every bulletin again on POST, and redirects to
+// the dashboard.
+func serveAdminRefresh(cache *ForecastCache, user string,
+	w http.ResponseWriter, req *http.Request) {
+
+	if req.Method != "POST" {
+		w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+		w.Header().Set("Allow", "POST")
+		w.WriteHeader(405)
+		fmt.Fprintf(w, "error: method not allowed\n")
+		return
+	}
+	_, err := cache.Refresh()
+	detail := ""
+	if err != nil {
+		detail = err.Error()
+	}
+	auditLog.Record(req, user, "refresh", "", detail)
+	if err != nil {
+		w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+		w.WriteHeader(502)
+		fmt.Fprintf(w, "error: %s\n", err)
+		return
+	}
+	http.Redirect(w, req, requestPrefix(req)+"/admin", http.StatusSeeOther)
+}
+
+// Admins grants admin access to users by name or group.
+type Admins struct {
+	users  map[string]bool
+	groups map[string]bool
+}
+
+func NewAdmins(users, groups []string) *Admins {
+	a := &Admins{
+		users:  map[string]bool{},
+		groups: map[string]bool{},
+	}
+	for _, name := range users {
+		a.users[name] = true
+	}
+	for _, group := range groups {
+		a.groups[group] = true
+	}
+	return a
+}
+
+// Allowed tells whether id is an admin.
+func (a *Admins) Allowed(id Identity) bool {
+	if a.users[id.Name] {
+		return true
+	}
+	for _, group := range id.Groups {
+		if a.groups[group] {
+			return true
+		}
+	}
+	return false
+}
+
+// sameOrigin tells whether req was sent by a page of this site, from
+// Sec-Fetch-Site or Origin headers. Browsers send credentials, like basic
+// authentication, with cross-site form posts, so admin actions and user
+// settings changes are rejected unless both headers are missing, like with
+// command line clients.
+func sameOrigin(req *http.Request) bool {
+	if site := req.Header.Get("Sec-Fetch-Site"); site != "" {
+		return site == "same-origin" || site == "none"
+	}
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == req.Host
+}
+
+// serveAdmin serves the dashboard of authenticated admins.
+func serveAdmin(cache *ForecastCache, auth Authenticator, admins *Admins,
+	w http.ResponseWriter, req *http.Request) {
+
+	user, ok := requireIdentity(auth, w, req)
+	if !ok {
+		return
+	}
+	if !admins.Allowed(user) {
+		w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+		w.WriteHeader(403)
+		fmt.Fprintf(w, "error: %s is not an admin\n", user.Name)
+		return
+	}
+	if req.Method != "GET" && req.Method != "HEAD" && !sameOrigin(req) {
+		w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+		w.WriteHeader(403)
+		fmt.Fprintf(w, "error: cross-site request rejected\n")
+		return
+	}
+	switch strings.TrimPrefix(req.URL.Path, "/admin") {
+	case "":
+		page, err := renderAdmin(monitor.Status(cache), requestPrefix(req))
+		if err != nil {
+			w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+			w.WriteHeader(500)
+			fmt.Fprintf(w, "error: %s\n", err)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html;charset=utf-8")
+		w.Header().Set("Content-Security-Policy", "default-src 'none'; "+
+			"script-src 'self'; connect-src 'self'; style-src 'unsafe-inline'")
+		w.Write(page)
+	case "/dashboard.js":
+		w.Header().Set("Content-Type", "application/javascript")
+		w.Write([]byte(adminScript))
+	case "/events":
+		serveAdminEvents(cache, w, req)
+	case "/refresh":
+		serveAdminRefresh(cache, user.Name, w, req)
+	case "/audit":
+		serveAudit(w, req)
+	case "/drill", "/drill/end":
+		serveDrill(cache, user.Name, w, req)
+	default:
+		writeNotFound(w, req.URL.Path)
+	}
+}
+
+var (
+	serveAdmins = serveCmd.Flag("admin",
+		"user allowed to access the dashboard at /admin, can be repeated").
+		Strings()
+	serveAdminGroups = serveCmd.Flag("admin-group",
+		"group whose members can access the dashboard at /admin, can be "+
+			"repeated").Strings()
+)
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Revisions are stored as AREA/AREA_TIME.txt, which is also understood by
+	// the gale command.
+	archiveTimeFormat = "2006_01_02T15_04_05"
+)
+
+// Revision is an archived edition of an area bulletin.
+type Revision struct {
+	Area string
+	Time time.Time
+	// Hash of the file content
+	Hash string
+	Path string
+	// Hash of the normalized content, shared by revisions of the same
+	// edition, like ones imported from another archive
+	Edition string
+	// Edition of the preceding revision, empty for the first one
+	Previous string
+}
+
+// Id identifies the revision among its area ones.
+func (r Revision) Id() string {
+	return r.Time.Format(archiveTimeFormat)
+}
+
+// NewEdition tells whether the revision content differs from the preceding
+// one.
+func (r Revision) NewEdition() bool {
+	return r.Edition != r.Previous
+}
+
+// normalizeReport returns report without line ending, trailing space and
+// blank line differences, which do not make new editions.
+func normalizeReport(report string) string {
+	lines := []string{}
+	for _, line := range strings.Split(report, "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// chainRevisions links sorted revisions to their preceding one.
+func chainRevisions(revisions []Revision) {
+	for i := range revisions {
+		revisions[i].Previous = ""
+		if i > 0 {
+			revisions[i].Previous = revisions[i-1].Edition
+		}
+	}
+}
+
+// Archive stores every distinct bulletin edition on disk, one directory per
+// area.
+type Archive struct {
+	lock      sync.Mutex
+	dir       string
+	revisions map[string][]Revision
+	closed    bool
+	// Retired area identifiers, revisions are archived under the new ones
+	areaMap AreaMap
+	// Free space guard, and whether old revisions are deleted when low
+	disk  DiskStatus
+	prune bool
+}
+
+var (
+	errArchiveClosed = fmt.Errorf("archive is closed")
+)
+
+// OpenArchive opens or creates an archive in dir and indexes existing
+// revisions.
+func OpenArchive(dir string) (*Archive, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	a := &Archive{
+		dir:       dir,
+		revisions: map[string][]Revision{},
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		err := a.scanArea(e.Name())
+		if err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+func (a *Archive) scanArea(area string) error {
+	entries, err := ioutil.ReadDir(filepath.Join(a.dir, area))
+	if err != nil {
+		return err
+	}
+	revisions := []Revision{}
+	for _, e := range entries {
+		rev, ok := parseRevisionName(area, e.Name())
+		if !ok || !e.Mode().IsRegular() {
+			continue
+		}
+		rev.Path = filepath.Join(a.dir, area, e.Name())
+		data, err := ioutil.ReadFile(rev.Path)
+		if err != nil {
+			return err
+		}
+		rev.Hash = hashReport(string(data))
+		rev.Edition = hashReport(normalizeReport(string(data)))
+		revisions = append(revisions, rev)
+	}
+	sortRevisions(revisions)
+	chainRevisions(revisions)
+	a.revisions[area] = revisions
+	return nil
+}
+
+// parseRevisionName parses revision file names like 3_2020_05_31T06_30_00.txt.
+func parseRevisionName(area, name string) (Revision, bool) {
+	prefix := area + "_"
+	if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ".txt") {
+		return Revision{}, false
+	}
+	stamp := strings.TrimSuffix(strings.TrimPrefix(name, prefix), ".txt")
+	t, err := time.Parse(archiveTimeFormat, stamp)
+	if err != nil {
+		return Revision{}, false
+	}
+	return Revision{
+		Area: area,
+		Time: t,
+	}, true
+}
+
+func sortRevisions(revisions []Revision) {
+	sort.Slice(revisions, func(i, j int) bool {
+		return revisions[i].Time.Before(revisions[j].Time)
+	})
+}
+
+// Save archives f as a new revision taken at now, unless its normalized
+// content equals the latest archived revision one. It returns the new
+// revision or nil.
+func (a *Archive) Save(f Forecast, now time.Time) (*Revision, error) {
+	if f.Id == "" || strings.ContainsAny(f.Id, `/\.`) {
+		return nil, fmt.Errorf("invalid area identifier: %q", f.Id)
+	}
+	edition := hashReport(normalizeReport(f.Content))
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.closed {
+		return nil, errArchiveClosed
+	}
+	f.Id = a.areaMap.Resolve(f.Id)
+	revisions := a.revisions[f.Id]
+	rev := Revision{
+		Area:    f.Id,
+		Time:    now.UTC().Truncate(time.Second),
+		Hash:    hashReport(f.Content),
+		Edition: edition,
+	}
+	if len(revisions) > 0 {
+		latest := revisions[len(revisions)-1]
+		if latest.Edition == edition {
+			return nil, nil
+		}
+		rev.Previous = latest.Edition
+		if !rev.Time.After(latest.Time) {
+			rev.Time = latest.Time.Add(time.Second)
+		}
+	}
+	err := a.checkDisk()
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(a.dir, f.Id)
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	rev.Path = filepath.Join(dir, f.Id+"_"+rev.Id()+".txt")
+	tmp := rev.Path + ".tmp"
+	err = ioutil.WriteFile(tmp, []byte(f.Content), 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Rename(tmp, rev.Path)
+	if err != nil {
+		return nil, err
+	}
+	a.revisions[f.Id] = append(revisions, rev)
+	return &rev, nil
+}
+
+// Import stores content as the area revision taken at t, typically copied
+// from another archive. It returns false if the revision already exists.
+func (a *Archive) Import(area string, t time.Time, content string) (bool, error) {
+	if area == "" || strings.ContainsAny(area, `/\.`) {
+		return false, fmt.Errorf("invalid area identifier: %q", area)
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.closed {
+		return false, errArchiveClosed
+	}
+	area = a.areaMap.Resolve(area)
+	rev := Revision{
+		Area:    area,
+		Time:    t.UTC(),
+		Hash:    hashReport(content),
+		Edition: hashReport(normalizeReport(content)),
+	}
+	revisions := a.revisions[area]
+	for _, r := range revisions {
+		if r.Id() != rev.Id() {
+			continue
+		}
+		if r.Hash != rev.Hash {
+			return false, fmt.Errorf("revision %s of area %s differs", rev.Id(),
+				area)
+		}
+		return false, nil
+	}
+	err := a.checkDisk()
+	if err != nil {
+		return false, err
+	}
+	dir := filepath.Join(a.dir, area)
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return false, err
+	}
+	rev.Path = filepath.Join(dir, area+"_"+rev.Id()+".txt")
+	tmp := rev.Path + ".tmp"
+	err = ioutil.WriteFile(tmp, []byte(content), 0644)
+	if err != nil {
+		return false, err
+	}
+	err = os.Rename(tmp, rev.Path)
+	if err != nil {
+		return false, err
+	}
+	revisions = append(revisions, rev)
+	sortRevisions(revisions)
+	chainRevisions(revisions)
+	a.revisions[area] = revisions
+	return true, nil
+}
+
+// Close waits for ongoing writes to complete and rejects later ones.
+func (a *Archive) Close() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.closed = true
+}
+
+// Listen is a ForecastListener archiving changed forecasts, drills aside.
+func (a *Archive) Listen(previous, current []Forecast) {
+	now := time.Now()
+	for _, f := range current {
+		if f.Drill {
+			continue
+		}
+		_, err := a.Save(f, now)
+		// Pauses are reported once by the disk guard
+		if err != nil && err != errArchivePaused {
+			slog.Error("archiving area", "area", f.Id, "error", err)
+		}
+	}
+}
+
+// Areas returns the archived areas, sorted.
+func (a *Archive) Areas() []string {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	areas := []string{}
+	for area := range a.revisions {
+		areas = append(areas, area)
+	}
+	sort.Strings(areas)
+	return areas
+}
+
+// Revisions returns area revisions, oldest first.
+func (a *Archive) Revisions(area string) []Revision {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return append([]Revision(nil), a.revisions[area]...)
+}
+
+// Editions returns area revisions starting a new edition, oldest first.
+// Revisions repeating the preceding content, like ones imported from an
+// archive written before normalization, are left out.
+func (a *Archive) Editions(area string) []Revision {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	editions := []Revision{}
+	for _, rev := range a.revisions[area] {
+		if rev.NewEdition() {
+			editions = append(editions, rev)
+		}
+	}
+	return editions
+}
+
+// Latest returns the most recent revision of area.
+func (a *Archive) Latest(area string) (Revision, bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	revisions := a.revisions[area]
+	if len(revisions) == 0 {
+		return Revision{}, false
+	}
+	return revisions[len(revisions)-1], true
+}
+
+// Revision looks up an area revision by identifier.
+func (a *Archive) Revision(area, id string) (Revision, bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for _, rev := range a.revisions[area] {
+		if rev.Id() == id {
+			return rev, true
+		}
+	}
+	return Revision{}, false
+}
+
+// Read returns the bulletin text of rev.
+func (a *Archive) Read(rev Revision) (string, error) {
+	data, err := ioutil.ReadFile(rev.Path)
+	return string(data), err
+}
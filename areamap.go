@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// AreaMap maps area identifiers retired by upstream to their replacement, so
+// bookmarks, subscriptions and archives survive zone renumbering.
+type AreaMap map[string]string
+
+// LoadAreaMap reads "old new" lines from path. Empty lines and lines starting
+// with # are ignored.
+func LoadAreaMap(path string) (AreaMap, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	m := AreaMap{}
+	scanner := bufio.NewScanner(fp)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 || strings.ContainsAny(line, `/\.`) {
+			return nil, fmt.Errorf("%s:%d: expected old and new area identifiers",
+				path, n)
+		}
+		m[fields[0]] = fields[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for old := range m {
+		if _, ok := m.resolve(old); !ok {
+			return nil, fmt.Errorf("%s: area %s renamings form a cycle", path, old)
+		}
+	}
+	return m, nil
+}
+
+func (m AreaMap) resolve(area string) (string, bool) {
+	for i := 0; i <= len(m); i++ {
+		next, ok := m[area]
+		if !ok {
+			return area, true
+		}
+		area = next
+	}
+	return area, false
+}
+
+// Resolve returns the current identifier of area, following chained
+// renamings.
+func (m AreaMap) Resolve(area string) string {
+	area, _ = m.resolve(area)
+	return area
+}
+
+// ResolveAll maps areas and removes duplicates.
+func (m AreaMap) ResolveAll(areas []string) []string {
+	seen := map[string]bool{}
+	resolved := []string{}
+	for _, area := range areas {
+		area = m.Resolve(area)
+		if !seen[area] {
+			seen[area] = true
+			resolved = append(resolved, area)
+		}
+	}
+	return resolved
+}
+
+// Redirect permanently redirects requests to area pages, feeds, archives and
+// actors of retired areas to their replacement.
+func (m AreaMap) Redirect(h http.Handler) http.Handler {
+	roots := []string{
+		"/areas/",
+		"/sync/",
+		"/ap/areas/",
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for _, root := range roots {
+			if !strings.HasPrefix(req.URL.Path, root) {
+				continue
+			}
+			rest := strings.TrimPrefix(req.URL.Path, root)
+			end := strings.IndexAny(rest, "/.")
+			if end < 0 {
+				end = len(rest)
+			}
+			area := m.Resolve(rest[:end])
+			if area == rest[:end] {
+				break
+			}
+			u := *req.URL
+			u.Path = requestPrefix(req) + root + area + rest[end:]
+			u.RawPath = ""
+			code := http.StatusMovedPermanently
+			if req.Method != "GET" && req.Method != "HEAD" {
+				// Keep the method and body, for ActivityPub inboxes
+				code = http.StatusPermanentRedirect
+			}
+			http.Redirect(w, req, u.String(), code)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// MapAreas files revisions of retired areas under their replacement, and
+// archives later ones there.
+func (a *Archive) MapAreas(m AreaMap) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.areaMap = m
+	for old := range m {
+		revisions, ok := a.revisions[old]
+		if !ok {
+			continue
+		}
+		delete(a.revisions, old)
+		area := m.Resolve(old)
+		for _, rev := range revisions {
+			rev.Area = area
+			a.revisions[area] = append(a.revisions[area], rev)
+		}
+		sortRevisions(a.revisions[area])
+	}
+}
+
+// MapAreas rewrites favorites and notification settings referring to retired
+// areas. They are persisted on the next update.
+func (s *UserStore) MapAreas(m AreaMap) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, d := range s.users {
+		d.Favorites = m.ResolveAll(d.Favorites)
+		d.Notifications.Areas = m.ResolveAll(d.Notifications.Areas)
+	}
+}
+
+// MapAreas moves followers of retired areas actors to their replacement and
+// resolves their WebFinger accounts.
+func (ap *ActivityPub) MapAreas(m AreaMap) error {
+	ap.lock.Lock()
+	defer ap.lock.Unlock()
+	ap.areaMap = m
+	changed := false
+	for old := range m {
+		followers, ok := ap.followers[old]
+		if !ok {
+			continue
+		}
+		delete(ap.followers, old)
+		area := m.Resolve(old)
+		if ap.followers[area] == nil {
+			ap.followers[area] = map[string]string{}
+		}
+		for actor, inbox := range followers {
+			ap.followers[area][actor] = inbox
+		}
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	return ap.saveFollowers()
+}
+
+var (
+	serveAreaMap = serveCmd.Flag("area-map",
+		"file of \"old new\" lines mapping retired area identifiers to new ones").
+		String()
+)
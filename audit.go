@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// AuditEntry records an action performed by an authenticated user or token.
+type AuditEntry struct {
+	Time time.Time `json:"time"`
+	// User name, or the kind of token for token authenticated requests
+	User   string `json:"user"`
+	Action string `json:"action"`
+	// Object of the action, like an area
+	Target string `json:"target,omitempty"`
+	Detail string `json:"detail,omitempty"`
+	Remote string `json:"remote,omitempty"`
+}
+
+// AuditLog appends entries to a file of JSON lines. Entries are never
+// rewritten.
+type AuditLog struct {
+	lock sync.Mutex
+	path string
+	fp   *os.File
+}
+
+var (
+	// auditLog records admin and user actions, if not nil
+	auditLog *AuditLog
+)
+
+func OpenAuditLog(path string) (*AuditLog, error) {
+	fp, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &AuditLog{
+		path: path,
+		fp:   fp,
+	}, nil
+}
+
+func (a *AuditLog) Close() error {
+	if a == nil {
+		return nil
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.fp.Close()
+}
+
+// Record appends an action of user on target, performed with req if not nil.
+// Failures are logged and reported to the dashboard, but do not fail the
+// action.
+func (a *AuditLog) Record(req *http.Request, user, action, target,
+	detail string) {
+
+	if a == nil {
+		return
+	}
+	e := AuditEntry{
+		Time:   time.Now().UTC(),
+		User:   user,
+		Action: action,
+		Target: target,
+		Detail: detail,
+	}
+	if req != nil {
+		e.Remote, _, _ = net.SplitHostPort(req.RemoteAddr)
+	}
+	data, err := json.Marshal(&e)
+	if err == nil {
+		a.lock.Lock()
+		_, err = a.fp.Write(append(data, '\n'))
+		if err == nil {
+			err = a.fp.Sync()
+		}
+		a.lock.Unlock()
+	}
+	if err != nil {
+		slog.Error("recording audit event", "action", action, "user", user,
+			"error", err)
+		monitor.Report("audit", "recording "+action, err)
+	}
+}
+
+// AuditQuery selects audit entries. Empty fields match everything.
+type AuditQuery struct {
+	User   string
+	Action string
+	Target string
+	Since  time.Time
+	// Maximum number of entries, most recent first
+	Limit int
+}
+
+// Query returns entries matching q, most recent first.
+func (a *AuditLog) Query(q AuditQuery) ([]AuditEntry, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	fp, err := os.Open(a.path)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	entries := []AuditEntry{}
+	scanner := bufio.NewScanner(fp)
+	for n := 1; scanner.Scan(); n++ {
+		e := AuditEntry{}
+		err := json.Unmarshal(scanner.Bytes(), &e)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", a.path, n, err)
+		}
+		if (q.User != "" && e.User != q.User) ||
+			(q.Action != "" && e.Action != q.Action) ||
+			(q.Target != "" && e.Target != q.Target) ||
+			e.Time.Before(q.Since) {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	if q.Limit > 0 && len(entries) > q.Limit {
+		entries = entries[:q.Limit]
+	}
+	return entries, nil
+}
+
+// parseAuditQuery reads the user, action, target, since (RFC 3339) and limit
+// query parameters. limit defaults to 100.
+func parseAuditQuery(req *http.Request) (AuditQuery, error) {
+	values := req.URL.Query()
+	q := AuditQuery{
+		User:   values.Get("user"),
+		Action: values.Get("action"),
+		Target: values.Get("target"),
+		Limit:  100,
+	}
+	if s := values.Get("since"); s != "" {
+		since, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return q, fmt.Errorf("invalid since: %q", s)
+		}
+		q.Since = since
+	}
+	if s := values.Get("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit <= 0 {
+			return q, fmt.Errorf("invalid limit: %q", s)
+		}
+		q.Limit = limit
+	}
+	return q, nil
+}
+
+// serveAudit returns audit entries matching the request query as JSON.
+func serveAudit(w http.ResponseWriter, req *http.Request) {
+	if auditLog == nil {
+		writeNotFound(w, req.URL.Path)
+		return
+	}
+	q, err := parseAuditQuery(req)
+	if err != nil {
+		w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "error: %s\n", err)
+		return
+	}
+	entries, err := auditLog.Query(q)
+	if err != nil {
+		w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "error: %s\n", err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, entries)
+}
+
+var (
+	serveAuditLog = serveCmd.Flag("audit-log",
+		"append admin and user actions to this file, queryable at /admin/audit").
+		String()
+)
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+type ProviderUsage struct {
+	// Bytes downloaded during the current month
+	MonthBytes int64 `json:"month_bytes"`
+	// Bytes downloaded since accounting started
+	TotalBytes int64 `json:"total_bytes"`
+}
+
+type BandwidthStatus struct {
+	Month     string                   `json:"month"`
+	Providers map[string]ProviderUsage `json:"providers"`
+	Quota     int64                    `json:"quota"`
+	OverQuota bool                     `json:"over_quota"`
+}
+
+// Bandwidth accounts bytes downloaded from upstream providers, per calendar
+// month. If path is set, counters are persisted there so a restart does not
+// reset the monthly quota.
+type Bandwidth struct {
+	lock  sync.Mutex
+	path  string
+	quota int64
+	month string
+	usage map[string]ProviderUsage
+}
+
+func monthKey(t time.Time) string {
+	return t.Format("2006-01")
+}
+
+func NewBandwidth(path string, quota int64) (*Bandwidth, error) {
+	b := &Bandwidth{
+		path:  path,
+		quota: quota,
+		month: monthKey(time.Now()),
+		usage: map[string]ProviderUsage{},
+	}
+	if path == "" {
+		return b, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return b, nil
+		}
+		return nil, err
+	}
+	st := BandwidthStatus{}
+	err = json.Unmarshal(data, &st)
+	if err != nil {
+		return nil, err
+	}
+	if st.Providers != nil {
+		b.usage = st.Providers
+	}
+	if st.Month != "" {
+		b.month = st.Month
+	}
+	return b, nil
+}
+
+// rollover resets monthly counters when entering a new month. Must be called
+// with the lock held.
+func (b *Bandwidth) rollover(now time.Time) {
+	month := monthKey(now)
+	if month == b.month {
+		return
+	}
+	b.month = month
+	for k, u := range b.usage {
+		u.MonthBytes = 0
+		b.usage[k] = u
+	}
+}
+
+// Add accounts n bytes downloaded from provider.
+func (b *Bandwidth) Add(provider string, n int64) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.rollover(time.Now())
+	u := b.usage[provider]
+	u.MonthBytes += n
+	u.TotalBytes += n
+	b.usage[provider] = u
+}
+
+func (b *Bandwidth) status() BandwidthStatus {
+	st := BandwidthStatus{
+		Month:     b.month,
+		Providers: map[string]ProviderUsage{},
+		Quota:     b.quota,
+	}
+	monthBytes := int64(0)
+	for k, u := range b.usage {
+		st.Providers[k] = u
+		monthBytes += u.MonthBytes
+	}
+	st.OverQuota = b.quota > 0 && monthBytes >= b.quota
+	return st
+}
+
+// Status returns a snapshot of current counters.
+func (b *Bandwidth) Status() BandwidthStatus {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.rollover(time.Now())
+	return b.status()
+}
+
+// OverQuota returns true if the monthly quota is set and exhausted.
+func (b *Bandwidth) OverQuota() bool {
+	return b.Status().OverQuota
+}
+
+// Save persists counters if a path was supplied.
+func (b *Bandwidth) Save() error {
+	if b.path == "" {
+		return nil
+	}
+	b.lock.Lock()
+	data, err := json.Marshal(b.status())
+	b.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	tmp := b.path + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, b.path)
+}
+
+// countingReader accounts bytes read from the wrapped body against a
+// provider.
+type countingReader struct {
+	io.ReadCloser
+	provider  string
+	bandwidth *Bandwidth
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.bandwidth.Add(r.provider, int64(n))
+	}
+	return n, err
+}
+
+// countingTransport accounts response bodies against upstreamBandwidth, per
+// host.
+type countingTransport struct {
+	// Base transport, http.DefaultTransport if nil
+	Base http.RoundTripper
+}
+
+func (t *countingTransport) RoundTrip(rq *http.Request) (*http.Response, error) {
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	rsp, err := base.RoundTrip(rq)
+	if err != nil {
+		return nil, err
+	}
+	rsp.Body = &countingReader{
+		ReadCloser: rsp.Body,
+		provider:   rq.URL.Host,
+		bandwidth:  upstreamBandwidth,
+	}
+	return rsp, nil
+}
+
+var (
+	// upstreamBandwidth accounts all bytes fetched by upstreamClient. It is replaced
+	// by serve with a persistent, quota aware instance.
+	upstreamBandwidth = &Bandwidth{
+		month: monthKey(time.Now()),
+		usage: map[string]ProviderUsage{},
+	}
+)
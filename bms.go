@@ -0,0 +1,106 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// bmsLevels lists wind warning levels by increasing severity.
+var bmsLevels = []string{
+	"Grand frais",
+	"Coup de vent",
+	"Fort coup de vent",
+	"Tempête",
+	"Violente tempête",
+	"Ouragan",
+}
+
+// BMS is a special marine bulletin (Bulletin Météorologique Spécial), issued
+// when winds of force 7 or more are expected.
+type BMS struct {
+	Number int
+	// Highest wind level mentioned by the bulletin, empty if unknown
+	Level string
+	Text  string
+}
+
+// Severity returns the rank of the BMS level, from 1 for "Grand frais" to 6
+// for "Ouragan", or 0 if unknown.
+func (b *BMS) Severity() int {
+	return levelSeverity(b.Level)
+}
+
+func levelSeverity(level string) int {
+	for i, l := range bmsLevels {
+		if l == level {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// parseBMSLevel returns the most severe level mentioned in text.
+func parseBMSLevel(text string) string {
+	lower := strings.ToLower(text)
+	level := ""
+	for _, l := range bmsLevels {
+		if strings.Contains(lower, strings.ToLower(l)) {
+			level = l
+		}
+	}
+	return level
+}
+
+// parseBMS extracts the special bulletin from the special section of a
+// coastal forecast. It returns nil if there is none.
+func parseBMS(special string) *BMS {
+	for _, line := range strings.Split(special, "\n") {
+		n, ok, err := parseWarningNumber(reWarning, []byte(line))
+		if err != nil || !ok || n == 0 {
+			continue
+		}
+		return &BMS{
+			Number: n,
+			Level:  parseBMSLevel(special),
+			Text:   strings.TrimSpace(special),
+		}
+	}
+	return nil
+}
+
+// GaleEvent reports a new special bulletin for an area.
+type GaleEvent struct {
+	Area      string    `json:"area"`
+	Title     string    `json:"title"`
+	Number    int       `json:"number"`
+	Level     string    `json:"level"`
+	Text      string    `json:"text"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// detectNewBMS compares two forecast sets and returns an event for every area
+// whose special bulletin number changed to a non-zero value.
+func detectNewBMS(previous, current []Forecast, now time.Time) []GaleEvent {
+	numbers := map[string]int{}
+	for _, f := range previous {
+		if b := parseBMS(f.Special); b != nil {
+			numbers[f.Id] = b.Number
+		}
+	}
+	events := []GaleEvent{}
+	for _, f := range current {
+		b := parseBMS(f.Special)
+		if b == nil || b.Number == numbers[f.Id] {
+			continue
+		}
+		events = append(events, GaleEvent{
+			Area:      f.Id,
+			Title:     f.Title,
+			Number:    b.Number,
+			Level:     b.Level,
+			Text:      b.Text,
+			Timestamp: now,
+		})
+	}
+	return events
+}
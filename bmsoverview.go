@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+const (
+	bmsOverviewTemplate = `<html>
+<head>
+	<meta charset="utf-8"/>
+	<title>Active special bulletins</title>
+	<style>
+		.bms { border: 2px solid #c00; background: #fee; padding: 0 1em; }
+		pre { white-space: pre-wrap; }
+	</style>
+</head>
+<body>
+	<p><a href="./">All areas</a></p>
+	<h1>Active special bulletins</h1>
+	{{range .Active}}
+	<div class="bms">
+		<h2><a href="areas/{{.Area}}{{$.Ext}}">{{.Title}}</a>: BMS n°{{.Number}}{{if .Level}}, {{.Level}}{{end}}</h2>
+		<pre>{{.Text}}</pre>
+	</div>
+	{{else}}
+		<p>No special bulletin in any area.</p>
+	{{end}}
+</body>
+</html>
+`
+)
+
+var (
+	bmsOverviewTmpl = template.Must(template.New("bms").Parse(
+		bmsOverviewTemplate))
+)
+
+// ActiveBMS is the special bulletin in force in a coastal area.
+type ActiveBMS struct {
+	Area   string `json:"area"`
+	Title  string `json:"title"`
+	Number int    `json:"number"`
+	Level  string `json:"level,omitempty"`
+	// From 1 for "Grand frais" to 6 for "Ouragan", 0 if unknown
+	Severity int    `json:"severity"`
+	Text     string `json:"text"`
+}
+
+// activeBMS returns the special bulletins of forecasts, most severe first,
+// then by area.
+func activeBMS(forecasts []Forecast) []ActiveBMS {
+	active := []ActiveBMS{}
+	for _, f := range forecasts {
+		b := parseBMS(f.Special)
+		if b == nil {
+			continue
+		}
+		active = append(active, ActiveBMS{
+			Area:     f.Id,
+			Title:    f.Title,
+			Number:   b.Number,
+			Level:    b.Level,
+			Severity: b.Severity(),
+			Text:     b.Text,
+		})
+	}
+	sort.SliceStable(active, func(i, j int) bool {
+		a, b := active[i], active[j]
+		if a.Severity != b.Severity {
+			return a.Severity > b.Severity
+		}
+		ai, erri := strconv.Atoi(a.Area)
+		bi, errj := strconv.Atoi(b.Area)
+		if erri == nil && errj == nil {
+			return ai < bi
+		}
+		return a.Area < b.Area
+	})
+	return active
+}
+
+// formatBMSOverview renders active special bulletins as an HTML page, whose
+// area links end with ext.
+func formatBMSOverview(active []ActiveBMS, ext string) ([]byte, error) {
+	data := struct {
+		Active []ActiveBMS
+		Ext    string
+	}{
+		Active: active,
+		Ext:    ext,
+	}
+	buf := &bytes.Buffer{}
+	err := bmsOverviewTmpl.Execute(buf, &data)
+	return buf.Bytes(), err
+}
+
+// serveBMSOverview lists the special bulletins of every area, as JSON when
+// negotiated and as HTML otherwise.
+func serveBMSOverview(cache *ForecastCache, w http.ResponseWriter,
+	req *http.Request) {
+
+	forecasts, err := cache.Get(req.Context())
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	active := activeBMS(forecasts)
+	format, _ := negotiateFormat(req)
+	var data []byte
+	if format == "json" {
+		data, err = json.Marshal(active)
+		w.Header().Set("Content-Type", "application/json")
+	} else {
+		data, err = formatBMSOverview(active, "")
+		w.Header().Set("Content-Type", "text/html;charset=utf-8")
+	}
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	w.Header().Set("Vary", "Accept")
+	writeStaleHeader(w, cache)
+	if writeCacheHeaders(w, req, hashReport(string(data)),
+		lastModified(cache, forecasts), cacheMaxAge(cache)) {
+		return
+	}
+	w.Write(data)
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Breaker stops upstream fetches for a cooldown period after consecutive
+// upstream failures, so portal outages are not hammered and cached
+// forecasts are served instead. Once the cooldown elapsed, a single trial
+// fetch is let through: the breaker closes if it succeeds and opens again
+// otherwise.
+type Breaker struct {
+	lock      sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	// End of the cooldown, zero when closed
+	until time.Time
+	// A trial fetch is in flight
+	trial bool
+}
+
+// NewBreaker returns a breaker opening after threshold consecutive failures
+// for cooldown.
+func NewBreaker(threshold int, cooldown time.Duration) *Breaker {
+	return &Breaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+}
+
+// Allow returns an upstream error if fetching at now is not allowed.
+func (b *Breaker) Allow(now time.Time) error {
+	if b == nil {
+		return nil
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.until.IsZero() {
+		return nil
+	}
+	if b.trial {
+		return upstreamError("upstream circuit breaker half-open, after %d "+
+			"consecutive failures", b.failures)
+	}
+	if now.Before(b.until) {
+		return upstreamError("upstream circuit breaker open until %s, "+
+			"after %d consecutive failures",
+			b.until.In(localZone).Format("15:04:05"), b.failures)
+	}
+	b.trial = true
+	return nil
+}
+
+// Record accounts the result of an allowed fetch. Only upstream errors are
+// failures, upstream answered otherwise.
+func (b *Breaker) Record(now time.Time, err error) {
+	if b == nil {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	trial := b.trial
+	b.trial = false
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	if err == nil || errorKind(err) != ErrUpstream {
+		if !b.until.IsZero() {
+			slog.Info("upstream circuit breaker closed")
+		}
+		b.failures = 0
+		b.until = time.Time{}
+		return
+	}
+	b.failures++
+	if trial || b.failures >= b.threshold {
+		if b.until.IsZero() {
+			slog.Error("upstream circuit breaker open",
+				"cooldown", b.cooldown, "failures", b.failures, "error", err)
+		}
+		b.until = now.Add(b.cooldown)
+	}
+}
+
+// BreakerStatus is the state of a Breaker: closed, open or half-open while
+// a trial fetch is in flight.
+type BreakerStatus struct {
+	State    string `json:"state"`
+	Failures int    `json:"failures"`
+	// End of the cooldown, when not closed
+	Until *time.Time `json:"until,omitempty"`
+}
+
+// Status returns the breaker state, or nil if b is nil.
+func (b *Breaker) Status() *BreakerStatus {
+	if b == nil {
+		return nil
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	status := &BreakerStatus{
+		State:    "closed",
+		Failures: b.failures,
+	}
+	if !b.until.IsZero() {
+		status.State = "open"
+		if b.trial {
+			status.State = "half-open"
+		}
+		until := b.until.In(localZone)
+		status.Until = &until
+	}
+	return status
+}
+
+var (
+	// upstreamBreaker guards upstream fetches when set
+	upstreamBreaker *Breaker
+
+	serveBreakerFailures = serveCmd.Flag("breaker-failures",
+		"consecutive upstream failures opening the circuit breaker, "+
+			"zero to disable").Default("5").Int()
+	serveBreakerCooldown = serveCmd.Flag("breaker-cooldown",
+		"delay before trying upstream again once the circuit breaker is open").
+		Default("5m").Duration()
+)
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	// formatExtensions are bundled file extensions by format
+	formatExtensions = map[string]string{
+		"text":     ".txt",
+		"html":     ".html",
+		"markdown": ".md",
+		"json":     ".json",
+	}
+)
+
+// parseBundleQuery returns the areas and formats selected by the "areas"
+// and "formats" comma separated parameters. "all" or no areas selects every
+// area, formats default to text.
+func parseBundleQuery(req *http.Request) (map[string]bool, []string, error) {
+	areas := map[string]bool{}
+	if s := req.URL.Query().Get("areas"); s != "" && s != "all" {
+		for _, area := range strings.Split(s, ",") {
+			areas[strings.TrimSpace(area)] = true
+		}
+	}
+	formats := []string{}
+	seen := map[string]bool{}
+	for _, format := range strings.Split(req.URL.Query().Get("formats"), ",") {
+		format = strings.TrimSpace(format)
+		if format == "" || seen[format] {
+			continue
+		}
+		if _, ok := formatTypes[format]; !ok {
+			return nil, nil, fmt.Errorf("unknown format: %q", format)
+		}
+		seen[format] = true
+		formats = append(formats, format)
+	}
+	if len(formats) == 0 {
+		formats = append(formats, "text")
+	}
+	return areas, formats, nil
+}
+
+// writeBundle zips every forecast in every format.
+func writeBundle(t *template.Template, forecasts []Forecast,
+	formats []string, units Units) ([]byte, error) {
+
+	buf := &bytes.Buffer{}
+	zw := zip.NewWriter(buf)
+	for _, f := range forecasts {
+		for _, format := range formats {
+			data, err := formatForecast(t, f, format, "fr", false, units,
+				areaAlmanac(f.Id, time.Now()), time.Time{})
+			if err != nil {
+				return nil, err
+			}
+			modified := f.Issued
+			if modified.IsZero() {
+				modified = time.Now()
+			}
+			fw, err := zw.CreateHeader(&zip.FileHeader{
+				Name:     "metmar/" + f.Id + formatExtensions[format],
+				Method:   zip.Deflate,
+				Modified: modified,
+			})
+			if err != nil {
+				return nil, err
+			}
+			_, err = fw.Write(data)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	err := zw.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// serveBundle returns current bulletins of selected areas as a zip file,
+// revalidated against a hash of their content.
+func serveBundle(cache *ForecastCache, t *template.Template,
+	w http.ResponseWriter, req *http.Request) {
+
+	areas, formats, err := parseBundleQuery(req)
+	var units Units
+	if err == nil {
+		units, err = parseUnits(req)
+	}
+	if err != nil {
+		w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "error: %s\n", err)
+		return
+	}
+	forecasts, err := cache.Get(req.Context())
+	var data []byte
+	if err == nil {
+		selected := []Forecast{}
+		for _, f := range forecasts {
+			if len(areas) == 0 || areas[f.Id] {
+				selected = append(selected, f)
+			}
+		}
+		etag := hashReport(hashForecasts(selected) + strings.Join(formats, ",") +
+			units.Wind + units.Distance)
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition",
+			`attachment; filename="metmar.zip"`)
+		if writeCacheHeaders(w, req, etag, lastModified(cache, selected),
+			cacheMaxAge(cache)) {
+			return
+		}
+		data, err = writeBundle(t, selected, formats, units)
+	}
+	if err != nil {
+		w.Header().Del("Content-Disposition")
+		writeError(w, req, err)
+		return
+	}
+	w.Write(data)
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// ForecastListener is called with the previous and current forecasts after
+// every successful fetch. previous is nil after the first one.
+type ForecastListener func(previous, current []Forecast)
+
+// ForecastCache keeps the last fetched forecasts and refetches them when they
+// are older than the refresh interval. Once the monthly bandwidth quota is
+// exhausted, the interval is raised to quotaRefresh.
+type ForecastCache struct {
+	lock         sync.Mutex
+	ctx          context.Context
+	source       ForecastSource
+	refresh      time.Duration
+	quotaRefresh time.Duration
+	bandwidth    *Bandwidth
+	// forecasts and fetched are written with both locks held, so Fetched and
+	// Cached do not wait for ongoing fetches
+	fetchedLock sync.Mutex
+	forecasts   []Forecast
+	fetched     time.Time
+	// lastErr is the error of the last fetch, nil if it succeeded
+	lastErr   error
+	listeners []ForecastListener
+	// tracker adapts per-area refresh intervals, if not nil
+	tracker *ChangeTracker
+	// ingestOnly caches forecasts are never fetched upstream
+	ingestOnly bool
+	// Drills in progress by area, and the last drill special bulletin number
+	drills      map[string]*Drill
+	drillNumber int
+	// rendered keeps forecast renderings until their area changes
+	rendered *RenderCache
+}
+
+// NewForecastCache returns a cache fetching forecasts from source, nil if
+// they are only ingested, whose upstream fetches are cancelled with ctx.
+func NewForecastCache(ctx context.Context, source ForecastSource,
+	refresh, quotaRefresh time.Duration, bandwidth *Bandwidth) *ForecastCache {
+
+	rendered := NewRenderCache()
+	return &ForecastCache{
+		ctx:          ctx,
+		source:       source,
+		refresh:      refresh,
+		quotaRefresh: quotaRefresh,
+		bandwidth:    bandwidth,
+		rendered:     rendered,
+		listeners:    []ForecastListener{rendered.Listen},
+	}
+}
+
+// Listen registers fn to be notified of fetched forecasts. Listeners are
+// called sequentially and must not block.
+func (c *ForecastCache) Listen(fn ForecastListener) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.listeners = append(c.listeners, fn)
+}
+
+// Interval returns the current refresh interval, accounting for the
+// bandwidth quota.
+func (c *ForecastCache) Interval() time.Duration {
+	if c.bandwidth.OverQuota() && c.quotaRefresh > c.refresh {
+		return c.quotaRefresh
+	}
+	return c.refresh
+}
+
+// Get returns cached forecasts, refetching them if they are stale. If the
+// refetch fails, previously fetched forecasts are returned instead, see
+// Stale. Fetches are logged with the request identifier of ctx.
+func (c *ForecastCache) Get(ctx context.Context) ([]Forecast, error) {
+	forecasts, err := c.get(ctx)
+	if err != nil {
+		if cached := c.Cached(); cached != nil {
+			return cached, nil
+		}
+	}
+	return forecasts, err
+}
+
+// get returns cached forecasts, refetching them if they are stale, or the
+// refetch error.
+func (c *ForecastCache) get(ctx context.Context) ([]Forecast, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.forecasts != nil && (c.ingestOnly || time.Since(c.fetched) < c.Interval()) {
+		return c.forecasts, nil
+	}
+	if c.ingestOnly {
+		return nil, upstreamError("no forecast ingested yet")
+	}
+	return c.fetch(ctx, c.tracker)
+}
+
+// Refresh fetches every area forecast, even fresh ones.
+func (c *ForecastCache) Refresh() ([]Forecast, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.fetch(c.ctx, nil)
+}
+
+// fetch refetches forecasts due according to tracker, or all of them if it is
+// nil, and notifies listeners. Fetches are cancelled with either the cache
+// context or ctx, like when the requesting client goes away or its deadline
+// expires, and logged with the request identifier of ctx. It must be called
+// with the lock held.
+func (c *ForecastCache) fetch(ctx context.Context, tracker *ChangeTracker) (
+	[]Forecast, error) {
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(c.ctx, cancel)
+	defer stop()
+	forecasts, err := refetchForecasts(ctx, c.source, c.forecasts, tracker,
+		c.Interval())
+	if err := c.bandwidth.Save(); err != nil {
+		// Forecasts were fetched, only the accounting is lost
+		ctxLogger(ctx).Error("saving upstream bandwidth", "error", err)
+	}
+	if err != nil && ctx.Err() != nil && c.ctx.Err() == nil {
+		// Abandoned by the requester, upstream is not to blame and the next
+		// request fetches again
+		return nil, err
+	}
+	c.fetchedLock.Lock()
+	c.lastErr = err
+	c.fetchedLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	forecasts = c.applyDrills(forecasts)
+	previous := c.forecasts
+	c.fetchedLock.Lock()
+	c.forecasts = forecasts
+	c.fetched = time.Now()
+	c.fetchedLock.Unlock()
+	for _, fn := range c.listeners {
+		fn(previous, forecasts)
+	}
+	return forecasts, nil
+}
+
+// Ingest merges forecasts fetched elsewhere into the cache, replacing the
+// same areas ones, and notifies listeners as if they were fetched locally.
+func (c *ForecastCache) Ingest(forecasts []Forecast) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	previous := c.forecasts
+	current := append([]Forecast{}, previous...)
+	now := time.Now()
+	for _, f := range forecasts {
+		if f.Fetched.IsZero() {
+			f.Fetched = now
+		}
+		found := false
+		for i := range current {
+			if current[i].Id == f.Id {
+				current[i] = f
+				found = true
+				break
+			}
+		}
+		if !found {
+			current = append(current, f)
+		}
+	}
+	current = c.applyDrills(current)
+	c.fetchedLock.Lock()
+	c.forecasts = current
+	c.fetched = now
+	c.fetchedLock.Unlock()
+	for _, fn := range c.listeners {
+		fn(previous, current)
+	}
+}
+
+// Rendered returns the cache of forecast renderings, invalidated when
+// forecasts change.
+func (c *ForecastCache) Rendered() *RenderCache {
+	return c.rendered
+}
+
+// Cached returns the cached forecasts, possibly stale, without fetching them.
+func (c *ForecastCache) Cached() []Forecast {
+	c.fetchedLock.Lock()
+	defer c.fetchedLock.Unlock()
+	return c.forecasts
+}
+
+// Fetched returns the time of the last successful fetch.
+func (c *ForecastCache) Fetched() time.Time {
+	c.fetchedLock.Lock()
+	defer c.fetchedLock.Unlock()
+	return c.fetched
+}
+
+// Replan is a clock listener moving the fetch times, including the ones of
+// cached forecasts, after a wall clock jump, so their displayed age stays
+// right. Refreshes remain scheduled on the
+// monotonic clock, without fetching everything at once on forward jumps or
+// stalling on backward ones.
+func (c *ForecastCache) Replan(jump time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := time.Now()
+	c.fetchedLock.Lock()
+	c.fetched = rebase(c.fetched, now)
+	if c.forecasts != nil {
+		// Readers may hold the previous slice
+		forecasts := append([]Forecast{}, c.forecasts...)
+		for i := range forecasts {
+			forecasts[i].Fetched = rebase(forecasts[i].Fetched, now)
+		}
+		c.forecasts = forecasts
+	}
+	c.fetchedLock.Unlock()
+	c.tracker.Replan(now)
+}
+
+// Stale returns the time of the last successful fetch if the last one failed
+// and its forecasts are served instead, the zero time otherwise.
+func (c *ForecastCache) Stale() time.Time {
+	c.fetchedLock.Lock()
+	defer c.fetchedLock.Unlock()
+	if c.lastErr == nil || c.forecasts == nil {
+		return time.Time{}
+	}
+	return c.fetched
+}
+
+// LastError returns the error of the last fetch, nil if it succeeded.
+func (c *ForecastCache) LastError() error {
+	c.fetchedLock.Lock()
+	defer c.fetchedLock.Unlock()
+	return c.lastErr
+}
+
+// Run refreshes forecasts in the background every refresh interval, so
+// listeners are notified even without incoming requests. It returns when the
+// cache context is cancelled.
+func (c *ForecastCache) Run() {
+	for {
+		_, err := c.get(c.ctx)
+		if err != nil && c.ctx.Err() == nil {
+			slog.Error("refreshing forecasts", "error", err)
+			monitor.Report("refresh", "refreshing forecasts", err)
+		}
+		wait := c.Interval()
+		if wait < time.Minute {
+			wait = time.Minute
+		}
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// changedForecasts returns forecasts of current whose content differs from
+// the same area in previous.
+func changedForecasts(previous, current []Forecast) []Forecast {
+	hashes := map[string]string{}
+	for _, f := range previous {
+		hashes[f.Id] = hashReport(f.Content)
+	}
+	changed := []Forecast{}
+	for _, f := range current {
+		if hashes[f.Id] != hashReport(f.Content) {
+			changed = append(changed, f)
+		}
+	}
+	return changed
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// caldavEvent is a gale warning event published in the calendar.
+type caldavEvent struct {
+	Event ICSEvent `json:"event"`
+	// Hash of the special bulletin text, to detect amendments
+	Hash string `json:"hash"`
+	// Number of the special bulletin
+	Number int `json:"number"`
+	// Closed events are kept until a new warning replaces them
+	Closed bool `json:"closed"`
+}
+
+// CalDAVNotifier publishes special bulletins as events of a CalDAV
+// calendar. Events are updated when the bulletin is amended and closed when
+// it is lifted. Published events are persisted in a state file.
+type CalDAVNotifier struct {
+	lock     sync.Mutex
+	url      string
+	user     string
+	password string
+	path     string
+	events   map[string]*caldavEvent
+	client   *http.Client
+}
+
+func NewCalDAVNotifier(url, user, password, path string) (*CalDAVNotifier, error) {
+	n := &CalDAVNotifier{
+		url:      strings.TrimSuffix(url, "/"),
+		user:     user,
+		password: password,
+		path:     path,
+		events:   map[string]*caldavEvent{},
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return n, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(data, &n.events)
+	return n, err
+}
+
+func (n *CalDAVNotifier) Name() string {
+	return "caldav " + n.url
+}
+
+func (n *CalDAVNotifier) save() error {
+	data, err := json.Marshal(n.events)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(n.path+".tmp", data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(n.path+".tmp", n.path)
+}
+
+func (n *CalDAVNotifier) put(ev ICSEvent) error {
+	body := formatICS("", []ICSEvent{ev})
+	rq, err := http.NewRequest("PUT", n.url+"/"+ev.UID+".ics", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	rq.Header.Set("Content-Type", "text/calendar; charset=utf-8")
+	if n.user != "" {
+		rq.SetBasicAuth(n.user, n.password)
+	}
+	rsp, err := n.client.Do(rq)
+	if err != nil {
+		return err
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode < 200 || rsp.StatusCode >= 300 {
+		return fmt.Errorf("got %d putting %s", rsp.StatusCode, ev.UID)
+	}
+	return nil
+}
+
+// galeICSEvent returns the calendar event of special bulletin b of forecast
+// f, issued at start.
+func galeICSEvent(f Forecast, b *BMS, start time.Time) ICSEvent {
+	level := b.Level
+	if level == "" {
+		level = "BMS"
+	}
+	end := f.Expires
+	if !end.After(start) {
+		end = start.Add(24 * time.Hour)
+	}
+	return ICSEvent{
+		UID:         fmt.Sprintf("metmar-%s-%d-%d", f.Id, start.Year(), b.Number),
+		Start:       start,
+		End:         end,
+		Summary:     fmt.Sprintf("%s n°%d: %s", level, b.Number, f.Title),
+		Description: b.Text,
+		Stamp:       start,
+	}
+}
+
+// update publishes ev, then records it. It must be called with the lock
+// held.
+func (n *CalDAVNotifier) update(area string, ev *caldavEvent) error {
+	ev.Event.Stamp = time.Now()
+	err := n.put(ev.Event)
+	if err != nil {
+		return err
+	}
+	n.events[area] = ev
+	return n.save()
+}
+
+func (n *CalDAVNotifier) Notify(notif Notification) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	f := notif.Forecast
+	now := time.Now()
+	current := n.events[f.Id]
+	b := parseBMS(f.Special)
+	if current != nil && !current.Closed && (b == nil || b.Number != current.Number) {
+		// Warning lifted or replaced, close it now
+		closed := *current
+		closed.Closed = true
+		closed.Event.End = now
+		closed.Event.Sequence++
+		err := n.update(f.Id, &closed)
+		if err != nil {
+			return err
+		}
+		current = &closed
+	}
+	if b == nil {
+		return nil
+	}
+	h := hashReport(b.Text)
+	if current != nil && current.Number == b.Number {
+		if current.Closed || current.Hash == h {
+			return nil
+		}
+		// Amended warning
+		amended := *current
+		amended.Hash = h
+		amended.Event.Description = b.Text
+		amended.Event.Summary = galeICSEvent(f, b, amended.Event.Start).Summary
+		if f.Expires.After(amended.Event.End) {
+			amended.Event.End = f.Expires
+		}
+		amended.Event.Sequence++
+		return n.update(f.Id, &amended)
+	}
+	return n.update(f.Id, &caldavEvent{
+		Event:  galeICSEvent(f, b, now),
+		Hash:   h,
+		Number: b.Number,
+	})
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// AreaActivity counts how often an area bulletin changes when fetched.
+type AreaActivity struct {
+	Fetches    int        `json:"fetches"`
+	Changes    int        `json:"changes"`
+	LastChange *time.Time `json:"last_change,omitempty"`
+	// Refresh interval of the area
+	Interval  time.Duration `json:"-"`
+	LastFetch time.Time     `json:"-"`
+}
+
+// ChangeTracker records per-area fetch outcomes and adapts area refresh
+// intervals: they double while a bulletin is unchanged, up to max, and
+// return to the cache interval when it changes. A zero max keeps the cache
+// interval.
+type ChangeTracker struct {
+	lock  sync.Mutex
+	max   time.Duration
+	areas map[string]*AreaActivity
+}
+
+func NewChangeTracker(max time.Duration) *ChangeTracker {
+	return &ChangeTracker{
+		max:   max,
+		areas: map[string]*AreaActivity{},
+	}
+}
+
+// Due returns true if area was not fetched within its interval, or base if
+// longer.
+func (t *ChangeTracker) Due(area string, now time.Time, base time.Duration) bool {
+	if t == nil {
+		return true
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	a := t.areas[area]
+	if a == nil {
+		return true
+	}
+	interval := a.Interval
+	if interval < base {
+		interval = base
+	}
+	return now.Sub(a.LastFetch) >= interval
+}
+
+// Record accounts a fetch of area at now, changed if its content differs
+// from the previous fetch.
+func (t *ChangeTracker) Record(area string, changed bool, now time.Time,
+	base time.Duration) {
+
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	a := t.areas[area]
+	if a == nil {
+		a = &AreaActivity{Interval: base}
+		t.areas[area] = a
+	}
+	a.Fetches++
+	a.LastFetch = now
+	if changed {
+		a.Changes++
+		changedAt := now
+		a.LastChange = &changedAt
+		a.Interval = base
+	} else if a.Interval < t.max {
+		a.Interval *= 2
+		if a.Interval < base {
+			a.Interval = base
+		}
+		if a.Interval > t.max {
+			a.Interval = t.max
+		}
+	}
+}
+
+// Replan moves fetch and change times after a wall clock jump, keeping
+// their monotonic age.
+func (t *ChangeTracker) Replan(now time.Time) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, a := range t.areas {
+		a.LastFetch = rebase(a.LastFetch, now)
+		if a.LastChange != nil {
+			changedAt := rebase(*a.LastChange, now)
+			a.LastChange = &changedAt
+		}
+	}
+}
+
+// AreaActivityStatus reports an area activity in /status.
+type AreaActivityStatus struct {
+	AreaActivity
+	ChangeRatio float64 `json:"change_ratio"`
+	Refresh     string  `json:"refresh"`
+}
+
+// Status returns the activity of every fetched area.
+func (t *ChangeTracker) Status() map[string]AreaActivityStatus {
+	status := map[string]AreaActivityStatus{}
+	if t == nil {
+		return status
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for area, a := range t.areas {
+		s := AreaActivityStatus{
+			AreaActivity: *a,
+			Refresh:      a.Interval.String(),
+		}
+		if a.Fetches > 0 {
+			s.ChangeRatio = float64(a.Changes) / float64(a.Fetches)
+		}
+		status[area] = s
+	}
+	return status
+}
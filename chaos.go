@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ChaosRule injects failures and latency into upstream fetches of an area,
+// or of every area if Area is "*".
+type ChaosRule struct {
+	Area string
+	// Probability of failing a fetch, between 0 and 1
+	Fail float64
+	// Delay added to every fetch
+	Latency time.Duration
+}
+
+// parseChaosRule parses rules like "area=3,fail=0.2,latency=2s".
+func parseChaosRule(s string) (ChaosRule, error) {
+	rule := ChaosRule{Area: "*"}
+	for _, kv := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(kv), "=", 2)
+		if len(parts) != 2 {
+			return rule, fmt.Errorf("invalid chaos setting: %q", kv)
+		}
+		var err error
+		switch parts[0] {
+		case "area":
+			rule.Area = parts[1]
+		case "fail":
+			rule.Fail, err = strconv.ParseFloat(parts[1], 64)
+			if err == nil && (rule.Fail < 0 || rule.Fail > 1) {
+				err = fmt.Errorf("probability out of [0, 1]")
+			}
+		case "latency":
+			rule.Latency, err = time.ParseDuration(parts[1])
+		default:
+			err = fmt.Errorf("unknown setting")
+		}
+		if err != nil {
+			return rule, fmt.Errorf("invalid chaos setting %q: %s", kv, err)
+		}
+	}
+	return rule, nil
+}
+
+// Chaos applies rules to upstream fetches, so fallbacks and alerting can be
+// exercised. A fixed seed makes failures reproducible.
+type Chaos struct {
+	lock  sync.Mutex
+	rules []ChaosRule
+	rand  *rand.Rand
+}
+
+func NewChaos(rules []string, seed int64) (*Chaos, error) {
+	c := &Chaos{
+		rand: rand.New(rand.NewSource(seed)),
+	}
+	for _, s := range rules {
+		rule, err := parseChaosRule(s)
+		if err != nil {
+			return nil, err
+		}
+		c.rules = append(c.rules, rule)
+	}
+	return c, nil
+}
+
+// Inject delays the fetch of area and may fail it, according to matching
+// rules. A nil Chaos does nothing.
+func (c *Chaos) Inject(ctx context.Context, area string) error {
+	if c == nil {
+		return nil
+	}
+	for _, rule := range c.rules {
+		if rule.Area != "*" && rule.Area != area {
+			continue
+		}
+		if rule.Latency > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(rule.Latency):
+			}
+		}
+		c.lock.Lock()
+		fail := c.rand.Float64() < rule.Fail
+		c.lock.Unlock()
+		if fail {
+			return upstreamError("chaos: injected failure fetching area %s",
+				area)
+		}
+	}
+	return nil
+}
+
+var (
+	// upstreamChaos disrupts upstream fetches when set
+	upstreamChaos *Chaos
+
+	serveChaos = serveCmd.Flag("chaos",
+		"inject upstream failures and latency, like area=3,fail=0.2,latency=2s, "+
+			"for testing, can be repeated").Hidden().Strings()
+	serveChaosSeed = serveCmd.Flag("chaos-seed",
+		"random seed of injected failures").Hidden().Default("1").Int64()
+)
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	// Wall clock jumps below this are ordinary NTP adjustments
+	clockJumpThreshold = time.Minute
+	clockCheckPeriod   = 30 * time.Second
+)
+
+// clockJump returns how much the wall clock moved between prev and now,
+// beyond the monotonic time elapsed. Both must come from time.Now().
+func clockJump(prev, now time.Time) time.Duration {
+	return now.Round(0).Sub(prev.Round(0)) - now.Sub(prev)
+}
+
+// rebase returns t with its wall time shifted so its age on the wall clock
+// matches its monotonic age, after the wall clock jumped. Times without a
+// monotonic reading, like parsed ones, keep their wall time.
+func rebase(t, now time.Time) time.Time {
+	if t.IsZero() {
+		return t
+	}
+	return now.Add(-now.Sub(t))
+}
+
+// ClockWatcher detects wall clock jumps, like when a GPS receiver sets the
+// clock of a boat computer, and tells listeners so they can plan again.
+// Refresh intervals and cache ages are measured with the monotonic clock and
+// are not affected by jumps, but times displayed or compared with other
+// processes are.
+type ClockWatcher struct {
+	lock      sync.Mutex
+	listeners []func(jump time.Duration)
+}
+
+func NewClockWatcher() *ClockWatcher {
+	return &ClockWatcher{}
+}
+
+// Listen registers fn to be called with the size of every wall clock jump.
+func (w *ClockWatcher) Listen(fn func(jump time.Duration)) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.listeners = append(w.listeners, fn)
+}
+
+// Run checks the wall clock every period until ctx is cancelled.
+func (w *ClockWatcher) Run(ctx context.Context, period time.Duration) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	prev := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		now := time.Now()
+		jump := clockJump(prev, now)
+		prev = now
+		if jump > -clockJumpThreshold && jump < clockJumpThreshold {
+			continue
+		}
+		msg := fmt.Sprintf("wall clock jumped by %s", jump.Truncate(time.Second))
+		slog.Warn(msg + ", rescheduling")
+		monitor.Report("clock", msg, nil)
+		w.lock.Lock()
+		listeners := append([]func(time.Duration){}, w.listeners...)
+		w.lock.Unlock()
+		for _, fn := range listeners {
+			fn(jump)
+		}
+	}
+}
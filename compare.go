@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+)
+
+const (
+	compareTemplate = `<html lang="{{.Lang}}">
+<head>
+	<meta charset="utf-8"/>
+	<title>{{.A.Title}} / {{.B.Title}}</title>
+	<style>
+		table { border-collapse: collapse; width: 100%; table-layout: fixed; }
+		td, th { border: 1px solid #ccc; padding: 4px 8px; text-align: left; vertical-align: top; }
+		.bms { border: 2px solid #c00; background: #fee; padding: 0 1em; }
+		pre { white-space: pre-wrap; margin: 0; }
+	</style>
+</head>
+<body>
+	<p><a href="./">All areas</a></p>
+	<table>
+		<tr>
+			<th></th>
+			<th><a href="areas/{{.A.Id}}">{{.A.Title}}</a></th>
+			<th><a href="areas/{{.B.Id}}">{{.B.Title}}</a></th>
+		</tr>
+		{{if or .A.BMS .B.BMS}}
+		<tr>
+			<th>BMS</th>
+			<td>{{with .A.BMS}}<div class="bms">n°{{.Number}}{{if .Level}}, {{.Level}}{{end}}<pre>{{.Text}}</pre></div>{{end}}</td>
+			<td>{{with .B.BMS}}<div class="bms">n°{{.Number}}{{if .Level}}, {{.Level}}{{end}}<pre>{{.Text}}</pre></div>{{end}}</td>
+		</tr>
+		{{end}}
+		{{range .Sections}}
+		<tr>
+			<th>{{.Title}}</th>
+			<td><pre>{{.A}}</pre></td>
+			<td><pre>{{.B}}</pre></td>
+		</tr>
+		{{end}}
+	</table>
+</body>
+</html>
+`
+)
+
+var (
+	compareTmpl = template.Must(template.New("compare").Parse(compareTemplate))
+)
+
+// comparedSection holds the texts of two areas for the same échéance, empty
+// when an area does not forecast it.
+type comparedSection struct {
+	Title string
+	A     string
+	B     string
+}
+
+// alignSections pairs the sections of a and b by échéance title, in the
+// order of a, with sections only found in b inserted before the next
+// common one.
+func alignSections(a, b []ForecastSection) []comparedSection {
+	key := func(s ForecastSection) string {
+		return strings.ToLower(strings.TrimSpace(s.Title))
+	}
+	aligned := []comparedSection{}
+	j := 0
+	for _, sa := range a {
+		match := -1
+		for k := j; k < len(b); k++ {
+			if key(b[k]) == key(sa) {
+				match = k
+				break
+			}
+		}
+		if match < 0 {
+			aligned = append(aligned, comparedSection{Title: sa.Title,
+				A: sa.Text})
+			continue
+		}
+		for ; j < match; j++ {
+			aligned = append(aligned, comparedSection{Title: b[j].Title,
+				B: b[j].Text})
+		}
+		aligned = append(aligned, comparedSection{sa.Title, sa.Text,
+			b[match].Text})
+		j = match + 1
+	}
+	for ; j < len(b); j++ {
+		aligned = append(aligned, comparedSection{Title: b[j].Title,
+			B: b[j].Text})
+	}
+	return aligned
+}
+
+// formatComparison renders a and b side by side as HTML in lang.
+func formatComparison(a, b Forecast, lang string) ([]byte, error) {
+	type area struct {
+		Id    string
+		Title string
+		BMS   *BMS
+	}
+	_, sa := forecastParts(a)
+	_, sb := forecastParts(b)
+	data := struct {
+		Lang     string
+		A        area
+		B        area
+		Sections []comparedSection
+	}{
+		Lang:     lang,
+		A:        area{a.Id, a.Title, parseBMS(a.Special)},
+		B:        area{b.Id, b.Title, parseBMS(b.Special)},
+		Sections: alignSections(sa, sb),
+	}
+	w := &bytes.Buffer{}
+	err := compareTmpl.Execute(w, &data)
+	return w.Bytes(), err
+}
+
+// formatComparisonText interleaves the sections of a and b, by échéance,
+// each text preceded by its area title.
+func formatComparisonText(a, b Forecast) []byte {
+	w := &bytes.Buffer{}
+	fmt.Fprintf(w, "%s / %s\n", a.Title, b.Title)
+	for _, f := range []Forecast{a, b} {
+		if bms := parseBMS(f.Special); bms != nil {
+			fmt.Fprintf(w, "\n%s: BMS n°%d\n%s\n", f.Title, bms.Number,
+				strings.TrimSpace(bms.Text))
+		}
+	}
+	_, sa := forecastParts(a)
+	_, sb := forecastParts(b)
+	for _, s := range alignSections(sa, sb) {
+		fmt.Fprintf(w, "\n%s\n", strings.ToUpper(s.Title))
+		if s.A != "" {
+			fmt.Fprintf(w, "  %s: %s\n", a.Title, s.A)
+		}
+		if s.B != "" {
+			fmt.Fprintf(w, "  %s: %s\n", b.Title, s.B)
+		}
+	}
+	return w.Bytes()
+}
+
+// serveCompare compares the bulletins of areas "a" and "b" query parameters,
+// in adjacent columns for HTML requests, or as interleaved text sections,
+// for passages crossing the boundary between two coastal areas.
+func serveCompare(cache *ForecastCache, w http.ResponseWriter,
+	req *http.Request) {
+
+	format, err := negotiateFormat(req)
+	if err != nil {
+		w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+		w.WriteHeader(406)
+		fmt.Fprintf(w, "error: %s\n", err)
+		return
+	}
+	query := req.URL.Query()
+	ids := []string{query.Get("a"), query.Get("b")}
+	lang, err := requestLanguage(req)
+	if err == nil && (ids[0] == "" || ids[1] == "") {
+		err = fmt.Errorf("a and b areas are required")
+	}
+	if err != nil {
+		w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "error: %s\n", err)
+		return
+	}
+	forecasts, err := cache.Get(req.Context())
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	compared := []Forecast{}
+	for _, id := range ids {
+		found := false
+		for _, f := range forecasts {
+			if f.Id == id {
+				if lang == "en" {
+					f = translateForecast(f)
+				}
+				compared = append(compared, f)
+				found = true
+				break
+			}
+		}
+		if !found {
+			writeError(w, req, notFoundError("cannot find forecast: %s", id))
+			return
+		}
+	}
+	var data []byte
+	if format == "html" {
+		data, err = formatComparison(compared[0], compared[1], lang)
+		if err != nil {
+			writeError(w, req, err)
+			return
+		}
+		w.Header().Set("Content-Type", formatTypes["html"])
+	} else {
+		data = formatComparisonText(compared[0], compared[1])
+		w.Header().Set("Content-Type", formatTypes["text"])
+	}
+	w.Header().Set("Content-Language", lang)
+	w.Header().Set("Vary", "Accept, Accept-Language")
+	writeStaleHeader(w, cache)
+	if writeCacheHeaders(w, req, hashReport(string(data)),
+		lastModified(cache, compared), cacheMaxAge(cache)) {
+		return
+	}
+	w.Write(data)
+}
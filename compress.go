@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// Smaller responses are not worth compressing
+	minCompressSize = 512
+	// Maximum number of compressed responses kept by ETag
+	maxCompressedEntries = 512
+)
+
+var (
+	// compressors encode a response body, by content coding
+	compressors = map[string]func([]byte) ([]byte, error){
+		"br":   compressBrotli,
+		"zstd": compressZstd,
+		"gzip": compressGzip,
+	}
+	zstdEncoder, _ = zstd.NewWriter(nil,
+		zstd.WithEncoderLevel(zstd.SpeedBetterCompression))
+)
+
+func compressBrotli(data []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	w := brotli.NewWriterLevel(buf, 6)
+	_, err := w.Write(data)
+	if err == nil {
+		err = w.Close()
+	}
+	return buf.Bytes(), err
+}
+
+func compressZstd(data []byte) ([]byte, error) {
+	return zstdEncoder.EncodeAll(data, nil), nil
+}
+
+func compressGzip(data []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	w, err := gzip.NewWriterLevel(buf, gzip.BestCompression)
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.Write(data)
+	if err == nil {
+		err = w.Close()
+	}
+	return buf.Bytes(), err
+}
+
+// parseEncodings parses a comma separated list of content codings, by
+// decreasing preference.
+func parseEncodings(s string) ([]string, error) {
+	encodings := []string{}
+	for _, e := range strings.Split(s, ",") {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		if compressors[e] == nil {
+			return nil, fmt.Errorf("unknown encoding: %q", e)
+		}
+		encodings = append(encodings, e)
+	}
+	return encodings, nil
+}
+
+// negotiateEncoding returns the preferred encoding of supported ones, by
+// decreasing preference, acceptable according to the Accept-Encoding header,
+// or "" for identity.
+func negotiateEncoding(accept string, supported []string) string {
+	qs := map[string]float64{}
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		q := 1.0
+		for _, p := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+			if len(kv) == 2 && kv[0] == "q" {
+				if v, err := strconv.ParseFloat(kv[1], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		qs[coding] = q
+	}
+	best, bestQ := "", 0.0
+	for _, e := range supported {
+		q, ok := qs[e]
+		if !ok {
+			q, ok = qs["*"]
+		}
+		if ok && q > bestQ {
+			best, bestQ = e, q
+		}
+	}
+	return best
+}
+
+// compressible tells whether responses of contentType are worth compressing.
+func compressible(contentType string) bool {
+	ct := strings.TrimSpace(strings.SplitN(contentType, ";", 2)[0])
+	return strings.HasPrefix(ct, "text/") ||
+		ct == "application/json" ||
+		ct == "application/xml" ||
+		ct == "application/javascript" ||
+		strings.HasSuffix(ct, "+json") ||
+		strings.HasSuffix(ct, "+xml")
+}
+
+// compressCache keeps compressed responses by ETag and encoding, so
+// unchanged pages are compressed once.
+type compressCache struct {
+	lock    sync.Mutex
+	entries map[string][]byte
+	// Keys by insertion order, evicted first in first out
+	keys []string
+}
+
+func (c *compressCache) get(key string) []byte {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.entries[key]
+}
+
+func (c *compressCache) put(key string, data []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, ok := c.entries[key]; ok {
+		return
+	}
+	if len(c.keys) >= maxCompressedEntries {
+		delete(c.entries, c.keys[0])
+		c.keys = c.keys[1:]
+	}
+	c.entries[key] = data
+	c.keys = append(c.keys, key)
+}
+
+// compressWriter buffers successful compressible responses, to compress them
+// once complete. Other responses are written as is.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding    string
+	cache       *compressCache
+	buf         *bytes.Buffer
+	wroteHeader bool
+}
+
+func (w *compressWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	h := w.Header()
+	if !compressible(h.Get("Content-Type")) {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	h.Add("Vary", "Accept-Encoding")
+	if code != 200 || w.encoding == "" || h.Get("Content-Encoding") != "" {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.buf = &bytes.Buffer{}
+}
+
+func (w *compressWriter) Write(data []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(data))
+		}
+		w.WriteHeader(200)
+	}
+	if w.buf != nil {
+		return w.buf.Write(data)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *compressWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok && w.buf == nil {
+		if !w.wroteHeader {
+			w.WriteHeader(200)
+		}
+		f.Flush()
+	}
+}
+
+// finish writes the buffered response, compressed if large enough.
+func (w *compressWriter) finish() {
+	if w.buf == nil {
+		return
+	}
+	data := w.buf.Bytes()
+	h := w.Header()
+	if len(data) < minCompressSize {
+		w.ResponseWriter.WriteHeader(200)
+		w.ResponseWriter.Write(data)
+		return
+	}
+	key := ""
+	if etag := h.Get("ETag"); etag != "" {
+		key = w.encoding + " " + h.Get("Content-Type") + " " + etag
+	}
+	compressed := w.cache.get(key)
+	if compressed == nil {
+		var err error
+		compressed, err = compressors[w.encoding](data)
+		if err != nil {
+			w.ResponseWriter.WriteHeader(200)
+			w.ResponseWriter.Write(data)
+			return
+		}
+		if key != "" {
+			w.cache.put(key, compressed)
+		}
+	}
+	h.Del("Content-Length")
+	h.Set("Content-Encoding", w.encoding)
+	w.ResponseWriter.WriteHeader(200)
+	w.ResponseWriter.Write(compressed)
+}
+
+// compressHandler compresses text and JSON responses of h with the preferred
+// of encodings accepted by the client. Compressed pages with an ETag are
+// cached. Responses of the uncompressed paths, like event streams which must
+// be flushed as they are written, are left alone.
+func compressHandler(h http.Handler, encodings []string,
+	uncompressed ...string) http.Handler {
+
+	if len(encodings) == 0 {
+		return h
+	}
+	cache := &compressCache{
+		entries: map[string][]byte{},
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for _, p := range uncompressed {
+			if req.URL.Path == p {
+				h.ServeHTTP(w, req)
+				return
+			}
+		}
+		cw := &compressWriter{
+			ResponseWriter: w,
+			encoding: negotiateEncoding(req.Header.Get("Accept-Encoding"),
+				encodings),
+			cache: cache,
+		}
+		defer cw.finish()
+		h.ServeHTTP(cw, req)
+	})
+}
+
+var (
+	serveCompression = serveCmd.Flag("compression",
+		"response encodings by preference, among br, zstd and gzip, "+
+			"empty to disable").Default("br,zstd,gzip").String()
+)
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Settings come, by decreasing priority, from command line flags, METMAR_*
+// environment variables named after flags, like METMAR_SMTP_HOST for
+// --smtp-host, and a configuration file. The file uses a TOML subset:
+//
+//	# Top-level keys apply to every command
+//	archive = "/var/lib/metmar"
+//
+//	[serve]
+//	http = ":8080"
+//	refresh = "10m"
+//	mail-to = ["alice@example.com", "bob@example.com=2,3"]
+//	push-bulletins = true
+//
+// Keys are flag names. Sections hold settings of a single command.
+
+// parseConfigValue parses a quoted string, a bare scalar or an array of
+// them.
+func parseConfigValue(s string) ([]string, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "[") {
+		if !strings.HasSuffix(s, "]") {
+			return nil, fmt.Errorf("unterminated array: %s", s)
+		}
+		values := []string{}
+		rest := strings.TrimSpace(s[1 : len(s)-1])
+		for rest != "" {
+			v, n, err := parseConfigScalar(rest)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+			rest = strings.TrimSpace(rest[n:])
+			if rest != "" {
+				if rest[0] != ',' {
+					return nil, fmt.Errorf("expected comma in array: %s", s)
+				}
+				rest = strings.TrimSpace(rest[1:])
+			}
+		}
+		return values, nil
+	}
+	v, n, err := parseConfigScalar(s)
+	if err != nil {
+		return nil, err
+	}
+	if strings.TrimSpace(s[n:]) != "" {
+		return nil, fmt.Errorf("unexpected data after value: %s", s)
+	}
+	return []string{v}, nil
+}
+
+// parseConfigScalar parses the value starting s and returns it with the
+// number of consumed bytes.
+func parseConfigScalar(s string) (string, int, error) {
+	if strings.HasPrefix(s, `"`) {
+		end := 1
+		for end < len(s) && s[end] != '"' {
+			if s[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		if end >= len(s) {
+			return "", 0, fmt.Errorf("unterminated string: %s", s)
+		}
+		v, err := strconv.Unquote(s[:end+1])
+		return v, end + 1, err
+	}
+	end := strings.IndexAny(s, ",]")
+	if end < 0 {
+		end = len(s)
+	}
+	return strings.TrimSpace(s[:end]), end, nil
+}
+
+// loadConfig returns the settings of path applying to command, by key.
+func loadConfig(path, command string) (map[string][]string, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	values := map[string][]string{}
+	section := ""
+	scanner := bufio.NewScanner(fp)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected key = value", path, n)
+		}
+		if section != "" && section != command {
+			continue
+		}
+		key := strings.TrimSpace(parts[0])
+		v, err := parseConfigValue(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, n, err)
+		}
+		values[key] = v
+	}
+	return values, scanner.Err()
+}
+
+// configEnvar returns the environment variable of a flag.
+func configEnvar(flag string) string {
+	return "METMAR_" + strings.ToUpper(strings.Replace(flag, "-", "_", -1))
+}
+
+// applyConfig exports settings as environment variables, unless already
+// set. Repeated values are separated by newlines.
+func applyConfig(values map[string][]string) error {
+	for key, v := range values {
+		name := configEnvar(key)
+		if _, ok := os.LookupEnv(name); ok {
+			continue
+		}
+		err := os.Setenv(name, strings.Join(v, "\n"))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// findConfig returns the configuration file and command of args, resolved
+// by kingpin without setting flag values. Invalid arguments are left to
+// app.Parse to report.
+func findConfig(args []string) (string, string) {
+	path := os.Getenv(configEnvar("config"))
+	command := ""
+	ctx, err := app.ParseContext(args)
+	if err != nil {
+		return path, command
+	}
+	if ctx.SelectedCommand != nil {
+		// Sections are named after top-level commands, like [gale] for
+		// "gale serve"
+		command = strings.SplitN(ctx.SelectedCommand.FullCommand(), " ", 2)[0]
+	}
+	for _, e := range ctx.Elements {
+		if e.Clause == configFlag && e.Value != nil {
+			path = *e.Value
+		}
+	}
+	return path, command
+}
+
+var (
+	configFlag = app.Flag("config",
+		"configuration file, overridden by environment variables and flags")
+	configFile = configFlag.String()
+)
+
+// loadSettings applies the configuration file designated by args, if any.
+func loadSettings(args []string) error {
+	path, command := findConfig(args)
+	if path == "" {
+		return nil
+	}
+	values, err := loadConfig(path, command)
+	if err != nil {
+		return err
+	}
+	return applyConfig(values)
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"html/template"
+	"net/http"
+	"strings"
+)
+
+type diffKind int
+
+const (
+	diffEqual diffKind = iota
+	diffDelete
+	diffInsert
+)
+
+type diffOp struct {
+	Kind diffKind
+	Text string
+}
+
+// diffTokens returns the edit script turning a into b, computed from their
+// longest common subsequence. Bulletins are short enough for the quadratic
+// table.
+func diffTokens(a, b []string) []diffOp {
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	ops := []diffOp{}
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			ops = append(ops, diffOp{diffEqual, a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			ops = append(ops, diffOp{diffDelete, a[i]})
+			i++
+		default:
+			ops = append(ops, diffOp{diffInsert, b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		ops = append(ops, diffOp{diffDelete, a[i]})
+	}
+	for ; j < len(b); j++ {
+		ops = append(ops, diffOp{diffInsert, b[j]})
+	}
+	return ops
+}
+
+func splitLines(s string) []string {
+	s = strings.TrimSuffix(s, "\n")
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
+
+// unifiedDiff formats the line differences between a and b as a unified
+// diff with context lines around each hunk.
+func unifiedDiff(nameA, nameB, a, b string, context int) string {
+	ops := diffTokens(splitLines(a), splitLines(b))
+	w := &bytes.Buffer{}
+	fmt.Fprintf(w, "--- %s\n+++ %s\n", nameA, nameB)
+	// Line numbers of ops[k] in a and b
+	posA := make([]int, len(ops)+1)
+	posB := make([]int, len(ops)+1)
+	for k, op := range ops {
+		posA[k+1], posB[k+1] = posA[k], posB[k]
+		if op.Kind != diffInsert {
+			posA[k+1]++
+		}
+		if op.Kind != diffDelete {
+			posB[k+1]++
+		}
+	}
+	for k := 0; k < len(ops); {
+		if ops[k].Kind == diffEqual {
+			k++
+			continue
+		}
+		// Extend the hunk while changes are separated by less than two
+		// contexts
+		start := k - context
+		if start < 0 {
+			start = 0
+		}
+		end := k
+		for end < len(ops) {
+			if ops[end].Kind != diffEqual {
+				end++
+				continue
+			}
+			next := end
+			for next < len(ops) && ops[next].Kind == diffEqual {
+				next++
+			}
+			if next == len(ops) || next-end > 2*context {
+				break
+			}
+			end = next
+		}
+		stop := end + context
+		if stop > len(ops) {
+			stop = len(ops)
+		}
+		fmt.Fprintf(w, "@@ -%d,%d +%d,%d @@\n", posA[start]+1,
+			posA[stop]-posA[start], posB[start]+1, posB[stop]-posB[start])
+		for _, op := range ops[start:stop] {
+			prefix := " "
+			if op.Kind == diffDelete {
+				prefix = "-"
+			} else if op.Kind == diffInsert {
+				prefix = "+"
+			}
+			w.WriteString(prefix + op.Text + "\n")
+		}
+		k = stop
+	}
+	return w.String()
+}
+
+// Differ splits texts into the units compared by diffTexts.
+type Differ interface {
+	Tokens(text string) []string
+	// Separator joins tokens back when rendering differences
+	Separator() string
+}
+
+type lineDiffer struct{}
+
+func (lineDiffer) Tokens(text string) []string { return splitLines(text) }
+func (lineDiffer) Separator() string           { return "\n" }
+
+type wordDiffer struct{}
+
+func (wordDiffer) Tokens(text string) []string { return strings.Fields(text) }
+func (wordDiffer) Separator() string           { return " " }
+
+type sentenceDiffer struct{}
+
+// Tokens splits text after sentence terminators and line breaks,
+// normalizing whitespace.
+func (sentenceDiffer) Tokens(text string) []string {
+	sentences := []string{}
+	for _, line := range splitLines(text) {
+		words := strings.Fields(line)
+		start := 0
+		for i, word := range words {
+			if strings.HasSuffix(word, ".") || strings.HasSuffix(word, "!") ||
+				strings.HasSuffix(word, "?") || i == len(words)-1 {
+				sentences = append(sentences, strings.Join(words[start:i+1], " "))
+				start = i + 1
+			}
+		}
+	}
+	return sentences
+}
+
+func (sentenceDiffer) Separator() string { return " " }
+
+var (
+	// differs are available diff algorithms by name
+	differs = map[string]Differ{
+		"lines":     lineDiffer{},
+		"words":     wordDiffer{},
+		"sentences": sentenceDiffer{},
+	}
+)
+
+// diffTexts returns the edit script turning a into b, compared with d.
+func diffTexts(d Differ, a, b string) []diffOp {
+	return diffTokens(d.Tokens(a), d.Tokens(b))
+}
+
+// formatDiffText marks deleted tokens like [-this-] and inserted ones like
+// {+this+}.
+func formatDiffText(ops []diffOp, sep string) string {
+	w := &bytes.Buffer{}
+	for k, op := range ops {
+		if k > 0 {
+			w.WriteString(sep)
+		}
+		switch op.Kind {
+		case diffDelete:
+			w.WriteString("[-" + op.Text + "-]")
+		case diffInsert:
+			w.WriteString("{+" + op.Text + "+}")
+		default:
+			w.WriteString(op.Text)
+		}
+	}
+	w.WriteString("\n")
+	return w.String()
+}
+
+// formatDiffHTML marks deleted tokens with <del> and inserted ones with <ins>.
+func formatDiffHTML(ops []diffOp, sep string) template.HTML {
+	w := &bytes.Buffer{}
+	for k, op := range ops {
+		if k > 0 {
+			w.WriteString(html.EscapeString(sep))
+		}
+		text := html.EscapeString(op.Text)
+		switch op.Kind {
+		case diffDelete:
+			w.WriteString("<del>" + text + "</del>")
+		case diffInsert:
+			w.WriteString("<ins>" + text + "</ins>")
+		default:
+			w.WriteString(text)
+		}
+	}
+	return template.HTML(w.String())
+}
+
+const (
+	diffTemplate = `<html>
+<head>
+	<meta charset="utf-8"/>
+	<title>{{.Title}}: changes</title>
+	<style>
+		.diff { white-space: pre-wrap; font-family: monospace; }
+		del { background: #fdd; color: #900; }
+		ins { background: #dfd; color: #060; text-decoration: none; }
+	</style>
+</head>
+<body>
+	<h1>{{.Title}}</h1>
+	<p>Changes from {{.From}} to {{.To}}, by {{.Mode}}.</p>
+	<div class="diff">{{.Diff}}</div>
+</body>
+</html>
+`
+)
+
+var (
+	diffTmpl = template.Must(template.New("diff").Parse(diffTemplate))
+)
+
+// serveDiff shows what changed between revision id of area, or the latest
+// one if id is empty, and the previous edition. Differences are
+// rendered as a unified diff or with one of the differs selected by
+// ?mode=, as text or as HTML with ?format=html.
+func serveDiff(archive *Archive, area, id string, w http.ResponseWriter,
+	req *http.Request) {
+
+	revisions := archive.Revisions(area)
+	i := len(revisions) - 1
+	if id != "" {
+		for i >= 0 && revisions[i].Id() != id {
+			i--
+		}
+	}
+	// Compare with the previous edition, skipping repeated contents
+	j := i - 1
+	for j >= 0 && revisions[j].Edition == revisions[i].Edition {
+		j--
+	}
+	if i < 1 || j < 0 {
+		writeNotFound(w, "previous revision in area "+area)
+		return
+	}
+	previous, latest := revisions[j], revisions[i]
+	a, err := archive.Read(previous)
+	var b string
+	if err == nil {
+		b, err = archive.Read(latest)
+	}
+	w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "error: %s\n", err)
+		return
+	}
+	mode := req.URL.Query().Get("mode")
+	format := req.URL.Query().Get("format")
+	if mode == "" || mode == "unified" {
+		if format != "html" {
+			w.Write([]byte(unifiedDiff(previous.Id(), latest.Id(), a, b, 3)))
+			return
+		}
+		mode = "lines"
+	}
+	d, ok := differs[mode]
+	if !ok {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "error: unknown diff mode: %q\n", mode)
+		return
+	}
+	ops := diffTexts(d, a, b)
+	if format != "html" {
+		w.Write([]byte(formatDiffText(ops, d.Separator())))
+		return
+	}
+	writeHTML(w, diffTmpl, &struct {
+		Title string
+		From  string
+		To    string
+		Mode  string
+		Diff  template.HTML
+	}{
+		Title: bulletinTitle(b),
+		From:  previous.Time.Format("2006-01-02 15:04"),
+		To:    latest.Time.Format("2006-01-02 15:04"),
+		Mode:  mode,
+		Diff:  formatDiffHTML(ops, d.Separator()),
+	})
+}
@@ -0,0 +1,11 @@
+//go:build !(linux || darwin || freebsd)
+
+package main
+
+import (
+	"fmt"
+)
+
+func diskFree(path string) (int64, error) {
+	return 0, fmt.Errorf("free disk space is not available on this platform")
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+// DiskStatus reports the free space left for the archive.
+type DiskStatus struct {
+	Free    int64 `json:"free"`
+	MinFree int64 `json:"min_free"`
+	// Archiving is paused until enough space is freed
+	Paused bool `json:"paused"`
+	// Revisions deleted to free space since startup
+	Pruned int `json:"pruned"`
+}
+
+var (
+	errArchivePaused = fmt.Errorf("archiving paused, disk space is low")
+)
+
+// GuardDisk pauses archiving while the archive file system has less than
+// minFree bytes available, or deletes the oldest revisions first if prune is
+// set. The latest revision of every area and annotated ones are never
+// deleted.
+func (a *Archive) GuardDisk(minFree int64, prune bool) error {
+	_, err := diskFree(a.dir)
+	if err != nil {
+		return err
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.disk.MinFree = minFree
+	a.prune = prune
+	return nil
+}
+
+// DiskStatus returns the free space measured before the last write, or nil
+// if the disk is not guarded.
+func (a *Archive) DiskStatus() *DiskStatus {
+	if a == nil {
+		return nil
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.disk.MinFree <= 0 {
+		return nil
+	}
+	st := a.disk
+	return &st
+}
+
+// pruneOldest deletes the oldest prunable revision. It returns false if there
+// is none. It must be called with the lock held.
+func (a *Archive) pruneOldest() (bool, error) {
+	var oldest *Revision
+	index := 0
+	for _, revisions := range a.revisions {
+		for i, rev := range revisions[:len(revisions)-1] {
+			if oldest != nil && !rev.Time.Before(oldest.Time) {
+				break
+			}
+			if _, err := os.Stat(notesPath(rev)); err == nil {
+				continue
+			}
+			r := rev
+			oldest, index = &r, i
+			break
+		}
+	}
+	if oldest == nil {
+		return false, nil
+	}
+	err := os.Remove(oldest.Path)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	revisions := a.revisions[oldest.Area]
+	// Link the next revision to the one preceding the pruned one
+	revisions[index+1].Previous = oldest.Previous
+	a.revisions[oldest.Area] = append(revisions[:index:index],
+		revisions[index+1:]...)
+	a.disk.Pruned++
+	return true, nil
+}
+
+// checkDisk returns errArchivePaused if there is not enough space left to
+// archive after pruning. It must be called with the lock held.
+func (a *Archive) checkDisk() error {
+	if a.disk.MinFree <= 0 {
+		return nil
+	}
+	free, err := diskFree(a.dir)
+	for err == nil && free < a.disk.MinFree && a.prune {
+		var pruned bool
+		pruned, err = a.pruneOldest()
+		if err == nil && !pruned {
+			break
+		}
+		if err == nil {
+			free, err = diskFree(a.dir)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	paused := a.disk.Paused
+	a.disk.Free = free
+	a.disk.Paused = free < a.disk.MinFree
+	if a.disk.Paused {
+		if !paused {
+			err := fmt.Errorf("%d bytes free, below %d", free, a.disk.MinFree)
+			slog.Error(errArchivePaused.Error(), "error", err)
+			monitor.Report("archive", errArchivePaused.Error(), err)
+		}
+		return errArchivePaused
+	}
+	if paused {
+		slog.Info("archiving resumed", "free", free)
+		monitor.Report("archive", "archiving resumed", nil)
+	}
+	return nil
+}
+
+var (
+	serveArchiveMinFree = serveCmd.Flag("archive-min-free",
+		"pause archiving when the archive disk has less free space, zero to "+
+			"disable").Default("0").Bytes()
+	serveArchivePrune = serveCmd.Flag("archive-prune",
+		"delete the oldest revisions instead of pausing archiving when disk "+
+			"space is low").Bool()
+)
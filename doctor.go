@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"time"
+)
+
+var (
+	// reMentionsWarning matches bulletins mentioning a special bulletin, whose
+	// number the gale regexes must extract
+	reMentionsWarning = regexp.MustCompile(`(?im)^\s*(?:Bulletin spécial|BMS)\b`)
+)
+
+// checkAreaBulletin fetches the bulletin of area from source, parses it and
+// renders it as text, HTML and JSON.
+func checkAreaBulletin(ctx context.Context, source ForecastSource,
+	area string) error {
+
+	b, err := source.Fetch(ctx, area)
+	if err != nil {
+		return err
+	}
+	if len(b.Sections) == 0 || b.Issued.IsZero() {
+		return kindError(ErrParse, fmt.Errorf("bulletin has no échéance or "+
+			"production date, the upstream schema may have changed"))
+	}
+	f := newForecast(b)
+	f.Id = area
+	if f.Content == "" {
+		return fmt.Errorf("text rendering is empty")
+	}
+	t, _, err := loadTemplate("", "area.html")
+	if err != nil {
+		return err
+	}
+	_, err = formatForecastPage(t, *f, "fr", false, "", Almanac{}, time.Time{})
+	if err != nil {
+		return fmt.Errorf("rendering HTML: %s", err)
+	}
+	data, err := formatJSON(*f, "fr", Units{Wind: "kt", Distance: "nm"},
+		Almanac{})
+	if err == nil && !json.Valid(data) {
+		err = fmt.Errorf("invalid JSON")
+	}
+	if err != nil {
+		return fmt.Errorf("rendering JSON: %s", err)
+	}
+	return nil
+}
+
+// checkGaleWarnings parses the archived bulletins of the last period with
+// the gale warning parser, and fails if one mentions a special bulletin
+// without a warning number being extracted from it. It returns the number
+// of checked bulletins.
+func checkGaleWarnings(archive *Archive, since time.Time) (int, error) {
+	checked := 0
+	for _, area := range archive.Areas() {
+		for _, rev := range archive.Editions(area) {
+			if rev.Time.Before(since) {
+				continue
+			}
+			content, err := archive.Read(rev)
+			if err != nil {
+				return checked, err
+			}
+			checked++
+			if !reMentionsWarning.MatchString(content) {
+				continue
+			}
+			w, ok, err := parseWarningFile(rev.Path)
+			if err == nil && !ok {
+				err = fmt.Errorf("file name is not recognized")
+			}
+			if err == nil && w.Number == 0 && w.Offshore == 0 {
+				err = fmt.Errorf("special bulletin number not found")
+			}
+			if err != nil {
+				return checked, kindError(ErrParse, fmt.Errorf("%s: %s",
+					rev.Path, err))
+			}
+		}
+	}
+	return checked, nil
+}
+
+var (
+	doctorCmd = app.Command("doctor",
+		"check upstream connectivity, parsing and rendering of every "+
+			"configured area, and gale warning parsing of recent archives")
+	doctorArchive = doctorCmd.Flag("archive",
+		"archive directory whose recent bulletins are parsed for gale "+
+			"warnings").String()
+	doctorSince = doctorCmd.Flag("since",
+		"age of the archived bulletins parsed for gale warnings").
+		Default("720h").Duration()
+	doctorTimeout = doctorCmd.Flag("timeout",
+		"maximum duration of every upstream request").Default("30s").Duration()
+)
+
+func doctorFn() error {
+	source, err := newForecastSource()
+	if err != nil {
+		return err
+	}
+	var archive *Archive
+	if *doctorArchive != "" {
+		archive, err = OpenArchive(*doctorArchive)
+		if err != nil {
+			return err
+		}
+		defer archive.Close()
+	}
+	checks := []selfCheck{
+		{Name: "upstream", Run: func() error {
+			ctx, cancel := context.WithTimeout(context.Background(),
+				*doctorTimeout)
+			defer cancel()
+			// Parsing failures are reported by area checks
+			_, err := source.Fetch(ctx, source.Areas()[0])
+			if errorKind(err) != ErrUpstream {
+				return nil
+			}
+			return err
+		}},
+	}
+	for _, area := range source.Areas() {
+		area := area
+		checks = append(checks, selfCheck{
+			Name: "area " + area,
+			Run: func() error {
+				ctx, cancel := context.WithTimeout(context.Background(),
+					*doctorTimeout)
+				defer cancel()
+				return checkAreaBulletin(ctx, source, area)
+			},
+			Independent: true,
+		})
+	}
+	if archive != nil {
+		checks = append(checks, selfCheck{
+			Name: "gale warnings",
+			Run: func() error {
+				n, err := checkGaleWarnings(archive,
+					time.Now().Add(-*doctorSince))
+				if err == nil && n == 0 {
+					err = configError("no bulletin archived in the last %s",
+						*doctorSince)
+				}
+				return err
+			},
+			Independent: true,
+		})
+	}
+	return runSelfChecks(checks)
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	drillWatermark = "EXERCICE - BULLETIN FICTIF, NE PAS UTILISER POUR LA NAVIGATION"
+	// Special bulletins of drills are numbered from there, far above real ones
+	firstDrillNumber = 900
+	maxDrillDuration = 24 * time.Hour
+)
+
+// Drill replaces the forecast of an area with a synthetic special bulletin
+// until it ends, so notifications and renderings can be rehearsed.
+type Drill struct {
+	Forecast Forecast
+	Until    time.Time
+	// replaced is the latest real forecast of the area
+	replaced Forecast
+	timer    *time.Timer
+}
+
+// newDrillForecast returns a watermarked forecast of area announcing a
+// special bulletin of level, described by text.
+func newDrillForecast(real Forecast, number int, level, text string,
+	now, until time.Time) Forecast {
+
+	if text == "" {
+		text = level + " prévu."
+	}
+	f := Forecast{
+		Id:     real.Id,
+		Title:  "EXERCICE - " + real.Title,
+		Header: drillWatermark,
+		Footer: "Fin de l'exercice : " + until.UTC().Format("2006-01-02 15:04") +
+			" UTC",
+		Special: fmt.Sprintf("BMS côte numéro %d\n%s\nAvis de %s.\n%s", number,
+			drillWatermark, strings.ToLower(level), text),
+		Sections: []ForecastSection{
+			{Title: "Exercice", Text: text},
+		},
+		Issued:  now.UTC().Truncate(time.Second),
+		Expires: until.UTC().Truncate(time.Second),
+		Drill:   true,
+	}
+	f.Content = formatText(&f)
+	return f
+}
+
+// publish replaces the cached forecasts with current and notifies listeners.
+// It must be called with the lock held.
+func (c *ForecastCache) publish(current []Forecast) {
+	previous := c.forecasts
+	c.fetchedLock.Lock()
+	c.forecasts = current
+	c.fetchedLock.Unlock()
+	for _, fn := range c.listeners {
+		fn(previous, current)
+	}
+}
+
+// applyDrills replaces drilled areas forecasts with their drill ones,
+// remembering the real ones. It must be called with the lock held.
+func (c *ForecastCache) applyDrills(forecasts []Forecast) []Forecast {
+	if len(c.drills) == 0 {
+		return forecasts
+	}
+	current := append([]Forecast{}, forecasts...)
+	for i, f := range current {
+		d, ok := c.drills[f.Id]
+		if !ok {
+			continue
+		}
+		// Areas not refetched keep their drill forecast
+		if f.Content != d.Forecast.Content {
+			d.replaced = f
+		}
+		current[i] = d.Forecast
+	}
+	return current
+}
+
+// StartDrill replaces the forecast of area with a drill special bulletin of
+// level until now+duration.
+func (c *ForecastCache) StartDrill(area, level, text string,
+	duration time.Duration) (*Drill, error) {
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	index := -1
+	for i, f := range c.forecasts {
+		if f.Id == area {
+			index = i
+		}
+	}
+	if index < 0 {
+		return nil, fmt.Errorf("unknown area: %q", area)
+	}
+	if c.drills == nil {
+		c.drills = map[string]*Drill{}
+		c.drillNumber = firstDrillNumber
+	}
+	c.drillNumber++
+	now := time.Now()
+	d := &Drill{
+		replaced: c.forecasts[index],
+		Until:    now.Add(duration),
+	}
+	if previous, ok := c.drills[area]; ok {
+		previous.timer.Stop()
+		d.replaced = previous.replaced
+	}
+	d.Forecast = newDrillForecast(d.replaced, c.drillNumber, level, text,
+		now, d.Until)
+	d.timer = time.AfterFunc(duration, func() {
+		c.EndDrill(area)
+	})
+	c.drills[area] = d
+	c.publish(c.applyDrills(c.forecasts))
+	return d, nil
+}
+
+// EndDrill restores the real forecast of area. It returns false if there was
+// no drill.
+func (c *ForecastCache) EndDrill(area string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	d, ok := c.drills[area]
+	if !ok {
+		return false
+	}
+	d.timer.Stop()
+	delete(c.drills, area)
+	current := append([]Forecast{}, c.forecasts...)
+	for i, f := range current {
+		if f.Id == area {
+			current[i] = d.replaced
+		}
+	}
+	c.publish(current)
+	return true
+}
+
+// serveDrill starts a drill on POST /admin/drill, from the area, level,
+// text and duration form fields, or ends the drill of area on POST
+// /admin/drill/end.
+func serveDrill(cache *ForecastCache, user string, w http.ResponseWriter,
+	req *http.Request) {
+
+	w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+	if req.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		w.WriteHeader(405)
+		fmt.Fprintf(w, "error: method not allowed\n")
+		return
+	}
+	area := req.FormValue("area")
+	if strings.HasSuffix(req.URL.Path, "/end") {
+		if !cache.EndDrill(area) {
+			writeNotFound(w, "drill of area "+area)
+			return
+		}
+		auditLog.Record(req, user, "drill-end", area, "")
+		http.Redirect(w, req, requestPrefix(req)+"/admin", http.StatusSeeOther)
+		return
+	}
+	level := req.FormValue("level")
+	if level == "" {
+		level = "Coup de vent"
+	}
+	duration := time.Hour
+	var err error
+	if s := req.FormValue("duration"); s != "" {
+		duration, err = time.ParseDuration(s)
+		if err == nil && (duration <= 0 || duration > maxDrillDuration) {
+			err = fmt.Errorf("duration must be positive and at most %s",
+				maxDrillDuration)
+		}
+	}
+	if err == nil && levelSeverity(level) == 0 {
+		err = fmt.Errorf("unknown level: %q", level)
+	}
+	if err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "error: %s\n", err)
+		return
+	}
+	text := strings.TrimSpace(req.FormValue("text"))
+	d, err := cache.StartDrill(area, level, text, duration)
+	if err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "error: %s\n", err)
+		return
+	}
+	auditLog.Record(req, user, "drill-start", area,
+		fmt.Sprintf("%s until %s", level, d.Until.UTC().Format(time.RFC3339)))
+	http.Redirect(w, req, requestPrefix(req)+"/admin", http.StatusSeeOther)
+}
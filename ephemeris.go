@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Position is a latitude and longitude in degrees, east positive.
+type Position struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+var (
+	// defaultAreaPositions are ports roughly in the middle of every coastal
+	// area
+	defaultAreaPositions = map[string]Position{
+		"1": {50.73, 1.60},  // Boulogne-sur-Mer
+		"2": {49.49, 0.11},  // Le Havre
+		"3": {48.72, -3.98}, // Roscoff
+		"4": {47.27, -2.20}, // Saint-Nazaire
+		"5": {44.66, -1.17}, // Arcachon
+		"6": {43.40, 3.70},  // Sète
+		"7": {43.30, 5.37},  // Marseille
+		"8": {43.70, 7.27},  // Nice
+		"9": {41.92, 8.74},  // Ajaccio
+	}
+)
+
+// parseAreaPosition parses AREA=LAT,LON positions.
+func parseAreaPosition(s string) (string, Position, error) {
+	p := Position{}
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 {
+		return "", p, fmt.Errorf("expected AREA=LAT,LON: %q", s)
+	}
+	coords := strings.Split(parts[1], ",")
+	if len(coords) != 2 {
+		return "", p, fmt.Errorf("expected AREA=LAT,LON: %q", s)
+	}
+	var err error
+	p.Latitude, err = strconv.ParseFloat(strings.TrimSpace(coords[0]), 64)
+	if err == nil {
+		p.Longitude, err = strconv.ParseFloat(strings.TrimSpace(coords[1]), 64)
+	}
+	if err != nil || math.Abs(p.Latitude) > 90 || math.Abs(p.Longitude) > 180 {
+		return "", p, fmt.Errorf("invalid position: %q", s)
+	}
+	return strings.TrimSpace(parts[0]), p, nil
+}
+
+// Ephemeris holds light hours and the moon phase of a day at the position of
+// an area. Times are nil when the sun does not cross the matching altitude.
+type Ephemeris struct {
+	Date     string   `json:"date"`
+	Position Position `json:"position"`
+	// Sun 12° and 6° below the horizon, the start of nautical and civil
+	// twilights
+	NauticalDawn *time.Time `json:"nautical_dawn,omitempty"`
+	CivilDawn    *time.Time `json:"civil_dawn,omitempty"`
+	Sunrise      *time.Time `json:"sunrise,omitempty"`
+	Sunset       *time.Time `json:"sunset,omitempty"`
+	CivilDusk    *time.Time `json:"civil_dusk,omitempty"`
+	NauticalDusk *time.Time `json:"nautical_dusk,omitempty"`
+	MoonPhase    string     `json:"moon_phase"`
+	// Illuminated percentage of the moon at noon
+	MoonIllumination int `json:"moon_illumination"`
+}
+
+const (
+	julianJ2000 = 2451545.0
+	// Mean synodic month, in days
+	synodicMonth = 29.530588853
+)
+
+var (
+	// A new moon, starting moon ages
+	referenceNewMoon = time.Date(2000, 1, 6, 18, 14, 0, 0, time.UTC)
+	moonPhases       = []string{"New moon", "Waxing crescent", "First quarter",
+		"Waxing gibbous", "Full moon", "Waning gibbous", "Last quarter",
+		"Waning crescent"}
+)
+
+func julianToTime(jd float64) time.Time {
+	unix := (jd - 2440587.5) * 86400
+	return time.Unix(0, int64(unix*1e9)).UTC()
+}
+
+// sunCrossings returns when the sun center rises and sets through altitude,
+// in degrees, on the UTC day of date at p, with the sunrise equation. ok is
+// false if the sun stays above or below altitude.
+func sunCrossings(date time.Time, p Position, altitude float64) (
+	time.Time, time.Time, bool) {
+
+	noon := time.Date(date.Year(), date.Month(), date.Day(), 12, 0, 0, 0,
+		time.UTC)
+	n := math.Round(float64(noon.Unix())/86400 + 2440587.5 - julianJ2000)
+	j := n - p.Longitude/360
+	m := math.Mod(357.5291+0.98560028*j, 360)
+	c := 1.9148*sinDeg(m) + 0.0200*sinDeg(2*m) + 0.0003*sinDeg(3*m)
+	lambda := math.Mod(m+c+180+102.9372, 360)
+	transit := julianJ2000 + j + 0.0053*sinDeg(m) - 0.0069*sinDeg(2*lambda)
+	sinDecl := sinDeg(lambda) * sinDeg(23.4397)
+	decl := math.Asin(sinDecl) * 180 / math.Pi
+	cosHour := (sinDeg(altitude) - sinDeg(p.Latitude)*sinDecl) /
+		(cosDeg(p.Latitude) * cosDeg(decl))
+	if cosHour < -1 || cosHour > 1 {
+		return time.Time{}, time.Time{}, false
+	}
+	hour := math.Acos(cosHour) * 180 / math.Pi
+	return julianToTime(transit - hour/360), julianToTime(transit + hour/360),
+		true
+}
+
+// moonPhase returns the phase name and illuminated percentage of the moon at
+// t, from its mean age.
+func moonPhase(t time.Time) (string, int) {
+	age := math.Mod(t.Sub(referenceNewMoon).Hours()/24, synodicMonth)
+	if age < 0 {
+		age += synodicMonth
+	}
+	fraction := age / synodicMonth
+	illumination := (1 - math.Cos(2*math.Pi*fraction)) / 2
+	index := int(math.Floor(fraction*8+0.5)) % 8
+	return moonPhases[index], int(math.Round(illumination * 100))
+}
+
+// Ephemerides computes the ephemeris of areas at their position.
+type Ephemerides struct {
+	positions map[string]Position
+	location  *time.Location
+}
+
+var (
+	// ephemerides adds ephemeris to area pages, if not nil
+	ephemerides *Ephemerides
+)
+
+// NewEphemerides returns ephemerides at the default area positions, replaced
+// or completed by AREA=LAT,LON positions. Days start at midnight in the zone
+// time zone.
+func NewEphemerides(positions []string, zone string) (*Ephemerides, error) {
+	location, err := time.LoadLocation(zone)
+	if err != nil {
+		return nil, err
+	}
+	e := &Ephemerides{
+		positions: map[string]Position{},
+		location:  location,
+	}
+	for area, p := range defaultAreaPositions {
+		e.positions[area] = p
+	}
+	for _, s := range positions {
+		area, p, err := parseAreaPosition(s)
+		if err != nil {
+			return nil, err
+		}
+		e.positions[area] = p
+	}
+	return e, nil
+}
+
+// Day returns the ephemeris of the day of now at the position of area, or nil
+// if the area has none.
+func (e *Ephemerides) Day(area string, now time.Time) *Ephemeris {
+	if e == nil {
+		return nil
+	}
+	p, ok := e.positions[area]
+	if !ok {
+		return nil
+	}
+	now = now.In(e.location)
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	eph := &Ephemeris{
+		Date:     day.Format("2006-01-02"),
+		Position: p,
+	}
+	crossings := []struct {
+		altitude  float64
+		rise, set **time.Time
+	}{
+		{-12, &eph.NauticalDawn, &eph.NauticalDusk},
+		{-6, &eph.CivilDawn, &eph.CivilDusk},
+		{-0.833, &eph.Sunrise, &eph.Sunset},
+	}
+	for _, c := range crossings {
+		rise, set, ok := sunCrossings(day, p, c.altitude)
+		if !ok {
+			continue
+		}
+		rise, set = rise.In(e.location), set.In(e.location)
+		*c.rise, *c.set = &rise, &set
+	}
+	noon := time.Date(now.Year(), now.Month(), now.Day(), 12, 0, 0, 0,
+		e.location)
+	eph.MoonPhase, eph.MoonIllumination = moonPhase(noon)
+	return eph
+}
+
+// Almanac holds the tides and ephemeris of the day at an area, and its latest
+// observation, rendered with its bulletin.
+type Almanac struct {
+	Tides       *TideDay
+	Ephemeris   *Ephemeris
+	Observation *Observation
+}
+
+// areaAlmanac returns the almanac of area for the day of now.
+func areaAlmanac(area string, now time.Time) Almanac {
+	return Almanac{
+		Tides:       tideTable.Day(area, now),
+		Ephemeris:   ephemerides.Day(area, now),
+		Observation: observations.Latest(area),
+	}
+}
+
+var (
+	serveAreaPositions = serveCmd.Flag("area-position",
+		"AREA=LAT,LON position of an area ephemeris, replacing the default "+
+			"port, can be repeated").Strings()
+	serveEphemerisZone = serveCmd.Flag("ephemeris-zone",
+		"time zone of sunrise and sunset times, --timezone if empty").
+		String()
+)
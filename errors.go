@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+)
+
+// ErrorKind classifies errors, so handlers, exit codes, the dashboard and
+// health checks can tell an upstream outage from a bug.
+type ErrorKind int
+
+const (
+	// ErrInternal is the kind of unclassified errors
+	ErrInternal ErrorKind = iota
+	// ErrUpstream reports upstream services failing or unreachable
+	ErrUpstream
+	// ErrParse reports upstream data which cannot be understood
+	ErrParse
+	// ErrNotFound reports unknown areas, revisions or files
+	ErrNotFound
+	// ErrConfig reports invalid settings or configuration files
+	ErrConfig
+)
+
+var (
+	errorKindNames = map[ErrorKind]string{
+		ErrInternal: "internal",
+		ErrUpstream: "upstream",
+		ErrParse:    "parse",
+		ErrNotFound: "not_found",
+		ErrConfig:   "config",
+	}
+)
+
+func (k ErrorKind) String() string {
+	return errorKindNames[k]
+}
+
+// Status returns the HTTP status of errors of kind k.
+func (k ErrorKind) Status() int {
+	switch k {
+	case ErrUpstream, ErrParse:
+		return 502
+	case ErrNotFound:
+		return 404
+	}
+	return 500
+}
+
+// ExitCode returns the process exit code of errors of kind k, from
+// sysexits.h.
+func (k ErrorKind) ExitCode() int {
+	switch k {
+	case ErrUpstream:
+		return 69 // EX_UNAVAILABLE
+	case ErrParse:
+		return 65 // EX_DATAERR
+	case ErrNotFound:
+		return 66 // EX_NOINPUT
+	case ErrConfig:
+		return 78 // EX_CONFIG
+	}
+	return 1
+}
+
+// Error is an error of a known kind.
+type Error struct {
+	Kind ErrorKind
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// kindError wraps err as an error of kind, unless it is nil or already
+// classified.
+func kindError(kind ErrorKind, err error) error {
+	if err == nil {
+		return nil
+	}
+	e := &Error{}
+	if errors.As(err, &e) {
+		return err
+	}
+	return &Error{Kind: kind, Err: err}
+}
+
+func upstreamError(format string, args ...interface{}) error {
+	return &Error{Kind: ErrUpstream, Err: fmt.Errorf(format, args...)}
+}
+
+func notFoundError(format string, args ...interface{}) error {
+	return &Error{Kind: ErrNotFound, Err: fmt.Errorf(format, args...)}
+}
+
+func configError(format string, args ...interface{}) error {
+	return &Error{Kind: ErrConfig, Err: fmt.Errorf(format, args...)}
+}
+
+// errorKind returns the kind of err, ErrInternal if it was not classified.
+func errorKind(err error) ErrorKind {
+	e := &Error{}
+	if errors.As(err, &e) {
+		return e.Kind
+	}
+	return ErrInternal
+}
+
+// writeError replies with err as plain text, with the status of its kind.
+// Server errors are logged, and both carry the request identifier, if any,
+// so reported failures can be found in the logs.
+func writeError(w http.ResponseWriter, req *http.Request, err error) {
+	status := errorKind(err).Status()
+	// Handlers run behind http.TimeoutHandler, whose response headers do
+	// not hold the identifier set by requestIDHandler
+	id := requestID(req.Context())
+	if status >= 500 {
+		slog.Error("request failed", "request_id", id, "status", status,
+			"kind", errorKind(err).String(), "error", err)
+	}
+	w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+	w.WriteHeader(status)
+	if id != "" {
+		fmt.Fprintf(w, "error: %s, request %s\n", err, id)
+		return
+	}
+	fmt.Fprintf(w, "error: %s\n", err)
+}
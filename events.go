@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BulletinEvent reports a changed area bulletin. Hash is the ETag of its
+// plain text version, like in the manifest.
+type BulletinEvent struct {
+	Area   string     `json:"area"`
+	Title  string     `json:"title"`
+	Hash   string     `json:"hash"`
+	Issued *time.Time `json:"issued,omitempty"`
+}
+
+// streamEvent is a server-sent event of type name.
+type streamEvent struct {
+	name string
+	area string
+	data interface{}
+}
+
+// eventSubscriber receives the events of areas, or of every area if nil.
+type eventSubscriber struct {
+	areas  map[string]bool
+	events chan streamEvent
+}
+
+// EventHub fans bulletin changes and new special bulletins out to event
+// stream subscribers.
+type EventHub struct {
+	lock        sync.Mutex
+	subscribers map[*eventSubscriber]bool
+}
+
+// NewEventHub returns a hub without subscribers.
+func NewEventHub() *EventHub {
+	return &EventHub{
+		subscribers: map[*eventSubscriber]bool{},
+	}
+}
+
+// Subscribe returns a channel of the events of areas, every area if empty,
+// and a function releasing it. Events are dropped while the channel is full.
+func (h *EventHub) Subscribe(areas []string) (<-chan streamEvent, func()) {
+	s := &eventSubscriber{
+		events: make(chan streamEvent, 32),
+	}
+	if len(areas) > 0 {
+		s.areas = map[string]bool{}
+		for _, a := range areas {
+			s.areas[a] = true
+		}
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.subscribers[s] = true
+	return s.events, func() {
+		h.lock.Lock()
+		defer h.lock.Unlock()
+		delete(h.subscribers, s)
+	}
+}
+
+func (h *EventHub) publish(ev streamEvent) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for s := range h.subscribers {
+		if s.areas != nil && !s.areas[ev.area] {
+			continue
+		}
+		select {
+		case s.events <- ev:
+		default:
+		}
+	}
+}
+
+// Listen is a cache listener publishing a "bulletin" event for every changed
+// bulletin and a "bms" event for every new special bulletin.
+func (h *EventHub) Listen(previous, current []Forecast) {
+	if previous == nil {
+		return
+	}
+	for _, f := range changedForecasts(previous, current) {
+		ev := BulletinEvent{
+			Area:  f.Id,
+			Title: f.Title,
+			Hash:  hashReport(f.Content),
+		}
+		if !f.Issued.IsZero() {
+			issued := f.Issued.In(localZone)
+			ev.Issued = &issued
+		}
+		h.publish(streamEvent{"bulletin", f.Id, ev})
+	}
+	for _, ev := range detectNewBMS(previous, current, time.Now()) {
+		h.publish(streamEvent{"bms", ev.Area, ev})
+	}
+}
+
+// serveEvents streams the events of the areas listed by the area query
+// parameters, or of every area, as server-sent events. A comment is sent
+// every heartbeat so proxies keep the connection open.
+func serveEvents(hub *EventHub, w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "error: streaming is not supported\n")
+		return
+	}
+	const heartbeat = 15 * time.Second
+	areas := []string{}
+	for _, v := range req.URL.Query()["area"] {
+		for _, a := range strings.Split(v, ",") {
+			if a = strings.TrimSpace(a); a != "" {
+				areas = append(areas, a)
+			}
+		}
+	}
+	events, release := hub.Subscribe(areas)
+	defer release()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	// Tell clients the stream is established
+	_, err := fmt.Fprintf(w, ": connected\n\n")
+	if err != nil {
+		return
+	}
+	flusher.Flush()
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-shuttingDown(req.Context()):
+			return
+		case ev := <-events:
+			data, err := json.Marshal(ev.data)
+			if err != nil {
+				return
+			}
+			_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.name, data)
+			if err != nil {
+				return
+			}
+		case <-time.After(heartbeat):
+			_, err := fmt.Fprintf(w, ": ping\n\n")
+			if err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
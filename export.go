@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"path/filepath"
+	"time"
+)
+
+// exportFormats are the renderings written for every area, by file extension
+var exportFormats = []struct {
+	ext    string
+	format string
+}{
+	{"txt", "text"},
+	{"html", "html"},
+	{"json", "json"},
+}
+
+// exportForecasts writes the text, HTML and JSON renderings of forecasts
+// into out, as out/areas/ID.txt, ID.html and ID.json files timestamped with
+// the bulletin issue time. Unchanged files are left untouched, so rsync only
+// transfers updated bulletins. It returns the number of written files.
+func exportForecasts(forecasts []Forecast, page *template.Template,
+	out string, units Units, now time.Time) (int, error) {
+
+	written := 0
+	for _, f := range forecasts {
+		almanac := areaAlmanac(f.Id, now)
+		for _, ef := range exportFormats {
+			data, err := formatForecast(page, f, ef.format, "fr", false,
+				units, almanac, time.Time{})
+			if err != nil {
+				return written, fmt.Errorf("cannot render %s of %s: %s",
+					ef.format, f.Id, err)
+			}
+			path := filepath.Join(out, "areas", f.Id+"."+ef.ext)
+			ok, err := writeIfChanged(path, data, f.Issued)
+			if err != nil {
+				return written, err
+			}
+			if ok {
+				written++
+			}
+		}
+	}
+	return written, nil
+}
+
+var (
+	exportCmd = app.Command("export",
+		"fetch every area and write its text, HTML and JSON renderings "+
+			"into a directory")
+	exportOut       = exportCmd.Arg("outdir", "output directory").Required().String()
+	exportTemplates = exportCmd.Flag("templates",
+		"directory of an area.html template overriding the default one").
+		String()
+	exportWindUnit = exportCmd.Flag("wind-unit",
+		"wind speed unit of JSON bulletins: kt, ms or kmh").
+		Default("kt").Enum("kt", "ms", "kmh")
+	exportDistanceUnit = exportCmd.Flag("distance-unit",
+		"distance unit of JSON bulletins: nm or km").
+		Default("nm").Enum("nm", "km")
+)
+
+func exportFn() error {
+	page, _, err := loadTemplate(*exportTemplates, "area.html")
+	if err != nil {
+		return err
+	}
+	upstream, err := newForecastSource()
+	if err != nil {
+		return err
+	}
+	forecasts, err := fetchForecasts(context.Background(), upstream)
+	if err != nil {
+		return err
+	}
+	units := Units{
+		Wind:     *exportWindUnit,
+		Distance: *exportDistanceUnit,
+	}
+	n, err := exportForecasts(forecasts, page, *exportOut, units, time.Now())
+	fmt.Printf("wrote %d files\n", n)
+	return err
+}
@@ -5,9 +5,11 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"html"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -18,40 +20,96 @@ import (
 )
 
 type GaleWarning struct {
+	// Coastal gale warning number
 	Number int
-	Date   time.Time
+	// Offshore ("BMS large") gale warning number
+	Offshore int
+	Date     time.Time
+	// Highest wind level of the coastal warning, empty if unknown
+	Level string
+	// Area of the forecast, from its file name, empty if unknown
+	Area string
+	// Forecast file
+	Path string
+}
+
+// warningCounter selects one of the gale warning series.
+type warningCounter func(w GaleWarning) int
+
+func coastalNumber(w GaleWarning) int {
+	return w.Number
+}
+
+func offshoreNumber(w GaleWarning) int {
+	return w.Offshore
 }
 
 // Bulletin spécial: Avis de Grand frais à Coup de vent numéro 36
+// BMS large numéro 12
 var (
-	reWarning = regexp.MustCompile(`^\s*(?:Bulletin spécial:|BMS\s+côte\s+numéro).*?(\d+)`)
+	reWarning         = regexp.MustCompile(`^\s*(?:Bulletin spécial:|BMS\s+côte\s+numéro).*?(\d+)`)
+	reOffshoreWarning = regexp.MustCompile(`^\s*BMS\s+large\s+numéro.*?(\d+)`)
 )
 
-// extractWarningNumber returns the gale warning number in supplied weatcher
-// forecast. It returns zero if there is none.
-func extractWarningNumber(path string) (int, error) {
+func parseWarningNumber(re *regexp.Regexp, line []byte) (int, bool, error) {
+	m := re.FindSubmatch(line)
+	if m == nil {
+		return 0, false, nil
+	}
+	n, err := strconv.ParseInt(string(m[1]), 10, 32)
+	if err != nil {
+		return 0, false, err
+	}
+	return int(n), true, nil
+}
+
+// extractWarningNumber returns the coastal and offshore gale warning numbers
+// in supplied weather forecast, zero if there is none, and the level of the
+// coastal one, read on its line. The forecast title, its first line unless
+// it is a warning, is returned as area.
+func extractWarningNumber(path string) (GaleWarning, error) {
 	fp, err := os.Open(path)
 	if err != nil {
-		return 0, err
+		return GaleWarning{}, err
 	}
 	defer fp.Close()
 
+	w := GaleWarning{}
+	foundCoastal, foundOffshore, titled := false, false, false
 	scanner := bufio.NewScanner(fp)
-	for scanner.Scan() {
-		m := reWarning.FindSubmatch(scanner.Bytes())
-		if m != nil {
-			n, err := strconv.ParseInt(string(m[1]), 10, 32)
+	// Fewer, larger reads on network filesystems
+	scanner.Buffer(make([]byte, 64*1024), bufio.MaxScanTokenSize)
+	for scanner.Scan() && !(foundCoastal && foundOffshore) {
+		line := scanner.Bytes()
+		if !foundCoastal {
+			w.Number, foundCoastal, err = parseWarningNumber(reWarning, line)
 			if err != nil {
-				return 0, err
+				return GaleWarning{}, err
+			}
+			if foundCoastal {
+				w.Level = parseBMSLevel(string(line))
+			}
+		}
+		if !foundOffshore {
+			w.Offshore, foundOffshore, err = parseWarningNumber(reOffshoreWarning, line)
+			if err != nil {
+				return GaleWarning{}, err
+			}
+		}
+		if title := bytes.TrimSpace(line); !titled && len(title) > 0 {
+			titled = true
+			if !foundCoastal && !foundOffshore {
+				w.Area = string(title)
 			}
-			return int(n), nil
 		}
 	}
-	return 0, scanner.Err()
+	return w, scanner.Err()
 }
 
 var (
 	rePath = regexp.MustCompile(`^.*(\d{4}_\d{2}_\d{2}T_?\d{2}_\d{2}_\d{2})\.txt$`)
+	// Archived forecasts are named AREA_YYYY_MM_DDTHH_MM_SS.txt
+	reArea = regexp.MustCompile(`^(\d+)_\d{4}_`)
 )
 
 type sortedWarnings []GaleWarning
@@ -68,140 +126,430 @@ func (s sortedWarnings) Less(i, j int) bool {
 	return s[i].Date.Before(s[j].Date)
 }
 
-// extractWarningNumbers returns the sequence of gale warnings extracted from
-// weather forecasts in supplied directory.
-func extractWarningNumbers(dir string) ([]GaleWarning, error) {
+// parseWarningFile extracts the gale warnings of the weather forecast at
+// path. It returns false if path does not look like a saved forecast.
+func parseWarningFile(path string) (GaleWarning, bool, error) {
+	m := rePath.FindStringSubmatch(path)
+	if m == nil {
+		return GaleWarning{}, false, nil
+	}
+	// Archived forecasts are named after UTC times, other saved forecasts
+	// after local ones
+	date := strings.Replace(m[1], "T_", "T", -1)
+	area := reArea.FindStringSubmatch(filepath.Base(path))
+	zone := localZone
+	if area != nil {
+		zone = time.UTC
+	}
+	d, err := time.ParseInLocation("2006_01_02T15_04_05", date, zone)
+	if err != nil {
+		return GaleWarning{}, false, err
+	}
+	w, err := extractWarningNumber(path)
+	if err != nil {
+		return GaleWarning{}, false, err
+	}
+	if area != nil {
+		w.Area = area[1]
+	}
+	w.Date = d.In(localZone)
+	w.Path = path
+	return w, true, nil
+}
 
-	warnings := []GaleWarning{}
-	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
-		if err != nil || !fi.Mode().IsRegular() {
-			return err
+// fillWarnings sorts warnings and fills intermediary reports without warnings
+// with the previous warning numbers and level of their area. Numbering
+// restarts every year.
+func fillWarnings(warnings []GaleWarning) []GaleWarning {
+	sort.Sort(sortedWarnings(warnings))
+	previous := map[string]GaleWarning{}
+	for i, w := range warnings {
+		prev := previous[w.Area]
+		if w.Date.Year() != prev.Date.Year() {
+			prev = GaleWarning{}
 		}
-		m := rePath.FindStringSubmatch(path)
-		if m == nil {
-			return nil
+		if w.Number == 0 {
+			w.Number, w.Level = prev.Number, prev.Level
 		}
-		date := strings.Replace(m[1], "T_", "T", -1)
-		d, err := time.Parse("2006_01_02T15_04_05", date)
-		if err != nil {
-			return err
+		if w.Offshore == 0 {
+			w.Offshore = prev.Offshore
 		}
-		n, err := extractWarningNumber(path)
-		if err != nil {
-			return err
+		previous[w.Area] = w
+		warnings[i] = w
+	}
+	return warnings
+}
+
+// warningAreas returns the areas of warnings, sorted.
+func warningAreas(warnings []GaleWarning) []string {
+	seen := map[string]bool{}
+	areas := []string{}
+	for _, w := range warnings {
+		if !seen[w.Area] {
+			seen[w.Area] = true
+			areas = append(areas, w.Area)
 		}
-		warnings = append(warnings, GaleWarning{
-			Number: n,
-			Date:   d,
-		})
-		return nil
-	})
-	sort.Sort(sortedWarnings(warnings))
-	// Fill intermediary reports without warnings with previous warning number
-	num := 1
-	for i, w := range warnings {
-		if w.Number != 0 {
-			num = w.Number
-		} else {
-			w := w
-			w.Number = num
-			warnings[i] = w
+	}
+	sort.Strings(areas)
+	return areas
+}
+
+// filterWarnings returns the warnings of area.
+func filterWarnings(warnings []GaleWarning, area string) []GaleWarning {
+	filtered := []GaleWarning{}
+	for _, w := range warnings {
+		if w.Area == area {
+			filtered = append(filtered, w)
 		}
 	}
-	return warnings, err
+	return filtered
 }
 
-func serveGaleWarnings(galeDir string, template []byte, w http.ResponseWriter,
-	req *http.Request) error {
+// requestWarnings returns the warnings of the area query parameter, or all
+// of them.
+func requestWarnings(index *GaleIndex, req *http.Request) []GaleWarning {
+	warnings := index.Warnings()
+	if area := req.URL.Query().Get("area"); area != "" {
+		warnings = filterWarnings(warnings, area)
+	}
+	return warnings
+}
 
-	warnings, err := extractWarningNumbers(galeDir)
-	if err != nil {
-		return err
+// areaLabel names area in series and events, like "area 3" for archived
+// forecasts or the bulletin title otherwise.
+func areaLabel(area string) string {
+	if _, err := strconv.Atoi(area); err == nil {
+		return "area " + area
 	}
-	// Add virtual beginning of year and current day points
-	now := time.Now()
-	jan1 := time.Date(now.Year(), time.January, 1, 0, 0, 0, 0, time.UTC)
-	if len(warnings) == 0 || jan1.Before(warnings[0].Date) {
-		warnings = append([]GaleWarning{GaleWarning{
-			Number: 0,
-			Date:   jan1,
-		}}, warnings...)
-	}
-	warnings = append(warnings, GaleWarning{
-		Number: warnings[len(warnings)-1].Number,
-		Date:   now,
-	})
+	return area
+}
+
+type warningPoint struct {
+	X       float64 `json:"x"`
+	Y       float64 `json:"y"`
+	Date    string  `json:"date"`
+	YearDay int     `json:"yearday"`
+}
 
-	baseDate := time.Date(2016, time.January, 1, 0, 0, 0, 0, time.UTC)
+type warningSeries struct {
+	Name string         `json:"name"`
+	Data []warningPoint `json:"data"`
+}
 
-	type warningOffset struct {
-		X       float64 `json:"x"`
-		Y       float64 `json:"y"`
-		Date    string  `json:"date"`
-		YearDay int     `json:"yearday"`
+// newWarningPoint plots w against its local day in the year. Days are
+// counted on the wall clock, so DST transitions do not shift warnings by an
+// hour.
+func newWarningPoint(w GaleWarning, counter warningCounter) warningPoint {
+	d := w.Date.In(localZone)
+	h, m, s := d.Clock()
+	return warningPoint{
+		X:       float64(d.YearDay()-1) + float64(h*3600+m*60+s)/86400.,
+		Y:       float64(counter(w)),
+		Date:    d.Format(time.RFC3339),
+		YearDay: d.YearDay(),
 	}
-	offsets := []warningOffset{}
-	refs := []warningOffset{}
-	for _, w := range warnings {
-		deltaDays := w.Date.Sub(baseDate).Hours() / 24.
-		offset := warningOffset{
-			X:       deltaDays,
-			Y:       float64(w.Number),
-			Date:    w.Date.Format("2006-01-02 15:04:05"),
-			YearDay: w.Date.YearDay(),
+}
+
+// groupWarningsByYear splits sorted warnings in one series per year, plotting
+// warning numbers selected by counter against the day in the year so years
+// can be overlaid. Each series starts on January 1st and ends on December
+// 31st, or now for the current year. Series names are the year followed by
+// suffix.
+func groupWarningsByYear(warnings []GaleWarning, counter warningCounter,
+	suffix string, now time.Time) []warningSeries {
+
+	series := []warningSeries{}
+	for i := 0; i < len(warnings); {
+		year := warnings[i].Date.Year()
+		j := i
+		for j < len(warnings) && warnings[j].Date.Year() == year {
+			j++
 		}
-		offsets = append(offsets, offset)
-		offset.Y = float64(offset.YearDay)
-		refs = append(refs, offset)
+		yearWarnings := warnings[i:j]
+		i = j
+
+		jan1 := time.Date(year, time.January, 1, 0, 0, 0, 0, localZone)
+		end := time.Date(year+1, time.January, 1, 0, 0, 0, 0, localZone).Add(-time.Second)
+		if end.After(now) {
+			end = now
+		}
+		points := []warningPoint{}
+		if jan1.Before(yearWarnings[0].Date) {
+			points = append(points, newWarningPoint(GaleWarning{Date: jan1}, counter))
+		}
+		for _, w := range yearWarnings {
+			points = append(points, newWarningPoint(w, counter))
+		}
+		last := yearWarnings[len(yearWarnings)-1]
+		if last.Date.Before(end) {
+			last.Date = end
+			points = append(points, newWarningPoint(last, counter))
+		}
+		series = append(series, warningSeries{
+			Name: strconv.Itoa(year) + suffix,
+			Data: points,
+		})
 	}
+	return series
+}
 
-	dataVar, err := json.Marshal(&offsets)
+// yearlyWarningSeries returns the coastal warning series of every area and
+// year, followed by the offshore ones of years having offshore warnings.
+// Series of known areas are suffixed with their label.
+func yearlyWarningSeries(warnings []GaleWarning, now time.Time) []warningSeries {
+	coastal, offshore := []warningSeries{}, []warningSeries{}
+	for _, area := range warningAreas(warnings) {
+		suffix := ""
+		if area != "" {
+			suffix = " " + areaLabel(area)
+		}
+		areaWarnings := filterWarnings(warnings, area)
+		coastal = append(coastal, groupWarningsByYear(areaWarnings,
+			coastalNumber, suffix, now)...)
+		// Offshore warnings only appear in "large" bulletins, skip years
+		// without any.
+		for _, s := range groupWarningsByYear(areaWarnings, offshoreNumber,
+			" large"+suffix, now) {
+			if s.Data[len(s.Data)-1].Y > 0 {
+				offshore = append(offshore, s)
+			}
+		}
+	}
+	return append(coastal, offshore...)
+}
+
+// padWarningSeries makes all series the same length by repeating the last
+// point of shorter ones. Rickshaw requires it and it does not change the plot.
+func padWarningSeries(series []warningSeries) []warningSeries {
+	maxLen := 0
+	for _, s := range series {
+		if len(s.Data) > maxLen {
+			maxLen = len(s.Data)
+		}
+	}
+	for i, s := range series {
+		for len(s.Data) < maxLen {
+			s.Data = append(s.Data, s.Data[len(s.Data)-1])
+		}
+		series[i] = s
+	}
+	return series
+}
+
+// describeWarnings summarizes the latest gale warnings for link previews.
+func describeWarnings(warnings []GaleWarning) string {
+	if len(warnings) == 0 {
+		return "No gale warning recorded."
+	}
+	last := warnings[len(warnings)-1]
+	desc := fmt.Sprintf("%d coastal gale warnings in %d", last.Number,
+		last.Date.Year())
+	if last.Area != "" {
+		desc = areaLabel(last.Area) + ": " + desc
+	}
+	if last.Offshore > 0 {
+		desc += fmt.Sprintf(", %d offshore", last.Offshore)
+	}
+	return desc + ", as of " + last.Date.Format("2006-01-02 15:04") + "."
+}
+
+// renderGaleWarnings renders the chart page template of all warnings, or
+// those of area if not empty. With areaLinks, the page links to the chart of
+// every area.
+func renderGaleWarnings(all []GaleWarning, area string, areaLinks bool,
+	template []byte, image string) ([]byte, error) {
+
+	warnings := all
+	if area != "" {
+		warnings = filterWarnings(all, area)
+	}
+	meta := PageMeta{
+		Title:       "Gale warning number evolution in Brest area",
+		Description: describeWarnings(warnings),
+		Image:       image,
+	}
+	if len(warnings) > 0 {
+		meta.Updated = warnings[len(warnings)-1].Date
+	}
+	metaVar, err := renderMeta(meta)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	now := time.Now().In(localZone)
+	if len(warnings) == 0 {
+		warnings = append(warnings, GaleWarning{Date: now})
 	}
-	refVar, err := json.Marshal(&refs)
+	series := padWarningSeries(yearlyWarningSeries(warnings, now))
+	seriesVar, err := json.Marshal(&series)
+	if err != nil {
+		return nil, err
+	}
+	fallback, err := renderGaleFallback(series)
+	if err != nil {
+		return nil, err
+	}
+	links := ""
+	if areaLinks {
+		links = renderAreaLinks(warningAreas(all), area)
+	}
+	page := bytes.Replace(template, []byte("$SERIES"), seriesVar, -1)
+	page = bytes.Replace(page, []byte("$NOSCRIPT"), []byte(fallback), -1)
+	page = bytes.Replace(page, []byte("$META"), []byte(metaVar), -1)
+	page = bytes.Replace(page, []byte("$AREAS"), []byte(links), -1)
+	return page, nil
+}
+
+func serveGaleWarnings(index *GaleIndex, template []byte, image string,
+	w http.ResponseWriter, req *http.Request) error {
+
+	page, err := renderGaleWarnings(index.Warnings(),
+		req.URL.Query().Get("area"), true, template, image)
 	if err != nil {
 		return err
 	}
-	page := bytes.Replace(template, []byte("$DATA"), dataVar, -1)
-	page = bytes.Replace(page, []byte("$REF"), refVar, -1)
 	w.Header().Set("Content-Type", "text/html")
 	_, err = w.Write(page)
 	return err
 }
 
-func handleGaleWarnings(galeDir string, template []byte, w http.ResponseWriter,
-	req *http.Request) {
+// renderAreaLinks returns links filtering the chart by area, with the
+// selected one in bold, or nothing if there is a single area.
+func renderAreaLinks(areas []string, selected string) string {
+	if len(areas) < 2 {
+		return ""
+	}
+	links := []string{`<a href="./">all</a>`}
+	if selected == "" {
+		links[0] = "<b>all</b>"
+	}
+	for _, area := range areas {
+		if area == "" {
+			continue
+		}
+		label := html.EscapeString(areaLabel(area))
+		if area == selected {
+			links = append(links, "<b>"+label+"</b>")
+			continue
+		}
+		links = append(links, fmt.Sprintf(`<a href="?area=%s">%s</a>`,
+			html.EscapeString(url.QueryEscape(area)), label))
+	}
+	return "<p>" + strings.Join(links, " | ") + "</p>"
+}
+
+func handleGaleWarnings(index *GaleIndex, template []byte, image string,
+	w http.ResponseWriter, req *http.Request) {
 
-	err := serveGaleWarnings(galeDir, template, w, req)
+	err := serveGaleWarnings(index, template, image, w, req)
 	if err != nil {
-		log.Printf("error: %s\n", err)
-		w.Header().Set("Content-Type", "text/plain")
-		w.WriteHeader(500)
-		w.Write([]byte(fmt.Sprintf("error: %s", err)))
+		writeError(w, req, err)
 	}
 }
 
 var (
-	galeCmd = app.Command("gale", "display gale warning number vs day in the year")
-	galeDir = galeCmd.Arg("forecastdir", "directory container weather forecasts").
+	galeCmd      = app.Command("gale", "display gale warning number vs day in the year")
+	galeServeCmd = galeCmd.Command("serve",
+		"chart gale warnings over HTTP, the default").Default()
+	galeDir = galeServeCmd.Arg("forecastdir", "directory container weather forecasts").
 		Required().String()
-	galePrefix = galeCmd.Flag("prefix", "public URL prefix").String()
-	galeHttp   = galeCmd.Flag("http", "HTTP host:port").Default(":5000").String()
+	galePrefix  = galeCmd.Flag("prefix", "public URL prefix").String()
+	galeHttp    = galeCmd.Flag("http", "HTTP host:port").Default(":5000").String()
+	galeTimeout = galeCmd.Flag("timeout",
+		"maximum duration of requests, zero to disable").Default("1m").Duration()
+	galeCSP = galeCmd.Flag("csp", "Content-Security-Policy of HTML pages").
+		Default(galeDefaultCSP).String()
+	galeImage = galeCmd.Flag("preview-image",
+		"absolute URL of the image shown in link previews").String()
+	galeFrameOptions = galeCmd.Flag("frame-options",
+		"X-Frame-Options of HTML pages").Default("DENY").String()
+	galeReferrerPolicy = galeCmd.Flag("referrer-policy",
+		"Referrer-Policy of HTML pages").Default("same-origin").String()
+	galeShutdownTimeout = galeCmd.Flag("shutdown-timeout",
+		"maximum duration of in-flight requests on shutdown").
+		Default("30s").Duration()
+	galeAccessLog = galeCmd.Flag("access-log",
+		"access log format: none, combined or json").Default("combined").
+		Enum("none", "combined", "json")
+	galeIndexFile = galeCmd.Flag("index",
+		"file saving extracted warnings, so restarts only parse new or "+
+			"modified forecasts").String()
+	galeScanWorkers = galeCmd.Flag("scan-workers",
+		"number of forecasts parsed in parallel while scanning").Default("8").
+		Int()
+	galeStdout = galeCmd.Flag("stdout",
+		"print warning series in the terminal instead of serving them").Bool()
+	galeMaxJump = galeCmd.Flag("max-jump",
+		"warning number increase between consecutive forecasts reported as "+
+			"an anomaly beyond, zero to disable").Default("5").Int()
 )
 
+const (
+	// The chart is drawn by an inline script
+	galeDefaultCSP = "default-src 'self'; script-src 'self' 'unsafe-inline'; " +
+		"style-src 'self' 'unsafe-inline'; img-src 'self' data:"
+)
+
+// handleGale registers the gale chart, its statistics, calendar, export,
+// anomalies and scripts below prefix. If not empty, csp overrides the
+// Content-Security-Policy of the chart.
+func handleGale(mux *http.ServeMux, prefix string, timeout time.Duration,
+	index *GaleIndex, template []byte, image, csp string, maxJump int) {
+
+	handleFunc(mux, prefix+"/", timeout, func(w http.ResponseWriter, req *http.Request) {
+		if csp != "" {
+			w.Header().Set("Content-Security-Policy", csp)
+		}
+		handleGaleWarnings(index, template, image, w, req)
+	})
+	handleFunc(mux, prefix+"/stats", timeout, func(w http.ResponseWriter, req *http.Request) {
+		err := serveGaleStats(index, w, req)
+		if err != nil {
+			writeError(w, req, err)
+		}
+	})
+	handleFunc(mux, prefix+"/calendar.ics", timeout, func(w http.ResponseWriter, req *http.Request) {
+		serveGaleCalendar(index, w, req)
+	})
+	handleFunc(mux, prefix+"/export", timeout, func(w http.ResponseWriter, req *http.Request) {
+		serveGaleExport(index, w, req)
+	})
+	handleFunc(mux, prefix+"/anomalies", timeout, func(w http.ResponseWriter, req *http.Request) {
+		serveGaleAnomalies(index, maxJump, w, req)
+	})
+	mux.Handle(prefix+"/scripts/", http.StripPrefix(prefix+"/scripts/",
+		http.FileServer(http.Dir("scripts"))))
+}
+
 func galeFn() error {
 	prefix := *galePrefix
 	addr := *galeHttp
+	index, err := NewGaleIndex(*galeDir, *galeIndexFile, *galeScanWorkers)
+	if err != nil {
+		return err
+	}
+	defer index.Close()
+	if *galeStdout {
+		return printGaleWarnings(os.Stdout, index.Warnings(), time.Now().In(localZone),
+			isTerminal(os.Stdout))
+	}
 	template, err := ioutil.ReadFile("scripts/main.html")
 	if err != nil {
 		return err
 	}
-	http.HandleFunc(prefix+"/", func(w http.ResponseWriter, req *http.Request) {
-		handleGaleWarnings(*galeDir, template, w, req)
-	})
-	http.Handle(prefix+"/scripts/", http.StripPrefix(prefix+"/scripts/",
-		http.FileServer(http.Dir("scripts"))))
-	fmt.Printf("serving on %s\n", addr)
-	return http.ListenAndServe(addr, nil)
+	mux := http.DefaultServeMux
+	handleGale(mux, "", *galeTimeout, index, template, *galeImage, "",
+		*galeMaxJump)
+	slog.Info("serving", "addr", addr)
+	security := SecurityHeaders{
+		ContentSecurityPolicy: *galeCSP,
+		FrameOptions:          *galeFrameOptions,
+		ReferrerPolicy:        *galeReferrerPolicy,
+	}
+	handler := securityHandler(recoverHandler(mux), security)
+	handler = prefixHandler(handler, prefix, false)
+	ctx, stop := signalContext()
+	defer stop()
+	return runServer(ctx, addr,
+		requestIDHandler(accessLogHandler(handler, *galeAccessLog)),
+		*galeShutdownTimeout, nil)
 }
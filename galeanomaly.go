@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const (
+	// Delay between anomaly checks of served gale warnings
+	galeAnomalyPeriod = time.Minute
+)
+
+// GaleAnomaly is a suspicious step in the warning numbers of an area, which
+// usually reveals missed archives or a parsing regression. Kind is
+// "decrease" when the number went down mid-year, "reset" when it restarted
+// from one, and "jump" when it increased by more than the tolerated jump.
+type GaleAnomaly struct {
+	Area string `json:"area"`
+	// Warning series: coastal or offshore
+	Series   string    `json:"series"`
+	Kind     string    `json:"kind"`
+	Date     time.Time `json:"date"`
+	Previous int       `json:"previous"`
+	Number   int       `json:"number"`
+	// Forecast files, relative to the forecast directory
+	PreviousPath string `json:"previous_path"`
+	Path         string `json:"path"`
+}
+
+func (a GaleAnomaly) String() string {
+	return fmt.Sprintf("%s %s warning number %s from %d to %d on %s, "+
+		"in %s after %s", areaLabel(a.Area), a.Series, a.Kind, a.Previous,
+		a.Number, a.Date.Format("2006-01-02 15:04"), a.Path, a.PreviousPath)
+}
+
+// detectGaleAnomalies returns the anomalies of the sorted, filled warnings
+// sequence, comparing every forecast to the previous one of its area in the
+// same year. Jumps are ignored if maxJump is zero. Paths are made relative
+// to dir.
+func detectGaleAnomalies(warnings []GaleWarning, dir string,
+	maxJump int) []GaleAnomaly {
+
+	relPath := func(path string) string {
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return path
+		}
+		return filepath.ToSlash(rel)
+	}
+	series := []struct {
+		name    string
+		counter warningCounter
+	}{
+		{"coastal", coastalNumber},
+		{"offshore", offshoreNumber},
+	}
+	anomalies := []GaleAnomaly{}
+	previous := map[string]GaleWarning{}
+	for _, w := range warnings {
+		prev, ok := previous[w.Area]
+		previous[w.Area] = w
+		if !ok || prev.Date.Year() != w.Date.Year() {
+			continue
+		}
+		for _, s := range series {
+			p, n := s.counter(prev), s.counter(w)
+			kind := ""
+			switch {
+			case n < p && n <= 1:
+				kind = "reset"
+			case n < p:
+				kind = "decrease"
+			case maxJump > 0 && n-p > maxJump:
+				kind = "jump"
+			default:
+				continue
+			}
+			anomalies = append(anomalies, GaleAnomaly{
+				Area:         w.Area,
+				Series:       s.name,
+				Kind:         kind,
+				Date:         w.Date,
+				Previous:     p,
+				Number:       n,
+				PreviousPath: relPath(prev.Path),
+				Path:         relPath(w.Path),
+			})
+		}
+	}
+	return anomalies
+}
+
+// serveGaleAnomalies lists the anomalies of every area, or the area one, as
+// JSON. The "max-jump" query parameter overrides maxJump.
+func serveGaleAnomalies(index *GaleIndex, maxJump int, w http.ResponseWriter,
+	req *http.Request) {
+
+	if s := req.URL.Query().Get("max-jump"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "error: invalid max-jump: %q\n", s)
+			return
+		}
+		maxJump = n
+	}
+	anomalies := detectGaleAnomalies(requestWarnings(index, req), index.dir,
+		maxJump)
+	data, err := json.MarshalIndent(anomalies, "", "  ")
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// watchGaleAnomalies checks index for new anomalies every period until ctx
+// is cancelled, reporting them to the monitor and dispatching them as
+// notifications. Anomalies present at startup are not reported.
+func watchGaleAnomalies(ctx context.Context, index *GaleIndex, maxJump int,
+	dispatcher *Dispatcher, period time.Duration) {
+
+	seen := map[GaleAnomaly]bool{}
+	for _, a := range detectGaleAnomalies(index.Warnings(), index.dir,
+		maxJump) {
+		seen[a] = true
+	}
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, a := range detectGaleAnomalies(index.Warnings(), index.dir,
+			maxJump) {
+			if seen[a] {
+				continue
+			}
+			seen[a] = true
+			monitor.Report("gale", a.String(), nil)
+			anomaly := a
+			dispatcher.Dispatch(Notification{Anomaly: &anomaly})
+		}
+	}
+}
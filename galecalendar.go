@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// galeCalendarEvents returns a calendar event for every new coastal and
+// offshore gale warning, starting at the bulletin time.
+func galeCalendarEvents(warnings []GaleWarning) []ICSEvent {
+	type key struct {
+		area string
+		date time.Time
+	}
+	levels := map[key]string{}
+	for _, w := range warnings {
+		levels[key{w.Area, w.Date}] = w.Level
+	}
+	series := []struct {
+		name    string
+		counter warningCounter
+	}{
+		{"coastal", coastalNumber},
+		{"offshore", offshoreNumber},
+	}
+	events := []ICSEvent{}
+	for _, s := range series {
+		for _, ev := range extractGaleEvents(warnings, s.counter) {
+			summary := fmt.Sprintf("BMS côte n°%d", ev.Number)
+			if s.name == "offshore" {
+				summary = fmt.Sprintf("BMS large n°%d", ev.Number)
+			} else if level := levels[key{ev.Area, ev.Date}]; level != "" {
+				summary = fmt.Sprintf("%s n°%d", level, ev.Number)
+			}
+			uid := fmt.Sprintf("metmar-gale-%s-%d-%d", s.name, ev.Date.Year(),
+				ev.Number)
+			if ev.Area != "" {
+				summary += ", " + areaLabel(ev.Area)
+				uid = fmt.Sprintf("metmar-gale-%s-%s-%d-%d", s.name,
+					hashReport(ev.Area)[:8], ev.Date.Year(), ev.Number)
+			}
+			events = append(events, ICSEvent{
+				UID:     uid,
+				Start:   ev.Date,
+				End:     ev.Date.Add(24 * time.Hour),
+				Summary: summary,
+				Stamp:   ev.Date,
+			})
+		}
+	}
+	return events
+}
+
+// serveGaleCalendar publishes gale warnings of every area, or the area one,
+// as an iCalendar feed, so they show up in calendar applications.
+func serveGaleCalendar(index *GaleIndex, w http.ResponseWriter,
+	req *http.Request) {
+
+	warnings := requestWarnings(index, req)
+	body := formatICS("Gale warnings", galeCalendarEvents(warnings))
+	modified := time.Time{}
+	if len(warnings) > 0 {
+		modified = warnings[len(warnings)-1].Date
+	}
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	if writeCacheHeaders(w, req, hashReport(string(body)), modified, 0) {
+		return
+	}
+	w.Write(body)
+}
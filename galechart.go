@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// The gale warnings chart is drawn by Rickshaw. Browsers without JavaScript
+// get a static SVG rendering of the same series and a summary table instead.
+
+const (
+	chartWidth  = 800
+	chartHeight = 400
+	chartMargin = 40
+
+	galeFallbackTemplate = `<svg xmlns="http://www.w3.org/2000/svg" width="{{.Width}}" height="{{.Height}}" viewBox="0 0 {{.Width}} {{.Height}}">
+	<line x1="{{.Left}}" y1="{{.Bottom}}" x2="{{.Right}}" y2="{{.Bottom}}" stroke="#888"/>
+	<line x1="{{.Left}}" y1="{{.Top}}" x2="{{.Left}}" y2="{{.Bottom}}" stroke="#888"/>
+	{{range .XTicks}}<text x="{{.X}}" y="{{.Y}}" font-size="11" text-anchor="middle">{{.Label}}</text>
+	{{end}}{{range .YTicks}}<text x="{{.X}}" y="{{.Y}}" font-size="11" text-anchor="end">{{.Label}}</text>
+	{{end}}{{range .Lines}}<polyline fill="none" stroke="{{.Color}}" stroke-width="1.5" points="{{.Points}}"><title>{{.Name}}</title></polyline>
+	{{end}}</svg>
+<table>
+	<tr><th></th><th>Series</th><th>Warnings</th><th>Last warning</th></tr>
+	{{range .Lines}}<tr><td><svg width="10" height="10"><rect width="10" height="10" fill="{{.Color}}"/></svg></td><td>{{.Name}}</td><td>{{.Count}}</td><td>{{.Last}}</td></tr>
+	{{end}}</table>
+`
+)
+
+var (
+	galeFallbackTmpl = template.Must(template.New("fallback").Parse(
+		galeFallbackTemplate))
+	chartPalette = []string{"#1f77b4", "#ff7f0e", "#2ca02c", "#d62728",
+		"#9467bd", "#8c564b", "#e377c2", "#7f7f7f", "#bcbd22", "#17becf"}
+	chartMonths = []string{"Jan", "Feb", "Mar", "Apr", "May", "Jun", "Jul",
+		"Aug", "Sep", "Oct", "Nov", "Dec"}
+)
+
+type chartLabel struct {
+	X     float64
+	Y     float64
+	Label string
+}
+
+type chartLine struct {
+	Name   string
+	Color  string
+	Points string
+	Count  int
+	// Date of the last warning, empty if none
+	Last string
+}
+
+// summarizeSeries returns the number of warnings of s and the date of the
+// last one, empty if none.
+func summarizeSeries(s warningSeries) (int, string) {
+	last := ""
+	prev := 0.0
+	for _, p := range s.Data {
+		if p.Y > prev {
+			last = p.Date
+		}
+		prev = p.Y
+	}
+	return int(prev), last
+}
+
+// renderGaleFallback renders series as an SVG chart of warning numbers
+// against the day in the year, followed by a table of warning counts.
+func renderGaleFallback(series []warningSeries) (string, error) {
+	left, right := float64(chartMargin), float64(chartWidth-chartMargin/2)
+	top, bottom := float64(chartMargin/2), float64(chartHeight-chartMargin)
+	maxY := 1.0
+	for _, s := range series {
+		for _, p := range s.Data {
+			if p.Y > maxY {
+				maxY = p.Y
+			}
+		}
+	}
+	x := func(day float64) float64 {
+		return math.Round((left+day/366*(right-left))*10) / 10
+	}
+	y := func(n float64) float64 {
+		return math.Round((bottom-n/maxY*(bottom-top))*10) / 10
+	}
+	data := struct {
+		Width, Height            int
+		Left, Right, Top, Bottom float64
+		XTicks, YTicks           []chartLabel
+		Lines                    []chartLine
+	}{
+		Width:  chartWidth,
+		Height: chartHeight,
+		Left:   left,
+		Right:  right,
+		Top:    top,
+		Bottom: bottom,
+	}
+	day := 0
+	for i, month := range chartMonths {
+		data.XTicks = append(data.XTicks, chartLabel{x(float64(day) + 15),
+			bottom + 16, month})
+		day += []int{31, 29, 31, 30, 31, 30, 31, 31, 30, 31, 30, 31}[i]
+	}
+	ticks := []float64{0, maxY}
+	if maxY >= 4 {
+		ticks = append(ticks, math.Round(maxY/2))
+	}
+	for _, n := range ticks {
+		data.YTicks = append(data.YTicks, chartLabel{left - 6, y(n) + 4,
+			fmt.Sprintf("%.0f", n)})
+	}
+	for i, s := range series {
+		line := chartLine{
+			Name:  s.Name,
+			Color: chartPalette[i%len(chartPalette)],
+		}
+		points := []string{}
+		for _, p := range s.Data {
+			points = append(points, fmt.Sprintf("%.1f,%.1f", x(p.X), y(p.Y)))
+		}
+		line.Points = strings.Join(points, " ")
+		line.Count, line.Last = summarizeSeries(s)
+		data.Lines = append(data.Lines, line)
+	}
+	w := &bytes.Buffer{}
+	err := galeFallbackTmpl.Execute(w, &data)
+	return w.String(), err
+}
+
+const (
+	// Sparkline columns, 4 per month
+	sparkWidth = 48
+)
+
+var (
+	sparkRunes = []rune("▁▂▃▄▅▆▇█")
+	// ANSI foreground colors of terminal series
+	terminalPalette = []int{34, 33, 32, 31, 35, 36}
+)
+
+// isTerminal returns true if f is a character device, like a terminal.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// sparkline renders warning numbers of s against the day in the year, scaled
+// to maxY. Columns after the end of the series are blank.
+func sparkline(s warningSeries, maxY float64) string {
+	step := 366. / sparkWidth
+	end := s.Data[len(s.Data)-1].X
+	line := []rune{}
+	y := 0.0
+	i := 0
+	for c := 0; c < sparkWidth; c++ {
+		if float64(c)*step > end {
+			line = append(line, ' ')
+			continue
+		}
+		for i < len(s.Data) && s.Data[i].X < float64(c+1)*step {
+			y = s.Data[i].Y
+			i++
+		}
+		level := int(math.Round(y / maxY * float64(len(sparkRunes)-1)))
+		line = append(line, sparkRunes[level])
+	}
+	return string(line)
+}
+
+// printGaleWarnings writes one sparkline per warning series to w, sharing
+// the same scale, followed by the number of warnings and the date of the
+// last one. Series are colored with ANSI sequences if color is true.
+func printGaleWarnings(w io.Writer, warnings []GaleWarning, now time.Time,
+	color bool) error {
+
+	if len(warnings) == 0 {
+		_, err := fmt.Fprintln(w, "No gale warning recorded.")
+		return err
+	}
+	series := yearlyWarningSeries(warnings, now)
+	maxY := 1.0
+	for _, s := range series {
+		for _, p := range s.Data {
+			if p.Y > maxY {
+				maxY = p.Y
+			}
+		}
+	}
+	nameWidth := 12
+	for _, s := range series {
+		if n := utf8.RuneCountInString(s.Name); n > nameWidth {
+			nameWidth = n
+		}
+	}
+	header := []rune(strings.Repeat(" ", sparkWidth))
+	for i, month := range chartMonths {
+		header[i*sparkWidth/len(chartMonths)] = rune(month[0])
+	}
+	_, err := fmt.Fprintf(w, "%-*s %s %5s  %s\n", nameWidth, "",
+		string(header), "count", "last warning")
+	if err != nil {
+		return err
+	}
+	for i, s := range series {
+		spark := sparkline(s, maxY)
+		if color {
+			spark = fmt.Sprintf("\x1b[%dm%s\x1b[0m",
+				terminalPalette[i%len(terminalPalette)], spark)
+		}
+		count, last := summarizeSeries(s)
+		_, err := fmt.Fprintf(w, "%-*s %s %5d  %s\n", nameWidth, s.Name, spark,
+			count, last)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// galeExportRow is a scanned forecast and its warning numbers, as exported.
+type galeExportRow struct {
+	Date     time.Time `json:"date"`
+	Area     string    `json:"area"`
+	Number   int       `json:"number"`
+	Offshore int       `json:"offshore"`
+	Level    string    `json:"level"`
+	// Forecast file, relative to the forecast directory
+	Path string `json:"path"`
+}
+
+// writeGaleExport writes warnings to w as CSV or JSON, one row per scanned
+// forecast. Forecast paths are made relative to dir.
+func writeGaleExport(w io.Writer, warnings []GaleWarning, dir,
+	format string) error {
+
+	rows := make([]galeExportRow, 0, len(warnings))
+	for _, gw := range warnings {
+		path, err := filepath.Rel(dir, gw.Path)
+		if err != nil {
+			path = gw.Path
+		}
+		rows = append(rows, galeExportRow{
+			Date:     gw.Date,
+			Area:     gw.Area,
+			Number:   gw.Number,
+			Offshore: gw.Offshore,
+			Level:    gw.Level,
+			Path:     filepath.ToSlash(path),
+		})
+	}
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(rows)
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"date", "area", "number", "offshore", "level", "path"})
+		for _, r := range rows {
+			cw.Write([]string{
+				r.Date.Format(time.RFC3339),
+				r.Area,
+				strconv.Itoa(r.Number),
+				strconv.Itoa(r.Offshore),
+				r.Level,
+				r.Path,
+			})
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+	return fmt.Errorf("unknown export format: %q", format)
+}
+
+// serveGaleExport exports gale warnings in the format query parameter, CSV
+// by default, of every area or the area one.
+func serveGaleExport(index *GaleIndex, w http.ResponseWriter,
+	req *http.Request) {
+
+	format := req.URL.Query().Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	contentType := map[string]string{
+		"csv":  "text/csv;charset=utf-8",
+		"json": "application/json",
+	}[format]
+	if contentType == "" {
+		w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "error: unknown export format: %q\n", format)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition",
+		"attachment; filename=gale-warnings."+format)
+	err := writeGaleExport(w, requestWarnings(index, req), index.dir, format)
+	if err != nil {
+		ctxLogger(req.Context()).Error("exporting gale warnings",
+			"error", err)
+	}
+}
+
+var (
+	galeExportCmd = galeCmd.Command("export",
+		"export gale warnings of every forecast as CSV or JSON")
+	galeExportDir = galeExportCmd.Arg("forecastdir",
+		"directory container weather forecasts").Required().String()
+	galeExportFormat = galeExportCmd.Flag("format",
+		"output format: csv or json").Default("csv").Enum("csv", "json")
+	galeExportOut = galeExportCmd.Flag("out",
+		"output file, standard output if empty").String()
+)
+
+func galeExportFn() error {
+	index, err := NewGaleIndex(*galeExportDir, *galeIndexFile, *galeScanWorkers)
+	if err != nil {
+		return err
+	}
+	defer index.Close()
+	if *galeExportOut == "" {
+		return writeGaleExport(os.Stdout, index.Warnings(), *galeExportDir,
+			*galeExportFormat)
+	}
+	fp, err := os.Create(*galeExportOut)
+	if err != nil {
+		return err
+	}
+	err = writeGaleExport(fp, index.Warnings(), *galeExportDir,
+		*galeExportFormat)
+	if closeErr := fp.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const (
+	// galeIndexVersion changes with warning extraction, discarding saved
+	// indexes
+	galeIndexVersion = 2
+	// Delay between scan progress messages
+	scanProgressPeriod = 10 * time.Second
+)
+
+// galeIndexEntry holds the warnings of a forecast file, and the size and
+// modification time they were extracted at.
+type galeIndexEntry struct {
+	ModTime time.Time   `json:"mtime"`
+	Size    int64       `json:"size"`
+	Warning GaleWarning `json:"warning"`
+}
+
+// savedGaleIndex is the index file format, keyed by paths relative to the
+// forecast directory. Saved forecast names are parsed in the Zone time zone.
+type savedGaleIndex struct {
+	Version int                       `json:"version"`
+	Zone    string                    `json:"zone"`
+	Entries map[string]galeIndexEntry `json:"entries"`
+}
+
+// GaleIndex keeps the gale warnings extracted from a forecast directory in
+// memory. The directory is scanned once then watched, new or modified
+// forecasts are parsed as they appear. If path is set, extracted warnings
+// are saved there so forecasts unchanged since the previous run are not
+// parsed again.
+type GaleIndex struct {
+	lock     sync.Mutex
+	dir      string
+	path     string
+	workers  int
+	warnings map[string]galeIndexEntry
+	// Entries loaded from path, until the initial scan completes
+	saved   map[string]galeIndexEntry
+	watcher *fsnotify.Watcher
+}
+
+// NewGaleIndex indexes the forecasts of dir with workers parallel parsers,
+// reusing the warnings saved at path if not empty.
+func NewGaleIndex(dir, path string, workers int) (*GaleIndex, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	idx := &GaleIndex{
+		dir:      dir,
+		path:     path,
+		workers:  workers,
+		warnings: map[string]galeIndexEntry{},
+		watcher:  watcher,
+	}
+	start := time.Now()
+	err = idx.load()
+	if err == nil {
+		err = idx.scan(dir)
+	}
+	if elapsed := time.Since(start); err == nil && elapsed > scanProgressPeriod {
+		slog.Info("scanned forecasts", "dir", dir,
+			"indexed", len(idx.warnings), "elapsed", elapsed.Round(time.Second))
+	}
+	if err == nil {
+		idx.saved = nil
+		err = idx.Save()
+	}
+	if err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	go idx.watch()
+	return idx, nil
+}
+
+// load reads the saved index, if any. Indexes of other versions or time
+// zones are ignored.
+func (idx *GaleIndex) load() error {
+	if idx.path == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(idx.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	saved := savedGaleIndex{}
+	err = json.Unmarshal(data, &saved)
+	if err != nil {
+		slog.Error("ignoring gale index", "path", idx.path, "error", err)
+		return nil
+	}
+	if saved.Version != galeIndexVersion || saved.Zone != localZone.String() {
+		return nil
+	}
+	idx.saved = map[string]galeIndexEntry{}
+	for rel, e := range saved.Entries {
+		path := filepath.Join(idx.dir, filepath.FromSlash(rel))
+		e.Warning.Path = path
+		e.Warning.Date = e.Warning.Date.In(localZone)
+		idx.saved[path] = e
+	}
+	return nil
+}
+
+// Save writes the index to its path, if any.
+func (idx *GaleIndex) Save() error {
+	if idx.path == "" {
+		return nil
+	}
+	saved := savedGaleIndex{
+		Version: galeIndexVersion,
+		Zone:    localZone.String(),
+		Entries: map[string]galeIndexEntry{},
+	}
+	idx.lock.Lock()
+	for path, e := range idx.warnings {
+		rel, err := filepath.Rel(idx.dir, path)
+		if err != nil {
+			continue
+		}
+		e.Warning.Path = ""
+		saved.Entries[filepath.ToSlash(rel)] = e
+	}
+	idx.lock.Unlock()
+	data, err := json.Marshal(&saved)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(idx.path+".tmp", data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(idx.path+".tmp", idx.path)
+}
+
+// scan watches dir and its subdirectories and indexes every forecast in
+// them, with idx.workers parallel parsers. Progress is logged every
+// scanProgressPeriod.
+func (idx *GaleIndex) scan(dir string) error {
+	type file struct {
+		path string
+		fi   os.FileInfo
+	}
+	var lock sync.Mutex
+	var firstErr error
+	fail := func(err error) {
+		lock.Lock()
+		defer lock.Unlock()
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	failed := func() error {
+		lock.Lock()
+		defer lock.Unlock()
+		return firstErr
+	}
+
+	files := make(chan file, 256)
+	scanned := int64(0)
+	wg := sync.WaitGroup{}
+	for i := 0; i < idx.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range files {
+				err := idx.update(f.path, f.fi)
+				if err != nil {
+					fail(err)
+				}
+				atomic.AddInt64(&scanned, 1)
+			}
+		}()
+	}
+	done := make(chan bool)
+	go func() {
+		ticker := time.NewTicker(scanProgressPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				slog.Info("scanning forecasts", "dir", dir,
+					"indexed", atomic.LoadInt64(&scanned))
+			}
+		}
+	}()
+
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := failed(); err != nil {
+			return err
+		}
+		if fi.IsDir() {
+			return idx.watcher.Add(path)
+		}
+		if !fi.Mode().IsRegular() {
+			return nil
+		}
+		files <- file{path, fi}
+		return nil
+	})
+	close(files)
+	wg.Wait()
+	close(done)
+	if err == nil {
+		err = failed()
+	}
+	return err
+}
+
+// update indexes the forecast at path, unless it was saved with the same
+// size and modification time.
+func (idx *GaleIndex) update(path string, fi os.FileInfo) error {
+	idx.lock.Lock()
+	e, ok := idx.saved[path]
+	idx.lock.Unlock()
+	if !ok || e.Size != fi.Size() || !e.ModTime.Equal(fi.ModTime()) {
+		w, ok, err := parseWarningFile(path)
+		if err != nil || !ok {
+			return err
+		}
+		e = galeIndexEntry{
+			ModTime: fi.ModTime(),
+			Size:    fi.Size(),
+			Warning: w,
+		}
+	}
+	idx.lock.Lock()
+	idx.warnings[path] = e
+	idx.lock.Unlock()
+	return nil
+}
+
+// remove drops path, and everything below it if it was a directory.
+func (idx *GaleIndex) remove(path string) {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	prefix := path + string(filepath.Separator)
+	for p := range idx.warnings {
+		if p == path || strings.HasPrefix(p, prefix) {
+			delete(idx.warnings, p)
+		}
+	}
+}
+
+func (idx *GaleIndex) handle(ev fsnotify.Event) error {
+	if ev.Has(fsnotify.Remove) || ev.Has(fsnotify.Rename) {
+		idx.remove(ev.Name)
+		return nil
+	}
+	if !ev.Has(fsnotify.Create) && !ev.Has(fsnotify.Write) {
+		return nil
+	}
+	fi, err := os.Stat(ev.Name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			idx.remove(ev.Name)
+			return nil
+		}
+		return err
+	}
+	if fi.IsDir() {
+		return idx.scan(ev.Name)
+	}
+	if !fi.Mode().IsRegular() {
+		return nil
+	}
+	return idx.update(ev.Name, fi)
+}
+
+func (idx *GaleIndex) watch() {
+	for {
+		select {
+		case ev, ok := <-idx.watcher.Events:
+			if !ok {
+				return
+			}
+			err := idx.handle(ev)
+			if err != nil {
+				slog.Error("indexing forecast", "path", ev.Name, "error", err)
+			}
+		case err, ok := <-idx.watcher.Errors:
+			if !ok {
+				return
+			}
+			slog.Error("watching forecasts", "dir", idx.dir, "error", err)
+		}
+	}
+}
+
+// Warnings returns the sorted sequence of indexed gale warnings.
+func (idx *GaleIndex) Warnings() []GaleWarning {
+	idx.lock.Lock()
+	warnings := make([]GaleWarning, 0, len(idx.warnings))
+	for _, e := range idx.warnings {
+		warnings = append(warnings, e.Warning)
+	}
+	idx.lock.Unlock()
+	return fillWarnings(warnings)
+}
+
+// Close stops watching the forecast directory and saves the index.
+func (idx *GaleIndex) Close() error {
+	err := idx.watcher.Close()
+	if saveErr := idx.Save(); err == nil {
+		err = saveErr
+	}
+	return err
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// galeEvent is the first report of a new gale warning number. Count is the
+// number of warnings issued since the previous event, it is greater than one
+// when intermediary forecasts are missing from the archive.
+type galeEvent struct {
+	Area   string
+	Number int
+	Count  int
+	Date   time.Time
+}
+
+// extractGaleEvents turns the sorted, filled warning sequence into the list
+// of warning issuances for the series selected by counter. Every area has
+// its own numbering.
+func extractGaleEvents(warnings []GaleWarning, counter warningCounter) []galeEvent {
+	events := []galeEvent{}
+	previous := map[string]GaleWarning{}
+	for _, w := range warnings {
+		prev := 0
+		if p, ok := previous[w.Area]; ok && p.Date.Year() == w.Date.Year() {
+			prev = counter(p)
+		}
+		previous[w.Area] = w
+		n := counter(w)
+		if n == prev {
+			continue
+		}
+		count := n - prev
+		if count < 0 {
+			// Counter reset without a year change
+			count = n
+		}
+		if count <= 0 {
+			continue
+		}
+		events = append(events, galeEvent{
+			Area:   w.Area,
+			Number: n,
+			Count:  count,
+			Date:   w.Date,
+		})
+	}
+	return events
+}
+
+type GaleGap struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+	Days float64   `json:"days"`
+}
+
+type GaleStats struct {
+	// Warnings issued per month, keyed by YYYY-MM
+	PerMonth map[string]int `json:"per_month"`
+	// Warnings issued per year, keyed by YYYY
+	PerYear map[string]int `json:"per_year"`
+	// Longest period without a new warning, up to now
+	LongestGap *GaleGap `json:"longest_gap,omitempty"`
+	// Average number of days between consecutive warnings
+	AverageIntervalDays float64 `json:"average_interval_days"`
+}
+
+func computeGaleStats(warnings []GaleWarning, counter warningCounter,
+	now time.Time) *GaleStats {
+
+	stats := &GaleStats{
+		PerMonth: map[string]int{},
+		PerYear:  map[string]int{},
+	}
+	events := extractGaleEvents(warnings, counter)
+	for _, e := range events {
+		stats.PerMonth[e.Date.Format("2006-01")] += e.Count
+		stats.PerYear[strconv.Itoa(e.Date.Year())] += e.Count
+	}
+	if len(events) == 0 {
+		return stats
+	}
+	total := time.Duration(0)
+	longest := &GaleGap{
+		From: events[len(events)-1].Date,
+		To:   now,
+	}
+	for i := 1; i < len(events); i++ {
+		d := events[i].Date.Sub(events[i-1].Date)
+		total += d
+		if d > longest.To.Sub(longest.From) {
+			longest.From = events[i-1].Date
+			longest.To = events[i].Date
+		}
+	}
+	longest.Days = longest.To.Sub(longest.From).Hours() / 24.
+	stats.LongestGap = longest
+	if len(events) > 1 {
+		stats.AverageIntervalDays = total.Hours() / 24. / float64(len(events)-1)
+	}
+	return stats
+}
+
+// formatGaleStats returns the coastal and offshore statistics of warnings
+// as JSON.
+func formatGaleStats(warnings []GaleWarning, now time.Time) ([]byte, error) {
+	stats := struct {
+		Coastal  *GaleStats `json:"coastal"`
+		Offshore *GaleStats `json:"offshore"`
+	}{
+		Coastal:  computeGaleStats(warnings, coastalNumber, now),
+		Offshore: computeGaleStats(warnings, offshoreNumber, now),
+	}
+	return json.MarshalIndent(&stats, "", "  ")
+}
+
+func serveGaleStats(index *GaleIndex, w http.ResponseWriter, req *http.Request) error {
+	data, err := formatGaleStats(requestWarnings(index, req),
+		time.Now().In(localZone))
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(data)
+	return err
+}
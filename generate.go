@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// generateSite writes a static site of forecasts into out, browsable
+// without a server:
+//
+//	index.html                areas index
+//	areas/ID.{txt,html,json}  area renderings, see exportForecasts
+//	bms.html, bms.json        active special bulletins
+//	api/manifest.json         area hashes, like /api/manifest
+//
+// Links between pages are relative and name the .html files. Directory
+// links, like ../ from area pages, rely on the host serving index.html.
+// Unchanged files are left untouched. It returns the number of written
+// files.
+func generateSite(forecasts []Forecast, index, page *template.Template,
+	out string, units Units, gale bool, now time.Time) (int, error) {
+
+	written, err := exportForecasts(forecasts, page, out, units, now)
+	if err != nil {
+		return written, err
+	}
+	areas, err := formatAreas(index, forecasts, "", gale, ".html",
+		time.Time{}, time.Time{})
+	if err != nil {
+		return written, err
+	}
+	active := activeBMS(forecasts)
+	overview, err := formatBMSOverview(active, ".html")
+	if err != nil {
+		return written, err
+	}
+	activeJSON, err := json.Marshal(active)
+	if err != nil {
+		return written, err
+	}
+	manifest, err := json.Marshal(manifestEntries(forecasts))
+	if err != nil {
+		return written, err
+	}
+	files := []struct {
+		path string
+		data []byte
+	}{
+		{"index.html", []byte(areas)},
+		{"bms.html", overview},
+		{"bms.json", activeJSON},
+		{"api/manifest.json", manifest},
+	}
+	modified := latestIssue(forecasts)
+	for _, f := range files {
+		path := filepath.Join(out, filepath.FromSlash(f.path))
+		ok, err := writeIfChanged(path, f.data, modified)
+		if err != nil {
+			return written, err
+		}
+		if ok {
+			written++
+		}
+	}
+	return written, nil
+}
+
+// generateGale writes the gale chart of warnings into out/gale, with its
+// scripts copied from scripts, the yearly series as series.json, the
+// statistics as stats.json, the warnings as export.csv and the
+// calendar.ics feed. It returns the number of written files.
+func generateGale(warnings []GaleWarning, dir, scripts, out string,
+	now time.Time) (int, error) {
+
+	chart, err := ioutil.ReadFile(filepath.Join(scripts, "main.html"))
+	if err != nil {
+		return 0, err
+	}
+	out = filepath.Join(out, "gale")
+	page, err := renderGaleWarnings(warnings, "", false, chart, "")
+	if err != nil {
+		return 0, err
+	}
+	series := []warningSeries{}
+	if len(warnings) > 0 {
+		series = padWarningSeries(yearlyWarningSeries(warnings, now))
+	}
+	seriesJSON, err := json.Marshal(&series)
+	if err != nil {
+		return 0, err
+	}
+	stats, err := formatGaleStats(warnings, now)
+	if err != nil {
+		return 0, err
+	}
+	export := &bytes.Buffer{}
+	err = writeGaleExport(export, warnings, dir, "csv")
+	if err != nil {
+		return 0, err
+	}
+	files := map[string][]byte{
+		"index.html":   page,
+		"series.json":  seriesJSON,
+		"stats.json":   stats,
+		"export.csv":   export.Bytes(),
+		"calendar.ics": formatICS("Gale warnings", galeCalendarEvents(warnings)),
+	}
+	modified := time.Time{}
+	if len(warnings) > 0 {
+		modified = warnings[len(warnings)-1].Date
+	}
+	written := 0
+	for name, data := range files {
+		ok, err := writeIfChanged(filepath.Join(out, name), data, modified)
+		if err != nil {
+			return written, err
+		}
+		if ok {
+			written++
+		}
+	}
+	// Copy chart scripts and stylesheets
+	err = filepath.Walk(scripts, func(path string, fi os.FileInfo,
+		err error) error {
+
+		if err != nil || fi.IsDir() || fi.Name() == "main.html" {
+			return err
+		}
+		rel, err := filepath.Rel(scripts, path)
+		if err != nil {
+			return err
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		ok, err := writeIfChanged(filepath.Join(out, "scripts", rel), data,
+			fi.ModTime())
+		if ok {
+			written++
+		}
+		return err
+	})
+	return written, err
+}
+
+var (
+	generateCmd = app.Command("generate",
+		"fetch every area and generate a static site of its bulletins")
+	generateOut = generateCmd.Arg("outdir", "output directory").
+			Required().String()
+	generateTemplates = generateCmd.Flag("templates",
+		"directory of index.html and area.html templates overriding the "+
+			"default ones").String()
+	generateWindUnit = generateCmd.Flag("wind-unit",
+		"wind speed unit of JSON bulletins: kt, ms or kmh").
+		Default("kt").Enum("kt", "ms", "kmh")
+	generateDistanceUnit = generateCmd.Flag("distance-unit",
+		"distance unit of JSON bulletins: nm or km").
+		Default("nm").Enum("nm", "km")
+	generateGaleDir = generateCmd.Flag("gale-dir",
+		"directory of saved forecasts, adding their gale chart to the site").
+		String()
+	generateGaleIndex = generateCmd.Flag("gale-index",
+		"file saving warnings extracted from --gale-dir").String()
+	generateScripts = generateCmd.Flag("scripts",
+		"directory of the gale chart page and scripts").
+		Default("scripts").String()
+)
+
+func generateFn() error {
+	index, _, err := loadTemplate(*generateTemplates, "index.html")
+	if err != nil {
+		return err
+	}
+	page, _, err := loadTemplate(*generateTemplates, "area.html")
+	if err != nil {
+		return err
+	}
+	upstream, err := newForecastSource()
+	if err != nil {
+		return err
+	}
+	forecasts, err := fetchForecasts(context.Background(), upstream)
+	if err != nil {
+		return err
+	}
+	units := Units{
+		Wind:     *generateWindUnit,
+		Distance: *generateDistanceUnit,
+	}
+	now := time.Now()
+	written := 0
+	if *generateGaleDir != "" {
+		galeIndex, err := NewGaleIndex(*generateGaleDir, *generateGaleIndex, 8)
+		if err != nil {
+			return err
+		}
+		written, err = generateGale(galeIndex.Warnings(), *generateGaleDir,
+			*generateScripts, *generateOut, now.In(localZone))
+		galeIndex.Close()
+		if err != nil {
+			return err
+		}
+	}
+	n, err := generateSite(forecasts, index, page, *generateOut, units,
+		*generateGaleDir != "", now)
+	fmt.Printf("wrote %d files\n", written+n)
+	return err
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// serveHealth reports the process is alive, with a warning if archiving is
+// paused for lack of disk space or if the upstream circuit breaker is open.
+func serveHealth(archive *Archive, w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	fmt.Fprintf(w, "ok\n")
+	if disk := archive.DiskStatus(); disk != nil && disk.Paused {
+		fmt.Fprintf(w, "warning: %s, %d bytes free\n", errArchivePaused,
+			disk.Free)
+	}
+	if b := upstreamBreaker.Status(); b != nil && b.State != "closed" {
+		fmt.Fprintf(w, "warning: upstream circuit breaker %s until %s, %d "+
+			"consecutive failures\n", b.State, b.Until.Format(time.RFC3339),
+			b.Failures)
+	}
+}
+
+// serveReady reports whether forecasts were successfully fetched less than
+// maxAge ago, with the kind of the last fetch error. It never triggers a
+// fetch itself.
+func serveReady(cache *ForecastCache, maxAge time.Duration,
+	w http.ResponseWriter, req *http.Request) {
+
+	w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	fetched := cache.Fetched()
+	age := time.Since(fetched)
+	if fetched.IsZero() || age > maxAge {
+		w.WriteHeader(503)
+		if fetched.IsZero() {
+			fmt.Fprintf(w, "error: forecasts were never fetched\n")
+		} else {
+			fmt.Fprintf(w, "error: forecasts were last fetched %s ago\n",
+				age.Truncate(time.Second))
+		}
+		// Tell upstream outages from local failures
+		if err := cache.LastError(); err != nil {
+			fmt.Fprintf(w, "error: %s: %s\n", errorKind(err), err)
+		}
+		return
+	}
+	fmt.Fprintf(w, "ok\n")
+}
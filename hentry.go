@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Revision pages are marked up with microformats2 h-feed and h-entry, so
+// IndieWeb readers can follow bulletin editions.
+const (
+	revisionsTemplate = `<html>
+<head>
+	<meta charset="utf-8"/>
+	<title>{{.Title}}: revisions</title>
+</head>
+<body class="h-feed">
+	<h1 class="p-name">{{.Title}}</h1>
+	<ul>
+	{{range .Entries}}
+		<li class="h-entry">
+			<a class="u-url p-name" href="{{.URL}}">{{.Title}}</a>
+			<time class="dt-published" datetime="{{.Published}}">{{.Published}}</time>
+		</li>
+	{{end}}
+	</ul>
+</body>
+</html>
+`
+	revisionTemplate = `<html>
+<head>
+	<meta charset="utf-8"/>
+	<title>{{.Title}}</title>
+</head>
+<body>
+	<article class="h-entry">
+		<h1 class="p-name">{{.Title}}</h1>
+		<p>
+			<a class="u-url" href="{{.URL}}">Published</a>
+			<time class="dt-published" datetime="{{.Published}}">{{.Published}}</time>
+			by <a class="p-author h-card" href="{{.AuthorURL}}">{{.Author}}</a>
+		</p>
+		{{range .Syndication}}
+		<a class="u-syndication" href="{{.}}">{{.}}</a>
+		{{end}}
+		<pre class="e-content">{{.Content}}</pre>
+	</article>
+	{{if or .Notes .Annotate}}
+	<h2>Notes</h2>
+	{{range .Notes}}
+		<div class="h-cite">
+			<p class="p-content">{{.Text}}</p>
+			<p>
+				by <span class="p-author">{{.Author}}</span>
+				<time class="dt-published" datetime="{{.Time.Format "2006-01-02T15:04:05Z07:00"}}">{{.Time.Format "2006-01-02 15:04"}}</time>
+			</p>
+		</div>
+	{{end}}
+	{{if .Annotate}}
+	<form method="post" action="{{.Id}}/notes">
+		<textarea name="text" maxlength="500" rows="3" cols="60"></textarea><br/>
+		<input type="submit" value="Add note"/>
+	</form>
+	{{end}}
+	{{end}}
+	<a href="{{.Id}}/diff?format=html&amp;mode=words">Changes</a>
+	<a href="../revisions">All revisions</a>
+</body>
+</html>
+`
+)
+
+var (
+	revisionsTmpl = template.Must(template.New("revisions").Parse(revisionsTemplate))
+	revisionTmpl  = template.Must(template.New("revision").Parse(revisionTemplate))
+)
+
+type revisionEntry struct {
+	Id        string
+	Title     string
+	URL       string
+	Published string
+	Content   string
+	// Author is the publisher of the bulletin, linking to AuthorURL
+	Author    string
+	AuthorURL string
+	// Syndication lists the URLs receiving a Webmention for the revision
+	Syndication []string
+	Notes       []Note
+	// Annotate shows the note form
+	Annotate bool
+}
+
+// revisionPath returns the URL path of rev below prefix.
+func revisionPath(prefix string, rev Revision) string {
+	return prefix + "/areas/" + rev.Area + "/revisions/" + rev.Id()
+}
+
+// bulletinTitle returns the first line of a bulletin text.
+func bulletinTitle(content string) string {
+	return strings.TrimSpace(strings.SplitN(content, "\n", 2)[0])
+}
+
+func writeHTML(w http.ResponseWriter, t *template.Template, data interface{}) {
+	buf := &bytes.Buffer{}
+	err := t.Execute(buf, data)
+	if err != nil {
+		w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+		w.WriteHeader(500)
+		w.Write([]byte("error: " + err.Error() + "\n"))
+		return
+	}
+	w.Header().Set("Content-Type", "text/html;charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+func writeNotFound(w http.ResponseWriter, what string) {
+	w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+	w.WriteHeader(404)
+	w.Write([]byte("error: cannot find " + what + "\n"))
+}
+
+// serveRevisions lists area editions as an h-feed, newest first. Entry URLs
+// are absolute when baseURL is set.
+func serveRevisions(archive *Archive, baseURL, prefix, area string,
+	w http.ResponseWriter, req *http.Request) {
+
+	revisions := archive.Editions(area)
+	if len(revisions) == 0 {
+		writeNotFound(w, "revisions of area "+area)
+		return
+	}
+	title := "Area " + area
+	content, err := archive.Read(revisions[len(revisions)-1])
+	if err == nil {
+		title = bulletinTitle(content)
+	}
+	data := struct {
+		Title   string
+		Entries []revisionEntry
+	}{
+		Title: title,
+	}
+	for i := len(revisions) - 1; i >= 0; i-- {
+		rev := revisions[i]
+		url := "revisions/" + rev.Id()
+		if baseURL != "" {
+			url = baseURL + revisionPath(prefix, rev)
+		}
+		data.Entries = append(data.Entries, revisionEntry{
+			Title:     title + ", " + rev.Time.Format("2006-01-02 15:04"),
+			URL:       url,
+			Published: rev.Time.Format(time.RFC3339),
+		})
+	}
+	writeHTML(w, revisionsTmpl, &data)
+}
+
+// serveRevision renders an area revision as an h-entry, credited to the
+// publisher of source and linking to the syndication URLs, followed by its
+// notes. The note form is shown when annotate is set.
+func serveRevision(archive *Archive, source ForecastSource, baseURL, prefix,
+	area, id string, annotate bool, syndication []string,
+	w http.ResponseWriter, req *http.Request) {
+
+	rev, ok := archive.Revision(area, id)
+	if !ok {
+		writeNotFound(w, "revision "+id+" of area "+area)
+		return
+	}
+	content, err := archive.Read(rev)
+	var notes []Note
+	if err == nil {
+		notes, err = archive.Notes(rev)
+	}
+	if err != nil {
+		w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+		w.WriteHeader(500)
+		w.Write([]byte("error: " + err.Error() + "\n"))
+		return
+	}
+	url := rev.Id()
+	if baseURL != "" {
+		url = baseURL + revisionPath(prefix, rev)
+	}
+	author, authorURL := source.Publisher()
+	writeHTML(w, revisionTmpl, &revisionEntry{
+		Id:          rev.Id(),
+		Title:       bulletinTitle(content),
+		URL:         url,
+		Published:   rev.Time.Format(time.RFC3339),
+		Content:     content,
+		Author:      author,
+		AuthorURL:   authorURL,
+		Syndication: syndication,
+		Notes:       notes,
+		Annotate:    annotate,
+	})
+}
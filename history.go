@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	historyTemplate = `<html>
+<head>
+	<meta charset="utf-8"/>
+	<title>{{.Title}}: history</title>
+	<style>
+		td, th { padding: 2px 8px; text-align: left; }
+		.bms { color: #c00; font-weight: bold; }
+	</style>
+</head>
+<body>
+	<h1>{{.Title}}</h1>
+	<form method="get">
+		<label>From <input type="date" name="from" value="{{.From}}"/></label>
+		<label>To <input type="date" name="to" value="{{.To}}"/></label>
+		<input type="submit" value="Filter"/>
+	</form>
+	<table>
+		<tr><th>Edition</th><th>Special bulletin</th><th></th></tr>
+		{{range .Entries}}
+		<tr>
+			<td><a href="{{.URL}}">{{.Time.Format "2006-01-02 15:04"}}</a></td>
+			<td>{{if .BMS}}<span class="bms">n°{{.BMS.Number}}{{if .BMS.Level}}, {{.BMS.Level}}{{end}}</span>{{end}}</td>
+			<td>{{if .Diff}}<a href="{{.Diff}}">changes</a>{{end}}</td>
+		</tr>
+		{{end}}
+	</table>
+	<p>
+		{{if .Previous}}<a href="{{.Previous}}">Newer</a>{{end}}
+		{{if .Next}}<a href="{{.Next}}">Older</a>{{end}}
+	</p>
+	<p><a href="../{{.Area}}">Current bulletin</a></p>
+</body>
+</html>
+`
+	// Default and maximum number of history entries per page
+	historyPageSize    = 50
+	maxHistoryPageSize = 500
+)
+
+var (
+	historyTmpl = template.Must(template.New("history").Parse(historyTemplate))
+)
+
+// historyBMS is the special bulletin in force in an edition.
+type historyBMS struct {
+	Number int    `json:"number"`
+	Level  string `json:"level,omitempty"`
+}
+
+// historyEntry is an area edition in its history.
+type historyEntry struct {
+	Id   string    `json:"id"`
+	Time time.Time `json:"time"`
+	// Archived full text
+	URL string `json:"url"`
+	// Changes since the previous edition, empty for the first one
+	Diff string      `json:"diff,omitempty"`
+	BMS  *historyBMS `json:"bms,omitempty"`
+	// Offshore special bulletin number, zero if none
+	Offshore int `json:"offshore,omitempty"`
+}
+
+// historyQuery selects a page of area editions between From and To, zero
+// when unbounded.
+type historyQuery struct {
+	From  time.Time
+	To    time.Time
+	Page  int
+	Limit int
+}
+
+// parseHistoryQuery reads the from and to inclusive YYYY-MM-DD dates, the
+// page, from 1, and limit query parameters.
+func parseHistoryQuery(req *http.Request) (historyQuery, error) {
+	values := req.URL.Query()
+	q := historyQuery{Page: 1, Limit: historyPageSize}
+	var err error
+	q.From, err = parseSearchDate(values.Get("from"))
+	if err != nil {
+		return q, err
+	}
+	q.To, err = parseSearchDate(values.Get("to"))
+	if err != nil {
+		return q, err
+	}
+	if !q.To.IsZero() {
+		q.To = q.To.AddDate(0, 0, 1)
+	}
+	if s := values.Get("page"); s != "" {
+		q.Page, err = strconv.Atoi(s)
+		if err != nil || q.Page < 1 {
+			return q, fmt.Errorf("invalid page: %q", s)
+		}
+	}
+	if s := values.Get("limit"); s != "" {
+		q.Limit, err = strconv.Atoi(s)
+		if err != nil || q.Limit < 1 || q.Limit > maxHistoryPageSize {
+			return q, fmt.Errorf("invalid limit, expected 1 to %d: %q",
+				maxHistoryPageSize, s)
+		}
+	}
+	return q, nil
+}
+
+// historyPageURL returns the relative URL of page of the history of req.
+func historyPageURL(req *http.Request, page int) string {
+	values := url.Values{}
+	for k, v := range req.URL.Query() {
+		values[k] = v
+	}
+	values.Set("page", strconv.Itoa(page))
+	return "history?" + values.Encode()
+}
+
+// serveHistory lists the editions of area, newest first, with the special
+// bulletins in force and links to their archived text and changes. Pages
+// link to the adjacent ones, in HTML and in the Link header.
+func serveHistory(archive *Archive, area string, w http.ResponseWriter,
+	req *http.Request) {
+
+	format, err := negotiateFormat(req)
+	if err != nil {
+		w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+		w.WriteHeader(406)
+		fmt.Fprintf(w, "error: %s\n", err)
+		return
+	}
+	q, err := parseHistoryQuery(req)
+	if err != nil {
+		w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "error: %s\n", err)
+		return
+	}
+	editions := archive.Editions(area)
+	if len(editions) == 0 {
+		writeNotFound(w, "revisions of area "+area)
+		return
+	}
+	title := "Area " + area
+	if content, err := archive.Read(editions[len(editions)-1]); err == nil {
+		title = bulletinTitle(content)
+	}
+	selected := []Revision{}
+	for i := len(editions) - 1; i >= 0; i-- {
+		rev := editions[i]
+		if (q.From.IsZero() || !rev.Time.Before(q.From)) &&
+			(q.To.IsZero() || rev.Time.Before(q.To)) {
+			selected = append(selected, rev)
+		}
+	}
+	start := (q.Page - 1) * q.Limit
+	if start > len(selected) {
+		start = len(selected)
+	}
+	end := start + q.Limit
+	if end > len(selected) {
+		end = len(selected)
+	}
+	entries := []historyEntry{}
+	for _, rev := range selected[start:end] {
+		entry := historyEntry{
+			Id:   rev.Id(),
+			Time: rev.Time.In(localZone),
+			URL:  "revisions/" + rev.Id(),
+		}
+		if rev.Previous != "" {
+			entry.Diff = entry.URL + "/diff?format=html"
+		}
+		warning, err := extractWarningNumber(rev.Path)
+		if err != nil {
+			writeError(w, req, err)
+			return
+		}
+		if warning.Number > 0 {
+			entry.BMS = &historyBMS{warning.Number, warning.Level}
+		}
+		entry.Offshore = warning.Offshore
+		entries = append(entries, entry)
+	}
+	previous, next := "", ""
+	links := []string{}
+	if q.Page > 1 {
+		previous = historyPageURL(req, q.Page-1)
+		links = append(links, fmt.Sprintf(`<%s>; rel="prev"`, previous))
+	}
+	if end < len(selected) {
+		next = historyPageURL(req, q.Page+1)
+		links = append(links, fmt.Sprintf(`<%s>; rel="next"`, next))
+	}
+	if len(links) > 0 {
+		w.Header().Set("Link", strings.Join(links, ", "))
+	}
+	w.Header().Set("Vary", "Accept")
+	switch format {
+	case "html":
+		data := struct {
+			Title    string
+			Area     string
+			From     string
+			To       string
+			Entries  []historyEntry
+			Previous string
+			Next     string
+		}{
+			Title:    title,
+			Area:     area,
+			From:     req.URL.Query().Get("from"),
+			To:       req.URL.Query().Get("to"),
+			Entries:  entries,
+			Previous: previous,
+			Next:     next,
+		}
+		writeHTML(w, historyTmpl, &data)
+	case "json":
+		writeJSON(w, struct {
+			Area    string         `json:"area"`
+			Title   string         `json:"title"`
+			Total   int            `json:"total"`
+			Page    int            `json:"page"`
+			Entries []historyEntry `json:"entries"`
+		}{area, title, len(selected), q.Page, entries})
+	default:
+		w.Header().Set("Content-Type", formatTypes["text"])
+		fmt.Fprintf(w, "%s\n\n", title)
+		for _, e := range entries {
+			fmt.Fprintf(w, "%s %s", e.Time.Format("2006-01-02 15:04"), e.URL)
+			if e.BMS != nil {
+				fmt.Fprintf(w, " BMS n°%d", e.BMS.Number)
+				if e.BMS.Level != "" {
+					fmt.Fprintf(w, ", %s", e.BMS.Level)
+				}
+			}
+			fmt.Fprintf(w, "\n")
+		}
+	}
+}
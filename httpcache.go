@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// cacheMaxAge returns how long fetched forecasts remain fresh, so clients
+// and proxies do not cache them beyond the next refresh.
+func cacheMaxAge(cache *ForecastCache) time.Duration {
+	fetched := cache.Fetched()
+	if fetched.IsZero() {
+		return 0
+	}
+	age := cache.Interval() - time.Since(fetched)
+	if age < 0 {
+		return 0
+	}
+	return age
+}
+
+// writeCacheHeaders sets ETag, Last-Modified and Cache-Control headers, then
+// replies with a 304 and returns true if the request conditions match.
+// If-None-Match takes precedence over If-Modified-Since. A zero modified time
+// is ignored.
+func writeCacheHeaders(w http.ResponseWriter, req *http.Request, etag string,
+	modified time.Time, maxAge time.Duration) bool {
+
+	h := w.Header()
+	h.Set("Cache-Control", fmt.Sprintf("public, max-age=%d",
+		int(maxAge.Seconds())))
+	h.Set("ETag", etag)
+	modified = modified.UTC().Truncate(time.Second)
+	if !modified.IsZero() {
+		h.Set("Last-Modified", modified.Format(http.TimeFormat))
+	}
+	if match := req.Header.Get("If-None-Match"); match != "" {
+		if match != etag {
+			return false
+		}
+	} else {
+		since, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+		if err != nil || modified.IsZero() || modified.After(since) {
+			return false
+		}
+	}
+	w.WriteHeader(304)
+	return true
+}
+
+// writeStaleHeader sets X-Metmar-Stale to the time of the last successful
+// fetch if the last one failed, and returns it, or the zero time.
+func writeStaleHeader(w http.ResponseWriter, cache *ForecastCache) time.Time {
+	stale := cache.Stale()
+	if !stale.IsZero() {
+		w.Header().Set("X-Metmar-Stale",
+			stale.In(localZone).Format(time.RFC3339))
+	}
+	return stale
+}
+
+// lastModified returns the latest issue time of forecasts, or the fetch time
+// if unknown.
+func lastModified(cache *ForecastCache, forecasts []Forecast) time.Time {
+	if issued := latestIssue(forecasts); !issued.IsZero() {
+		return issued
+	}
+	return cache.Fetched()
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ICSEvent is an iCalendar VEVENT.
+type ICSEvent struct {
+	UID         string
+	Start       time.Time
+	End         time.Time
+	Summary     string
+	Description string
+	URL         string
+	Sequence    int
+	Stamp       time.Time
+}
+
+const (
+	icsTimeFormat = "20060102T150405Z"
+)
+
+func escapeICSText(s string) string {
+	s = strings.Replace(s, "\\", "\\\\", -1)
+	s = strings.Replace(s, ";", "\\;", -1)
+	s = strings.Replace(s, ",", "\\,", -1)
+	s = strings.Replace(s, "\r\n", "\\n", -1)
+	s = strings.Replace(s, "\n", "\\n", -1)
+	return s
+}
+
+// writeICSLine writes a content line folded at 75 octets, without splitting
+// UTF-8 sequences.
+func writeICSLine(w *bytes.Buffer, line string) {
+	first := true
+	for len(line) > 0 {
+		max := 75
+		if !first {
+			max = 74
+		}
+		if len(line) <= max {
+			if !first {
+				w.WriteString(" ")
+			}
+			w.WriteString(line)
+			break
+		}
+		cut := max
+		for cut > 0 && !utf8RuneStart(line[cut]) {
+			cut--
+		}
+		if !first {
+			w.WriteString(" ")
+		}
+		w.WriteString(line[:cut])
+		w.WriteString("\r\n")
+		line = line[cut:]
+		first = false
+	}
+	w.WriteString("\r\n")
+}
+
+func writeICSEvent(w *bytes.Buffer, ev ICSEvent) {
+	writeICSLine(w, "BEGIN:VEVENT")
+	writeICSLine(w, "UID:"+ev.UID)
+	writeICSLine(w, "DTSTAMP:"+ev.Stamp.UTC().Format(icsTimeFormat))
+	writeICSLine(w, "DTSTART:"+ev.Start.UTC().Format(icsTimeFormat))
+	if !ev.End.IsZero() {
+		writeICSLine(w, "DTEND:"+ev.End.UTC().Format(icsTimeFormat))
+	}
+	writeICSLine(w, fmt.Sprintf("SEQUENCE:%d", ev.Sequence))
+	writeICSLine(w, "SUMMARY:"+escapeICSText(ev.Summary))
+	if ev.Description != "" {
+		writeICSLine(w, "DESCRIPTION:"+escapeICSText(ev.Description))
+	}
+	if ev.URL != "" {
+		writeICSLine(w, "URL:"+ev.URL)
+	}
+	writeICSLine(w, "END:VEVENT")
+}
+
+// formatICS returns an iCalendar document holding events.
+func formatICS(name string, events []ICSEvent) []byte {
+	w := &bytes.Buffer{}
+	writeICSLine(w, "BEGIN:VCALENDAR")
+	writeICSLine(w, "VERSION:2.0")
+	writeICSLine(w, "PRODID:-//metmar//gale warnings//FR")
+	if name != "" {
+		writeICSLine(w, "X-WR-CALNAME:"+escapeICSText(name))
+	}
+	for _, ev := range events {
+		writeICSEvent(w, ev)
+	}
+	writeICSLine(w, "END:VCALENDAR")
+	return w.Bytes()
+}
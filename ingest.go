@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+const (
+	maxIngestSize = 1 << 20
+)
+
+// parseIngest decodes bulletins pushed to /ingest. JSON bodies hold one
+// forecast or an array of them, with id, title, content, special, issued and
+// expires fields. Plain text bodies are the content of the area passed as
+// "area" query parameter.
+func parseIngest(w http.ResponseWriter, req *http.Request) ([]Forecast, error) {
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, maxIngestSize))
+	if err != nil {
+		return nil, err
+	}
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	forecasts := []Forecast{}
+	switch mediaType {
+	case "application/json":
+		trimmed := strings.TrimSpace(string(data))
+		if strings.HasPrefix(trimmed, "[") {
+			err = json.Unmarshal(data, &forecasts)
+		} else {
+			f := Forecast{}
+			err = json.Unmarshal(data, &f)
+			forecasts = append(forecasts, f)
+		}
+		if err != nil {
+			return nil, err
+		}
+	case "text/plain", "":
+		q := req.URL.Query()
+		content := string(data)
+		title := q.Get("title")
+		if title == "" {
+			title = bulletinTitle(content)
+		}
+		forecasts = append(forecasts, Forecast{
+			Id:      q.Get("area"),
+			Title:   title,
+			Content: content,
+		})
+	default:
+		return nil, fmt.Errorf("unsupported content type: %s", mediaType)
+	}
+	for _, f := range forecasts {
+		if f.Id == "" || strings.ContainsAny(f.Id, `/\.`) {
+			return nil, fmt.Errorf("invalid area identifier: %q", f.Id)
+		}
+		if strings.TrimSpace(f.Content) == "" {
+			return nil, fmt.Errorf("empty content for area %s", f.Id)
+		}
+	}
+	return forecasts, nil
+}
+
+// serveIngest feeds bulletins from external fetchers into cache, after
+// checking the request bears token.
+func serveIngest(cache *ForecastCache, token string, w http.ResponseWriter,
+	req *http.Request) {
+
+	w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+	if req.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		w.WriteHeader(405)
+		fmt.Fprintf(w, "error: method not allowed\n")
+		return
+	}
+	auth := req.Header.Get("Authorization")
+	if subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+token)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="metmar"`)
+		w.WriteHeader(401)
+		fmt.Fprintf(w, "error: invalid token\n")
+		return
+	}
+	forecasts, err := parseIngest(w, req)
+	if err != nil {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "error: %s\n", err)
+		return
+	}
+	cache.Ingest(forecasts)
+	ids := []string{}
+	for _, f := range forecasts {
+		ids = append(ids, f.Id)
+	}
+	auditLog.Record(req, "ingest-token", "ingest", strings.Join(ids, ","), "")
+	fmt.Fprintf(w, "ingested %d bulletins\n", len(forecasts))
+}
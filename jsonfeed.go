@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+const (
+	jsonFeedVersion = "https://jsonfeed.org/version/1.1"
+	// Maximum number of editions listed in area feeds
+	maxFeedItems = 50
+)
+
+// JSON Feed 1.1 document, see https://jsonfeed.org/version/1.1
+type jsonFeed struct {
+	Version     string           `json:"version"`
+	Title       string           `json:"title"`
+	HomePageURL string           `json:"home_page_url,omitempty"`
+	FeedURL     string           `json:"feed_url,omitempty"`
+	Language    string           `json:"language"`
+	Authors     []jsonFeedAuthor `json:"authors"`
+	Items       []jsonFeedItem   `json:"items"`
+}
+
+type jsonFeedAuthor struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+type jsonFeedItem struct {
+	Id            string `json:"id"`
+	URL           string `json:"url"`
+	Title         string `json:"title"`
+	ContentText   string `json:"content_text"`
+	DatePublished string `json:"date_published"`
+}
+
+// serveJSONFeed lists the latest area revisions as a JSON Feed, newest
+// first, with one item per bulletin edition. Item URLs point to the
+// revision pages and are absolute when baseURL is set.
+func serveJSONFeed(archive *Archive, baseURL, prefix, area string,
+	w http.ResponseWriter, req *http.Request) {
+
+	revisions := archive.Editions(area)
+	if len(revisions) == 0 {
+		writeNotFound(w, "revisions of area "+area)
+		return
+	}
+	latest := revisions[len(revisions)-1]
+	feed := jsonFeed{
+		Version:  jsonFeedVersion,
+		Title:    "Area " + area,
+		Language: "fr",
+		Authors: []jsonFeedAuthor{
+			{Name: "Météo-France", URL: "https://meteofrance.com"},
+		},
+		Items: []jsonFeedItem{},
+	}
+	if baseURL != "" {
+		feed.HomePageURL = baseURL + prefix + "/areas/" + area
+		feed.FeedURL = feed.HomePageURL + "/feed.json"
+	}
+	for i := len(revisions) - 1; i >= 0 && len(feed.Items) < maxFeedItems; i-- {
+		rev := revisions[i]
+		content, err := archive.Read(rev)
+		if err != nil {
+			writeError(w, req, err)
+			return
+		}
+		title := bulletinTitle(content)
+		if i == len(revisions)-1 {
+			feed.Title = title
+		}
+		url := "revisions/" + rev.Id()
+		if baseURL != "" {
+			url = baseURL + revisionPath(prefix, rev)
+		}
+		feed.Items = append(feed.Items, jsonFeedItem{
+			Id:            url,
+			URL:           url,
+			Title:         title + ", " + rev.Time.Format("2006-01-02 15:04"),
+			ContentText:   content,
+			DatePublished: rev.Time.Format(time.RFC3339),
+		})
+	}
+	data, err := json.MarshalIndent(&feed, "", "  ")
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/feed+json")
+	if writeCacheHeaders(w, req, hashReport(string(data)), latest.Time, 0) {
+		return
+	}
+	w.Write(data)
+}
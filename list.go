@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+var (
+	listCmd = app.Command("list",
+		"fetch and list area identifiers with their bulletin title")
+	listBMS = listCmd.Flag("bms",
+		"also tell whether a special bulletin is in force").Bool()
+)
+
+func listFn() error {
+	upstream, err := newForecastSource()
+	if err != nil {
+		return err
+	}
+	forecasts, err := fetchForecasts(context.Background(), upstream)
+	if err != nil {
+		return err
+	}
+	for _, f := range forecasts {
+		line := f.Id + "\t" + f.Title
+		if *listBMS {
+			if b := parseBMS(f.Special); b != nil {
+				level := b.Level
+				if level == "" {
+					level = "avis en cours"
+				}
+				line += fmt.Sprintf("\tBMS n°%d: %s", b.Number, level)
+			} else {
+				line += "\t-"
+			}
+		}
+		fmt.Println(line)
+	}
+	return nil
+}
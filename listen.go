@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+)
+
+const (
+	// First file descriptor passed by systemd socket activation
+	listenFdsStart = 3
+)
+
+// systemdListener returns the socket passed by systemd socket activation, as
+// described by sd_listen_fds(3), or nil if the process was not activated.
+// The activation variables are cleared so child processes do not inherit
+// them.
+func systemdListener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if err != nil || n == 0 {
+		return nil, nil
+	}
+	if n != 1 {
+		return nil, configError("systemd passed %d sockets, expected one", n)
+	}
+	f := os.NewFile(uintptr(listenFdsStart), "LISTEN_FD_3")
+	ln, err := net.FileListener(f)
+	// FileListener duplicates the descriptor
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("using systemd socket: %s", err)
+	}
+	return ln, nil
+}
+
+// listen returns the socket passed by systemd socket activation if any, so
+// the service can bind privileged ports without root and keep accepting
+// connections across restarts, or a new TCP listener on addr.
+func listen(addr string) (net.Listener, error) {
+	ln, err := systemdListener()
+	if err != nil {
+		return nil, err
+	}
+	if ln != nil {
+		slog.Info("using systemd socket", "addr", ln.Addr().String())
+		return ln, nil
+	}
+	return net.Listen("tcp", addr)
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// loadRequest is a kind of request replayed by the load test, with its
+// share of the traffic.
+type loadRequest struct {
+	Kind   string
+	Weight int
+	// Path returns the path of a request, below the target URL
+	Path   func(area string) string
+	Accept string
+	// Conditional requests reuse ETags of previous responses
+	Conditional bool
+}
+
+var (
+	loadMix = []loadRequest{
+		{"index", 20, func(string) string { return "/" }, "text/html", false},
+		{"area html", 25, func(a string) string { return "/areas/" + a }, "text/html", false},
+		{"area text", 15, func(a string) string { return "/areas/" + a + ".txt" }, "", false},
+		{"area json", 15, func(a string) string { return "/areas/" + a }, "application/json", false},
+		{"status", 5, func(string) string { return "/status" }, "", false},
+		{"conditional", 20, func(a string) string { return "/areas/" + a }, "text/html", true},
+	}
+)
+
+type loadResult struct {
+	Kind    string
+	Status  int
+	Latency time.Duration
+	Err     error
+}
+
+// LoadTester sends a request mix at a fixed rate and collects latencies.
+type LoadTester struct {
+	target  string
+	areas   []string
+	client  *http.Client
+	lock    sync.Mutex
+	etags   map[string]string
+	results []loadResult
+	dropped int
+}
+
+func (l *LoadTester) pick() loadRequest {
+	total := 0
+	for _, r := range loadMix {
+		total += r.Weight
+	}
+	n := rand.Intn(total)
+	for _, r := range loadMix {
+		if n < r.Weight {
+			return r
+		}
+		n -= r.Weight
+	}
+	return loadMix[0]
+}
+
+func (l *LoadTester) do(r loadRequest) loadResult {
+	area := l.areas[rand.Intn(len(l.areas))]
+	url := l.target + r.Path(area)
+	res := loadResult{Kind: r.Kind}
+	rq, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		res.Err = err
+		return res
+	}
+	if r.Accept != "" {
+		rq.Header.Set("Accept", r.Accept)
+	}
+	key := r.Accept + " " + url
+	if r.Conditional {
+		l.lock.Lock()
+		etag := l.etags[key]
+		l.lock.Unlock()
+		if etag != "" {
+			rq.Header.Set("If-None-Match", etag)
+		}
+	}
+	start := time.Now()
+	rsp, err := l.client.Do(rq)
+	if err != nil {
+		res.Err = err
+		res.Latency = time.Since(start)
+		return res
+	}
+	io.Copy(ioutil.Discard, rsp.Body)
+	rsp.Body.Close()
+	res.Latency = time.Since(start)
+	res.Status = rsp.StatusCode
+	if etag := rsp.Header.Get("ETag"); etag != "" {
+		l.lock.Lock()
+		l.etags[key] = etag
+		l.lock.Unlock()
+	}
+	return res
+}
+
+// Run sends rps requests per second during duration, with at most
+// concurrency requests in flight. Requests which cannot be sent are counted
+// as dropped.
+func (l *LoadTester) Run(rps int, duration time.Duration, concurrency int) {
+	slots := make(chan struct{}, concurrency)
+	ticker := time.NewTicker(time.Second / time.Duration(rps))
+	defer ticker.Stop()
+	deadline := time.After(duration)
+	wg := sync.WaitGroup{}
+	for {
+		select {
+		case <-deadline:
+			wg.Wait()
+			return
+		case <-ticker.C:
+		}
+		select {
+		case slots <- struct{}{}:
+		default:
+			l.lock.Lock()
+			l.dropped++
+			l.lock.Unlock()
+			continue
+		}
+		wg.Add(1)
+		go func(r loadRequest) {
+			defer wg.Done()
+			res := l.do(r)
+			<-slots
+			l.lock.Lock()
+			l.results = append(l.results, res)
+			l.lock.Unlock()
+		}(l.pick())
+	}
+}
+
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(p * float64(len(sorted)-1))
+	return sorted[i]
+}
+
+// Report writes latency percentiles and status counts per request kind.
+func (l *LoadTester) Report(w io.Writer, elapsed time.Duration) {
+	byKind := map[string][]loadResult{}
+	kinds := []string{"all"}
+	for _, r := range loadMix {
+		kinds = append(kinds, r.Kind)
+	}
+	for _, res := range l.results {
+		byKind[res.Kind] = append(byKind[res.Kind], res)
+		byKind["all"] = append(byKind["all"], res)
+	}
+	fmt.Fprintf(w, "%d requests in %s, %.1f/s, %d dropped\n", len(l.results),
+		elapsed.Truncate(time.Millisecond),
+		float64(len(l.results))/elapsed.Seconds(), l.dropped)
+	fmt.Fprintf(w, "%-12s %6s %9s %9s %9s %9s  %s\n", "kind", "count", "p50",
+		"p90", "p99", "max", "statuses")
+	for _, kind := range kinds {
+		results := byKind[kind]
+		if len(results) == 0 {
+			continue
+		}
+		latencies := []time.Duration{}
+		statuses := map[string]int{}
+		for _, res := range results {
+			latencies = append(latencies, res.Latency)
+			if res.Err != nil {
+				statuses["error"]++
+			} else {
+				statuses[fmt.Sprintf("%d", res.Status)]++
+			}
+		}
+		sort.Slice(latencies, func(i, j int) bool {
+			return latencies[i] < latencies[j]
+		})
+		counts := []string{}
+		for s, n := range statuses {
+			counts = append(counts, fmt.Sprintf("%s:%d", s, n))
+		}
+		sort.Strings(counts)
+		fmt.Fprintf(w, "%-12s %6d %9s %9s %9s %9s  %s\n", kind, len(results),
+			percentile(latencies, 0.5).Truncate(time.Microsecond),
+			percentile(latencies, 0.9).Truncate(time.Microsecond),
+			percentile(latencies, 0.99).Truncate(time.Microsecond),
+			latencies[len(latencies)-1].Truncate(time.Microsecond),
+			strings.Join(counts, " "))
+	}
+}
+
+var (
+	loadtestCmd = app.Command("loadtest",
+		"replay a realistic request mix against a server and report latencies")
+	loadtestTarget = loadtestCmd.Flag("target",
+		"URL of the tested server, including its prefix").Required().String()
+	loadtestRPS = loadtestCmd.Flag("rps",
+		"requests per second").Default("50").Int()
+	loadtestDuration = loadtestCmd.Flag("duration",
+		"test duration").Default("30s").Duration()
+	loadtestConcurrency = loadtestCmd.Flag("concurrency",
+		"maximum requests in flight").Default("100").Int()
+	loadtestAreas = loadtestCmd.Flag("area",
+		"requested area, can be repeated").Default("1", "2", "3", "4", "5", "6",
+		"7", "8", "9").Strings()
+	loadtestTimeout = loadtestCmd.Flag("timeout",
+		"maximum duration of every request").Default("30s").Duration()
+)
+
+func loadtestFn() error {
+	if *loadtestRPS <= 0 || *loadtestConcurrency <= 0 {
+		return fmt.Errorf("rps and concurrency must be positive")
+	}
+	l := &LoadTester{
+		target: strings.TrimSuffix(*loadtestTarget, "/"),
+		areas:  *loadtestAreas,
+		client: &http.Client{
+			Timeout: *loadtestTimeout,
+			Transport: &http.Transport{
+				MaxIdleConnsPerHost: *loadtestConcurrency,
+			},
+		},
+		etags: map[string]string{},
+	}
+	start := time.Now()
+	l.Run(*loadtestRPS, *loadtestDuration, *loadtestConcurrency)
+	l.Report(os.Stdout, time.Since(start))
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// requestIDKey is the context key of request identifiers.
+type requestIDKey struct{}
+
+// withRequestID returns ctx carrying the request identifier id.
+func withRequestID(ctx context.Context, id string) context.Context {
+	if id == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// requestID returns the request identifier carried by ctx, or "".
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// ctxLogger returns the default logger, tagging records with the request
+// identifier of ctx if any.
+func ctxLogger(ctx context.Context) *slog.Logger {
+	if id := requestID(ctx); id != "" {
+		return slog.Default().With("request_id", id)
+	}
+	return slog.Default()
+}
+
+// validRequestID tells whether a client supplied X-Request-Id can be echoed
+// in responses and logs.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+			c >= '0' && c <= '9' || strings.ContainsRune("-_.:", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// requestIDHandler identifies every request handled by h with its
+// X-Request-Id header, set by a proxy or the client, or a new identifier.
+// The identifier is returned in the X-Request-Id response header and carried
+// by the request context.
+func requestIDHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get("X-Request-Id")
+		if !validRequestID(id) {
+			id = newRequestId()
+		}
+		w.Header().Set("X-Request-Id", id)
+		h.ServeHTTP(w, req.WithContext(withRequestID(req.Context(), id)))
+	})
+}
+
+var (
+	logFormat = app.Flag("log-format", "log format: text or json").
+			Default("text").Enum("text", "json")
+	logLevel = app.Flag("log-level",
+		"minimum level of logged messages: debug, info, warn or error").
+		Default("info").Enum("debug", "info", "warn", "error")
+)
+
+// setupLogging makes the default logger write --log-format records of
+// --log-level and above to stderr.
+func setupLogging() {
+	level := slog.LevelInfo
+	level.UnmarshalText([]byte(*logLevel))
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, opts)
+	if *logFormat == "json" {
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	}
+	slog.SetDefault(slog.New(handler))
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// MailSubscription is a recipient and the areas it is interested in. An
+// empty area set means every area.
+type MailSubscription struct {
+	Address string
+	Areas   map[string]bool
+}
+
+// parseMailSubscription parses "address" or "address=area1,area2".
+func parseMailSubscription(s string) (MailSubscription, error) {
+	sub := MailSubscription{
+		Areas: map[string]bool{},
+	}
+	parts := strings.SplitN(s, "=", 2)
+	sub.Address = strings.TrimSpace(parts[0])
+	if sub.Address == "" {
+		return sub, fmt.Errorf("invalid mail subscription: %q", s)
+	}
+	if len(parts) > 1 {
+		for _, area := range strings.Split(parts[1], ",") {
+			area = strings.TrimSpace(area)
+			if area != "" {
+				sub.Areas[area] = true
+			}
+		}
+	}
+	return sub, nil
+}
+
+func (s MailSubscription) Wants(area string) bool {
+	return len(s.Areas) == 0 || s.Areas[area]
+}
+
+// MailNotifier sends changed bulletins as plain text emails.
+type MailNotifier struct {
+	host          string
+	user          string
+	password      string
+	from          string
+	subscriptions []MailSubscription
+	// Prepends changes to bulletins if not nil
+	differ Differ
+}
+
+// NewMailNotifier returns a notifier mailing subscriptions with the SMTP
+// server at host, localhost:25 if empty.
+func NewMailNotifier(host, user, password, from string,
+	subscriptions []string) (*MailNotifier, error) {
+
+	if host == "" {
+		host = "localhost:25"
+	}
+	n := &MailNotifier{
+		host:     host,
+		user:     user,
+		password: password,
+		from:     from,
+	}
+	for _, s := range subscriptions {
+		sub, err := parseMailSubscription(s)
+		if err != nil {
+			return nil, err
+		}
+		n.subscriptions = append(n.subscriptions, sub)
+	}
+	return n, nil
+}
+
+// formatMail returns the message sent to the to recipients. Subscribers do
+// not know each other, so multiple recipients only appear in the SMTP
+// envelope, not in the headers.
+func formatMail(from string, to []string, subject, body string) []byte {
+	w := &bytes.Buffer{}
+	fmt.Fprintf(w, "From: %s\r\n", from)
+	if len(to) == 1 {
+		fmt.Fprintf(w, "To: %s\r\n", to[0])
+	} else {
+		fmt.Fprintf(w, "To: undisclosed-recipients:;\r\n")
+	}
+	fmt.Fprintf(w, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(w, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(w, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(w, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(w, "Content-Transfer-Encoding: 8bit\r\n")
+	fmt.Fprintf(w, "\r\n")
+	w.WriteString(strings.Replace(body, "\n", "\r\n", -1))
+	return w.Bytes()
+}
+
+func (n *MailNotifier) send(to []string, subject, body string) error {
+	var auth smtp.Auth
+	if n.user != "" {
+		host, _, err := net.SplitHostPort(n.host)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", n.user, n.password, host)
+	}
+	msg := formatMail(n.from, to, subject, body)
+	return smtp.SendMail(n.host, auth, n.from, to, msg)
+}
+
+// bulletinSubject returns a mail subject for forecast f, highlighting its
+// special bulletin if any.
+func bulletinSubject(f Forecast) string {
+	if b := parseBMS(f.Special); b != nil {
+		level := b.Level
+		if level == "" {
+			level = "avis"
+		}
+		return fmt.Sprintf("BMS n°%d %s: %s", b.Number, level, f.Title)
+	}
+	return f.Title
+}
+
+func (n *MailNotifier) Name() string {
+	return "smtp " + n.host
+}
+
+// Notify mails the changed bulletin to interested subscribers.
+func (n *MailNotifier) Notify(notif Notification) error {
+	f := notif.Forecast
+	to := []string{}
+	for _, sub := range n.subscriptions {
+		if sub.Wants(f.Id) {
+			to = append(to, sub.Address)
+		}
+	}
+	if len(to) == 0 {
+		return nil
+	}
+	return n.send(to, bulletinSubject(f), mailBody(notif, n.differ))
+}
+
+// mailBody returns the bulletin of notif, preceded by its changes if d is
+// not nil and the previous bulletin is known.
+func mailBody(notif Notification, d Differ) string {
+	if d == nil || notif.Previous == "" {
+		return notif.Forecast.Content
+	}
+	changes := formatDiffText(diffTexts(d, notif.Previous,
+		notif.Forecast.Content), d.Separator())
+	return "Changements :\n\n" + changes + "\n" + notif.Forecast.Content
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// ManifestEntry describes the current bulletin of an area. Hash is also the
+// ETag of the plain text bulletin.
+type ManifestEntry struct {
+	Id     string     `json:"id"`
+	Title  string     `json:"title"`
+	Kind   string     `json:"kind"`
+	Hash   string     `json:"hash"`
+	Size   int        `json:"size"`
+	Issued *time.Time `json:"issued,omitempty"`
+	URL    string     `json:"url"`
+}
+
+// manifestEntries describes forecasts, with URLs relative to the manifest.
+func manifestEntries(forecasts []Forecast) []ManifestEntry {
+	entries := []ManifestEntry{}
+	for _, f := range forecasts {
+		e := ManifestEntry{
+			Id:    f.Id,
+			Title: f.Title,
+			Kind:  string(areaKind(f.Id)),
+			Hash:  hashReport(f.Content),
+			Size:  len(f.Content),
+			URL:   "../areas/" + f.Id + ".txt",
+		}
+		if !f.Issued.IsZero() {
+			issued := f.Issued
+			e.Issued = &issued
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// serveManifest lists every area current bulletin hash, issue time and size,
+// so clients can tell which bulletins changed in one request.
+func serveManifest(cache *ForecastCache, w http.ResponseWriter,
+	req *http.Request) {
+
+	forecasts, err := cache.Get(req.Context())
+	var data []byte
+	if err == nil {
+		data, err = json.Marshal(manifestEntries(forecasts))
+	}
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if writeCacheHeaders(w, req, hashReport(string(data)),
+		lastModified(cache, forecasts), cacheMaxAge(cache)) {
+		return
+	}
+	w.Write(data)
+}
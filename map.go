@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Positions further than this from every area are not near any
+	maxNearestKm  = 50
+	earthRadiusKm = 6371
+
+	// Map projection, an equirectangular one centered on metropolitan France
+	mapScale     = 60
+	mapMinLon    = -5.6
+	mapMaxLon    = 10.1
+	mapMinLat    = 41
+	mapMaxLat    = 51.6
+	mapCenterLat = 46.3
+
+	mapTemplate = `<html lang="fr">
+<head>
+	<meta charset="utf-8"/>
+	<meta name="viewport" content="width=device-width, initial-scale=1"/>
+	<title>Coastal areas map</title>
+	<style>
+		svg { max-width: 100%; height: auto; background: #eef6fb; }
+		path { fill: #7fb3d5; stroke: #1f618d; stroke-width: 1; }
+		a:hover path { fill: #2e86c1; }
+		path.bms { fill: #e6a0a0; stroke: #c00; }
+		text { font: bold 14px sans-serif; text-anchor: middle; pointer-events: none; }
+		.error { color: #c00; }
+	</style>
+</head>
+<body>
+	<p><a href="./">All areas</a></p>
+	<svg xmlns="http://www.w3.org/2000/svg" width="{{.Width}}" height="{{.Height}}" viewBox="0 0 {{.Width}} {{.Height}}">
+		{{range .Areas}}
+		<a href="areas/{{.Id}}">
+			<title>{{.Title}}</title>
+			<path d="{{.Path}}"{{if .BMS}} class="bms"{{end}}/>
+		</a>
+		<text x="{{.X}}" y="{{.Y}}">{{.Id}}</text>
+		{{end}}
+	</svg>
+	<form action="map" method="get">
+		{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+		<label>Latitude <input name="lat" value="{{.Lat}}" inputmode="decimal" size="8"/></label>
+		<label>Longitude <input name="lon" value="{{.Lon}}" inputmode="decimal" size="8"/></label>
+		<input type="submit" value="Open the area forecast"/>
+	</form>
+</body>
+</html>
+`
+)
+
+var (
+	//go:embed geo/areas.geojson
+	areaBoundariesData []byte
+	// areaBoundaries are the polygons of the metropolitan coastal areas
+	areaBoundaries = mustParseAreaBoundaries(areaBoundariesData)
+
+	mapTmpl = template.Must(template.New("map").Parse(mapTemplate))
+)
+
+// areaBoundary is a coastal area polygon, in longitude and latitude pairs,
+// covering its waters up to 20 miles offshore and the coast.
+type areaBoundary struct {
+	Id      string
+	Name    string
+	Polygon [][2]float64
+}
+
+// mustParseAreaBoundaries parses the first ring of the polygons of a GeoJSON
+// feature collection.
+func mustParseAreaBoundaries(data []byte) []areaBoundary {
+	collection := struct {
+		Features []struct {
+			Properties struct {
+				Id   string `json:"id"`
+				Name string `json:"name"`
+			} `json:"properties"`
+			Geometry struct {
+				Type        string         `json:"type"`
+				Coordinates [][][2]float64 `json:"coordinates"`
+			} `json:"geometry"`
+		} `json:"features"`
+	}{}
+	err := json.Unmarshal(data, &collection)
+	if err != nil {
+		panic(err)
+	}
+	boundaries := []areaBoundary{}
+	for _, f := range collection.Features {
+		if f.Geometry.Type != "Polygon" || len(f.Geometry.Coordinates) == 0 {
+			panic(fmt.Errorf("area %s boundary is not a polygon",
+				f.Properties.Id))
+		}
+		boundaries = append(boundaries, areaBoundary{
+			Id:      f.Properties.Id,
+			Name:    f.Properties.Name,
+			Polygon: f.Geometry.Coordinates[0],
+		})
+	}
+	return boundaries
+}
+
+// Contains tells whether p is inside the boundary, by ray casting.
+func (b areaBoundary) Contains(p Position) bool {
+	inside := false
+	ring := b.Polygon
+	for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+		xi, yi := ring[i][0], ring[i][1]
+		xj, yj := ring[j][0], ring[j][1]
+		if (yi > p.Latitude) != (yj > p.Latitude) &&
+			p.Longitude < (xj-xi)*(p.Latitude-yi)/(yj-yi)+xi {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// Distance returns the distance in kilometers from p to the boundary
+// vertices, a fair approximation at the scale of coastal areas.
+func (b areaBoundary) Distance(p Position) float64 {
+	d := math.Inf(1)
+	for _, v := range b.Polygon {
+		d = math.Min(d, greatCircleKm(p, Position{v[1], v[0]}))
+	}
+	return d
+}
+
+// greatCircleKm returns the haversine distance between a and b.
+func greatCircleKm(a, b Position) float64 {
+	rad := math.Pi / 180
+	dLat := (b.Latitude - a.Latitude) * rad
+	dLon := (b.Longitude - a.Longitude) * rad
+	h := math.Pow(math.Sin(dLat/2), 2) + math.Cos(a.Latitude*rad)*
+		math.Cos(b.Latitude*rad)*math.Pow(math.Sin(dLon/2), 2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(h))
+}
+
+// nearestArea returns the area covering p, or the closest one within
+// maxNearestKm with covering set to false, and false if there is none.
+func nearestArea(p Position) (area areaBoundary, covering bool, ok bool) {
+	best := math.Inf(1)
+	for _, b := range areaBoundaries {
+		if b.Contains(p) {
+			return b, true, true
+		}
+		if d := b.Distance(p); d < best {
+			best = d
+			area = b
+		}
+	}
+	return area, false, best <= maxNearestKm
+}
+
+// parsePosition parses the "lat" and "lon" query parameters.
+func parsePosition(req *http.Request) (Position, error) {
+	query := req.URL.Query()
+	lat, err := strconv.ParseFloat(strings.TrimSpace(query.Get("lat")), 64)
+	if err != nil || math.Abs(lat) > 90 {
+		return Position{}, fmt.Errorf("invalid latitude: %q", query.Get("lat"))
+	}
+	lon, err := strconv.ParseFloat(strings.TrimSpace(query.Get("lon")), 64)
+	if err != nil || math.Abs(lon) > 180 {
+		return Position{}, fmt.Errorf("invalid longitude: %q", query.Get("lon"))
+	}
+	return Position{lat, lon}, nil
+}
+
+// projectMap returns the map coordinates of a longitude and latitude.
+func projectMap(lon, lat float64) (float64, float64) {
+	x := (lon - mapMinLon) * math.Cos(mapCenterLat*math.Pi/180) * mapScale
+	y := (mapMaxLat - lat) * mapScale
+	return math.Round(x*10) / 10, math.Round(y*10) / 10
+}
+
+// formatMap renders the coastal areas as an SVG map whose areas link to
+// their forecast, highlighting areas in bms. A position form, filled with
+// lat and lon, is followed by message if not empty.
+func formatMap(bms map[string]bool, lat, lon, message string) ([]byte,
+	error) {
+
+	type mapArea struct {
+		Id    string
+		Title string
+		Path  string
+		X, Y  float64
+		BMS   bool
+	}
+	areas := []mapArea{}
+	for _, b := range areaBoundaries {
+		path := &strings.Builder{}
+		cx, cy := 0.0, 0.0
+		// The ring is closed, its last vertex repeats the first one
+		vertices := b.Polygon[:len(b.Polygon)-1]
+		for i, v := range vertices {
+			x, y := projectMap(v[0], v[1])
+			cmd := "L"
+			if i == 0 {
+				cmd = "M"
+			}
+			fmt.Fprintf(path, "%s%g %g ", cmd, x, y)
+			cx += x / float64(len(vertices))
+			cy += y / float64(len(vertices))
+		}
+		path.WriteString("Z")
+		areas = append(areas, mapArea{
+			Id:    b.Id,
+			Title: b.Id + ". " + b.Name,
+			Path:  path.String(),
+			X:     math.Round(cx),
+			Y:     math.Round(cy),
+			BMS:   bms[b.Id],
+		})
+	}
+	width, height := projectMap(mapMaxLon, mapMinLat)
+	data := struct {
+		Width  float64
+		Height float64
+		Areas  []mapArea
+		Lat    string
+		Lon    string
+		Error  string
+	}{width, height, areas, lat, lon, message}
+	w := &bytes.Buffer{}
+	err := mapTmpl.Execute(w, &data)
+	return w.Bytes(), err
+}
+
+// serveMap serves the map of coastal areas, those under a special bulletin
+// highlighted. Submitting a position redirects to the forecast of the area
+// covering it.
+func serveMap(cache *ForecastCache, w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	message := ""
+	if query.Get("lat") != "" || query.Get("lon") != "" {
+		p, err := parsePosition(req)
+		if err == nil {
+			area, _, ok := nearestArea(p)
+			if ok {
+				http.Redirect(w, req, requestPrefix(req)+"/areas/"+area.Id,
+					http.StatusSeeOther)
+				return
+			}
+			err = fmt.Errorf("no coastal area near %.4f, %.4f", p.Latitude,
+				p.Longitude)
+		}
+		message = err.Error()
+	}
+	// Upstream is not queried, the map is useful without forecasts
+	bms := map[string]bool{}
+	for _, f := range cache.Cached() {
+		bms[f.Id] = parseBMS(f.Special) != nil
+	}
+	data, err := formatMap(bms, query.Get("lat"), query.Get("lon"), message)
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	w.Header().Set("Content-Type", formatTypes["html"])
+	if message != "" {
+		w.WriteHeader(400)
+	}
+	w.Write(data)
+}
+
+// serveNearestArea returns the area covering the "lat" and "lon" query
+// parameters position, or the closest one near the coast.
+func serveNearestArea(w http.ResponseWriter, req *http.Request) {
+	p, err := parsePosition(req)
+	if err != nil {
+		w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "error: %s\n", err)
+		return
+	}
+	area, covering, ok := nearestArea(p)
+	if !ok {
+		writeError(w, req, notFoundError("no coastal area near %.4f, %.4f",
+			p.Latitude, p.Longitude))
+		return
+	}
+	data, err := json.MarshalIndent(struct {
+		Id       string `json:"id"`
+		Name     string `json:"name"`
+		URL      string `json:"url"`
+		Covering bool   `json:"covering"`
+	}{
+		Id:       area.Id,
+		Name:     area.Name,
+		URL:      requestPrefix(req) + "/areas/" + area.Id,
+		Covering: covering,
+	}, "", "  ")
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// serveAreaBoundaries serves the embedded coastal area boundaries.
+func serveAreaBoundaries(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/geo+json")
+	if writeCacheHeaders(w, req, hashReport(string(areaBoundariesData)),
+		time.Time{}, 0) {
+		return
+	}
+	w.Write(areaBoundariesData)
+}
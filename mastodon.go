@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// MastodonNotifier toots bulletin summaries to a Mastodon account.
+type MastodonNotifier struct {
+	instance   string
+	token      string
+	visibility string
+	// Public URL of the server including its prefix, to link areas, optional
+	publicURL string
+	client    *http.Client
+}
+
+func NewMastodonNotifier(instance, token, visibility,
+	publicURL string) *MastodonNotifier {
+
+	return &MastodonNotifier{
+		instance:   strings.TrimSuffix(instance, "/"),
+		token:      token,
+		visibility: visibility,
+		publicURL:  publicURL,
+		client:     &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (n *MastodonNotifier) Name() string {
+	return "mastodon " + n.instance
+}
+
+// formatToot summarizes a bulletin change: area, special bulletin level and
+// validity.
+func formatToot(notif Notification, publicURL string) string {
+	f := notif.Forecast
+	lines := []string{}
+	if notif.Event != nil {
+		lines = append(lines, "Nouveau BMS: "+f.Title)
+	} else {
+		lines = append(lines, "Nouveau bulletin: "+f.Title)
+	}
+	if b := parseBMS(f.Special); b != nil {
+		level := b.Level
+		if level == "" {
+			level = "avis en cours"
+		}
+		lines = append(lines, fmt.Sprintf("⚠ BMS n°%d: %s", b.Number, level))
+	} else {
+		lines = append(lines, "Pas de BMS en cours.")
+	}
+	if !f.Expires.IsZero() {
+		lines = append(lines, "Valable jusqu'au "+
+			f.Expires.Format("02/01/2006 15:04")+" UTC")
+	}
+	if publicURL != "" {
+		lines = append(lines, publicURL+"/areas/"+f.Id)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (n *MastodonNotifier) Notify(notif Notification) error {
+	status := formatToot(notif, n.publicURL)
+	rq, err := http.NewRequest("POST", n.instance+"/api/v1/statuses",
+		strings.NewReader(url.Values{
+			"status":     {status},
+			"visibility": {n.visibility},
+		}.Encode()))
+	if err != nil {
+		return err
+	}
+	rq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rq.Header.Set("Authorization", "Bearer "+n.token)
+	// Retried deliveries must not be posted twice
+	rq.Header.Set("Idempotency-Key", hashReport(notif.Forecast.Id+status))
+	rsp, err := n.client.Do(rq)
+	return checkPushResponse(rsp, err, "mastodon")
+}
+
+var (
+	postCmd = app.Command("post",
+		"toot new bulletins and gale warnings of some areas to Mastodon")
+	postInstance = postCmd.Flag("instance",
+		"Mastodon instance URL").Required().String()
+	postToken = postCmd.Flag("token",
+		"Mastodon access token").Envar("METMAR_MASTODON_TOKEN").Required().String()
+	postAreas = postCmd.Flag("area",
+		"area to post, can be repeated").Required().Strings()
+	postVisibility = postCmd.Flag("visibility",
+		"toots visibility").Default("unlisted").Enum("public", "unlisted", "private")
+	postRefresh = postCmd.Flag("refresh",
+		"delay between upstream fetches").Default("10m").Duration()
+	postState = postCmd.Flag("state",
+		"file remembering posted bulletins").Default("metmar-post.json").String()
+	postURL = postCmd.Flag("url",
+		"public URL of a metmar server, to link areas in toots").String()
+)
+
+// postedBulletin records the last bulletin posted for an area.
+type postedBulletin struct {
+	Hash   string `json:"hash"`
+	Number int    `json:"number"`
+}
+
+func loadPostState(path string) (map[string]postedBulletin, error) {
+	state := map[string]postedBulletin{}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return state, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(data, &state)
+	return state, err
+}
+
+func savePostState(path string, state map[string]postedBulletin) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(path+".tmp", data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// postChanges toots forecasts of selected areas which changed since the
+// state was recorded. Areas seen for the first time are recorded silently.
+func postChanges(notifier Notifier, forecasts []Forecast, areas map[string]bool,
+	state map[string]postedBulletin) error {
+
+	for _, f := range forecasts {
+		if !areas[f.Id] {
+			continue
+		}
+		posted := postedBulletin{Hash: hashReport(f.Content)}
+		b := parseBMS(f.Special)
+		if b != nil {
+			posted.Number = b.Number
+		}
+		prev, seen := state[f.Id]
+		if seen && prev.Hash == posted.Hash {
+			continue
+		}
+		if seen {
+			notif := Notification{Forecast: f}
+			if b != nil && b.Number != prev.Number {
+				notif.Event = &GaleEvent{
+					Area:      f.Id,
+					Title:     f.Title,
+					Number:    b.Number,
+					Level:     b.Level,
+					Text:      b.Text,
+					Timestamp: time.Now(),
+				}
+			}
+			err := notifier.Notify(notif)
+			if err != nil {
+				return err
+			}
+		}
+		state[f.Id] = posted
+	}
+	return nil
+}
+
+func postFn() error {
+	areas := map[string]bool{}
+	for _, a := range *postAreas {
+		areas[a] = true
+	}
+	state, err := loadPostState(*postState)
+	if err != nil {
+		return err
+	}
+	upstream, err := newForecastSource()
+	if err != nil {
+		return err
+	}
+	notifier := NewMastodonNotifier(*postInstance, *postToken, *postVisibility,
+		strings.TrimSuffix(*postURL, "/"))
+	for {
+		forecasts, err := fetchForecasts(context.Background(), upstream)
+		if err == nil {
+			err = postChanges(notifier, forecasts, areas, state)
+			if saveErr := savePostState(*postState, state); err == nil {
+				err = saveErr
+			}
+		}
+		if err != nil {
+			slog.Error("posting forecasts", "error", err)
+		}
+		time.Sleep(*postRefresh)
+	}
+}
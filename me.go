@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+)
+
+const (
+	meTemplate = `<html>
+<head>
+	<meta charset="utf-8"/>
+	<title>{{.User}}: favorite areas</title>
+</head>
+<body>
+	<h1>Favorite areas</h1>
+	{{range .Favorites}}
+		<h2><a href="{{.URL}}">{{.Title}}</a></h2>
+		<pre>{{.Content}}</pre>
+	{{else}}
+		<p>No favorite area yet.</p>
+	{{end}}
+	<p><a href="{{.Prefix}}/me/bulletins">All favorite bulletins as text</a></p>
+	<p><a href="{{.Prefix}}/me/settings">Notification settings</a></p>
+	<h2>Choose favorites</h2>
+	<form method="post" action="{{.Prefix}}/me">
+	{{range .Areas}}
+		<label><input type="checkbox" name="area" value="{{.Id}}"{{if .Favorite}} checked{{end}}/> {{.Title}}</label><br/>
+	{{end}}
+		<input type="submit" value="Save"/>
+	</form>
+	<a href="{{.Prefix}}/">All areas</a>
+</body>
+</html>
+`
+)
+
+var (
+	meTmpl = template.Must(template.New("me").Parse(meTemplate))
+)
+
+// favoriteForecasts returns forecasts of favorite areas, in favorites order.
+func favoriteForecasts(forecasts []Forecast, favorites []string) []Forecast {
+	selected := []Forecast{}
+	for _, id := range favorites {
+		for _, f := range forecasts {
+			if f.Id == id {
+				selected = append(selected, f)
+				break
+			}
+		}
+	}
+	return selected
+}
+
+// serveMe renders the personal index of the authenticated user, with their
+// favorite bulletins and a form to choose them. /me/bulletins returns the
+// favorite bulletins as a single text document and /me/settings their
+// notification preferences.
+func serveMe(cache *ForecastCache, auth Authenticator, store *UserStore,
+	w http.ResponseWriter, req *http.Request) {
+
+	user, ok := requireUser(auth, w, req)
+	if !ok {
+		return
+	}
+	prefix := requestPrefix(req)
+	sub := strings.Trim(strings.TrimPrefix(req.URL.Path, "/me"), "/")
+	if sub == "settings" {
+		serveSettings(cache, store, user, *notifySmtpHost != "",
+			*notifyUserNtfy, zoneOrDefault(*notifyQuietZone), w, req)
+		return
+	}
+	if sub != "" && sub != "bulletins" {
+		writeNotFound(w, req.URL.Path)
+		return
+	}
+	if req.Method == "POST" && sub == "" {
+		if !sameOrigin(req) {
+			w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+			w.WriteHeader(403)
+			fmt.Fprintf(w, "error: cross-site request rejected\n")
+			return
+		}
+		err := req.ParseForm()
+		if err == nil {
+			err = store.Update(user, func(d *UserData) {
+				d.Favorites = req.PostForm["area"]
+			})
+		}
+		if err == nil {
+			auditLog.Record(req, user, "favorites", user,
+				strings.Join(req.PostForm["area"], ","))
+		}
+		if err != nil {
+			w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+			w.WriteHeader(500)
+			fmt.Fprintf(w, "error: %s\n", err)
+			return
+		}
+		http.Redirect(w, req, prefix+"/me", http.StatusSeeOther)
+		return
+	}
+	forecasts, err := cache.Get(req.Context())
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	data := store.Get(user)
+	favorites := favoriteForecasts(forecasts, data.Favorites)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if sub == "bulletins" {
+		w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+		for _, f := range favorites {
+			fmt.Fprintf(w, "%s\n\n", strings.TrimSpace(f.Content))
+		}
+		return
+	}
+	type bulletin struct {
+		URL     string
+		Title   string
+		Content string
+	}
+	type area struct {
+		Id       string
+		Title    string
+		Favorite bool
+	}
+	page := struct {
+		User      string
+		Prefix    string
+		Favorites []bulletin
+		Areas     []area
+	}{
+		User:   user,
+		Prefix: prefix,
+	}
+	isFavorite := map[string]bool{}
+	for _, f := range favorites {
+		isFavorite[f.Id] = true
+		page.Favorites = append(page.Favorites, bulletin{
+			URL:     prefix + "/areas/" + f.Id,
+			Title:   f.Title,
+			Content: f.Content,
+		})
+	}
+	for _, f := range forecasts {
+		page.Areas = append(page.Areas, area{f.Id, f.Title, isFavorite[f.Id]})
+	}
+	writeHTML(w, meTmpl, &page)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"sort"
+	"strings"
+	"time"
+)
+
+// PageMeta describes a page for link previews in messaging applications and
+// social networks.
+type PageMeta struct {
+	Title       string
+	Description string
+	// Absolute URL of a preview image, optional
+	Image   string
+	Updated time.Time
+}
+
+var (
+	metaTemplate = template.Must(template.New("meta").Parse(
+		`<meta property="og:type" content="website"/>
+	<meta property="og:title" content="{{.Title}}"/>
+	<meta property="og:description" content="{{.Description}}"/>
+	{{- if .Image}}
+	<meta property="og:image" content="{{.Image}}"/>
+	<meta name="twitter:card" content="summary_large_image"/>
+	<meta name="twitter:image" content="{{.Image}}"/>
+	{{- else}}
+	<meta name="twitter:card" content="summary"/>
+	{{- end}}
+	<meta name="twitter:title" content="{{.Title}}"/>
+	<meta name="twitter:description" content="{{.Description}}"/>
+	{{- if not .Updated.IsZero}}
+	<meta property="og:updated_time" content="{{.Updated.Format "2006-01-02T15:04:05Z07:00"}}"/>
+	{{- end}}`))
+)
+
+// renderMeta returns Open Graph and Twitter card meta tags for m.
+func renderMeta(m PageMeta) (template.HTML, error) {
+	w := &bytes.Buffer{}
+	err := metaTemplate.Execute(w, &m)
+	if err != nil {
+		return "", err
+	}
+	return template.HTML(w.String()), nil
+}
+
+// summarizeSeverity describes active special bulletins in forecasts, most
+// severe first.
+func summarizeSeverity(forecasts []Forecast) string {
+	type active struct {
+		Title string
+		BMS   *BMS
+	}
+	bulletins := []active{}
+	for _, f := range forecasts {
+		if b := parseBMS(f.Special); b != nil {
+			bulletins = append(bulletins, active{f.Title, b})
+		}
+	}
+	if len(bulletins) == 0 {
+		return "No special bulletin in force."
+	}
+	sort.SliceStable(bulletins, func(i, j int) bool {
+		return bulletins[i].BMS.Severity() > bulletins[j].BMS.Severity()
+	})
+	parts := []string{}
+	for _, a := range bulletins {
+		level := a.BMS.Level
+		if level == "" {
+			level = "BMS"
+		}
+		parts = append(parts, fmt.Sprintf("%s n°%d: %s", level, a.BMS.Number,
+			a.Title))
+	}
+	return strings.Join(parts, ", ") + "."
+}
+
+// latestIssue returns the most recent issue time of forecasts.
+func latestIssue(forecasts []Forecast) time.Time {
+	latest := time.Time{}
+	for _, f := range forecasts {
+		if f.Issued.After(latest) {
+			latest = f.Issued
+		}
+	}
+	return latest
+}
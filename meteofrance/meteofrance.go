@@ -0,0 +1,389 @@
+// Package meteofrance fetches and parses Meteo France marine weather
+// bulletins of metropolitan coastal areas, harbors ("rades") and beaches
+// ("plages").
+package meteofrance
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Areas is the number of coastal areas, numbered from 1
+	Areas = 9
+	// DefaultURL is the bulletin URL format, taking the area number
+	DefaultURL = "http://www.meteofrance.com/mf3-rpc-portlet/rest/bulletins/cote/%d/bulletinsMarineMetropole"
+	// DefaultHarborURL is the harbor bulletin URL format, taking its number
+	DefaultHarborURL = "http://www.meteofrance.com/mf3-rpc-portlet/rest/bulletins/rade/%d/bulletinsMarineMetropole"
+	// DefaultBeachURL is the beach bulletin URL format, taking its number
+	DefaultBeachURL = "http://www.meteofrance.com/mf3-rpc-portlet/rest/bulletins/plage/%d/bulletinsMarineMetropole"
+	// DefaultUserAgent is sent unless overridden, the service is picky
+	DefaultUserAgent = "Mozilla/4.0 (compatible; MSIE 7.0; Windows NT 6.0)"
+)
+
+// Kind is a bulletin family. Every family numbers its bulletins on its own.
+type Kind string
+
+const (
+	// Coast bulletins cover coastal areas, up to 20 miles offshore
+	Coast Kind = "cote"
+	// Harbor bulletins cover a harbor roadstead
+	Harbor Kind = "rade"
+	// Beach bulletins cover a beach and its nearshore waters
+	Beach Kind = "plage"
+)
+
+type Region struct {
+	Title       string `json:"titreRegion"`
+	Situation   string
+	Observation string
+	WindAndSea  string `json:"ventEtMer"`
+	Swell       string `json:"houle"`
+	Weather     string `json:"ts"`
+	Visibility  string `json:"visi"`
+}
+
+type Echeance struct {
+	Title   string   `json:"titreEcheance"`
+	Kind    string   `json:"nomEcheance"`
+	Regions []Region `json:"region"`
+}
+
+// Report is a bulletin as returned by the service, with HTML fragments.
+type Report struct {
+	Title     string     `json:"titreBulletin"`
+	Special   string     `json:"bulletinSpecial"`
+	Header    string     `json:"chapeauBulletin"`
+	Footer    string     `json:"piedBulletin"`
+	Units     string     `json:"uniteBulletin"`
+	Produced  string     `json:"dateDeProduction"`
+	Ends      string     `json:"dateDeFin"`
+	Echeances []Echeance `json:"echeance"`
+}
+
+// Section is the plain text forecast of an échéance.
+type Section struct {
+	Title string
+	Text  string
+}
+
+// Units describes the units of a bulletin texts, parsed from its notice, like
+// "Vent moyen selon échelle Beaufort. Mer selon échelle Douglas.". Fields are
+// empty when the notice does not tell.
+type Units struct {
+	// Wind scale or speed unit: beaufort, kt or kmh
+	Wind string
+	// Sea state scale: douglas
+	Sea string
+	// Visibility distance unit: nm or km
+	Visibility string
+	// Notice in plain text
+	Text string
+}
+
+// Bulletin is a coastal bulletin converted to plain text.
+type Bulletin struct {
+	Title   string
+	Header  string
+	Footer  string
+	Special string
+	// Units of the forecast texts
+	Units Units
+	// Forecast per échéance
+	Sections []Section
+	// Production time, zero if unknown
+	Issued time.Time
+	// End of validity, zero if unknown
+	Expires time.Time
+}
+
+// cachedResponse is the last response to a bulletin URL and its
+// validators.
+type cachedResponse struct {
+	etag     string
+	modified string
+	body     []byte
+}
+
+// Client fetches bulletins from Meteo France.
+type Client struct {
+	// HTTPClient performs requests, http.DefaultClient if nil
+	HTTPClient *http.Client
+	// URL is the bulletin URL format, taking the area number
+	URL string
+	// HarborURL and BeachURL are the URL formats of other bulletin kinds
+	HarborURL string
+	BeachURL  string
+	UserAgent string
+	// Conditional makes the client revalidate the last response to every URL
+	// with If-None-Match or If-Modified-Since, and return it again when
+	// upstream answers 304 Not Modified.
+	Conditional bool
+
+	lock      sync.Mutex
+	responses map[string]*cachedResponse
+}
+
+// NewClient returns a client performing conditional requests.
+func NewClient(client *http.Client) *Client {
+	return &Client{
+		HTTPClient:  client,
+		URL:         DefaultURL,
+		HarborURL:   DefaultHarborURL,
+		BeachURL:    DefaultBeachURL,
+		UserAgent:   DefaultUserAgent,
+		Conditional: true,
+	}
+}
+
+func (c *Client) cached(url string) *cachedResponse {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.responses[url]
+}
+
+func (c *Client) store(url string, rsp *cachedResponse) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.responses == nil {
+		c.responses = map[string]*cachedResponse{}
+	}
+	c.responses[url] = rsp
+}
+
+// AreaURL returns the bulletin URL of area.
+func (c *Client) AreaURL(area int) string {
+	return c.KindURL(Coast, area)
+}
+
+// KindURL returns the URL of the bulletin of kind numbered number.
+func (c *Client) KindURL(kind Kind, number int) string {
+	format := c.URL
+	switch kind {
+	case Harbor:
+		format = c.HarborURL
+	case Beach:
+		format = c.BeachURL
+	}
+	return fmt.Sprintf(format, number)
+}
+
+// Fetch returns the raw response to an area bulletin request, to be decoded
+// with DecodeReports.
+func (c *Client) Fetch(ctx context.Context, area int) ([]byte, error) {
+	return c.FetchKind(ctx, Coast, area)
+}
+
+// FetchKind returns the raw response to the request of the bulletin of kind
+// numbered number, to be decoded with DecodeReports.
+func (c *Client) FetchKind(ctx context.Context, kind Kind, number int) (
+	[]byte, error) {
+
+	data, _, err := c.FetchKindModified(ctx, kind, number)
+	return data, err
+}
+
+// FetchKindModified is like FetchKind but also tells whether upstream
+// returned a new response, or answered 304 Not Modified to a conditional
+// request and the previous response is returned again.
+func (c *Client) FetchKindModified(ctx context.Context, kind Kind,
+	number int) ([]byte, bool, error) {
+
+	url := c.KindURL(kind, number)
+	rq, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	rq.Header.Set("User-Agent", c.UserAgent)
+	var cached *cachedResponse
+	if c.Conditional {
+		cached = c.cached(url)
+	}
+	if cached != nil {
+		if cached.etag != "" {
+			rq.Header.Set("If-None-Match", cached.etag)
+		}
+		if cached.modified != "" {
+			rq.Header.Set("If-Modified-Since", cached.modified)
+		}
+	}
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	rsp, err := client.Do(rq)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode == http.StatusNotModified && cached != nil {
+		return cached.body, false, nil
+	}
+	if rsp.StatusCode != http.StatusOK {
+		return nil, false, fmt.Errorf("got %d fetching %s", rsp.StatusCode,
+			url)
+	}
+	data, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return nil, false, err
+	}
+	if c.Conditional {
+		etag := rsp.Header.Get("ETag")
+		modified := rsp.Header.Get("Last-Modified")
+		if etag != "" || modified != "" {
+			c.store(url, &cachedResponse{
+				etag:     etag,
+				modified: modified,
+				body:     data,
+			})
+		}
+	}
+	return data, true, nil
+}
+
+// Reports returns the offshore and coastal reports of area.
+func (c *Client) Reports(ctx context.Context, area int) ([]*Report, error) {
+	data, err := c.Fetch(ctx, area)
+	if err != nil {
+		return nil, err
+	}
+	return DecodeReports(bytes.NewReader(data))
+}
+
+// DecodeReports decodes a bulletin response, like the ones returned by
+// Reports.
+func DecodeReports(r io.Reader) ([]*Report, error) {
+	reports := []*Report{}
+	err := json.NewDecoder(r).Decode(&reports)
+	return reports, err
+}
+
+// Bulletin returns the coastal bulletin of area.
+func (c *Client) Bulletin(ctx context.Context, area int) (*Bulletin, error) {
+	reports, err := c.Reports(ctx, area)
+	if err != nil {
+		return nil, err
+	}
+	return ParseBulletin(reports)
+}
+
+var (
+	reLines = regexp.MustCompile(`\n+`)
+	// Sentences end with a period followed by a space or a line break, unlike
+	// decimal numbers
+	reSentences = regexp.MustCompile(`\.(?:\s|$)|\n`)
+)
+
+// HTMLToText converts the HTML fragments of reports to plain text.
+func HTMLToText(html string) string {
+	s := strings.Replace(html, "<br />", "\n", -1)
+	s = strings.TrimSpace(s)
+	s = reLines.ReplaceAllString(s, "\n")
+	return s
+}
+
+// ParseUnits parses the units notice of a bulletin, in plain text.
+func ParseUnits(notice string) Units {
+	units := Units{Text: strings.TrimSpace(notice)}
+	for _, sentence := range reSentences.Split(strings.ToLower(notice), -1) {
+		switch {
+		case strings.Contains(sentence, "visibilit"):
+			if strings.Contains(sentence, "mille") {
+				units.Visibility = "nm"
+			} else if strings.Contains(sentence, "km") ||
+				strings.Contains(sentence, "kilom") {
+				units.Visibility = "km"
+			}
+		case strings.Contains(sentence, "vent"):
+			if strings.Contains(sentence, "beaufort") {
+				units.Wind = "beaufort"
+			} else if strings.Contains(sentence, "km/h") {
+				units.Wind = "kmh"
+			} else if strings.Contains(sentence, "nœud") ||
+				strings.Contains(sentence, "noeud") {
+				units.Wind = "kt"
+			}
+		case strings.Contains(sentence, "mer"):
+			if strings.Contains(sentence, "douglas") {
+				units.Sea = "douglas"
+			}
+		}
+	}
+	return units
+}
+
+// ParseBulletin converts the coastal report of an area to plain text.
+func ParseBulletin(reports []*Report) (*Bulletin, error) {
+	if len(reports) != 2 {
+		return nil, fmt.Errorf("2 reports expected, go %d", len(reports))
+	}
+	// Coastal report
+	return ParseReport(reports[1]), nil
+}
+
+// ParseNearshoreBulletin converts the report of a harbor or beach bulletin
+// to plain text. Such responses lack the offshore report of coastal ones.
+func ParseNearshoreBulletin(reports []*Report) (*Bulletin, error) {
+	if len(reports) != 1 {
+		return nil, fmt.Errorf("1 report expected, got %d", len(reports))
+	}
+	return ParseReport(reports[0]), nil
+}
+
+// ParseReport converts a report to plain text.
+func ParseReport(r *Report) *Bulletin {
+	sections := []Section{}
+	for _, e := range r.Echeances {
+		lines := []string{}
+		for _, a := range e.Regions {
+			parts := []string{
+				a.Situation,
+				a.Observation,
+				a.WindAndSea,
+				a.Swell,
+				a.Weather,
+				a.Visibility,
+			}
+			for _, part := range parts {
+				if part == "" {
+					continue
+				}
+				part = HTMLToText(part)
+				part = strings.TrimSpace(part)
+				lines = append(lines, part)
+			}
+		}
+		sections = append(sections, Section{
+			Title: e.Title,
+			Text:  strings.Join(lines, "\n"),
+		})
+	}
+	// Production dates are UTC
+	issued, err := time.Parse("2006-01-02 15:04:05", r.Produced)
+	if err != nil {
+		issued = time.Time{}
+	}
+	expires, err := time.Parse("2006-01-02 15:04:05", r.Ends)
+	if err != nil {
+		expires = time.Time{}
+	}
+	return &Bulletin{
+		Title:    r.Title,
+		Header:   HTMLToText(r.Header),
+		Footer:   HTMLToText(r.Footer),
+		Special:  HTMLToText(r.Special),
+		Units:    ParseUnits(HTMLToText(r.Units)),
+		Sections: sections,
+		Issued:   issued,
+		Expires:  expires,
+	}
+}
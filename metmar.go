@@ -8,18 +8,58 @@ import (
 )
 
 var (
-	app = kingpin.New("metmar", "French weather forecast server")
+	app = kingpin.New("metmar", "French weather forecast server").
+		DefaultEnvars()
 )
 
 func dispatch() error {
+	err := loadSettings(os.Args[1:])
+	if err != nil {
+		return kindError(ErrConfig, err)
+	}
 	cmd := kingpin.MustParse(app.Parse(os.Args[1:]))
+	setupLogging()
+	err = loadTimezone()
+	if err != nil {
+		return err
+	}
+	err = loadTextTemplate()
+	if err != nil {
+		return err
+	}
 	switch cmd {
 	case serveCmd.FullCommand():
 		return serveFn()
-	case galeCmd.FullCommand():
+	case galeServeCmd.FullCommand():
 		return galeFn()
+	case galeExportCmd.FullCommand():
+		return galeExportFn()
 	case parseCmd.FullCommand():
 		return parseFn()
+	case listCmd.FullCommand():
+		return listFn()
+	case exportCmd.FullCommand():
+		return exportFn()
+	case generateCmd.FullCommand():
+		return generateFn()
+	case watchCmd.FullCommand():
+		return watchFn()
+	case postCmd.FullCommand():
+		return postFn()
+	case syncCmd.FullCommand():
+		return syncFn()
+	case replayCmd.FullCommand():
+		return replayFn()
+	case searchCmd.FullCommand():
+		return searchFn()
+	case archiveMirrorCmd.FullCommand():
+		return archiveMirrorFn()
+	case loadtestCmd.FullCommand():
+		return loadtestFn()
+	case selftestCmd.FullCommand():
+		return selftestFn()
+	case doctorCmd.FullCommand():
+		return doctorFn()
 	}
 	return fmt.Errorf("unknown command: %s", cmd)
 }
@@ -28,6 +68,6 @@ func main() {
 	err := dispatch()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error: %s\n", err)
-		os.Exit(1)
+		os.Exit(errorKind(err).ExitCode())
 	}
 }
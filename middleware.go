@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+func newRequestId() string {
+	buf := make([]byte, 8)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(buf)
+}
+
+// statusWriter records whether the response header was written.
+type statusWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(data []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		w.wroteHeader = true
+		f.Flush()
+	}
+}
+
+// recoverHandler recovers panics raised by h, logs them with their stack trace
+// and the request identifier, and replies with a 500 unless a response was
+// already started.
+func recoverHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		sw := &statusWriter{ResponseWriter: w}
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+			id := requestID(req.Context())
+			if id == "" {
+				id = newRequestId()
+			}
+			slog.Error("panic", "request_id", id, "method", req.Method,
+				"url", req.URL.String(), "panic", fmt.Sprint(p),
+				"stack", string(debug.Stack()))
+			if sw.wroteHeader {
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+			w.WriteHeader(500)
+			w.Write([]byte("error: internal error, request " + id + "\n"))
+		}()
+		h.ServeHTTP(sw, req)
+	})
+}
+
+// timeoutHandler fails requests handled by h taking longer than d with a 503.
+// The request context is cancelled when the deadline expires. A zero duration
+// disables the timeout.
+func timeoutHandler(h http.Handler, d time.Duration) http.Handler {
+	if d <= 0 {
+		return h
+	}
+	return http.TimeoutHandler(h, d, "error: request timed out\n")
+}
+
+// handleFunc registers fn on mux for pattern, bounded by timeout.
+func handleFunc(mux *http.ServeMux, pattern string, timeout time.Duration,
+	fn http.HandlerFunc) {
+
+	mux.Handle(pattern, timeoutHandler(fn, timeout))
+}
+
+// SecurityHeaders are added to HTML responses. Empty values are omitted.
+type SecurityHeaders struct {
+	ContentSecurityPolicy string
+	FrameOptions          string
+	ReferrerPolicy        string
+}
+
+// securityWriter sets security headers right before the response header is
+// written, once the handler has chosen the content type.
+type securityWriter struct {
+	http.ResponseWriter
+	headers     SecurityHeaders
+	wroteHeader bool
+}
+
+func (w *securityWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		h := w.Header()
+		h.Set("X-Content-Type-Options", "nosniff")
+		if strings.HasPrefix(h.Get("Content-Type"), "text/html") {
+			sec := w.headers
+			// Handlers may set a stricter or specific policy
+			if sec.ContentSecurityPolicy != "" &&
+				h.Get("Content-Security-Policy") == "" {
+				h.Set("Content-Security-Policy", sec.ContentSecurityPolicy)
+			}
+			if sec.FrameOptions != "" {
+				h.Set("X-Frame-Options", sec.FrameOptions)
+			}
+			if sec.ReferrerPolicy != "" {
+				h.Set("Referrer-Policy", sec.ReferrerPolicy)
+			}
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *securityWriter) Write(data []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(data))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *securityWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		if !w.wroteHeader {
+			w.WriteHeader(http.StatusOK)
+		}
+		f.Flush()
+	}
+}
+
+// securityHandler adds X-Content-Type-Options to every response handled by h,
+// and supplied security headers to HTML ones.
+func securityHandler(h http.Handler, headers SecurityHeaders) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		h.ServeHTTP(&securityWriter{
+			ResponseWriter: w,
+			headers:        headers,
+		}, req)
+	})
+}
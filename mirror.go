@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseSince parses durations like 30d in addition to Go ones.
+func parseSince(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration: %q", s)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// writeIfChanged writes data to path unless it already holds it, so
+// unchanged files keep their modification time.
+func writeIfChanged(path string, data []byte, mtime time.Time) (bool, error) {
+	current, err := ioutil.ReadFile(path)
+	if err == nil && bytes.Equal(current, data) {
+		return false, nil
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return false, err
+	}
+	tmp := path + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return false, err
+	}
+	if !mtime.IsZero() {
+		err = os.Chtimes(tmp, mtime, mtime)
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, os.Rename(tmp, path)
+}
+
+// mirrorArchive copies area revisions taken after since into out, as
+// out/AREA/YEAR/AREA_TIME.txt files timestamped with the revision time, plus
+// an out/AREA/index.txt listing revision identifiers and hashes. Existing
+// files are left untouched, so rsync or rclone only transfer new revisions.
+// It returns the number of written files.
+func mirrorArchive(archive *Archive, out string, areas []string,
+	since time.Time) (int, error) {
+
+	written := 0
+	for _, area := range areas {
+		index := &bytes.Buffer{}
+		for _, rev := range archive.Revisions(area) {
+			if rev.Time.Before(since) {
+				continue
+			}
+			content, err := archive.Read(rev)
+			if err != nil {
+				return written, err
+			}
+			path := filepath.Join(out, area, rev.Time.Format("2006"),
+				area+"_"+rev.Id()+".txt")
+			ok, err := writeIfChanged(path, []byte(content), rev.Time)
+			if err != nil {
+				return written, err
+			}
+			if ok {
+				written++
+			}
+			fmt.Fprintf(index, "%s %s\n", rev.Id(), rev.Hash)
+		}
+		if index.Len() == 0 {
+			continue
+		}
+		ok, err := writeIfChanged(filepath.Join(out, area, "index.txt"),
+			index.Bytes(), time.Time{})
+		if err != nil {
+			return written, err
+		}
+		if ok {
+			written++
+		}
+	}
+	return written, nil
+}
+
+var (
+	archiveCmd       = app.Command("archive", "manipulate bulletin archives")
+	archiveMirrorCmd = archiveCmd.Command("mirror",
+		"copy part of an archive into a directory suited to rsync or rclone")
+	archiveMirrorDir = archiveMirrorCmd.Flag("archive",
+		"archive directory").Required().String()
+	archiveMirrorOut = archiveMirrorCmd.Flag("out",
+		"output directory").Required().String()
+	archiveMirrorAreas = archiveMirrorCmd.Flag("areas",
+		"comma separated areas to mirror, all if empty").String()
+	archiveMirrorSince = archiveMirrorCmd.Flag("since",
+		"only mirror revisions younger than this, like 30d or 12h, all if empty").
+		String()
+)
+
+func archiveMirrorFn() error {
+	archive, err := OpenArchive(*archiveMirrorDir)
+	if err != nil {
+		return err
+	}
+	areas := archive.Areas()
+	if *archiveMirrorAreas != "" {
+		areas = nil
+		for _, a := range strings.Split(*archiveMirrorAreas, ",") {
+			if a = strings.TrimSpace(a); a != "" {
+				areas = append(areas, a)
+			}
+		}
+	}
+	since := time.Time{}
+	if *archiveMirrorSince != "" {
+		d, err := parseSince(*archiveMirrorSince)
+		if err != nil {
+			return err
+		}
+		since = time.Now().Add(-d)
+	}
+	n, err := mirrorArchive(archive, *archiveMirrorOut, areas, since)
+	fmt.Printf("wrote %d files\n", n)
+	return err
+}
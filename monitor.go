@@ -0,0 +1,201 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	maxMonitorEvents = 50
+)
+
+// MonitorEvent is a notable operation or error reported to the dashboard.
+type MonitorEvent struct {
+	Time    time.Time `json:"time"`
+	Source  string    `json:"source"`
+	Message string    `json:"message"`
+	Error   bool      `json:"error"`
+	// Kind of the error, like "upstream"
+	Kind string `json:"kind,omitempty"`
+}
+
+// AreaFreshness tells how old the cached bulletin of an area is.
+type AreaFreshness struct {
+	Area   string    `json:"area"`
+	Title  string    `json:"title"`
+	Issued time.Time `json:"issued"`
+}
+
+// MonitorStatus is a snapshot of the server activity.
+type MonitorStatus struct {
+	// Upstream fetches in flight, with their start time
+	InFlight map[string]time.Time `json:"in_flight"`
+	// Notifications waiting for delivery, by notifier
+	Backlogs   map[string]int  `json:"backlogs"`
+	QueueDepth int             `json:"queue_depth"`
+	Fetched    time.Time       `json:"fetched"`
+	Areas      []AreaFreshness `json:"areas"`
+	// Errors reported since startup, by kind
+	Errors map[string]int `json:"errors"`
+	// Most recent events first
+	Events []MonitorEvent `json:"events"`
+}
+
+// Monitor tracks fetches, notification deliveries and recent errors, and
+// wakes subscribers up when they change.
+type Monitor struct {
+	lock        sync.Mutex
+	inFlight    map[string]time.Time
+	backlogs    map[string]int
+	events      []MonitorEvent
+	errors      map[string]int
+	subscribers map[chan struct{}]bool
+}
+
+func NewMonitor() *Monitor {
+	return &Monitor{
+		inFlight:    map[string]time.Time{},
+		backlogs:    map[string]int{},
+		errors:      map[string]int{},
+		subscribers: map[chan struct{}]bool{},
+	}
+}
+
+var (
+	// monitor records the activity of the running command
+	monitor = NewMonitor()
+)
+
+// changed wakes subscribers up. It must be called with the lock held.
+func (m *Monitor) changed() {
+	for ch := range m.subscribers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Subscribe returns a channel signalled after changes, and a function
+// releasing it.
+func (m *Monitor) Subscribe() (chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.subscribers[ch] = true
+	return ch, func() {
+		m.lock.Lock()
+		defer m.lock.Unlock()
+		delete(m.subscribers, ch)
+	}
+}
+
+func (m *Monitor) add(ev MonitorEvent) {
+	if ev.Error {
+		m.errors[ev.Kind]++
+	}
+	m.events = append(m.events, ev)
+	if len(m.events) > maxMonitorEvents {
+		m.events = m.events[len(m.events)-maxMonitorEvents:]
+	}
+}
+
+// Report records an event, as an error if err is not nil.
+func (m *Monitor) Report(source, message string, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	ev := MonitorEvent{
+		Time:    time.Now(),
+		Source:  source,
+		Message: message,
+	}
+	if err != nil {
+		ev.Message = message + ": " + err.Error()
+		ev.Error = true
+		ev.Kind = errorKind(err).String()
+	}
+	m.add(ev)
+	m.changed()
+}
+
+// StartFetch records an upstream fetch started.
+func (m *Monitor) StartFetch(name string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.inFlight[name] = time.Now()
+	m.changed()
+}
+
+// EndFetch records the end of an upstream fetch.
+func (m *Monitor) EndFetch(name string, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.inFlight, name)
+	if err != nil {
+		m.add(MonitorEvent{
+			Time:    time.Now(),
+			Source:  "fetch",
+			Message: name + ": " + err.Error(),
+			Error:   true,
+			Kind:    errorKind(err).String(),
+		})
+	}
+	m.changed()
+}
+
+// AddBacklog adjusts the number of notifications waiting for notifier.
+func (m *Monitor) AddBacklog(notifier string, delta int) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.backlogs[notifier] += delta
+	if m.backlogs[notifier] <= 0 {
+		delete(m.backlogs, notifier)
+	}
+	m.changed()
+}
+
+// ErrorCounts returns the number of errors reported since startup, by kind.
+func (m *Monitor) ErrorCounts() map[string]int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	counts := map[string]int{}
+	for k, v := range m.errors {
+		counts[k] = v
+	}
+	return counts
+}
+
+// Status returns a snapshot of the activity and of the bulletins in cache,
+// without fetching them.
+func (m *Monitor) Status(cache *ForecastCache) MonitorStatus {
+	forecasts := cache.Cached()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	st := MonitorStatus{
+		InFlight: map[string]time.Time{},
+		Backlogs: map[string]int{},
+		Fetched:  cache.Fetched(),
+		Errors:   map[string]int{},
+	}
+	for k, v := range m.errors {
+		st.Errors[k] = v
+	}
+	for k, v := range m.inFlight {
+		st.InFlight[k] = v
+	}
+	for k, v := range m.backlogs {
+		st.Backlogs[k] = v
+		st.QueueDepth += v
+	}
+	for i := len(m.events) - 1; i >= 0; i-- {
+		st.Events = append(st.Events, m.events[i])
+	}
+	for _, f := range forecasts {
+		st.Areas = append(st.Areas, AreaFreshness{f.Id, f.Title, f.Issued})
+	}
+	sort.Slice(st.Areas, func(i, j int) bool {
+		return st.Areas[i].Area < st.Areas[j].Area
+	})
+	return st
+}
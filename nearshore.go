@@ -0,0 +1,80 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/pmezard/metmar/meteofrance"
+)
+
+// upstreamArea is a bulletin fetched from upstream. Coastal areas are
+// identified by their number, harbor and beach bulletins by their kind and
+// number, like "rade-3".
+type upstreamArea struct {
+	Id     string
+	Kind   meteofrance.Kind
+	Number int
+}
+
+// URL returns the upstream URL of the area bulletin.
+func (a upstreamArea) URL() string {
+	return upstreamClient.KindURL(a.Kind, a.Number)
+}
+
+// parse converts the upstream reports of the area to a bulletin.
+func (a upstreamArea) parse(reports []*meteofrance.Report) (
+	*meteofrance.Bulletin, error) {
+
+	if a.Kind == meteofrance.Coast {
+		return meteofrance.ParseBulletin(reports)
+	}
+	return meteofrance.ParseNearshoreBulletin(reports)
+}
+
+// upstreamAreas returns the coastal areas followed by the --rade and --plage
+// bulletins.
+func upstreamAreas() ([]upstreamArea, error) {
+	areas := []upstreamArea{}
+	for i := 1; i <= meteofrance.Areas; i++ {
+		areas = append(areas, upstreamArea{strconv.Itoa(i), meteofrance.Coast, i})
+	}
+	nearshore := []struct {
+		kind    meteofrance.Kind
+		numbers []string
+	}{
+		{meteofrance.Harbor, *upstreamHarbors},
+		{meteofrance.Beach, *upstreamBeaches},
+	}
+	for _, ns := range nearshore {
+		for _, s := range ns.numbers {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 1 {
+				return nil, configError("invalid %s bulletin number: %q",
+					ns.kind, s)
+			}
+			id := string(ns.kind) + "-" + strconv.Itoa(n)
+			areas = append(areas, upstreamArea{id, ns.kind, n})
+		}
+	}
+	return areas, nil
+}
+
+// areaKind returns the bulletin kind of area id.
+func areaKind(id string) meteofrance.Kind {
+	for _, kind := range []meteofrance.Kind{meteofrance.Harbor,
+		meteofrance.Beach} {
+		if strings.HasPrefix(id, string(kind)+"-") {
+			return kind
+		}
+	}
+	return meteofrance.Coast
+}
+
+var (
+	upstreamHarbors = app.Flag("rade",
+		"harbor bulletin number to fetch with coastal areas, as area "+
+			"rade-NUMBER, can be repeated").Strings()
+	upstreamBeaches = app.Flag("plage",
+		"beach bulletin number to fetch with coastal areas, as area "+
+			"plage-NUMBER, can be repeated").Strings()
+)
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	maxNoteLength = 500
+)
+
+// Note is a short remark attached by a user to a bulletin revision, like
+// "actually gusted 40kt at Ouessant".
+type Note struct {
+	Author string    `json:"author"`
+	Text   string    `json:"text"`
+	Time   time.Time `json:"time"`
+}
+
+func notesPath(rev Revision) string {
+	return strings.TrimSuffix(rev.Path, ".txt") + ".notes.json"
+}
+
+func readNotes(rev Revision) ([]Note, error) {
+	notes := []Note{}
+	data, err := ioutil.ReadFile(notesPath(rev))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return notes, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(data, &notes)
+	return notes, err
+}
+
+// Notes returns the notes attached to rev, oldest first.
+func (a *Archive) Notes(rev Revision) ([]Note, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return readNotes(rev)
+}
+
+// AddNote attaches note to rev. Notes are stored next to the revision file.
+func (a *Archive) AddNote(rev Revision, note Note) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.closed {
+		return errArchiveClosed
+	}
+	notes, err := readNotes(rev)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(append(notes, note))
+	if err != nil {
+		return err
+	}
+	path := notesPath(rev)
+	err = ioutil.WriteFile(path+".tmp", data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// serveNotes lists revision notes as JSON, or adds one on POST from a form
+// "text" field or a JSON {"text": ...} body. Form posts are redirected to the
+// revision page.
+func serveNotes(archive *Archive, auth Authenticator, area, id string,
+	w http.ResponseWriter, req *http.Request) {
+
+	rev, ok := archive.Revision(area, id)
+	if !ok {
+		writeNotFound(w, "revision "+id+" of area "+area)
+		return
+	}
+	if req.Method == "GET" {
+		notes, err := archive.Notes(rev)
+		if err != nil {
+			w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+			w.WriteHeader(500)
+			fmt.Fprintf(w, "error: %s\n", err)
+			return
+		}
+		writeJSON(w, notes)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+	if req.Method != "POST" || auth == nil {
+		w.Header().Set("Allow", "GET")
+		w.WriteHeader(405)
+		fmt.Fprintf(w, "error: method not allowed\n")
+		return
+	}
+	author, ok := requireUser(auth, w, req)
+	if !ok {
+		return
+	}
+	if !sameOrigin(req) {
+		w.WriteHeader(403)
+		fmt.Fprintf(w, "error: cross-site request rejected\n")
+		return
+	}
+	req.Body = http.MaxBytesReader(w, req.Body, 16*maxNoteLength)
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	text := ""
+	if mediaType == "application/json" {
+		body := struct {
+			Text string `json:"text"`
+		}{}
+		err := json.NewDecoder(req.Body).Decode(&body)
+		if err != nil {
+			w.WriteHeader(400)
+			fmt.Fprintf(w, "error: %s\n", err)
+			return
+		}
+		text = body.Text
+	} else {
+		text = req.PostFormValue("text")
+	}
+	text = strings.TrimSpace(text)
+	if text == "" || utf8.RuneCountInString(text) > maxNoteLength {
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "error: notes must hold 1 to %d characters\n",
+			maxNoteLength)
+		return
+	}
+	note := Note{
+		Author: author,
+		Text:   text,
+		Time:   time.Now().UTC().Truncate(time.Second),
+	}
+	err := archive.AddNote(rev, note)
+	if err != nil {
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "error: %s\n", err)
+		return
+	}
+	if mediaType == "application/json" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(201)
+		json.NewEncoder(w).Encode(&note)
+		return
+	}
+	http.Redirect(w, req, "../"+rev.Id(), http.StatusSeeOther)
+}
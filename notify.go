@@ -0,0 +1,263 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+)
+
+// Notification reports a changed bulletin. Event is set when the change is a
+// new special bulletin, Revision when the bulletin was archived. Anomaly is
+// only set, without bulletin, for gale archive anomalies.
+type Notification struct {
+	Forecast Forecast
+	Event    *GaleEvent
+	Revision *Revision
+	// Previous bulletin text, empty if unknown
+	Previous string
+	Anomaly  *GaleAnomaly
+}
+
+// Notifier delivers notifications to an external service.
+type Notifier interface {
+	// Name identifies the notifier in logs
+	Name() string
+	Notify(n Notification) error
+}
+
+// bmsNotifier only forwards new special bulletins to the wrapped notifier.
+type bmsNotifier struct {
+	Notifier
+}
+
+func (n bmsNotifier) Notify(notif Notification) error {
+	if notif.Event == nil {
+		return nil
+	}
+	return n.Notifier.Notify(notif)
+}
+
+// onlyBMS wraps n so it ignores bulletin changes without new special
+// bulletin.
+func onlyBMS(n Notifier) Notifier {
+	return bmsNotifier{n}
+}
+
+// buildNotifications returns a notification for every changed forecast
+// between previous and current.
+func buildNotifications(previous, current []Forecast, now time.Time) []Notification {
+	events := map[string]GaleEvent{}
+	for _, ev := range detectNewBMS(previous, current, now) {
+		events[ev.Area] = ev
+	}
+	contents := map[string]string{}
+	for _, f := range previous {
+		contents[f.Id] = f.Content
+	}
+	notifs := []Notification{}
+	for _, f := range changedForecasts(previous, current) {
+		n := Notification{Forecast: f, Previous: contents[f.Id]}
+		if ev, ok := events[f.Id]; ok {
+			n.Event = &ev
+		}
+		notifs = append(notifs, n)
+	}
+	return notifs
+}
+
+// Dispatcher delivers notifications to a set of notifiers in the
+// background, retrying failed deliveries with exponential backoff.
+type Dispatcher struct {
+	notifiers []Notifier
+	retries   int
+	archive   *Archive
+}
+
+// NewDispatcher returns a dispatcher for notifiers. If archive is not nil,
+// notifications refer to the latest archived revision of their bulletin, the
+// archive must listen to forecasts before the dispatcher. Drill ones and
+// those ending drills have none.
+func NewDispatcher(notifiers []Notifier, retries int,
+	archive *Archive) *Dispatcher {
+
+	return &Dispatcher{
+		notifiers: notifiers,
+		retries:   retries,
+		archive:   archive,
+	}
+}
+
+func (d *Dispatcher) deliver(notifier Notifier, n Notification) {
+	defer monitor.AddBacklog(notifier.Name(), -1)
+	delay := 10 * time.Second
+	for i := 0; ; i++ {
+		err := notifier.Notify(n)
+		if err == nil {
+			return
+		}
+		monitor.Report("notify", "notifying "+notifier.Name(), err)
+		if i >= d.retries {
+			slog.Error("notifying, giving up", "notifier", notifier.Name(),
+				"error", err)
+			return
+		}
+		slog.Warn("notifying, retrying", "notifier", notifier.Name(),
+			"delay", delay, "error", err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// Dispatch sends n to every notifier.
+func (d *Dispatcher) Dispatch(n Notification) {
+	for _, notifier := range d.notifiers {
+		monitor.AddBacklog(notifier.Name(), 1)
+		go d.deliver(notifier, n)
+	}
+}
+
+// Listen is a ForecastListener dispatching bulletin changes. Bulletins active
+// when the server starts are not reported.
+func (d *Dispatcher) Listen(previous, current []Forecast) {
+	if previous == nil {
+		return
+	}
+	drills := map[string]bool{}
+	for _, f := range previous {
+		drills[f.Id] = f.Drill
+	}
+	for _, n := range buildNotifications(previous, current, time.Now()) {
+		// Drills are not archived, and the revision restored after them was
+		// already federated
+		if d.archive != nil && !n.Forecast.Drill && !drills[n.Forecast.Id] {
+			if rev, ok := d.archive.Latest(n.Forecast.Id); ok {
+				n.Revision = &rev
+			}
+		}
+		d.Dispatch(n)
+	}
+}
+
+var (
+	notifyRetries = serveCmd.Flag("notify-retries",
+		"number of notification delivery retries").Default("5").Int()
+	notifyPushBulletins = serveCmd.Flag("push-bulletins",
+		"push every changed bulletin, not only new special bulletins").Bool()
+	notifyWebhooks = serveCmd.Flag("webhook",
+		"URL receiving new gale warnings as JSON, can be repeated").Strings()
+	notifySmtpHost = serveCmd.Flag("smtp-host",
+		"SMTP server host:port, localhost:25 for --mail-to if empty, lets "+
+			"users receive emails when set").String()
+	notifySmtpUser = serveCmd.Flag("smtp-user",
+		"SMTP user, enables PLAIN authentication").String()
+	notifySmtpPassword = serveCmd.Flag("smtp-password",
+		"SMTP password").String()
+	notifyMailFrom = serveCmd.Flag("mail-from",
+		"sender of bulletin emails").Default("metmar@localhost").String()
+	notifyMailDiff = serveCmd.Flag("mail-diff",
+		"prepend changes to mailed bulletins, compared by lines, words or sentences").
+		Enum("lines", "words", "sentences")
+	notifyMailTo = serveCmd.Flag("mail-to",
+		"mail changed bulletins to address, or address=area1,area2 to select "+
+			"areas, can be repeated").Strings()
+	notifyNtfy = serveCmd.Flag("ntfy",
+		"ntfy topic URL, like https://ntfy.sh/topic, can be repeated").Strings()
+	notifyPushoverToken = serveCmd.Flag("pushover-token",
+		"Pushover application token").String()
+	notifyPushoverUser = serveCmd.Flag("pushover-user",
+		"Pushover user or group key").String()
+	notifyTelegramToken = serveCmd.Flag("telegram-token",
+		"Telegram bot token").String()
+	notifyTelegramChats = serveCmd.Flag("telegram-chat",
+		"Telegram chat identifier, can be repeated").Strings()
+	notifyCalDAV = serveCmd.Flag("caldav-url",
+		"CalDAV calendar collection URL receiving gale warning events").String()
+	notifyCalDAVUser = serveCmd.Flag("caldav-user",
+		"CalDAV user").String()
+	notifyCalDAVPassword = serveCmd.Flag("caldav-password",
+		"CalDAV password").String()
+	notifyCalDAVState = serveCmd.Flag("caldav-state",
+		"file remembering published CalDAV events").Default("caldav.json").String()
+	notifyWebmentions = serveCmd.Flag("webmention-target",
+		"URL receiving a Webmention for every bulletin revision, can be "+
+			"repeated").Strings()
+	notifyAnomalyWebhooks = serveCmd.Flag("anomaly-webhook",
+		"URL receiving --gale-dir warning number anomalies as JSON, can be "+
+			"repeated").Strings()
+	notifyAnomalyNtfy = serveCmd.Flag("anomaly-ntfy",
+		"ntfy topic URL receiving --gale-dir warning number anomalies, can "+
+			"be repeated").Strings()
+)
+
+// newAnomalyNotifiers returns the notifiers of gale archive anomalies
+// configured on the command line. They are meant for operators, bulletin
+// notifiers do not receive anomalies.
+func newAnomalyNotifiers() []Notifier {
+	notifiers := []Notifier{}
+	for _, url := range *notifyAnomalyWebhooks {
+		notifiers = append(notifiers, NewWebhookNotifier(url))
+	}
+	for _, url := range *notifyAnomalyNtfy {
+		notifiers = append(notifiers, NewNtfyNotifier(url))
+	}
+	return notifiers
+}
+
+// newNotifiers returns the notifiers configured on the command line. Some
+// require an archive and the public URL of the server, including its prefix.
+func newNotifiers(archive *Archive, publicURL string) ([]Notifier, error) {
+	notifiers := []Notifier{}
+	if len(*notifyWebmentions) > 0 {
+		if archive == nil || *serveBaseURL == "" {
+			return nil, configError("webmentions require --archive and --base-url")
+		}
+		for _, target := range *notifyWebmentions {
+			notifiers = append(notifiers, NewWebmentionNotifier(publicURL, target))
+		}
+	}
+	for _, url := range *notifyWebhooks {
+		notifiers = append(notifiers, NewWebhookNotifier(url))
+	}
+	if len(*notifyMailTo) > 0 {
+		n, err := NewMailNotifier(*notifySmtpHost, *notifySmtpUser,
+			*notifySmtpPassword, *notifyMailFrom, *notifyMailTo)
+		if err != nil {
+			return nil, err
+		}
+		n.differ = differs[*notifyMailDiff]
+		notifiers = append(notifiers, n)
+	}
+	if *notifyCalDAV != "" {
+		n, err := NewCalDAVNotifier(*notifyCalDAV, *notifyCalDAVUser,
+			*notifyCalDAVPassword, *notifyCalDAVState)
+		if err != nil {
+			return nil, err
+		}
+		notifiers = append(notifiers, n)
+	}
+	push := []Notifier{}
+	for _, url := range *notifyNtfy {
+		push = append(push, NewNtfyNotifier(url))
+	}
+	if *notifyPushoverToken != "" || *notifyPushoverUser != "" {
+		if *notifyPushoverToken == "" || *notifyPushoverUser == "" {
+			return nil, configError("pushover requires both a token and a user")
+		}
+		push = append(push, NewPushoverNotifier(*notifyPushoverToken,
+			*notifyPushoverUser))
+	}
+	if len(*notifyTelegramChats) > 0 {
+		if *notifyTelegramToken == "" {
+			return nil, configError("telegram requires a bot token")
+		}
+		for _, chat := range *notifyTelegramChats {
+			push = append(push, NewTelegramNotifier(*notifyTelegramToken, chat))
+		}
+	}
+	for _, n := range push {
+		if !*notifyPushBulletins {
+			n = onlyBMS(n)
+		}
+		notifiers = append(notifiers, n)
+	}
+	return notifiers, nil
+}
@@ -0,0 +1,267 @@
+// Package nws fetches and parses US National Weather Service marine zone
+// forecasts, the zone sections of coastal waters (CWF), nearshore (NSH) and
+// offshore (OFF) text products.
+package nws
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultURL is the zone forecast URL format, taking the directory of
+	// the zone, "coastal" or "offshore", its two letters prefix and the
+	// zone, both lowercase, like "an" and "anz335"
+	DefaultURL = "https://tgftp.nws.noaa.gov/data/forecasts/marine/%s/%s/%s.txt"
+	// DefaultUserAgent is sent unless overridden, the service rejects
+	// requests without one
+	DefaultUserAgent = "metmar (https://github.com/pmezard/metmar)"
+)
+
+var (
+	// reZone matches marine zone identifiers, like "ANZ335"
+	reZone = regexp.MustCompile(`^[A-Za-z]{2}[Zz]\d{3}$`)
+	// reUGC matches the zone codes line opening a zone forecast, like
+	// "ANZ335-161515-" or "ANZ330-335-161515-"
+	reUGC = regexp.MustCompile(`^[A-Z]{2}Z\d{3}[-0-9>A-Z]*-\d{6}-$`)
+	// rePeriod matches period paragraphs, like ".TONIGHT...NW winds 10 kt."
+	rePeriod = regexp.MustCompile(`^\.([^.]+)\.\.\.\s*(.*)$`)
+	// reHeadline matches headline paragraphs, like "...GALE WARNING..."
+	reHeadline = regexp.MustCompile(`^\.\.\.(.*?)\.\.\.$`)
+	// reIssued matches issue times, like "425 AM EDT Wed Oct 16 2024"
+	reIssued = regexp.MustCompile(`^(\d{3,4}) (AM|PM) ([A-Za-z]+) (\w{3} \w{3} +\d{1,2} \d{4})$`)
+
+	// zoneOffsets are the UTC offsets of the time zones of marine products
+	zoneOffsets = map[string]string{
+		"AST":  "-0400",
+		"EST":  "-0500",
+		"EDT":  "-0400",
+		"CST":  "-0600",
+		"CDT":  "-0500",
+		"MST":  "-0700",
+		"MDT":  "-0600",
+		"PST":  "-0800",
+		"PDT":  "-0700",
+		"AKST": "-0900",
+		"AKDT": "-0800",
+		"HST":  "-1000",
+		"SST":  "-1100",
+		"CHST": "+1000",
+		"UTC":  "+0000",
+		"GMT":  "+0000",
+	}
+)
+
+// Period is the forecast of a named period, like "TONIGHT" or "THU NIGHT".
+type Period struct {
+	Name string
+	Text string
+}
+
+// Forecast is a marine zone forecast.
+type Forecast struct {
+	// Zone identifier, like "ANZ335"
+	Zone string
+	// Zone name
+	Title string
+	// Advisories and warnings in force, like "SMALL CRAFT ADVISORY IN
+	// EFFECT THROUGH THIS EVENING"
+	Headlines []string
+	// Text preceding the periods, like the synopsis, empty if none
+	Synopsis string
+	Periods  []Period
+	// Issue time, zero if unknown
+	Issued time.Time
+	// End of validity, zero if unknown
+	Expires time.Time
+}
+
+// ValidZone tells whether zone is a marine zone identifier.
+func ValidZone(zone string) bool {
+	return reZone.MatchString(zone)
+}
+
+// Client fetches zone forecasts from the National Weather Service.
+type Client struct {
+	// HTTPClient performs requests, http.DefaultClient if nil
+	HTTPClient *http.Client
+	// URL is the zone forecast URL format, see DefaultURL
+	URL       string
+	UserAgent string
+}
+
+// NewClient returns a client fetching DefaultURL forecasts.
+func NewClient(client *http.Client) *Client {
+	return &Client{
+		HTTPClient: client,
+		URL:        DefaultURL,
+		UserAgent:  DefaultUserAgent,
+	}
+}
+
+// Offshore tells whether zone is an offshore one, whose forecasts are part of
+// OFF products: Ocean Prediction Center zones numbered from 800 in the
+// Atlantic and the Pacific, and Tropical Analysis and Forecast Branch ones
+// numbered below 100 in the Gulf of Mexico and the Caribbean. Other zones
+// are coastal or nearshore.
+func Offshore(zone string) bool {
+	if !ValidZone(zone) {
+		return false
+	}
+	zone = strings.ToUpper(zone)
+	n, _ := strconv.Atoi(zone[3:])
+	switch zone[:3] {
+	case "ANZ", "PZZ":
+		return n >= 800
+	case "GMZ", "AMZ":
+		return n < 100
+	}
+	return false
+}
+
+// ZoneURL returns the forecast URL of zone.
+func (c *Client) ZoneURL(zone string) string {
+	zone = strings.ToLower(zone)
+	prefix := zone
+	if len(prefix) > 2 {
+		prefix = prefix[:2]
+	}
+	dir := "coastal"
+	if Offshore(zone) {
+		dir = "offshore"
+	}
+	return fmt.Sprintf(c.URL, dir, prefix, zone)
+}
+
+// Fetch returns the raw forecast text of zone, to be parsed with Parse.
+func (c *Client) Fetch(ctx context.Context, zone string) ([]byte, error) {
+	url := c.ZoneURL(zone)
+	rq, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	rq.Header.Set("User-Agent", c.UserAgent)
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	rsp, err := client.Do(rq)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("got %d fetching %s", rsp.StatusCode, url)
+	}
+	return ioutil.ReadAll(rsp.Body)
+}
+
+// parseIssued parses product issue times, like "425 AM EDT Wed Oct 16 2024".
+func parseIssued(s string) (time.Time, error) {
+	m := reIssued.FindStringSubmatch(strings.TrimSpace(s))
+	if m == nil {
+		return time.Time{}, fmt.Errorf("invalid issue time: %q", s)
+	}
+	offset, ok := zoneOffsets[strings.ToUpper(m[3])]
+	if !ok {
+		return time.Time{}, fmt.Errorf("unknown time zone: %q", m[3])
+	}
+	clock := m[1]
+	if len(clock) == 3 {
+		clock = "0" + clock
+	}
+	return time.Parse("0304 PM -0700 Mon Jan 2 2006",
+		clock+" "+m[2]+" "+offset+" "+strings.Join(strings.Fields(m[4]), " "))
+}
+
+// Parse parses the first zone forecast of a text product, up to its "$$"
+// terminator. The "Expires:" line of the files served at DefaultURL sets the
+// end of validity.
+func Parse(data []byte) (*Forecast, error) {
+	lines := []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		lines = append(lines, strings.TrimRight(scanner.Text(), " \r"))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	f := &Forecast{}
+	start := -1
+	for i, line := range lines {
+		if strings.HasPrefix(line, "Expires:") && f.Expires.IsZero() {
+			s := strings.TrimPrefix(line, "Expires:")
+			if n := strings.Index(s, ";"); n >= 0 {
+				s = s[:n]
+			}
+			expires, err := time.Parse("200601021504", s)
+			if err == nil {
+				f.Expires = expires
+			}
+		}
+		if reUGC.MatchString(line) {
+			start = i
+			break
+		}
+	}
+	if start < 0 || start+2 >= len(lines) {
+		return nil, fmt.Errorf("no zone forecast found")
+	}
+	f.Zone = lines[start][:6]
+	f.Title = strings.TrimSuffix(strings.TrimSpace(lines[start+1]), "-")
+	issued, err := parseIssued(lines[start+2])
+	if err != nil {
+		return nil, err
+	}
+	f.Issued = issued
+
+	// Paragraphs are separated by blank lines, periods may follow each other
+	// without one
+	paragraphs := []string{}
+	current := []string{}
+	flush := func() {
+		if len(current) > 0 {
+			paragraphs = append(paragraphs, strings.Join(current, " "))
+			current = nil
+		}
+	}
+	for _, line := range lines[start+3:] {
+		line = strings.TrimSpace(line)
+		if line == "$$" {
+			break
+		}
+		if line == "" || rePeriod.MatchString(line) {
+			flush()
+		}
+		if line != "" {
+			current = append(current, line)
+		}
+	}
+	flush()
+	synopsis := []string{}
+	for _, p := range paragraphs {
+		if m := reHeadline.FindStringSubmatch(p); m != nil {
+			f.Headlines = append(f.Headlines, strings.TrimSpace(m[1]))
+		} else if m := rePeriod.FindStringSubmatch(p); m != nil {
+			f.Periods = append(f.Periods, Period{
+				Name: strings.TrimSpace(m[1]),
+				Text: strings.TrimSpace(m[2]),
+			})
+		} else if len(f.Periods) == 0 {
+			synopsis = append(synopsis, p)
+		}
+	}
+	f.Synopsis = strings.Join(synopsis, "\n")
+	if len(f.Periods) == 0 {
+		return nil, fmt.Errorf("zone %s forecast has no period", f.Zone)
+	}
+	return f, nil
+}
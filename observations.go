@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultObservationURL serves the latest 6 minutes observations of a
+	// Météo-France station, with an API key from portail-api.meteofrance.fr
+	defaultObservationURL = "https://public-api.meteofrance.fr/public/DPObs/v1/station/infrahoraire-6m"
+	knotsPerMS            = 3600. / 1852.
+)
+
+// Observation is the latest measurement of the station of an area. Missing
+// measurements are nil.
+type Observation struct {
+	Station string    `json:"station"`
+	Time    time.Time `json:"time"`
+	// Direction the wind comes from, in degrees
+	WindDirection *int     `json:"wind_direction,omitempty"`
+	WindKt        *float64 `json:"wind_kt,omitempty"`
+	GustKt        *float64 `json:"gust_kt,omitempty"`
+	// Sea level pressure
+	PressureHPa *float64 `json:"pressure_hpa,omitempty"`
+}
+
+// dpobsObservation is a station measurement returned by the DPObs API, in SI
+// units.
+type dpobsObservation struct {
+	Station string   `json:"geo_id_insee"`
+	Time    string   `json:"validity_time"`
+	Dir     *float64 `json:"dd"`
+	Wind    *float64 `json:"ff"`
+	Gust    *float64 `json:"fxi10"`
+	Pmer    *float64 `json:"pmer"`
+}
+
+func roundedKnots(ms *float64) *float64 {
+	if ms == nil {
+		return nil
+	}
+	kt := math.Round(*ms*knotsPerMS*10) / 10
+	return &kt
+}
+
+// parseObservations returns the latest observation of a DPObs response.
+func parseObservations(data []byte) (*Observation, error) {
+	obs := []dpobsObservation{}
+	err := json.Unmarshal(data, &obs)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse observations: %s", err)
+	}
+	var latest *Observation
+	for _, o := range obs {
+		t, err := time.Parse(time.RFC3339, o.Time)
+		if err != nil {
+			return nil, fmt.Errorf("invalid observation time: %q", o.Time)
+		}
+		if latest != nil && !t.After(latest.Time) {
+			continue
+		}
+		latest = &Observation{
+			Station: o.Station,
+			Time:    t,
+			WindKt:  roundedKnots(o.Wind),
+			GustKt:  roundedKnots(o.Gust),
+		}
+		if o.Dir != nil {
+			dir := int(math.Round(*o.Dir))
+			latest.WindDirection = &dir
+		}
+		if o.Pmer != nil {
+			hpa := math.Round(*o.Pmer/10) / 10
+			latest.PressureHPa = &hpa
+		}
+	}
+	if latest == nil {
+		return nil, fmt.Errorf("no observation")
+	}
+	return latest, nil
+}
+
+// ObservationCache refreshes the observations of every area station in the
+// background, independently of forecasts.
+type ObservationCache struct {
+	client   *http.Client
+	url      string
+	apiKey   string
+	refresh  time.Duration
+	stations map[string]string
+	lock     sync.Mutex
+	latest   map[string]*Observation
+}
+
+// NewObservationCache returns a cache of the stations of AREA=STATION
+// entries, fetched every refresh from baseURL.
+func NewObservationCache(baseURL, apiKey string, stations []string,
+	refresh time.Duration) (*ObservationCache, error) {
+
+	c := &ObservationCache{
+		client: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &countingTransport{},
+		},
+		url:      baseURL,
+		apiKey:   apiKey,
+		refresh:  refresh,
+		stations: map[string]string{},
+		latest:   map[string]*Observation{},
+	}
+	for _, s := range stations {
+		parts := strings.SplitN(s, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("expected AREA=STATION: %q", s)
+		}
+		c.stations[parts[0]] = parts[1]
+	}
+	return c, nil
+}
+
+func (c *ObservationCache) fetch(ctx context.Context, station string) (
+	*Observation, error) {
+
+	u := c.url + "?" + url.Values{
+		"id_station": {station},
+		"format":     {"json"},
+	}.Encode()
+	rq, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	rq = rq.WithContext(ctx)
+	rq.Header.Set("apikey", c.apiKey)
+	rsp, err := c.client.Do(rq)
+	if err != nil {
+		return nil, kindError(ErrUpstream, err)
+	}
+	defer rsp.Body.Close()
+	data, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return nil, kindError(ErrUpstream, err)
+	}
+	if rsp.StatusCode != 200 {
+		return nil, upstreamError("fetching station %s failed with %d",
+			station, rsp.StatusCode)
+	}
+	obs, err := parseObservations(data)
+	return obs, kindError(ErrParse, err)
+}
+
+// Refresh fetches the observations of every station. Failed stations keep
+// their previous observation.
+func (c *ObservationCache) Refresh(ctx context.Context) error {
+	var lastErr error
+	for area, station := range c.stations {
+		obs, err := c.fetch(ctx, station)
+		if err != nil {
+			lastErr = err
+			ctxLogger(ctx).Error("observing area", "area", area,
+				"station", station, "error", err)
+			continue
+		}
+		c.lock.Lock()
+		c.latest[area] = obs
+		c.lock.Unlock()
+	}
+	return lastErr
+}
+
+// Run refreshes observations every refresh interval until ctx is cancelled.
+func (c *ObservationCache) Run(ctx context.Context) {
+	for {
+		err := c.Refresh(ctx)
+		if err != nil && ctx.Err() == nil {
+			monitor.Report("observations", "refreshing observations", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(c.refresh):
+		}
+	}
+}
+
+// Latest returns the latest observation of area, or nil.
+func (c *ObservationCache) Latest(area string) *Observation {
+	if c == nil {
+		return nil
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.latest[area]
+}
+
+var (
+	// observations adds observations to area pages, if not nil
+	observations *ObservationCache
+
+	serveObsKey = serveCmd.Flag("obs-api-key",
+		"Météo-France observations API key, enables observations").
+		Envar("METMAR_OBS_API_KEY").String()
+	serveObsURL = serveCmd.Flag("obs-url",
+		"station observations URL").Default(defaultObservationURL).String()
+	serveObsStations = serveCmd.Flag("obs-station",
+		"AREA=STATION station observed next to an area bulletin, like "+
+			"3=29075001, can be repeated").Strings()
+	serveObsRefresh = serveCmd.Flag("obs-refresh",
+		"delay between observation refreshes").Default("10m").Duration()
+)
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	oidcSessionCookie = "metmar_session"
+	oidcLoginCookie   = "metmar_login"
+	// Time allowed to log in at the provider
+	oidcLoginLifetime = 10 * time.Minute
+)
+
+// OIDC authenticates users with an OpenID Connect provider, using the
+// authorization code flow, and keeps them logged in with a signed session
+// cookie.
+//
+// The ID token is received directly from the token endpoint over TLS, which
+// authenticates the issuer, so its signature is not checked. Its issuer,
+// audience, expiration and nonce are.
+type OIDC struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	authURL      string
+	tokenURL     string
+	// Public URL of the server, including its prefix
+	baseURL     string
+	prefix      string
+	userClaim   string
+	groupsClaim string
+	lifetime    time.Duration
+	key         []byte
+	client      *http.Client
+}
+
+type oidcDiscovery struct {
+	Issuer   string `json:"issuer"`
+	AuthURL  string `json:"authorization_endpoint"`
+	TokenURL string `json:"token_endpoint"`
+}
+
+// NewOIDC discovers the endpoints of issuer. Sessions are signed with key,
+// or with a random key if empty, logging users out when the server restarts.
+func NewOIDC(ctx context.Context, issuer, clientID, clientSecret, baseURL,
+	prefix, userClaim, groupsClaim, key string, lifetime time.Duration) (
+	*OIDC, error) {
+
+	issuer = strings.TrimSuffix(issuer, "/")
+	o := &OIDC{
+		issuer:       issuer,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		baseURL:      baseURL,
+		prefix:       prefix,
+		userClaim:    userClaim,
+		groupsClaim:  groupsClaim,
+		lifetime:     lifetime,
+		key:          []byte(key),
+		client:       &http.Client{Timeout: 30 * time.Second},
+	}
+	if key == "" {
+		o.key = make([]byte, 32)
+		_, err := rand.Read(o.key)
+		if err != nil {
+			return nil, err
+		}
+	}
+	rq, err := http.NewRequestWithContext(ctx, "GET",
+		issuer+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+	rsp, err := o.client.Do(rq)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("got %d discovering %s", rsp.StatusCode, issuer)
+	}
+	d := oidcDiscovery{}
+	err = json.NewDecoder(rsp.Body).Decode(&d)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode %s configuration: %s", issuer,
+			err)
+	}
+	if strings.TrimSuffix(d.Issuer, "/") != issuer {
+		return nil, fmt.Errorf("issuer mismatch: %s announces %s", issuer,
+			d.Issuer)
+	}
+	if d.AuthURL == "" || d.TokenURL == "" {
+		return nil, fmt.Errorf("%s has no authorization or token endpoint", issuer)
+	}
+	o.authURL = d.AuthURL
+	o.tokenURL = d.TokenURL
+	return o, nil
+}
+
+// sign returns data encoded with its signature.
+func (o *OIDC) sign(data interface{}) (string, error) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, o.key)
+	mac.Write(payload)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// verify decodes into data a value returned by sign.
+func (o *OIDC) verify(value string, data interface{}) error {
+	parts := strings.SplitN(value, ".", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("invalid signed value")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return err
+	}
+	mac := hmac.New(sha256.New, o.key)
+	mac.Write(payload)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return fmt.Errorf("invalid signature")
+	}
+	return json.Unmarshal(payload, data)
+}
+
+type oidcSession struct {
+	Name    string    `json:"name"`
+	Groups  []string  `json:"groups,omitempty"`
+	Expires time.Time `json:"expires"`
+}
+
+type oidcLogin struct {
+	State   string    `json:"state"`
+	Nonce   string    `json:"nonce"`
+	Next    string    `json:"next"`
+	Expires time.Time `json:"expires"`
+}
+
+func (o *OIDC) setCookie(w http.ResponseWriter, name, value string,
+	maxAge time.Duration) {
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     o.prefix + "/",
+		MaxAge:   int(maxAge.Seconds()),
+		Secure:   strings.HasPrefix(o.baseURL, "https://"),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// Authenticate returns the user of the session cookie of req.
+func (o *OIDC) Authenticate(req *http.Request) (Identity, bool) {
+	c, err := req.Cookie(oidcSessionCookie)
+	if err != nil {
+		return Identity{}, false
+	}
+	s := oidcSession{}
+	err = o.verify(c.Value, &s)
+	if err != nil || s.Name == "" || time.Now().After(s.Expires) {
+		return Identity{}, false
+	}
+	return Identity{Name: s.Name, Groups: s.Groups}, true
+}
+
+// Challenge redirects browsers to the provider login page, and replies with
+// a 401 to other requests.
+func (o *OIDC) Challenge(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+		w.WriteHeader(401)
+		fmt.Fprintf(w, "error: authentication required, log in at %s\n",
+			o.baseURL+"/auth/login")
+		return
+	}
+	o.login(w, req, requestPrefix(req)+req.URL.RequestURI())
+}
+
+func randomToken() (string, error) {
+	buf := make([]byte, 16)
+	_, err := rand.Read(buf)
+	return hex.EncodeToString(buf), err
+}
+
+// login redirects to the provider login page, then back to next.
+func (o *OIDC) login(w http.ResponseWriter, req *http.Request, next string) {
+	// Only redirect to local paths after login
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") {
+		next = requestPrefix(req) + "/"
+	}
+	state, err := randomToken()
+	nonce := ""
+	if err == nil {
+		nonce, err = randomToken()
+	}
+	value := ""
+	if err == nil {
+		value, err = o.sign(&oidcLogin{
+			State:   state,
+			Nonce:   nonce,
+			Next:    next,
+			Expires: time.Now().Add(oidcLoginLifetime),
+		})
+	}
+	if err != nil {
+		w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "error: %s\n", err)
+		return
+	}
+	o.setCookie(w, oidcLoginCookie, value, oidcLoginLifetime)
+	q := url.Values{}
+	q.Set("response_type", "code")
+	q.Set("client_id", o.clientID)
+	q.Set("redirect_uri", o.baseURL+"/auth/callback")
+	q.Set("scope", "openid profile email")
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	sep := "?"
+	if strings.Contains(o.authURL, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, req, o.authURL+sep+q.Encode(), http.StatusFound)
+}
+
+// exchange returns the ID token claims obtained for code.
+func (o *OIDC) exchange(ctx context.Context, code string) (
+	map[string]interface{}, error) {
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", o.baseURL+"/auth/callback")
+	form.Set("client_id", o.clientID)
+	rq, err := http.NewRequestWithContext(ctx, "POST", o.tokenURL,
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	rq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rq.SetBasicAuth(url.QueryEscape(o.clientID), url.QueryEscape(o.clientSecret))
+	rsp, err := o.client.Do(rq)
+	if err != nil {
+		return nil, err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("got %d exchanging authorization code",
+			rsp.StatusCode)
+	}
+	token := struct {
+		IDToken string `json:"id_token"`
+	}{}
+	err = json.NewDecoder(rsp.Body).Decode(&token)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Split(token.IDToken, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid ID token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid ID token: %s", err)
+	}
+	claims := map[string]interface{}{}
+	err = json.Unmarshal(payload, &claims)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ID token: %s", err)
+	}
+	return claims, nil
+}
+
+// claimStrings returns a string or array of strings claim.
+func claimStrings(claims map[string]interface{}, name string) []string {
+	switch v := claims[name].(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		values := []string{}
+		for _, s := range v {
+			if s, ok := s.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// checkClaims validates the ID token claims against the login.
+func (o *OIDC) checkClaims(claims map[string]interface{}, l oidcLogin) error {
+	iss, _ := claims["iss"].(string)
+	if strings.TrimSuffix(iss, "/") != o.issuer {
+		return fmt.Errorf("unexpected issuer: %q", iss)
+	}
+	audience := false
+	for _, aud := range claimStrings(claims, "aud") {
+		audience = audience || aud == o.clientID
+	}
+	if !audience {
+		return fmt.Errorf("ID token not issued for %s", o.clientID)
+	}
+	exp, _ := claims["exp"].(float64)
+	if time.Now().After(time.Unix(int64(exp), 0)) {
+		return fmt.Errorf("ID token expired")
+	}
+	nonce, _ := claims["nonce"].(string)
+	if nonce != l.Nonce {
+		return fmt.Errorf("nonce mismatch")
+	}
+	return nil
+}
+
+// callback completes a login and opens a session.
+func (o *OIDC) callback(w http.ResponseWriter, req *http.Request) {
+	l := oidcLogin{}
+	c, err := req.Cookie(oidcLoginCookie)
+	if err == nil {
+		err = o.verify(c.Value, &l)
+	}
+	q := req.URL.Query()
+	if err == nil && time.Now().After(l.Expires) {
+		err = fmt.Errorf("login expired")
+	}
+	if err == nil && q.Get("state") != l.State {
+		err = fmt.Errorf("state mismatch")
+	}
+	if err == nil && q.Get("error") != "" {
+		err = fmt.Errorf("login failed: %s %s", q.Get("error"),
+			q.Get("error_description"))
+	}
+	if err != nil {
+		w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "error: %s\n", err)
+		return
+	}
+	claims, err := o.exchange(req.Context(), q.Get("code"))
+	if err == nil {
+		err = o.checkClaims(claims, l)
+	}
+	if err != nil {
+		w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+		w.WriteHeader(502)
+		fmt.Fprintf(w, "error: %s\n", err)
+		return
+	}
+	name, _ := claims[o.userClaim].(string)
+	if name == "" {
+		name, _ = claims["sub"].(string)
+	}
+	value, err := o.sign(&oidcSession{
+		Name:    name,
+		Groups:  claimStrings(claims, o.groupsClaim),
+		Expires: time.Now().Add(o.lifetime),
+	})
+	if err != nil {
+		w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "error: %s\n", err)
+		return
+	}
+	o.setCookie(w, oidcLoginCookie, "", -1)
+	o.setCookie(w, oidcSessionCookie, value, o.lifetime)
+	http.Redirect(w, req, l.Next, http.StatusSeeOther)
+}
+
+// ServeAuth serves /auth/login, which accepts a "next" local path to return
+// to, the provider callback at /auth/callback and /auth/logout.
+func (o *OIDC) ServeAuth(w http.ResponseWriter, req *http.Request) {
+	switch strings.TrimPrefix(req.URL.Path, "/auth") {
+	case "/login":
+		o.login(w, req, req.URL.Query().Get("next"))
+	case "/callback":
+		o.callback(w, req)
+	case "/logout":
+		o.setCookie(w, oidcSessionCookie, "", -1)
+		http.Redirect(w, req, requestPrefix(req)+"/", http.StatusSeeOther)
+	default:
+		writeNotFound(w, req.URL.Path)
+	}
+}
+
+var (
+	serveOIDCIssuer = serveCmd.Flag("oidc-issuer",
+		"OpenID Connect issuer URL, enables login with the provider").String()
+	serveOIDCClientID = serveCmd.Flag("oidc-client-id",
+		"OpenID Connect client identifier").String()
+	serveOIDCClientSecret = serveCmd.Flag("oidc-client-secret",
+		"OpenID Connect client secret").String()
+	// Claims like preferred_username are often editable by users and not
+	// unique, so one could take the name of an --admin
+	serveOIDCUserClaim = serveCmd.Flag("oidc-user-claim",
+		"ID token claim naming users, the subject if missing, it must be "+
+			"unique and not editable by users").Default("sub").String()
+	serveOIDCGroupsClaim = serveCmd.Flag("oidc-groups-claim",
+		"ID token claim listing user groups").Default("groups").String()
+	serveSessionKey = serveCmd.Flag("session-key",
+		"key signing login sessions, random if empty").String()
+	serveSessionLifetime = serveCmd.Flag("session-lifetime",
+		"duration of login sessions").Default("168h").Duration()
+)
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+type prefixKey struct{}
+
+// prefixHandler strips prefix from request paths before h routes them, so
+// handlers are registered and parse paths below the server root. Requests
+// outside prefix, like WebFinger ones at the host root or ones forwarded by
+// a proxy which already stripped it, are passed unchanged. Requests to the
+// prefix itself are redirected to prefix/, so relative links resolve below
+// it.
+//
+// Generated links start with the public prefix returned by requestPrefix,
+// which is prefix, or the X-Forwarded-Prefix header set by a reverse proxy
+// followed by the stripped prefix if trustForwarded is set.
+func prefixHandler(h http.Handler, prefix string,
+	trustForwarded bool) http.Handler {
+
+	prefix = strings.TrimSuffix(prefix, "/")
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		public := prefix
+		stripped := ""
+		p := req.URL.Path
+		if prefix != "" && (p == prefix || strings.HasPrefix(p, prefix+"/")) {
+			stripped = prefix
+			p = strings.TrimPrefix(p, prefix)
+		}
+		if trustForwarded {
+			if fwd, ok := forwardedPrefix(req); ok {
+				public = fwd + stripped
+			}
+		}
+		if p == "" {
+			http.Redirect(w, req, public+"/", http.StatusMovedPermanently)
+			return
+		}
+		r := req.WithContext(context.WithValue(req.Context(), prefixKey{},
+			public))
+		if stripped != "" {
+			r.URL = &url.URL{}
+			*r.URL = *req.URL
+			r.URL.Path = p
+			r.URL.RawPath = ""
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// forwardedPrefix returns the cleaned X-Forwarded-Prefix header of req, and
+// false if it is missing or is not an absolute path.
+func forwardedPrefix(req *http.Request) (string, bool) {
+	fwd := req.Header.Get("X-Forwarded-Prefix")
+	if fwd == "" || !strings.HasPrefix(fwd, "/") {
+		return "", false
+	}
+	fwd = path.Clean(fwd)
+	if fwd == "/" {
+		fwd = ""
+	}
+	return fwd, true
+}
+
+// requestPrefix returns the public URL path prefix of req, without trailing
+// slash, to build links and redirects.
+func requestPrefix(req *http.Request) string {
+	prefix, _ := req.Context().Value(prefixKey{}).(string)
+	return prefix
+}
+
+var (
+	serveTrustProxy = serveCmd.Flag("trust-proxy",
+		"trust the X-Forwarded-Prefix header of a reverse proxy to build "+
+			"links, and its X-Forwarded-For one to rate limit clients").Bool()
+)
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	reClock     = regexp.MustCompile(`^([01]\d|2[0-3]):([0-5]\d)$`)
+	reNtfyTopic = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+)
+
+// parseClock returns the minutes since midnight of an HH:MM time.
+func parseClock(s string) (int, bool) {
+	m := reClock.FindStringSubmatch(s)
+	if m == nil {
+		return 0, false
+	}
+	h, _ := strconv.Atoi(m[1])
+	min, _ := strconv.Atoi(m[2])
+	return h*60 + min, true
+}
+
+// Quiet returns true if t falls within the quiet hours, which may span
+// midnight.
+func (p NotificationPrefs) Quiet(t time.Time) bool {
+	start, ok1 := parseClock(p.QuietStart)
+	end, ok2 := parseClock(p.QuietEnd)
+	if !ok1 || !ok2 || start == end {
+		return false
+	}
+	now := t.Hour()*60 + t.Minute()
+	if start < end {
+		return now >= start && now < end
+	}
+	return now >= start || now < end
+}
+
+// Wants returns true if notif matches the areas and severity preferences.
+func (p NotificationPrefs) Wants(notif Notification) bool {
+	found := false
+	for _, area := range p.Areas {
+		if area == notif.Forecast.Id {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return false
+	}
+	if p.MinSeverity <= 0 {
+		return true
+	}
+	if notif.Event == nil {
+		return false
+	}
+	// Unknown levels are notified rather than missed
+	severity := levelSeverity(notif.Event.Level)
+	return severity == 0 || severity >= p.MinSeverity
+}
+
+// UserNotifier delivers notifications according to every user preferences.
+// Delivery failures are logged rather than returned, so retries do not
+// notify other users twice.
+type UserNotifier struct {
+	store    *UserStore
+	mail     *MailNotifier
+	ntfyURL  string
+	location *time.Location
+}
+
+// NewUserNotifier returns a notifier mailing users when --smtp-host is set
+// and publishing to their topics on the ntfyURL server. Quiet hours are
+// interpreted in the zone time zone.
+func NewUserNotifier(store *UserStore, ntfyURL, zone string) (*UserNotifier, error) {
+	location, err := time.LoadLocation(zone)
+	if err != nil {
+		return nil, err
+	}
+	n := &UserNotifier{
+		store:    store,
+		ntfyURL:  strings.TrimSuffix(ntfyURL, "/"),
+		location: location,
+	}
+	if *notifySmtpHost != "" {
+		n.mail, err = NewMailNotifier(*notifySmtpHost, *notifySmtpUser,
+			*notifySmtpPassword, *notifyMailFrom, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+func (n *UserNotifier) Name() string {
+	return "users"
+}
+
+func (n *UserNotifier) Notify(notif Notification) error {
+	now := time.Now().In(n.location)
+	for user, data := range n.store.All() {
+		prefs := data.Notifications
+		if !prefs.Wants(notif) || prefs.Quiet(now) {
+			continue
+		}
+		if prefs.Email != "" && n.mail != nil {
+			err := n.mail.send([]string{prefs.Email},
+				bulletinSubject(notif.Forecast), notif.Forecast.Content)
+			if err != nil {
+				slog.Error("mailing user", "user", user, "error", err)
+			}
+		}
+		if prefs.Ntfy != "" && n.ntfyURL != "" {
+			err := NewNtfyNotifier(n.ntfyURL + "/" + prefs.Ntfy).Notify(notif)
+			if err != nil {
+				slog.Error("pushing to user", "user", user, "error", err)
+			}
+		}
+	}
+	return nil
+}
+
+const (
+	settingsTemplate = `<html>
+<head>
+	<meta charset="utf-8"/>
+	<title>{{.User}}: notifications</title>
+</head>
+<body>
+	<h1>Notifications</h1>
+	{{if .Error}}<p><strong>{{.Error}}</strong></p>{{end}}
+	<form method="post" action="settings">
+		<h2>Areas</h2>
+		{{range .Areas}}
+			<label><input type="checkbox" name="area" value="{{.Id}}"{{if .Selected}} checked{{end}}/> {{.Title}}</label><br/>
+		{{end}}
+		<h2>Channels</h2>
+		{{if .Mail}}
+		<label>Email <input type="email" name="email" value="{{.Prefs.Email}}"/></label><br/>
+		{{end}}
+		{{if .NtfyURL}}
+		<label>ntfy topic on {{.NtfyURL}} <input type="text" name="ntfy" value="{{.Prefs.Ntfy}}"/></label><br/>
+		{{end}}
+		<h2>Severity</h2>
+		<select name="min_severity">
+		{{range .Levels}}
+			<option value="{{.Value}}"{{if .Selected}} selected{{end}}>{{.Name}}</option>
+		{{end}}
+		</select>
+		<h2>Quiet hours</h2>
+		<label>From <input type="time" name="quiet_start" value="{{.Prefs.QuietStart}}"/></label>
+		<label>to <input type="time" name="quiet_end" value="{{.Prefs.QuietEnd}}"/></label>
+		({{.Zone}})<br/>
+		<input type="submit" value="Save"/>
+	</form>
+	<a href="../me">Favorite areas</a>
+</body>
+</html>
+`
+)
+
+var (
+	settingsTmpl = template.Must(template.New("settings").Parse(settingsTemplate))
+)
+
+// parsePrefs validates notification preferences posted by the settings form.
+func parsePrefs(req *http.Request) (NotificationPrefs, error) {
+	prefs := NotificationPrefs{
+		Areas:      req.PostForm["area"],
+		Email:      strings.TrimSpace(req.PostFormValue("email")),
+		Ntfy:       strings.TrimSpace(req.PostFormValue("ntfy")),
+		QuietStart: req.PostFormValue("quiet_start"),
+		QuietEnd:   req.PostFormValue("quiet_end"),
+	}
+	if prefs.Email != "" && !strings.Contains(prefs.Email, "@") ||
+		strings.ContainsAny(prefs.Email, "\r\n,") {
+		return prefs, fmt.Errorf("invalid email address: %q", prefs.Email)
+	}
+	if prefs.Ntfy != "" && !reNtfyTopic.MatchString(prefs.Ntfy) {
+		return prefs, fmt.Errorf("invalid ntfy topic: %q", prefs.Ntfy)
+	}
+	severity, err := strconv.Atoi(req.PostFormValue("min_severity"))
+	if err != nil || severity < 0 || severity > len(bmsLevels) {
+		return prefs, fmt.Errorf("invalid severity")
+	}
+	prefs.MinSeverity = severity
+	for _, s := range []string{prefs.QuietStart, prefs.QuietEnd} {
+		if _, ok := parseClock(s); s != "" && !ok {
+			return prefs, fmt.Errorf("invalid time: %q", s)
+		}
+	}
+	return prefs, nil
+}
+
+// serveSettings shows and saves the notification preferences of the
+// authenticated user. The email field is shown if mail is set.
+func serveSettings(cache *ForecastCache, store *UserStore, user string,
+	mail bool, ntfyURL, zone string, w http.ResponseWriter, req *http.Request) {
+
+	prefs := store.Get(user).Notifications
+	errMsg := ""
+	if req.Method == "POST" && !sameOrigin(req) {
+		w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+		w.WriteHeader(403)
+		fmt.Fprintf(w, "error: cross-site request rejected\n")
+		return
+	}
+	if req.Method == "POST" {
+		err := req.ParseForm()
+		if err == nil {
+			prefs, err = parsePrefs(req)
+			if err == nil {
+				err = store.Update(user, func(d *UserData) {
+					d.Notifications = prefs
+				})
+				if err == nil {
+					detail, _ := json.Marshal(&prefs)
+					auditLog.Record(req, user, "settings", user, string(detail))
+					http.Redirect(w, req, "settings", http.StatusSeeOther)
+					return
+				}
+			}
+		}
+		errMsg = err.Error()
+	}
+	forecasts, err := cache.Get(req.Context())
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	type area struct {
+		Id       string
+		Title    string
+		Selected bool
+	}
+	type level struct {
+		Value    int
+		Name     string
+		Selected bool
+	}
+	page := struct {
+		User    string
+		Error   string
+		Prefs   NotificationPrefs
+		Mail    bool
+		NtfyURL string
+		Zone    string
+		Areas   []area
+		Levels  []level
+	}{
+		User:    user,
+		Error:   errMsg,
+		Prefs:   prefs,
+		Mail:    mail,
+		NtfyURL: ntfyURL,
+		Zone:    zone,
+	}
+	selected := map[string]bool{}
+	for _, a := range prefs.Areas {
+		selected[a] = true
+	}
+	for _, f := range forecasts {
+		page.Areas = append(page.Areas, area{f.Id, f.Title, selected[f.Id]})
+	}
+	page.Levels = append(page.Levels, level{0, "Every bulletin",
+		prefs.MinSeverity == 0})
+	for i, l := range bmsLevels {
+		page.Levels = append(page.Levels, level{i + 1, "BMS " + l + " or more",
+			prefs.MinSeverity == i+1})
+	}
+	w.Header().Set("Cache-Control", "private, no-cache")
+	if errMsg != "" {
+		w.WriteHeader(400)
+	}
+	writeHTML(w, settingsTmpl, &page)
+}
+
+var (
+	notifyUserNtfy = serveCmd.Flag("user-ntfy",
+		"ntfy server users can publish their notifications to, empty to disable").
+		Default("https://ntfy.sh").String()
+	notifyQuietZone = serveCmd.Flag("quiet-zone",
+		"time zone of user quiet hours, --timezone if empty").String()
+)
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// notificationTitle returns a short title for n.
+func notificationTitle(n Notification) string {
+	if n.Anomaly != nil {
+		return "Gale warning anomaly: " + areaLabel(n.Anomaly.Area)
+	}
+	if n.Event != nil {
+		return bulletinSubject(n.Forecast)
+	}
+	return "Nouveau bulletin: " + n.Forecast.Title
+}
+
+// notificationText returns the special bulletin text for new special
+// bulletins, the bulletin otherwise, truncated to max bytes.
+func notificationText(n Notification, max int) string {
+	text := n.Forecast.Content
+	if n.Event != nil {
+		text = n.Event.Text
+	} else if n.Anomaly != nil {
+		text = n.Anomaly.String()
+	}
+	if len(text) <= max {
+		return text
+	}
+	// Do not cut UTF-8 sequences
+	cut := max - len("…")
+	for cut > 0 && !utf8RuneStart(text[cut]) {
+		cut--
+	}
+	return text[:cut] + "…"
+}
+
+func utf8RuneStart(b byte) bool {
+	return b&0xC0 != 0x80
+}
+
+var (
+	pushClient = &http.Client{Timeout: 30 * time.Second}
+)
+
+// urlHost returns the host of rawURL. Push and webhook URLs, like Telegram or
+// ntfy ones, embed credentials or secret topics, so only their host may end
+// up in logs.
+func urlHost(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return "unknown host"
+	}
+	return u.Host
+}
+
+// checkPushResponse returns an error if the request to service failed.
+// Request URLs are reduced to their host.
+func checkPushResponse(rsp *http.Response, err error, service string) error {
+	if ue, ok := err.(*url.Error); ok {
+		return fmt.Errorf("%s: %s %s: %s", service, ue.Op, urlHost(ue.URL),
+			ue.Err)
+	}
+	if err != nil {
+		return err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode < 200 || rsp.StatusCode >= 300 {
+		body, _ := ioutil.ReadAll(rsp.Body)
+		return fmt.Errorf("%s returned %d: %s", service, rsp.StatusCode,
+			strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// NtfyNotifier publishes to a ntfy.sh topic URL.
+type NtfyNotifier struct {
+	url string
+}
+
+func NewNtfyNotifier(url string) *NtfyNotifier {
+	return &NtfyNotifier{url: url}
+}
+
+func (n *NtfyNotifier) Name() string {
+	return "ntfy " + urlHost(n.url)
+}
+
+func (n *NtfyNotifier) Notify(notif Notification) error {
+	rq, err := http.NewRequest("POST", n.url,
+		strings.NewReader(notificationText(notif, 4096)))
+	if err != nil {
+		return err
+	}
+	rq.Header.Set("Title", notificationTitle(notif))
+	rq.Header.Set("Tags", "ocean")
+	if notif.Event != nil {
+		rq.Header.Set("Priority", "high")
+		rq.Header.Set("Tags", "warning,ocean")
+	}
+	rsp, err := pushClient.Do(rq)
+	return checkPushResponse(rsp, err, "ntfy")
+}
+
+// PushoverNotifier sends Pushover messages to a user or group key.
+type PushoverNotifier struct {
+	token string
+	user  string
+}
+
+func NewPushoverNotifier(token, user string) *PushoverNotifier {
+	return &PushoverNotifier{
+		token: token,
+		user:  user,
+	}
+}
+
+func (n *PushoverNotifier) Name() string {
+	return "pushover"
+}
+
+func (n *PushoverNotifier) Notify(notif Notification) error {
+	form := url.Values{
+		"token":   {n.token},
+		"user":    {n.user},
+		"title":   {notificationTitle(notif)},
+		"message": {notificationText(notif, 1024)},
+	}
+	if notif.Event != nil {
+		form.Set("priority", "1")
+	}
+	rsp, err := pushClient.PostForm("https://api.pushover.net/1/messages.json", form)
+	return checkPushResponse(rsp, err, "pushover")
+}
+
+// TelegramNotifier sends messages to a Telegram chat through a bot.
+type TelegramNotifier struct {
+	token string
+	chat  string
+}
+
+func NewTelegramNotifier(token, chat string) *TelegramNotifier {
+	return &TelegramNotifier{
+		token: token,
+		chat:  chat,
+	}
+}
+
+func (n *TelegramNotifier) Name() string {
+	return "telegram " + n.chat
+}
+
+func (n *TelegramNotifier) Notify(notif Notification) error {
+	title := notificationTitle(notif)
+	form := url.Values{
+		"chat_id": {n.chat},
+		"text": {title + "\n\n" +
+			notificationText(notif, 4000-len(title))},
+	}
+	rsp, err := pushClient.PostForm("https://api.telegram.org/bot"+n.token+
+		"/sendMessage", form)
+	return checkPushResponse(rsp, err, "telegram")
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+type failingTransport struct{}
+
+func (failingTransport) RoundTrip(rq *http.Request) (*http.Response, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestTelegramErrorHidesToken(t *testing.T) {
+	client := pushClient
+	defer func() { pushClient = client }()
+	pushClient = &http.Client{Transport: failingTransport{}}
+
+	token := "123456:SECRET-bot-token"
+	n := NewTelegramNotifier(token, "42")
+	err := n.Notify(Notification{Forecast: Forecast{Id: "3", Title: "Area 3"}})
+	if err == nil {
+		t.Fatal("delivery did not fail")
+	}
+	if strings.Contains(err.Error(), "SECRET") {
+		t.Fatalf("error leaks the bot token: %s", err)
+	}
+	if !strings.Contains(err.Error(), "api.telegram.org") {
+		t.Fatalf("error lacks the host: %s", err)
+	}
+}
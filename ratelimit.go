@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter is a per client IP token bucket, refilled with limit tokens
+// every interval and holding at most burst tokens.
+type RateLimiter struct {
+	lock    sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*tokenBucket
+	swept   time.Time
+	// trustProxy identifies clients by the address forwarded by a reverse
+	// proxy
+	trustProxy bool
+}
+
+// NewRateLimiter returns a limiter of limit requests per interval, which must
+// be positive.
+func NewRateLimiter(limit int, interval time.Duration, burst int,
+	trustProxy bool) *RateLimiter {
+
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		rate:       float64(limit) / interval.Seconds(),
+		burst:      float64(burst),
+		buckets:    map[string]*tokenBucket{},
+		swept:      time.Now(),
+		trustProxy: trustProxy,
+	}
+}
+
+// rateLimitedClient returns the client address of req. Behind a trusted
+// proxy, it is the last X-Forwarded-For entry, appended by the proxy, as
+// earlier ones are set by clients.
+func (l *RateLimiter) rateLimitedClient(req *http.Request) string {
+	if l.trustProxy {
+		entries := strings.Split(req.Header.Get("X-Forwarded-For"), ",")
+		if client := strings.TrimSpace(entries[len(entries)-1]); client != "" {
+			return client
+		}
+	}
+	return clientIP(req)
+}
+
+// Allow consumes a token of client bucket. Otherwise, it returns false and
+// the delay until the next token.
+func (l *RateLimiter) Allow(client string, now time.Time) (bool, time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.sweep(now)
+	b := l.buckets[client]
+	if b == nil {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+// sweep drops buckets which refilled completely, so memory does not grow
+// with every client ever seen.
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < time.Minute {
+		return
+	}
+	l.swept = now
+	for client, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+// Wrap rejects requests of clients exceeding their rate with a 429. A nil
+// limiter returns fn unchanged.
+func (l *RateLimiter) Wrap(fn http.HandlerFunc) http.HandlerFunc {
+	if l == nil {
+		return fn
+	}
+	return func(w http.ResponseWriter, req *http.Request) {
+		ok, wait := l.Allow(l.rateLimitedClient(req), time.Now())
+		if !ok {
+			w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+			w.Header().Set("Retry-After",
+				fmt.Sprintf("%d", int(math.Ceil(wait.Seconds()))))
+			w.WriteHeader(429)
+			fmt.Fprintf(w, "error: too many requests\n")
+			return
+		}
+		fn(w, req)
+	}
+}
+
+var (
+	serveRateLimit = serveCmd.Flag("rate-limit",
+		"maximum requests per client IP and rate interval, zero to disable").
+		Default("0").Int()
+	serveRateInterval = serveCmd.Flag("rate-interval",
+		"rate limiting interval").Default("1m").Duration()
+	serveRateBurst = serveCmd.Flag("rate-burst",
+		"maximum requests per client IP in a burst").Default("10").Int()
+)
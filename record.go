@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var (
+	recordDir = app.Flag("record",
+		"save every upstream response in this directory, for --source or later inspection").
+		String()
+	// recordLock serializes index updates
+	recordLock sync.Mutex
+)
+
+// recordResponse saves an upstream response of area as dir/AREA_TIME.json,
+// readable by --source, and appends its time, area and URL to
+// dir/index.txt.
+func recordResponse(dir string, area string, url string, data []byte,
+	now time.Time) error {
+
+	recordLock.Lock()
+	defer recordLock.Unlock()
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+	stamp := now.UTC().Format(archiveTimeFormat)
+	name := area + "_" + stamp + ".json"
+	path := filepath.Join(dir, name)
+	err = ioutil.WriteFile(path+".tmp", data, 0644)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(path+".tmp", path)
+	if err != nil {
+		return err
+	}
+	fp, err := os.OpenFile(filepath.Join(dir, "index.txt"),
+		os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(fp, "%s %s %s %s\n", now.UTC().Format(time.RFC3339),
+		area, url, name)
+	if closeErr := fp.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
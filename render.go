@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pmezard/metmar/meteofrance"
+)
+
+// Forecasts are rendered from their structured parts, or from sections parsed
+// back from their content when only the content is known.
+
+// formatText renders f as the plain text bulletin archived and served by
+// default, with templates/bulletin.txt or the --text-template file.
+func formatText(f *Forecast) string {
+	return executeTextTemplate(f)
+}
+
+// forecastParts returns the introduction, without title nor special
+// bulletin, and the sections of f.
+func forecastParts(f Forecast) (string, []ForecastSection) {
+	if f.Sections == nil {
+		return splitForecast(f)
+	}
+	intro := strings.TrimSpace(f.Header + "\n" + f.Footer)
+	return intro, f.Sections
+}
+
+// formatMarkdown renders f as a Markdown document.
+func formatMarkdown(f Forecast) string {
+	intro, sections := forecastParts(f)
+	w := &bytes.Buffer{}
+	fmt.Fprintf(w, "# %s\n\n", f.Title)
+	if !f.Issued.IsZero() {
+		fmt.Fprintf(w, "*Issued %s UTC", f.Issued.Format("2006-01-02 15:04"))
+		if !f.Expires.IsZero() {
+			fmt.Fprintf(w, ", valid until %s UTC",
+				f.Expires.Format("2006-01-02 15:04"))
+		}
+		w.WriteString("*\n\n")
+	}
+	if b := parseBMS(f.Special); b != nil {
+		fmt.Fprintf(w, "> **BMS n°%d", b.Number)
+		if b.Level != "" {
+			fmt.Fprintf(w, ": %s", b.Level)
+		}
+		w.WriteString("**\n>\n")
+		for _, line := range strings.Split(b.Text, "\n") {
+			w.WriteString(strings.TrimRight("> "+line, " ") + "\n")
+		}
+		w.WriteString("\n")
+	}
+	if intro != "" {
+		w.WriteString(markdownLines(intro) + "\n\n")
+	}
+	for _, s := range sections {
+		fmt.Fprintf(w, "## %s\n\n", s.Title)
+		if s.Text != "" {
+			w.WriteString(markdownLines(s.Text) + "\n\n")
+		}
+	}
+	return w.String()
+}
+
+// markdownLines keeps text line breaks in Markdown.
+func markdownLines(text string) string {
+	return strings.Replace(text, "\n", "  \n", -1)
+}
+
+type jsonSection struct {
+	Title string `json:"title"`
+	Text  string `json:"text"`
+	// Wind speeds and distances of the text, converted
+	Measures []Measure `json:"measures"`
+}
+
+type jsonBMS struct {
+	Number int    `json:"number"`
+	Level  string `json:"level,omitempty"`
+	Text   string `json:"text"`
+}
+
+// jsonUnits are the units of the bulletin texts, measures being converted to
+// the requested ones.
+type jsonUnits struct {
+	Wind       string `json:"wind,omitempty"`
+	Sea        string `json:"sea,omitempty"`
+	Visibility string `json:"visibility,omitempty"`
+	Notice     string `json:"notice,omitempty"`
+}
+
+type jsonForecast struct {
+	Id    string `json:"id"`
+	Title string `json:"title"`
+	Kind  string `json:"kind"`
+	// Language of the texts, fr or en
+	Lang      string        `json:"lang"`
+	Issued    *time.Time    `json:"issued,omitempty"`
+	Expires   *time.Time    `json:"expires,omitempty"`
+	Units     *jsonUnits    `json:"units,omitempty"`
+	Intro     string        `json:"intro"`
+	Special   string        `json:"special,omitempty"`
+	BMS       *jsonBMS      `json:"bms,omitempty"`
+	Sections  []jsonSection `json:"sections"`
+	Tides     *TideDay      `json:"tides,omitempty"`
+	Ephemeris *Ephemeris    `json:"ephemeris,omitempty"`
+	// Latest observation of the area station
+	Observation *Observation `json:"observation,omitempty"`
+}
+
+// formatJSON renders f as structured JSON, with the units of its texts, wind
+// speeds and distances converted to units, and the area almanac. Texts are
+// translated to English if lang is "en", while measures are still extracted
+// from the French ones.
+func formatJSON(f Forecast, lang string, units Units, almanac Almanac) (
+	[]byte, error) {
+
+	translate := func(s string) string {
+		if lang == "en" {
+			return translateText(s)
+		}
+		return s
+	}
+	intro, sections := forecastParts(f)
+	out := jsonForecast{
+		Id:          f.Id,
+		Title:       translate(f.Title),
+		Kind:        string(areaKind(f.Id)),
+		Lang:        lang,
+		Intro:       translate(intro),
+		Special:     translate(f.Special),
+		Sections:    []jsonSection{},
+		Tides:       almanac.Tides,
+		Ephemeris:   almanac.Ephemeris,
+		Observation: almanac.Observation,
+	}
+	// Timestamps carry the local offset, for clients displaying them as is
+	if !f.Issued.IsZero() {
+		issued := f.Issued.In(localZone)
+		out.Issued = &issued
+	}
+	if !f.Expires.IsZero() {
+		expires := f.Expires.In(localZone)
+		out.Expires = &expires
+	}
+	if u := f.SourceUnits; u != (meteofrance.Units{}) {
+		out.Units = &jsonUnits{u.Wind, u.Sea, u.Visibility, translate(u.Text)}
+	}
+	if out.Observation != nil {
+		obs := *out.Observation
+		obs.Time = obs.Time.In(localZone)
+		out.Observation = &obs
+	}
+	if b := parseBMS(f.Special); b != nil {
+		out.BMS = &jsonBMS{b.Number, b.Level, translate(b.Text)}
+	}
+	for _, s := range sections {
+		out.Sections = append(out.Sections, jsonSection{translate(s.Title),
+			translate(s.Text), convertMeasures(s.Text, f.SourceUnits, units)})
+	}
+	return json.MarshalIndent(&out, "", "  ")
+}
+
+// formatForecastPage renders f as an HTML page in lang with t, with its
+// special bulletin highlighted, a section per échéance and the area almanac.
+// If stale is not zero, f was fetched then and upstream is unreachable.
+func formatForecastPage(t *template.Template, f Forecast, lang string,
+	archived bool, image string, almanac Almanac, stale time.Time) ([]byte,
+	error) {
+
+	intro, sections := forecastParts(f)
+	bms := parseBMS(f.Special)
+	description := intro
+	if bms != nil {
+		description = bms.Text
+	} else if len(sections) > 0 {
+		description = sections[0].Title + ": " + sections[0].Text
+	}
+	meta, err := renderMeta(PageMeta{
+		Title:       f.Title,
+		Description: description,
+		Image:       image,
+		Updated:     f.Issued,
+	})
+	if err != nil {
+		return nil, err
+	}
+	data := struct {
+		Meta        template.HTML
+		Lang        string
+		Id          string
+		Title       string
+		Issued      time.Time
+		Expires     time.Time
+		BMS         *BMS
+		Intro       string
+		Sections    []ForecastSection
+		Archived    bool
+		Tides       *TideDay
+		Ephemeris   *Ephemeris
+		Observation *Observation
+		// Time of the last successful fetch when upstream is unreachable
+		Stale time.Time
+	}{
+		Meta:        meta,
+		Lang:        lang,
+		Id:          f.Id,
+		Title:       f.Title,
+		Issued:      f.Issued,
+		Expires:     f.Expires,
+		BMS:         bms,
+		Intro:       intro,
+		Sections:    sections,
+		Archived:    archived,
+		Tides:       almanac.Tides,
+		Ephemeris:   almanac.Ephemeris,
+		Observation: almanac.Observation,
+	}
+	if !stale.IsZero() {
+		data.Stale = stale.In(localZone)
+	}
+	w := &bytes.Buffer{}
+	err = t.Execute(w, &data)
+	return w.Bytes(), err
+}
+
+var (
+	// Supported output formats and their media types
+	formatTypes = map[string]string{
+		"text":     "text/plain;charset=utf-8",
+		"html":     "text/html;charset=utf-8",
+		"markdown": "text/markdown;charset=utf-8",
+		"json":     "application/json",
+	}
+	mediaFormats = map[string]string{
+		"text/plain":       "text",
+		"text/*":           "text",
+		"*/*":              "text",
+		"text/html":        "html",
+		"text/markdown":    "markdown",
+		"application/json": "json",
+	}
+)
+
+// negotiateFormat returns the output format requested by the "format" query
+// parameter or the Accept header. It defaults to text.
+func negotiateFormat(req *http.Request) (string, error) {
+	if format := req.URL.Query().Get("format"); format != "" {
+		if _, ok := formatTypes[format]; !ok {
+			return "", fmt.Errorf("unknown format: %q", format)
+		}
+		return format, nil
+	}
+	accept := req.Header.Get("Accept")
+	if accept == "" {
+		return "text", nil
+	}
+	type candidate struct {
+		format string
+		q      float64
+	}
+	candidates := []candidate{}
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		media := strings.ToLower(strings.TrimSpace(params[0]))
+		q := 1.0
+		for _, p := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+			if len(kv) == 2 && kv[0] == "q" {
+				if v, err := strconv.ParseFloat(kv[1], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		format, ok := mediaFormats[media]
+		if !ok || q <= 0 {
+			continue
+		}
+		// Prefer explicit types over wildcards of the same quality
+		if strings.HasSuffix(media, "*") {
+			q -= 0.0001
+		}
+		candidates = append(candidates, candidate{format, q})
+	}
+	if len(candidates) == 0 {
+		return "", fmt.Errorf("no acceptable format in %q", accept)
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].q > candidates[j].q
+	})
+	return candidates[0].format, nil
+}
+
+// formatForecast renders f in format, one of formatTypes keys, and in lang,
+// "fr" or "en". The almanac is added to HTML and JSON renderings, and HTML
+// ones warn about stale forecasts.
+func formatForecast(t *template.Template, f Forecast, format, lang string,
+	archived bool, units Units, almanac Almanac, stale time.Time) ([]byte,
+	error) {
+
+	if format == "json" {
+		return formatJSON(f, lang, units, almanac)
+	}
+	if lang == "en" {
+		f = translateForecast(f)
+	}
+	switch format {
+	case "html":
+		return formatForecastPage(t, f, lang, archived, *serveImage, almanac,
+			stale)
+	case "markdown":
+		return []byte(formatMarkdown(f)), nil
+	}
+	return []byte(f.Content), nil
+}
+
+// renderKey identifies the rendering of f by formatForecast with the other
+// arguments. Almanacs are identified by their days and observation time.
+func renderKey(f Forecast, format, lang string, archived bool, units Units,
+	almanac Almanac, stale time.Time) string {
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%d\x00%d\x00%s\x00%s\x00%t\x00%s\x00%s\x00%d\x00",
+		hashReport(f.Content), f.Issued.Unix(), f.Expires.Unix(), format, lang,
+		archived, units.Wind, units.Distance, stale.Unix())
+	if almanac.Tides != nil {
+		fmt.Fprintf(h, "tides\x00%s\x00", almanac.Tides.Date)
+	}
+	if almanac.Ephemeris != nil {
+		fmt.Fprintf(h, "ephemeris\x00%s\x00", almanac.Ephemeris.Date)
+	}
+	if almanac.Observation != nil {
+		fmt.Fprintf(h, "observation\x00%d\x00", almanac.Observation.Time.Unix())
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// serveForecast serves the forecast of area id in format, with cache
+// validators, in the language negotiated by requestLanguage.
+func serveForecast(cache *ForecastCache, t *template.Template, id, format string,
+	archived bool, w http.ResponseWriter, req *http.Request) {
+
+	if _, ok := formatTypes[format]; !ok {
+		format = "text"
+	}
+	units, err := parseUnits(req)
+	var lang string
+	if err == nil {
+		lang, err = requestLanguage(req)
+	}
+	if err != nil {
+		w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "error: %s\n", err)
+		return
+	}
+	forecast, err := findForecast(req.Context(), cache, id)
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	stale := writeStaleHeader(w, cache)
+	almanac := areaAlmanac(forecast.Id, time.Now())
+	key := renderKey(forecast, format, lang, archived, units, almanac, stale)
+	data, etag, ok := cache.Rendered().Get(forecast.Id, key)
+	if !ok {
+		data, err = formatForecast(t, forecast, format, lang, archived, units,
+			almanac, stale)
+		if err != nil {
+			writeError(w, req, err)
+			return
+		}
+		etag = cache.Rendered().Put(forecast.Id, key, data)
+	}
+	w.Header().Set("Content-Type", formatTypes[format])
+	w.Header().Set("Content-Language", lang)
+	w.Header().Set("Vary", "Accept, Accept-Language")
+	modified := lastModified(cache, []Forecast{forecast})
+	if writeCacheHeaders(w, req, etag, modified, cacheMaxAge(cache)) {
+		return
+	}
+	w.Write(data)
+}
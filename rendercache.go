@@ -0,0 +1,69 @@
+package main
+
+import (
+	"sync"
+)
+
+const (
+	// Maximum number of renderings kept per area, beyond which the area ones
+	// are dropped, as almanac days and stale times keep adding keys
+	maxRenderedPerArea = 64
+)
+
+// renderedPage is a forecast rendering and its ETag.
+type renderedPage struct {
+	data []byte
+	etag string
+}
+
+// RenderCache keeps area forecast renderings, keyed by the hash of the
+// forecast content and the rendering parameters, so serving unchanged
+// bulletins does not execute templates again. Area renderings are dropped
+// when its forecast changes.
+type RenderCache struct {
+	lock  sync.Mutex
+	areas map[string]map[string]renderedPage
+}
+
+// NewRenderCache returns an empty render cache.
+func NewRenderCache() *RenderCache {
+	return &RenderCache{
+		areas: map[string]map[string]renderedPage{},
+	}
+}
+
+// Get returns the rendering of area for key, its ETag, and false if it is not
+// cached.
+func (c *RenderCache) Get(area, key string) ([]byte, string, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	page, ok := c.areas[area][key]
+	return page.data, page.etag, ok
+}
+
+// Put caches data, rendered for area with key, and returns its ETag.
+func (c *RenderCache) Put(area, key string, data []byte) string {
+	etag := hashReport(string(data))
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	pages := c.areas[area]
+	if pages == nil || len(pages) >= maxRenderedPerArea {
+		pages = map[string]renderedPage{}
+		c.areas[area] = pages
+	}
+	pages[key] = renderedPage{data, etag}
+	return etag
+}
+
+// Listen is a forecast listener dropping the renderings of changed areas.
+func (c *RenderCache) Listen(previous, current []Forecast) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if previous == nil {
+		c.areas = map[string]map[string]renderedPage{}
+		return
+	}
+	for _, f := range changedForecasts(previous, current) {
+		delete(c.areas, f.Id)
+	}
+}
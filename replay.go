@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/pmezard/metmar/meteofrance"
+)
+
+var (
+	sourceDir = app.Flag("source",
+		"load upstream responses recorded in this directory instead of fetching them").
+		String()
+)
+
+// loadReports returns the reports of area recorded in dir, from AREA.json or
+// the latest AREA_TIME.json file.
+func loadReports(dir string, area string) ([]*meteofrance.Report, error) {
+	name := area
+	paths, err := filepath.Glob(filepath.Join(dir, name+"_*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	path := filepath.Join(dir, name+".json")
+	if len(paths) > 0 {
+		path = paths[len(paths)-1]
+	}
+	fp, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("no recorded response for area %s in %s",
+				area, dir)
+		}
+		return nil, err
+	}
+	defer fp.Close()
+	reports, err := meteofrance.DecodeReports(fp)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode %s: %s", path, err)
+	}
+	return reports, nil
+}
+
+// fetchReports returns area reports from upstream, or from --source.
+// Upstream responses are saved in --record before being decoded, so parsing
+// failures can be investigated.
+func fetchReports(ctx context.Context, area upstreamArea) (
+	[]*meteofrance.Report, error) {
+
+	if *sourceDir != "" {
+		return loadReports(*sourceDir, area.Id)
+	}
+	data, modified, err := upstreamClient.FetchKindModified(ctx, area.Kind,
+		area.Number)
+	if err != nil {
+		return nil, kindError(ErrUpstream, err)
+	}
+	// Responses revalidated with 304 were already recorded
+	if *recordDir != "" && modified {
+		err := recordResponse(*recordDir, area.Id, area.URL(), data,
+			time.Now())
+		if err != nil {
+			ctxLogger(ctx).Error("recording area", "area", area.Id,
+				"error", err)
+		}
+	}
+	reports, err := meteofrance.DecodeReports(bytes.NewReader(data))
+	return reports, kindError(ErrParse, err)
+}
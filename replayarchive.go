@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	replayCmd = app.Command("replay",
+		"serve and notify archived bulletins as if time were passing, faster")
+	replayArchive = replayCmd.Flag("archive",
+		"archive directory").Required().String()
+	replaySpeed = replayCmd.Flag("speed",
+		"replay speed, like 60x for an hour per minute").Default("60x").String()
+	replayFrom = replayCmd.Flag("from",
+		"replay start day, like 2023-11-01, the first revision by default").
+		String()
+	replayTo = replayCmd.Flag("to",
+		"replay last day, the last revision by default").String()
+	replayHttp = replayCmd.Flag("http",
+		"HTTP host:port serving replayed bulletins, empty to disable").
+		Default(":5000").String()
+	replayWebhooks = replayCmd.Flag("webhook",
+		"URL receiving replayed gale warnings as JSON, can be repeated").Strings()
+	replayExec = replayCmd.Flag("exec",
+		"shell command receiving every replayed bulletin on stdin, with METMAR_AREA and METMAR_TITLE set").
+		String()
+)
+
+// parseSpeed parses replay speeds like "60x" or "60".
+func parseSpeed(s string) (float64, error) {
+	speed, err := strconv.ParseFloat(strings.TrimSuffix(s, "x"), 64)
+	if err != nil || speed <= 0 || math.IsInf(speed, 0) {
+		return 0, fmt.Errorf("invalid speed: %q", s)
+	}
+	return speed, nil
+}
+
+// archivedSpecial returns the paragraph of an archived bulletin holding its
+// special bulletin, if any.
+func archivedSpecial(content string) string {
+	for _, para := range strings.Split(content, "\n\n") {
+		for _, line := range strings.Split(para, "\n") {
+			if reWarning.MatchString(line) {
+				return strings.TrimSpace(para)
+			}
+		}
+	}
+	return ""
+}
+
+// replayStep is a set of revisions to replay at the same time.
+type replayStep struct {
+	Time      time.Time
+	Forecasts []Forecast
+}
+
+// loadReplay returns the latest revision of every area archived before from,
+// then revisions archived in [from, to), in chronological order. Zero bounds
+// default to the first and last revisions.
+func loadReplay(archive *Archive, from, to time.Time) ([]replayStep, error) {
+	revisions := []Revision{}
+	for _, area := range archive.Areas() {
+		revisions = append(revisions, archive.Revisions(area)...)
+	}
+	sortRevisions(revisions)
+	if len(revisions) == 0 {
+		return nil, fmt.Errorf("archive is empty")
+	}
+	if from.IsZero() {
+		from = revisions[0].Time
+	}
+	initial := map[string]Revision{}
+	steps := []replayStep{}
+	for _, rev := range revisions {
+		if !to.IsZero() && !rev.Time.Before(to) {
+			break
+		}
+		if rev.Time.Before(from) {
+			initial[rev.Area] = rev
+			continue
+		}
+		if len(steps) == 0 || !steps[len(steps)-1].Time.Equal(rev.Time) {
+			steps = append(steps, replayStep{Time: rev.Time})
+		}
+		f, err := archivedForecast(archive, rev)
+		if err != nil {
+			return nil, err
+		}
+		last := &steps[len(steps)-1]
+		last.Forecasts = append(last.Forecasts, f)
+	}
+	first := replayStep{Time: from}
+	areas := []string{}
+	for area := range initial {
+		areas = append(areas, area)
+	}
+	sort.Strings(areas)
+	for _, area := range areas {
+		f, err := archivedForecast(archive, initial[area])
+		if err != nil {
+			return nil, err
+		}
+		first.Forecasts = append(first.Forecasts, f)
+	}
+	return append([]replayStep{first}, steps...), nil
+}
+
+// archivedForecast returns the forecast archived as rev.
+func archivedForecast(archive *Archive, rev Revision) (Forecast, error) {
+	content, err := archive.Read(rev)
+	if err != nil {
+		return Forecast{}, err
+	}
+	return Forecast{
+		Id:      rev.Area,
+		Title:   bulletinTitle(content),
+		Content: content,
+		Special: archivedSpecial(content),
+		Issued:  rev.Time,
+	}, nil
+}
+
+// replayClock maps real time to replayed time, passing speed times faster
+// from origin.
+type replayClock struct {
+	lock   sync.Mutex
+	start  time.Time
+	origin time.Time
+	speed  float64
+	done   bool
+}
+
+func (c *replayClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	elapsed := float64(time.Since(c.start)) * c.speed
+	return c.origin.Add(time.Duration(elapsed))
+}
+
+// Wait returns when replayed time reaches t, or ctx is done.
+func (c *replayClock) Wait(ctx context.Context, t time.Time) error {
+	delay := time.Duration(float64(t.Sub(c.Now())) / c.speed)
+	if delay <= 0 {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(delay):
+		return nil
+	}
+}
+
+// replay feeds steps into cache at their replayed time, and outputs every
+// changed bulletin.
+func replay(ctx context.Context, cache *ForecastCache, clock *replayClock,
+	steps []replayStep, command string) error {
+
+	for _, step := range steps {
+		err := clock.Wait(ctx, step.Time)
+		if err != nil {
+			return err
+		}
+		cache.Ingest(step.Forecasts)
+		fmt.Printf("replaying %s\n", step.Time.Format("2006-01-02 15:04"))
+		for _, f := range step.Forecasts {
+			err := outputBulletin(f, command)
+			if err != nil {
+				slog.Error("outputting bulletin", "area", f.Id, "error", err)
+			}
+		}
+	}
+	clock.lock.Lock()
+	clock.done = true
+	clock.lock.Unlock()
+	fmt.Printf("replay finished\n")
+	return nil
+}
+
+// serveReplayStatus returns the replayed time as JSON.
+func serveReplayStatus(clock *replayClock, w http.ResponseWriter,
+	req *http.Request) {
+
+	now := clock.Now()
+	clock.lock.Lock()
+	done := clock.done
+	clock.lock.Unlock()
+	writeJSON(w, map[string]interface{}{
+		"time":  now,
+		"speed": clock.speed,
+		"done":  done,
+	})
+}
+
+func replayFn() error {
+	speed, err := parseSpeed(*replaySpeed)
+	if err != nil {
+		return err
+	}
+	from, err := parseSearchDate(*replayFrom)
+	if err != nil {
+		return err
+	}
+	to, err := parseSearchDate(*replayTo)
+	if err != nil {
+		return err
+	}
+	if !to.IsZero() {
+		to = to.AddDate(0, 0, 1)
+	}
+	archive, err := OpenArchive(*replayArchive)
+	if err != nil {
+		return err
+	}
+	steps, err := loadReplay(archive, from, to)
+	if err != nil {
+		return err
+	}
+	ctx, stop := signalContext()
+	defer stop()
+	bandwidth, err := NewBandwidth("", 0)
+	if err != nil {
+		return err
+	}
+	// Ingested forecasts only, nothing is fetched
+	cache := NewForecastCache(ctx, nil, 0, 0, bandwidth)
+	cache.ingestOnly = true
+	cache.Ingest(steps[0].Forecasts)
+	if len(*replayWebhooks) > 0 {
+		notifiers := []Notifier{}
+		for _, url := range *replayWebhooks {
+			notifiers = append(notifiers, NewWebhookNotifier(url))
+		}
+		dispatcher := NewDispatcher(notifiers, 0, nil)
+		cache.Listen(dispatcher.Listen)
+	}
+	clock := &replayClock{
+		start:  time.Now(),
+		origin: steps[0].Time,
+		speed:  speed,
+	}
+	if *replayHttp == "" {
+		return replay(ctx, cache, clock, steps, *replayExec)
+	}
+	go func() {
+		err := replay(ctx, cache, clock, steps, *replayExec)
+		if err != nil && ctx.Err() == nil {
+			slog.Error("replaying", "error", err)
+		}
+	}()
+	t, source, err := loadTemplate("", "index.html")
+	if err != nil {
+		return err
+	}
+	areaTmpl, _, err := loadTemplate("", "area.html")
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	index := NewAreasIndex(t, source, cache, "")
+	handleFunc(mux, "/", statusTimeout, func(w http.ResponseWriter, req *http.Request) {
+		serveAreas(index, 0, w, req)
+	})
+	handleFunc(mux, "/areas/", statusTimeout, func(w http.ResponseWriter, req *http.Request) {
+		serveArea(cache, nil, nil, areaTmpl, "", w, req)
+	})
+	handleFunc(mux, "/replay", statusTimeout, func(w http.ResponseWriter, req *http.Request) {
+		serveReplayStatus(clock, w, req)
+	})
+	slog.Info("serving", "addr", *replayHttp)
+	return runServer(ctx, *replayHttp, requestIDHandler(recoverHandler(mux)),
+		5*time.Second, nil)
+}
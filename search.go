@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// accentFolder removes French diacritics so "tempete" finds "tempête"
+	accentFolder = strings.NewReplacer(
+		"à", "a", "â", "a", "ä", "a", "ç", "c", "é", "e", "è", "e", "ê", "e",
+		"ë", "e", "î", "i", "ï", "i", "ô", "o", "ö", "o", "ù", "u", "û", "u",
+		"ü", "u", "ÿ", "y", "œ", "oe", "æ", "ae")
+)
+
+// foldText lower cases text and removes its accents.
+func foldText(text string) string {
+	return accentFolder.Replace(strings.ToLower(text))
+}
+
+// parseSearchTerms splits q into folded terms. Double quoted phrases are kept
+// as single terms.
+func parseSearchTerms(q string) []string {
+	terms := []string{}
+	for i, part := range strings.Split(q, `"`) {
+		if i%2 == 1 {
+			if phrase := strings.Join(strings.Fields(part), " "); phrase != "" {
+				terms = append(terms, foldText(phrase))
+			}
+			continue
+		}
+		for _, word := range strings.Fields(part) {
+			terms = append(terms, foldText(word))
+		}
+	}
+	return terms
+}
+
+// SearchQuery selects archived revisions containing every term.
+type SearchQuery struct {
+	Terms []string
+	// Area identifier, or part of the area bulletin title, all areas if empty
+	Area string
+	// Revisions archived in [From, To), unbounded if zero
+	From time.Time
+	To   time.Time
+	// Maximum number of results, most recent first
+	Limit int
+}
+
+// SearchResult is a revision matching a search.
+type SearchResult struct {
+	Area  string    `json:"area"`
+	Id    string    `json:"id"`
+	Time  time.Time `json:"time"`
+	Title string    `json:"title"`
+	// Lines containing the terms
+	Excerpt string `json:"excerpt"`
+	URL     string `json:"url"`
+}
+
+// matchArea tells whether a revision of area titled title is selected by the
+// query area filter.
+func (q SearchQuery) matchArea(area, title string) bool {
+	if q.Area == "" || q.Area == area {
+		return true
+	}
+	return strings.Contains(foldText(title), foldText(q.Area))
+}
+
+// searchExcerpt returns the lines of content containing terms.
+func searchExcerpt(content string, terms []string) string {
+	lines := []string{}
+	for _, line := range strings.Split(content, "\n") {
+		folded := foldText(line)
+		for _, term := range terms {
+			if strings.Contains(folded, term) {
+				lines = append(lines, strings.TrimSpace(line))
+				break
+			}
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Search returns revisions matching q, most recent first. Revisions are read
+// from disk, so date and area filters speed searches up.
+func (a *Archive) Search(q SearchQuery) ([]SearchResult, error) {
+	if len(q.Terms) == 0 {
+		return nil, fmt.Errorf("empty search")
+	}
+	areas := a.Areas()
+	for _, area := range areas {
+		if area == q.Area {
+			areas = []string{area}
+			break
+		}
+	}
+	candidates := []Revision{}
+	for _, area := range areas {
+		for _, rev := range a.Revisions(area) {
+			if (!q.From.IsZero() && rev.Time.Before(q.From)) ||
+				(!q.To.IsZero() && !rev.Time.Before(q.To)) {
+				continue
+			}
+			candidates = append(candidates, rev)
+		}
+	}
+	sortRevisions(candidates)
+	results := []SearchResult{}
+	for i := len(candidates) - 1; i >= 0; i-- {
+		if q.Limit > 0 && len(results) >= q.Limit {
+			break
+		}
+		rev := candidates[i]
+		content, err := a.Read(rev)
+		if err != nil {
+			return nil, err
+		}
+		title := bulletinTitle(content)
+		if !q.matchArea(rev.Area, title) {
+			continue
+		}
+		folded := foldText(content)
+		matched := true
+		for _, term := range q.Terms {
+			if !strings.Contains(folded, term) {
+				matched = false
+				break
+			}
+		}
+		if !matched {
+			continue
+		}
+		results = append(results, SearchResult{
+			Area:    rev.Area,
+			Id:      rev.Id(),
+			Time:    rev.Time,
+			Title:   title,
+			Excerpt: searchExcerpt(content, q.Terms),
+		})
+	}
+	return results, nil
+}
+
+// parseSearchDate parses YYYY-MM-DD dates, starting at midnight in the
+// --timezone zone, or returns the zero time if s is empty.
+func parseSearchDate(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", s, localZone)
+	if err != nil {
+		return t, fmt.Errorf("invalid date, expected YYYY-MM-DD: %q", s)
+	}
+	return t, nil
+}
+
+// newSearchQuery returns the query of folded terms in area between from and
+// to inclusive dates.
+func newSearchQuery(terms []string, area, from, to string, limit int) (
+	SearchQuery, error) {
+
+	query := SearchQuery{
+		Terms: terms,
+		Area:  strings.TrimSpace(area),
+		Limit: limit,
+	}
+	var err error
+	query.From, err = parseSearchDate(from)
+	if err != nil {
+		return query, err
+	}
+	query.To, err = parseSearchDate(to)
+	if err != nil {
+		return query, err
+	}
+	if !query.To.IsZero() {
+		query.To = query.To.AddDate(0, 0, 1)
+	}
+	if len(query.Terms) == 0 {
+		return query, fmt.Errorf("empty search")
+	}
+	return query, nil
+}
+
+// formatSearchResults renders results as text, one block per revision.
+func formatSearchResults(results []SearchResult) string {
+	w := &strings.Builder{}
+	for _, r := range results {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", r.Area, r.Time.Format("2006-01-02 15:04"),
+			r.Title)
+		if r.URL != "" {
+			fmt.Fprintf(w, "%s\n", r.URL)
+		}
+		for _, line := range strings.Split(r.Excerpt, "\n") {
+			fmt.Fprintf(w, "  %s\n", line)
+		}
+		w.WriteString("\n")
+	}
+	return w.String()
+}
+
+// serveSearch searches archive with the q, area, from, to and limit query
+// parameters, and returns results as text or JSON.
+func serveSearch(archive *Archive, baseURL, prefix string,
+	w http.ResponseWriter, req *http.Request) {
+
+	values := req.URL.Query()
+	limit := 50
+	var err error
+	if s := values.Get("limit"); s != "" {
+		limit, err = strconv.Atoi(s)
+		if err == nil && (limit <= 0 || limit > 1000) {
+			err = fmt.Errorf("limit must be between 1 and 1000")
+		}
+	}
+	var q SearchQuery
+	if err == nil {
+		q, err = newSearchQuery(parseSearchTerms(values.Get("q")),
+			values.Get("area"), values.Get("from"), values.Get("to"), limit)
+	}
+	if err != nil {
+		w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+		w.WriteHeader(400)
+		fmt.Fprintf(w, "error: %s\n", err)
+		return
+	}
+	results, err := archive.Search(q)
+	if err != nil {
+		w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "error: %s\n", err)
+		return
+	}
+	for i, r := range results {
+		results[i].URL = baseURL + revisionPath(prefix, Revision{
+			Area: r.Area,
+			Time: r.Time,
+		})
+	}
+	format, _ := negotiateFormat(req)
+	if format == "json" {
+		writeJSON(w, results)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+	w.Write([]byte(formatSearchResults(results)))
+}
+
+var (
+	searchCmd = app.Command("search",
+		"search archived bulletins containing every term")
+	searchArchive = searchCmd.Flag("archive",
+		"archive directory").Required().String()
+	searchArea = searchCmd.Flag("area",
+		"area identifier or part of its bulletin title").String()
+	searchFrom = searchCmd.Flag("from",
+		"only search revisions archived on or after this day, like 2023-11-01").
+		String()
+	searchTo = searchCmd.Flag("to",
+		"only search revisions archived on or before this day").String()
+	searchLimit = searchCmd.Flag("limit",
+		"maximum number of results, zero for all").Default("50").Int()
+	searchJSON  = searchCmd.Flag("json", "print results as JSON").Bool()
+	searchTerms = searchCmd.Arg("terms", "search terms").Required().Strings()
+)
+
+func searchFn() error {
+	archive, err := OpenArchive(*searchArchive)
+	if err != nil {
+		return err
+	}
+	// Arguments are terms or phrases, already split by the shell
+	terms := []string{}
+	for _, arg := range *searchTerms {
+		if phrase := strings.Join(strings.Fields(arg), " "); phrase != "" {
+			terms = append(terms, foldText(phrase))
+		}
+	}
+	q, err := newSearchQuery(terms, *searchArea, *searchFrom, *searchTo,
+		*searchLimit)
+	if err != nil {
+		return err
+	}
+	results, err := archive.Search(q)
+	if err != nil {
+		return err
+	}
+	if *searchJSON {
+		data, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+	fmt.Print(formatSearchResults(results))
+	return nil
+}
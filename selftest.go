@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pmezard/metmar/meteofrance"
+)
+
+const (
+	// Special bulletin number published by the mock upstream
+	mockBMSNumber = 7
+	mockBMSLevel  = "Coup de vent"
+)
+
+// MockUpstream serves synthetic bulletins of every area at /AREA, in the
+// Meteo France format. Every Publish starts a new edition, and area 1 carries
+// a special bulletin from the second one on.
+type MockUpstream struct {
+	lock     sync.Mutex
+	edition  int
+	requests int
+}
+
+// Publish starts a new edition of every bulletin.
+func (m *MockUpstream) Publish() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.edition++
+}
+
+// Requests returns the number of bulletins served.
+func (m *MockUpstream) Requests() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.requests
+}
+
+func (m *MockUpstream) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	area, err := strconv.Atoi(strings.Trim(req.URL.Path, "/"))
+	if err != nil || area < 1 || area > meteofrance.Areas {
+		http.NotFound(w, req)
+		return
+	}
+	m.lock.Lock()
+	m.requests++
+	edition := m.edition
+	m.lock.Unlock()
+	data, err := json.Marshal(mockReports(area, edition, time.Now()))
+	if err != nil {
+		writeError(w, req, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// mockReports returns the offshore and coastal reports of the edition of an
+// area bulletin produced at now.
+func mockReports(area, edition int, now time.Time) []*meteofrance.Report {
+	now = now.UTC()
+	coastal := &meteofrance.Report{
+		Title:    fmt.Sprintf("Bulletin côte zone %d", area),
+		Header:   fmt.Sprintf("<p>Bulletin de test numéro %d.</p>", edition),
+		Footer:   "<p>Prochain bulletin dans une heure.</p>",
+		Produced: now.Format("2006-01-02 15:04:05"),
+		Ends:     now.Add(24 * time.Hour).Format("2006-01-02 15:04:05"),
+		Echeances: []meteofrance.Echeance{
+			{
+				Title: "Situation générale",
+				Regions: []meteofrance.Region{{
+					Situation: "Dépression 1005 hPa sur l'Irlande.",
+				}},
+			},
+			{
+				Title: "Prévisions pour aujourd'hui",
+				Regions: []meteofrance.Region{{
+					WindAndSea: "Ouest 5 à 6. Mer agitée.",
+					Swell:      "Houle ouest 2 m.",
+					Visibility: "Bonne.",
+				}},
+			},
+		},
+	}
+	if area == 1 && edition > 1 {
+		coastal.Special = fmt.Sprintf("BMS côte numéro %d. %s de secteur "+
+			"ouest 8.", mockBMSNumber, mockBMSLevel)
+	}
+	offshore := &meteofrance.Report{
+		Title: fmt.Sprintf("Bulletin large zone %d", area),
+	}
+	return []*meteofrance.Report{offshore, coastal}
+}
+
+// selfCheck is a step of the self test, relying on the previous ones unless
+// it is independent.
+type selfCheck struct {
+	Name string
+	Run  func() error
+	// Independent checks run after failures of other independent ones, and
+	// do not skip the next ones when failing
+	Independent bool
+}
+
+// selftestGet returns the body of a successful GET of url.
+func selftestGet(client *http.Client, url, accept string) (string, error) {
+	rq, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+	if accept != "" {
+		rq.Header.Set("Accept", accept)
+	}
+	rsp, err := client.Do(rq)
+	if err != nil {
+		return "", err
+	}
+	defer rsp.Body.Close()
+	data, err := ioutil.ReadAll(rsp.Body)
+	if err != nil {
+		return "", err
+	}
+	if rsp.StatusCode != 200 {
+		return "", fmt.Errorf("got %d fetching %s: %s", rsp.StatusCode, url,
+			strings.TrimSpace(string(data)))
+	}
+	return string(data), nil
+}
+
+// runSelfChecks runs checks in order and prints their results. Checks after
+// the failure of a dependent one are skipped. It returns the first failure.
+func runSelfChecks(checks []selfCheck) error {
+	var failure error
+	blocked := false
+	for _, c := range checks {
+		if blocked {
+			fmt.Printf("%-14s skipped\n", c.Name)
+			continue
+		}
+		start := time.Now()
+		err := c.Run()
+		if err != nil {
+			fmt.Printf("%-14s FAIL: %s\n", c.Name, err)
+			if failure == nil {
+				failure = &Error{
+					Kind: errorKind(err),
+					Err:  fmt.Errorf("%s check failed: %s", c.Name, err),
+				}
+			}
+			blocked = !c.Independent
+			continue
+		}
+		fmt.Printf("%-14s ok (%s)\n", c.Name,
+			time.Since(start).Round(time.Millisecond))
+	}
+	return failure
+}
+
+var (
+	selftestCmd = app.Command("selftest",
+		"check fetching, caching, rendering, feeds and notifications "+
+			"in-process, against a mock upstream")
+	selftestTemplates = selftestCmd.Flag("templates",
+		"directory of index.html and area.html templates to check").String()
+	selftestTimeout = selftestCmd.Flag("timeout",
+		"maximum duration of every request and notification").
+		Default("10s").Duration()
+)
+
+func selftestFn() error {
+	// Everything runs against the mock upstream
+	*sourceDir = ""
+	*recordDir = ""
+	*upstreamHarbors = nil
+	*upstreamBeaches = nil
+	upstream := &MockUpstream{edition: 1}
+	upstreamServer := httptest.NewServer(upstream)
+	defer upstreamServer.Close()
+	upstreamClient.URL = upstreamServer.URL + "/%d"
+
+	events := make(chan GaleEvent, 1)
+	webhook := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, req *http.Request) {
+			ev := GaleEvent{}
+			err := json.NewDecoder(req.Body).Decode(&ev)
+			if err != nil {
+				w.WriteHeader(400)
+				return
+			}
+			select {
+			case events <- ev:
+			default:
+			}
+		}))
+	defer webhook.Close()
+
+	dir, err := ioutil.TempDir("", "metmar-selftest")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	archive, err := OpenArchive(filepath.Join(dir, "archive"))
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	bandwidth, err := NewBandwidth("", 0)
+	if err != nil {
+		return err
+	}
+	upstreamBandwidth = bandwidth
+	source, err := newMeteoFranceSource()
+	if err != nil {
+		return err
+	}
+	cache := NewForecastCache(context.Background(), source, time.Hour, 0,
+		bandwidth)
+	cache.Listen(archive.Listen)
+	dispatcher := NewDispatcher([]Notifier{NewWebhookNotifier(webhook.URL)}, 0,
+		archive)
+	cache.Listen(dispatcher.Listen)
+	client := &http.Client{Timeout: *selftestTimeout}
+
+	var server *httptest.Server
+	defer func() {
+		if server != nil {
+			server.Close()
+		}
+	}()
+	// Serve flags do not apply here, units are explicit
+	query := "?wind=kt&distance=nm"
+	checks := []selfCheck{
+		{Name: "templates", Run: func() error {
+			t, source, err := loadTemplate(*selftestTemplates, "index.html")
+			if err != nil {
+				return kindError(ErrConfig, err)
+			}
+			areaTmpl, _, err := loadTemplate(*selftestTemplates, "area.html")
+			if err != nil {
+				return kindError(ErrConfig, err)
+			}
+			index := NewAreasIndex(t, source, cache, "")
+			mux := http.NewServeMux()
+			mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+				serveAreas(index, 0, w, req)
+			})
+			mux.HandleFunc("/areas/", func(w http.ResponseWriter, req *http.Request) {
+				serveArea(cache, archive, nil, areaTmpl, "", w, req)
+			})
+			server = httptest.NewServer(recoverHandler(mux))
+			return nil
+		}},
+		{Name: "fetch", Run: func() error {
+			forecasts, err := cache.Refresh()
+			if err != nil {
+				return err
+			}
+			if len(forecasts) != meteofrance.Areas {
+				return fmt.Errorf("expected %d forecasts, got %d",
+					meteofrance.Areas, len(forecasts))
+			}
+			for _, f := range forecasts {
+				if len(f.Sections) == 0 || f.Issued.IsZero() {
+					return kindError(ErrParse,
+						fmt.Errorf("area %s bulletin was not parsed", f.Id))
+				}
+			}
+			return nil
+		}},
+		{Name: "cache", Run: func() error {
+			_, err := cache.Get(context.Background())
+			if err != nil {
+				return err
+			}
+			if n := upstream.Requests(); n != meteofrance.Areas {
+				return fmt.Errorf("cached forecasts were fetched again: %d "+
+					"upstream requests", n)
+			}
+			return nil
+		}},
+		{Name: "archive", Run: func() error {
+			for i := 1; i <= meteofrance.Areas; i++ {
+				area := strconv.Itoa(i)
+				if n := len(archive.Revisions(area)); n != 1 {
+					return fmt.Errorf("expected 1 revision of area %s, got %d",
+						area, n)
+				}
+			}
+			return nil
+		}},
+		{Name: "render", Run: func() error {
+			pages := []struct {
+				path, accept, expected string
+			}{
+				{"/", "text/html", "zone 1"},
+				{"/areas/1", "text/html", "Bulletin côte zone 1"},
+				{"/areas/1.txt", "", "Ouest 5 à 6"},
+				{"/areas/1", "application/json", `"Bulletin côte zone 1"`},
+			}
+			for _, p := range pages {
+				body, err := selftestGet(client, server.URL+p.path+query,
+					p.accept)
+				if err != nil {
+					return err
+				}
+				if !strings.Contains(body, p.expected) {
+					return fmt.Errorf("%s (%s) does not contain %q", p.path,
+						p.accept, p.expected)
+				}
+			}
+			return nil
+		}},
+		{Name: "feed", Run: func() error {
+			body, err := selftestGet(client, server.URL+"/areas/1/revisions",
+				"text/html")
+			if err != nil {
+				return err
+			}
+			if n := strings.Count(body, `class="h-entry"`); n != 1 {
+				return fmt.Errorf("expected 1 feed entry, got %d", n)
+			}
+			return nil
+		}},
+		{Name: "notification", Run: func() error {
+			upstream.Publish()
+			_, err := cache.Refresh()
+			if err != nil {
+				return err
+			}
+			select {
+			case ev := <-events:
+				if ev.Area != "1" || ev.Number != mockBMSNumber ||
+					ev.Level != mockBMSLevel {
+					return fmt.Errorf("unexpected gale warning: area %s, "+
+						"number %d, level %q", ev.Area, ev.Number, ev.Level)
+				}
+			case <-time.After(*selftestTimeout):
+				return fmt.Errorf("no gale warning posted after %s",
+					*selftestTimeout)
+			}
+			if n := len(archive.Revisions("1")); n != 2 {
+				return fmt.Errorf("expected 2 revisions of area 1, got %d", n)
+			}
+			return nil
+		}},
+	}
+	return runSelfChecks(checks)
+}
@@ -2,19 +2,20 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"html/template"
-	"io"
+	"io/ioutil"
+	"log/slog"
 	"net/http"
-	"path"
-	"regexp"
-	"strconv"
 	"strings"
+	"sync"
+	"time"
 
-	httpgzip "github.com/daaku/go.httpgzip"
+	"github.com/pmezard/metmar/meteofrance"
 )
 
 func hashReport(report string) string {
@@ -22,256 +23,806 @@ func hashReport(report string) string {
 	return hex.EncodeToString(h[:])
 }
 
-func httpGet(url string, headers map[string]string) (io.ReadCloser, error) {
-	rq, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return nil, err
-	}
-	for k, v := range headers {
-		rq.Header.Set(k, v)
-	}
-	rq.Header.Set("User-Agent", "Mozilla/4.0 (compatible; MSIE 7.0; Windows NT 6.0)")
-	rsp, err := http.DefaultClient.Do(rq)
-	if err != nil {
-		return nil, err
-	}
-	if rsp.StatusCode != http.StatusOK {
-		rsp.Body.Close()
-		return nil, fmt.Errorf("got %d fetching %s", rsp.StatusCode, url)
-	}
-	return rsp.Body, nil
-}
-
-type Region struct {
-	Title       string `json:"titreRegion"`
-	Situation   string
-	Observation string
-	WindAndSea  string `json:"ventEtMer"`
-	Swell       string `json:"houle"`
-	Weather     string `json:"ts"`
-	Visibility  string `json:"visi"`
-}
-
-type Echeance struct {
-	Title   string   `json:"titreEcheance"`
-	Kind    string   `json:"nomEcheance"`
-	Regions []Region `json:"region"`
-}
-
-type Report struct {
-	Title     string     `json:"titreBulletin"`
-	Special   string     `json:"bulletinSpecial"`
-	Header    string     `json:"chapeauBulletin"`
-	Footer    string     `json:"piedBulletin"`
-	Units     string     `json:"uniteBulletin"`
-	Echeances []Echeance `json:"echeance"`
+type Forecast struct {
+	Id    string
+	Title string
+	// Bulletin rendered as text by formatText
+	Content string
+	// Header and footer paragraphs, in plain text
+	Header string
+	Footer string
+	// Special bulletin section, in plain text
+	Special string
+	// Bulletin per échéance, nil when the forecast only has a content, like
+	// ingested ones
+	Sections []ForecastSection
+	// Production time of the bulletin, zero if unknown
+	Issued time.Time
+	// End of the bulletin validity, zero if unknown
+	Expires time.Time
+	// Time the bulletin was last fetched upstream or ingested
+	Fetched time.Time
+	// Units of the bulletin texts, zero if unknown, like for ingested
+	// forecasts
+	SourceUnits meteofrance.Units
+	// Drill is set on synthetic drill bulletins, which are notified and
+	// rendered but never archived, federated or published to MQTT
+	Drill bool
 }
 
-func jsonGet(url string) ([]*Report, error) {
-	headers := map[string]string{}
-	r, err := httpGet(url, headers)
-	if err != nil {
-		return nil, err
+// newForecast converts a Meteo France bulletin to a forecast.
+func newForecast(b *meteofrance.Bulletin) *Forecast {
+	sections := []ForecastSection{}
+	for _, s := range b.Sections {
+		sections = append(sections, ForecastSection{
+			Title: s.Title,
+			Text:  s.Text,
+		})
 	}
-	defer r.Close()
-	reports := []*Report{}
-	err = json.NewDecoder(r).Decode(&reports)
-	return reports, err
-}
-
-type Forecast struct {
-	Id      string
-	Title   string
-	Content string
+	f := &Forecast{
+		Title:       b.Title,
+		Header:      b.Header,
+		Footer:      b.Footer,
+		Special:     b.Special,
+		Sections:    sections,
+		Issued:      b.Issued,
+		Expires:     b.Expires,
+		SourceUnits: b.Units,
+	}
+	f.Content = formatText(f)
+	return f
 }
 
 var (
-	reLines = regexp.MustCompile(`\n+`)
+	// upstreamClient fetches bulletins, accounting bytes in upstreamBandwidth
+	upstreamClient = meteofrance.NewClient(&http.Client{
+		Transport: &countingTransport{},
+	})
 )
 
-func htmlToText(html string) string {
-	s := strings.Replace(html, "<br />", "\n", -1)
-	s = strings.TrimSpace(s)
-	s = reLines.ReplaceAllString(s, "\n")
-	return s
-}
+// fetchForecasts fetches the forecasts of every source area.
+func fetchForecasts(ctx context.Context, source ForecastSource) ([]Forecast,
+	error) {
 
-func formatReport(reports []*Report) (*Forecast, error) {
-	if len(reports) != 2 {
-		return nil, fmt.Errorf("2 reports expected, go %d", len(reports))
-	}
-	// Coastal report
-	r := reports[1]
-	content := []string{}
-	content = append(content, r.Title, "\n\n")
-	content = append(content, htmlToText(r.Header), "\n")
-	content = append(content, htmlToText(r.Footer), "\n\n")
-	content = append(content, htmlToText(r.Special), "\n\n")
-	for _, e := range r.Echeances {
-		content = append(content, "# ", e.Title, "\n\n")
-		for _, a := range e.Regions {
-			parts := []string{
-				a.Situation,
-				a.Observation,
-				a.WindAndSea,
-				a.Swell,
-				a.Weather,
-				a.Visibility,
-			}
-			for _, part := range parts {
-				if part == "" {
-					continue
-				}
-				part = htmlToText(part)
-				part = strings.TrimSpace(part)
-				content = append(content, part, "\n")
-			}
-		}
-		content = append(content, "\n\n")
-	}
-	return &Forecast{
-		Title:   r.Title,
-		Content: strings.Join(content, ""),
-	}, nil
+	return refetchForecasts(ctx, source, nil, nil, 0)
 }
 
-func fetchForecasts() ([]Forecast, error) {
-	urlFmt := "http://www.meteofrance.com/mf3-rpc-portlet/rest/bulletins/cote/%d/bulletinsMarineMetropole"
+// refetchForecasts fetches source forecasts whose area is due according to
+// tracker, reusing previous ones otherwise, and records whether they
+// changed. base is the minimum refresh interval.
+func refetchForecasts(ctx context.Context, source ForecastSource,
+	previous []Forecast, tracker *ChangeTracker, base time.Duration) (
+	[]Forecast, error) {
+
+	cached := map[string]Forecast{}
+	for _, f := range previous {
+		cached[f.Id] = f
+	}
+	now := time.Now()
 	forecasts := []Forecast{}
-	for i := 1; i <= 9; i++ {
-		url := fmt.Sprintf(urlFmt, i)
-		reports, err := jsonGet(url)
-		if err != nil {
+	for _, id := range source.Areas() {
+		prev, ok := cached[id]
+		if ok && !tracker.Due(id, now, base) {
+			forecasts = append(forecasts, prev)
+			continue
+		}
+		name := "area " + id
+		monitor.StartFetch(name)
+		var b *meteofrance.Bulletin
+		err := upstreamBreaker.Allow(now)
+		if err == nil {
+			err = upstreamChaos.Inject(ctx, id)
+			if err == nil {
+				b, err = source.Fetch(ctx, id)
+			}
+			upstreamBreaker.Record(time.Now(), err)
+		}
+		monitor.EndFetch(name, err)
+		if err != nil && ctx.Err() != nil {
+			ctxLogger(ctx).Info("fetching area cancelled", "area", id,
+				"url", source.URL(id), "error", err)
 			return nil, err
 		}
-		forecast, err := formatReport(reports)
 		if err != nil {
+			ctxLogger(ctx).Error("fetching area failed", "area", id,
+				"url", source.URL(id), "error", err)
 			return nil, err
 		}
-		forecast.Id = strconv.FormatInt(int64(i), 10)
+		ctxLogger(ctx).Debug("fetched area", "area", id, "url", source.URL(id))
+		forecast := newForecast(b)
+		forecast.Id = id
+		forecast.Fetched = now
+		tracker.Record(id, ok && prev.Content != forecast.Content, now, base)
 		forecasts = append(forecasts, *forecast)
 	}
 	return forecasts, nil
 }
 
-const (
-	htmlTemplate = `<html>
-<head>
-	<title>Marine weather forecasts in Brest area</title>
-</head>
-<body>
-	{{range .}}
-		<a href="{{.URL}}">{{.Name}}</a><br/>
-	{{end}}
-</body>
-</html>
-`
-)
+// formatDataAge formats the age of fetched data, rounded to the minute.
+func formatDataAge(d time.Duration) string {
+	minutes := int(d.Minutes() + 0.5)
+	if minutes < 60 {
+		return fmt.Sprintf("%d min", minutes)
+	}
+	return fmt.Sprintf("%dh%02d", minutes/60, minutes%60)
+}
+
+// formatAreas renders the index of forecasts with t. Page links end with
+// ext, like ".html" in static sites. If stale is not zero, forecasts were
+// fetched then and upstream is unreachable. Area data ages are computed at
+// now, and left out if it is zero.
+func formatAreas(t *template.Template, forecasts []Forecast,
+	image string, gale bool, ext string, stale, now time.Time) (string, error) {
 
-func formatAreas(t *template.Template, forecasts []Forecast) (string, error) {
 	type Area struct {
 		URL  string
 		Name string
+		// Bulletin issue time, zero if unknown
+		Updated time.Time
+		// Age of the fetched bulletin, empty if unknown
+		Age string
+		// Active special bulletin, nil if none
+		BMS *BMS
 	}
-	data := []Area{}
+	areas := []Area{}
 	for _, forecast := range forecasts {
-		data = append(data, Area{
-			URL:  "areas/" + forecast.Id,
+		area := Area{
+			URL:  "areas/" + forecast.Id + ext,
 			Name: forecast.Title,
-		})
+			BMS:  parseBMS(forecast.Special),
+		}
+		if !forecast.Issued.IsZero() {
+			area.Updated = forecast.Issued.In(localZone)
+		}
+		if !now.IsZero() && !forecast.Fetched.IsZero() {
+			area.Age = formatDataAge(now.Sub(forecast.Fetched))
+		}
+		areas = append(areas, area)
+	}
+	meta, err := renderMeta(PageMeta{
+		Title:       "Marine weather forecasts in Brest area",
+		Description: summarizeSeverity(forecasts),
+		Image:       image,
+		Updated:     latestIssue(forecasts),
+	})
+	if err != nil {
+		return "", err
+	}
+	data := struct {
+		Meta  template.HTML
+		Areas []Area
+		// URL of the special bulletins overview
+		BMS string
+		// The gale chart is served at gale/
+		Gale bool
+		// The areas map is served at map, static sites lack it
+		Map bool
+		// Time of the last successful fetch when upstream is unreachable
+		Stale time.Time
+	}{
+		Meta:  meta,
+		Areas: areas,
+		BMS:   "bms" + ext,
+		Gale:  gale,
+		Map:   ext == "",
+	}
+	if !stale.IsZero() {
+		data.Stale = stale.In(localZone)
 	}
 	w := &bytes.Buffer{}
-	err := t.Execute(w, data)
+	err = t.Execute(w, &data)
 	if err != nil {
 		return "", err
 	}
 	return w.String(), nil
 }
 
-func renderAreas(t *template.Template) (string, error) {
-	forecasts, err := fetchForecasts()
+// hashForecasts returns a hash covering the content of every forecast.
+func hashForecasts(forecasts []Forecast) string {
+	h := sha256.New()
+	for _, f := range forecasts {
+		fmt.Fprintf(h, "%s\x00%s\x00%s\x00", f.Id, f.Title, hashReport(f.Content))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// AreasIndex renders the areas index page and keeps the result until the
+// forecast set changes.
+type AreasIndex struct {
+	lock         sync.Mutex
+	t            *template.Template
+	templateHash string
+	cache        *ForecastCache
+	image        string
+	// gale tells whether the gale chart is served along
+	gale     bool
+	key      string
+	page     string
+	etag     string
+	modified time.Time
+}
+
+// NewAreasIndex returns an index rendered with t, whose source is used to
+// detect template changes. image is the optional preview image URL.
+func NewAreasIndex(t *template.Template, source string, cache *ForecastCache,
+	image string) *AreasIndex {
+
+	return &AreasIndex{
+		t:            t,
+		templateHash: hashReport(source),
+		cache:        cache,
+		image:        image,
+	}
+}
+
+// Render returns the index page, its ETag and modification time,
+// regenerating it only when any forecast changed since last call, or at
+// most every minute to update data ages.
+func (idx *AreasIndex) Render(ctx context.Context) (string, string, time.Time,
+	error) {
+
+	forecasts, err := idx.cache.Get(ctx)
 	if err != nil {
-		return "", err
+		return "", "", time.Time{}, err
+	}
+	stale := idx.cache.Stale()
+	now := time.Now()
+	key := idx.templateHash + hashForecasts(forecasts) + stale.String() +
+		now.Truncate(time.Minute).String()
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	if key == idx.key {
+		return idx.page, idx.etag, idx.modified, nil
+	}
+	page, err := formatAreas(idx.t, forecasts, idx.image, idx.gale, "",
+		stale, now)
+	if err != nil {
+		return "", "", time.Time{}, err
 	}
-	return formatAreas(t, forecasts)
+	idx.key = key
+	idx.page = page
+	idx.etag = hashReport(page)
+	idx.modified = lastModified(idx.cache, forecasts)
+	return idx.page, idx.etag, idx.modified, nil
 }
 
-func serveAreas(t *template.Template, w http.ResponseWriter, req *http.Request) {
-	areas, err := renderAreas(t)
+func serveAreas(idx *AreasIndex, maxAge time.Duration, w http.ResponseWriter,
+	req *http.Request) {
+
+	areas, h, modified, err := idx.Render(req.Context())
 	if err != nil {
-		w.Header().Set("Content-Type", "text/plain;charset=utf-8")
-		w.WriteHeader(500)
-		fmt.Fprintf(w, "error: %s\n", err)
+		writeError(w, req, err)
 		return
 	}
 	w.Header().Set("Content-Type", "text/html;charset=utf-8")
-	h := hashReport(areas)
-	w.Header().Set("ETag", h)
-	etag := req.Header.Get("If-None-Match")
-	if etag == h {
-		w.WriteHeader(304)
+	if !writeStaleHeader(w, idx.cache).IsZero() {
+		maxAge = 0
+	}
+	if writeCacheHeaders(w, req, h, modified, maxAge) {
 		return
 	}
 	fmt.Fprintf(w, "%s", areas)
 }
 
-func renderForecast(id string) (string, error) {
-	forecasts, err := fetchForecasts()
+func findForecast(ctx context.Context, cache *ForecastCache, id string) (
+	Forecast, error) {
+
+	forecasts, err := cache.Get(ctx)
 	if err != nil {
-		return "", err
+		return Forecast{}, err
 	}
-	forecast := Forecast{}
 	for _, f := range forecasts {
 		if f.Id == id {
-			forecast = f
-			break
+			return f, nil
 		}
 	}
-	if forecast.Id == "" {
-		return "", fmt.Errorf("cannot find forecast: %s", id)
-	}
-	return forecast.Content, nil
+	return Forecast{}, notFoundError("cannot find forecast: %s", id)
 }
 
-func serveForecast(w http.ResponseWriter, req *http.Request) {
-	id := path.Base(req.URL.Path)
-	report, err := renderForecast(id)
-	w.Header().Set("Content-Type", "text/plain;charset=utf-8")
-	if err != nil {
-		w.WriteHeader(500)
-		fmt.Fprintf(w, "error: %s\n", err)
+func renderForecast(cache *ForecastCache, id string) (string, error) {
+	forecast, err := findForecast(context.Background(), cache, id)
+	return forecast.Content, err
+}
+
+// serveArea dispatches requests below /areas/ to the forecast, in the
+// negotiated format or as text at /areas/ID.txt, or to its revisions and
+// their JSON Feed. Revisions are only available if archive is not nil, and
+// can be annotated by users if auth is not nil.
+func serveArea(cache *ForecastCache, archive *Archive, auth Authenticator,
+	page *template.Template, baseURL string, w http.ResponseWriter,
+	req *http.Request) {
+
+	prefix := requestPrefix(req)
+	p := strings.TrimPrefix(req.URL.Path, "/areas/")
+	parts := strings.Split(strings.Trim(p, "/"), "/")
+	if len(parts) == 1 {
+		id, format := parts[0], ""
+		if strings.HasSuffix(id, ".txt") {
+			id, format = strings.TrimSuffix(id, ".txt"), "text"
+		} else {
+			var err error
+			format, err = negotiateFormat(req)
+			if err != nil {
+				w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+				w.WriteHeader(406)
+				fmt.Fprintf(w, "error: %s\n", err)
+				return
+			}
+		}
+		serveForecast(cache, page, id, format, archive != nil, w, req)
+		return
+	}
+	area := parts[0]
+	if archive != nil && parts[1] == "diff" && len(parts) == 2 {
+		serveDiff(archive, area, "", w, req)
+		return
+	}
+	if archive != nil && parts[1] == "history" && len(parts) == 2 {
+		serveHistory(archive, area, w, req)
+		return
+	}
+	if archive != nil && parts[1] == "feed.json" && len(parts) == 2 {
+		serveJSONFeed(archive, baseURL, prefix, area, w, req)
+		return
+	}
+	if archive == nil || parts[1] != "revisions" || len(parts) > 4 {
+		writeNotFound(w, req.URL.Path)
 		return
 	}
-	h := hashReport(report)
-	w.Header().Set("ETag", h)
-	etag := req.Header.Get("If-None-Match")
-	if etag == h {
-		w.WriteHeader(304)
+	if len(parts) == 2 {
+		serveRevisions(archive, baseURL, prefix, area, w, req)
 		return
 	}
-	fmt.Fprintf(w, "%s", report)
+	if len(parts) == 4 {
+		switch parts[3] {
+		case "notes":
+			serveNotes(archive, auth, area, parts[2], w, req)
+		case "diff":
+			serveDiff(archive, area, parts[2], w, req)
+		default:
+			writeNotFound(w, req.URL.Path)
+		}
+		return
+	}
+	serveRevision(archive, cache.source, baseURL, prefix, area, parts[2],
+		auth != nil, *notifyWebmentions, w, req)
 }
 
 var (
-	serveCmd    = app.Command("serve", "reformat forecasts and serve them over HTTP")
-	servePrefix = serveCmd.Flag("prefix", "public URL prefix").String()
-	serveHttp   = serveCmd.Flag("http", "HTTP host:port").Default(":5000").String()
+	serveCmd     = app.Command("serve", "reformat forecasts and serve them over HTTP")
+	servePrefix  = serveCmd.Flag("prefix", "public URL prefix").String()
+	serveHttp    = serveCmd.Flag("http", "HTTP host:port").Default(":5000").String()
+	serveRefresh = serveCmd.Flag("refresh",
+		"minimum delay between upstream fetches").Default("0s").Duration()
+	serveQuota = serveCmd.Flag("quota",
+		"monthly upstream download quota, zero to disable").Default("0").Bytes()
+	serveRefreshMax = serveCmd.Flag("refresh-max",
+		"maximum delay between fetches of unchanged areas, zero to fetch all areas every refresh").
+		Default("0s").Duration()
+	serveQuotaRefresh = serveCmd.Flag("quota-refresh",
+		"minimum delay between upstream fetches once the quota is exhausted").
+		Default("1h").Duration()
+	serveBandwidthFile = serveCmd.Flag("bandwidth-file",
+		"file persisting bandwidth counters across restarts").String()
+	serveIndexMaxAge = serveCmd.Flag("index-max-age",
+		"Cache-Control max-age of the areas index").Default("1m").Duration()
+	serveArchive = serveCmd.Flag("archive",
+		"directory archiving every bulletin edition").String()
+	serveGaleDir = serveCmd.Flag("gale-dir",
+		"forecast directory, like --archive, whose gale warnings are charted "+
+			"at /gale/").String()
+	serveGaleIndex = serveCmd.Flag("gale-index",
+		"file saving warnings extracted from --gale-dir, so restarts only "+
+			"parse new or modified forecasts").String()
+	serveGaleScanWorkers = serveCmd.Flag("gale-scan-workers",
+		"number of --gale-dir forecasts parsed in parallel while scanning").
+		Default("8").Int()
+	serveGaleMaxJump = serveCmd.Flag("gale-max-jump",
+		"--gale-dir warning number increase between consecutive forecasts "+
+			"reported as an anomaly beyond, zero to disable").Default("5").Int()
+	serveBaseURL = serveCmd.Flag("base-url",
+		"public scheme and host of the server, like https://example.com").String()
+	serveActivityPub = serveCmd.Flag("activitypub",
+		"directory storing ActivityPub keys and followers, enables area actors").
+		String()
+	serveReadyMaxAge = serveCmd.Flag("ready-max-age",
+		"maximum age of the last successful fetch for /readyz to succeed").
+		Default("1h").Duration()
+	serveIngestToken = serveCmd.Flag("ingest-token",
+		"bearer token enabling bulletin ingestion on POST /ingest").
+		Envar("METMAR_INGEST_TOKEN").String()
+	serveAccessLog = serveCmd.Flag("access-log",
+		"access log format: none, combined or json").Default("combined").
+		Enum("none", "combined", "json")
+	serveShutdownTimeout = serveCmd.Flag("shutdown-timeout",
+		"maximum duration of in-flight requests on shutdown").
+		Default("30s").Duration()
+	serveTimeout = serveCmd.Flag("timeout",
+		"maximum duration of forecast requests, zero to disable").
+		Default("1m").Duration()
+	serveCSP = serveCmd.Flag("csp",
+		"Content-Security-Policy of HTML pages").Default(serveDefaultCSP).String()
+	serveFrameOptions = serveCmd.Flag("frame-options",
+		"X-Frame-Options of HTML pages").Default("DENY").String()
+	serveReferrerPolicy = serveCmd.Flag("referrer-policy",
+		"Referrer-Policy of HTML pages").Default("same-origin").String()
+	serveImage = serveCmd.Flag("preview-image",
+		"absolute URL of the image shown in link previews").String()
+)
+
+const (
+	serveDefaultCSP = "default-src 'none'; style-src 'self' 'unsafe-inline'; img-src 'self'"
+	// statusTimeout bounds requests which do not fetch anything upstream
+	statusTimeout = 5 * time.Second
 )
 
+func serveStatus(cache *ForecastCache, archive *Archive, w http.ResponseWriter,
+	req *http.Request) {
+
+	status := struct {
+		Bandwidth BandwidthStatus `json:"bandwidth"`
+		Refresh   string          `json:"refresh"`
+		Fetched   *time.Time      `json:"fetched,omitempty"`
+		// Fetch and change counts per area
+		Areas map[string]AreaActivityStatus `json:"areas"`
+		// Archive disk space, if guarded
+		Disk *DiskStatus `json:"disk,omitempty"`
+		// Errors reported since startup, by kind
+		Errors map[string]int `json:"errors"`
+		// Upstream circuit breaker, if enabled
+		Breaker *BreakerStatus `json:"breaker,omitempty"`
+	}{
+		Bandwidth: upstreamBandwidth.Status(),
+		Refresh:   cache.Interval().String(),
+		Areas:     cache.tracker.Status(),
+		Disk:      archive.DiskStatus(),
+		Errors:    monitor.ErrorCounts(),
+		Breaker:   upstreamBreaker.Status(),
+	}
+	if fetched := cache.Fetched(); !fetched.IsZero() {
+		status.Fetched = &fetched
+	}
+	data, err := json.MarshalIndent(&status, "", "  ")
+	if err != nil {
+		w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "error: %s\n", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
 func serveFn() error {
 	prefix := *servePrefix
 	addr := *serveHttp
-	t, err := template.New("areas").Parse(htmlTemplate)
+	tlsConf, err := NewTLSConfig(*serveTLSCert, *serveTLSKey, *serveAutocert,
+		*serveAutocertCache, *serveAutocertHTTP)
+	if err != nil {
+		return err
+	}
+	t, source, err := loadTemplate(*serveTemplates, "index.html")
+	if err != nil {
+		return err
+	}
+	areaTmpl, _, err := loadTemplate(*serveTemplates, "area.html")
+	if err != nil {
+		return err
+	}
+	bandwidth, err := NewBandwidth(*serveBandwidthFile, int64(*serveQuota))
+	if err != nil {
+		return err
+	}
+	upstreamBandwidth = bandwidth
+	if *serveAuditLog != "" {
+		auditLog, err = OpenAuditLog(*serveAuditLog)
+		if err != nil {
+			return err
+		}
+		defer auditLog.Close()
+		auditLog.Record(nil, "metmar", "start", *configFile, "")
+	}
+	if len(*serveChaos) > 0 {
+		upstreamChaos, err = NewChaos(*serveChaos, *serveChaosSeed)
+		if err != nil {
+			return kindError(ErrConfig, err)
+		}
+	}
+	encodings, err := parseEncodings(*serveCompression)
+	if err != nil {
+		return kindError(ErrConfig, err)
+	}
+	if *serveBreakerFailures > 0 {
+		upstreamBreaker = NewBreaker(*serveBreakerFailures, *serveBreakerCooldown)
+	}
+	ctx, stop := signalContext()
+	defer stop()
+	upstream, err := newForecastSource()
+	if err != nil {
+		return err
+	}
+	cache := NewForecastCache(ctx, upstream, *serveRefresh, *serveQuotaRefresh,
+		bandwidth)
+	cache.tracker = NewChangeTracker(*serveRefreshMax)
+	baseURL := strings.TrimSuffix(*serveBaseURL, "/")
+	var areaMap AreaMap
+	if *serveAreaMap != "" {
+		areaMap, err = LoadAreaMap(*serveAreaMap)
+		if err != nil {
+			return kindError(ErrConfig, err)
+		}
+	}
+	var archive *Archive
+	if *serveArchive != "" {
+		archive, err = OpenArchive(*serveArchive)
+		if err != nil {
+			return err
+		}
+		archive.MapAreas(areaMap)
+		if *serveArchiveMinFree > 0 {
+			err = archive.GuardDisk(int64(*serveArchiveMinFree), *serveArchivePrune)
+			if err != nil {
+				return err
+			}
+		}
+		cache.Listen(archive.Listen)
+	}
+	notifiers, err := newNotifiers(archive, baseURL+prefix)
+	if err != nil {
+		return err
+	}
+	var activityPub *ActivityPub
+	if *serveActivityPub != "" {
+		if archive == nil || baseURL == "" {
+			return configError("activitypub requires --archive and --base-url")
+		}
+		activityPub, err = OpenActivityPub(*serveActivityPub, baseURL+prefix,
+			archive)
+		if err != nil {
+			return err
+		}
+		err = activityPub.MapAreas(areaMap)
+		if err != nil {
+			return err
+		}
+		notifiers = append(notifiers, activityPub)
+	}
+	authenticators := authChain{}
+	var oidc *OIDC
+	if *serveOIDCIssuer != "" {
+		if baseURL == "" {
+			return configError("oidc requires --base-url")
+		}
+		oidc, err = NewOIDC(ctx, *serveOIDCIssuer, *serveOIDCClientID,
+			*serveOIDCClientSecret, baseURL+prefix, prefix, *serveOIDCUserClaim,
+			*serveOIDCGroupsClaim, *serveSessionKey, *serveSessionLifetime)
+		if err != nil {
+			return err
+		}
+		authenticators = append(authenticators, oidc)
+	}
+	if *serveUsers != "" {
+		users, err := LoadUsers(*serveUsers)
+		if err != nil {
+			return kindError(ErrConfig, err)
+		}
+		authenticators = append(authenticators, users)
+	}
+	var auth Authenticator
+	var userStore *UserStore
+	if len(authenticators) > 0 {
+		auth = authenticators
+		userStore, err = OpenUserStore(*serveUserData)
+		if err != nil {
+			return err
+		}
+		userStore.MapAreas(areaMap)
+		n, err := NewUserNotifier(userStore, *notifyUserNtfy,
+			zoneOrDefault(*notifyQuietZone))
+		if err != nil {
+			return err
+		}
+		notifiers = append(notifiers, n)
+	}
+	siteAuth, err := newSiteAuth(*serveAuthBasic, *serveAuthToken)
 	if err != nil {
 		return err
 	}
+	if siteAuth != nil && auth != nil {
+		// Users may access the site with their own credentials
+		siteAuth = authChain{siteAuth, auth}
+	}
+	if len(notifiers) > 0 {
+		dispatcher := NewDispatcher(notifiers, *notifyRetries, archive)
+		cache.Listen(dispatcher.Listen)
+	}
+	if *serveMQTT != "" {
+		broker, err := parseMQTTBroker(*serveMQTT)
+		if err != nil {
+			return err
+		}
+		// Flags override URL credentials
+		if *serveMQTTUser != "" {
+			broker.User = *serveMQTTUser
+			broker.Password = *serveMQTTPassword
+		}
+		ha := NewHomeAssistant(broker.Client("metmar"), *serveMQTTTopic, *serveMQTTDiscovery)
+		cache.Listen(ha.Listen)
+	}
+	events := NewEventHub()
+	cache.Listen(events.Listen)
+	if *serveRefresh > 0 {
+		go cache.Run()
+	}
+	if *serveTides != "" {
+		tideTable, err = LoadTides(*serveTides,
+			zoneOrDefault(*serveTideZone))
+		if err != nil {
+			return kindError(ErrConfig, err)
+		}
+	}
+	ephemerides, err = NewEphemerides(*serveAreaPositions,
+		zoneOrDefault(*serveEphemerisZone))
+	if err != nil {
+		return kindError(ErrConfig, err)
+	}
+	if *serveObsKey != "" {
+		if len(*serveObsStations) == 0 || *serveObsRefresh <= 0 {
+			return configError("observations require --obs-station and a " +
+				"positive --obs-refresh")
+		}
+		observations, err = NewObservationCache(*serveObsURL, *serveObsKey,
+			*serveObsStations, *serveObsRefresh)
+		if err != nil {
+			return kindError(ErrConfig, err)
+		}
+		go observations.Run(ctx)
+	}
+	clock := NewClockWatcher()
+	clock.Listen(cache.Replan)
+	go clock.Run(ctx, clockCheckPeriod)
+	var limiter *RateLimiter
+	if *serveRateLimit > 0 {
+		if *serveRateInterval <= 0 {
+			return configError("--rate-interval must be positive, got %s",
+				*serveRateInterval)
+		}
+		limiter = NewRateLimiter(*serveRateLimit, *serveRateInterval,
+			*serveRateBurst, *serveTrustProxy)
+	}
 	mux := http.NewServeMux()
-	mux.HandleFunc(prefix+"/", func(w http.ResponseWriter, req *http.Request) {
-		serveAreas(t, w, req)
+	index := NewAreasIndex(t, source, cache, *serveImage)
+	timeout := *serveTimeout
+	if *serveGaleDir != "" {
+		chart, err := ioutil.ReadFile("scripts/main.html")
+		if err != nil {
+			return err
+		}
+		galeIndex, err := NewGaleIndex(*serveGaleDir, *serveGaleIndex,
+			*serveGaleScanWorkers)
+		if err != nil {
+			return err
+		}
+		defer galeIndex.Close()
+		handleGale(mux, "/gale", timeout, galeIndex, chart,
+			*serveImage, galeDefaultCSP, *serveGaleMaxJump)
+		// ServeMux would redirect to /gale/, ignoring the public prefix
+		mux.HandleFunc("/gale", func(w http.ResponseWriter, req *http.Request) {
+			http.Redirect(w, req, requestPrefix(req)+"/gale/",
+				http.StatusMovedPermanently)
+		})
+		index.gale = true
+		anomalyNotifiers := newAnomalyNotifiers()
+		go watchGaleAnomalies(ctx, galeIndex, *serveGaleMaxJump,
+			NewDispatcher(anomalyNotifiers, *notifyRetries, nil),
+			galeAnomalyPeriod)
+	}
+	handleFunc(mux, "/", timeout, limiter.Wrap(func(w http.ResponseWriter, req *http.Request) {
+		serveAreas(index, *serveIndexMaxAge, w, req)
+	}))
+	handleFunc(mux, "/areas/", timeout, limiter.Wrap(func(w http.ResponseWriter, req *http.Request) {
+		serveArea(cache, archive, auth, areaTmpl, baseURL, w, req)
+	}))
+	// The event stream lasts longer than any request timeout
+	mux.HandleFunc("/events", limiter.Wrap(func(w http.ResponseWriter, req *http.Request) {
+		serveEvents(events, w, req)
+	}))
+	handleFunc(mux, "/bms", timeout, limiter.Wrap(func(w http.ResponseWriter, req *http.Request) {
+		serveBMSOverview(cache, w, req)
+	}))
+	handleFunc(mux, "/compare", timeout, limiter.Wrap(func(w http.ResponseWriter, req *http.Request) {
+		serveCompare(cache, w, req)
+	}))
+	handleFunc(mux, "/map", statusTimeout, limiter.Wrap(func(w http.ResponseWriter, req *http.Request) {
+		serveMap(cache, w, req)
+	}))
+	handleFunc(mux, "/api/areas/nearest", statusTimeout, limiter.Wrap(serveNearestArea))
+	handleFunc(mux, "/api/areas.geojson", statusTimeout, limiter.Wrap(serveAreaBoundaries))
+	handleFunc(mux, "/api/manifest", timeout, limiter.Wrap(func(w http.ResponseWriter, req *http.Request) {
+		serveManifest(cache, w, req)
+	}))
+	handleFunc(mux, "/api/bundle.zip", timeout, limiter.Wrap(func(w http.ResponseWriter, req *http.Request) {
+		serveBundle(cache, areaTmpl, w, req)
+	}))
+	if auth != nil {
+		handleFunc(mux, "/me", timeout, limiter.Wrap(func(w http.ResponseWriter, req *http.Request) {
+			serveMe(cache, auth, userStore, w, req)
+		}))
+		handleFunc(mux, "/me/", timeout, limiter.Wrap(func(w http.ResponseWriter, req *http.Request) {
+			serveMe(cache, auth, userStore, w, req)
+		}))
+	}
+	if oidc != nil {
+		handleFunc(mux, "/auth/", timeout, limiter.Wrap(oidc.ServeAuth))
+	}
+	if auth != nil && (len(*serveAdmins) > 0 || len(*serveAdminGroups) > 0) {
+		admins := NewAdmins(*serveAdmins, *serveAdminGroups)
+		admin := func(w http.ResponseWriter, req *http.Request) {
+			serveAdmin(cache, auth, admins, w, req)
+		}
+		// The event stream lasts longer than any request timeout, and
+		// /admin/refresh fetches upstream
+		mux.HandleFunc("/admin/events", admin)
+		handleFunc(mux, "/admin", timeout, admin)
+		handleFunc(mux, "/admin/", timeout, admin)
+	}
+	if archive != nil {
+		handleFunc(mux, "/search", timeout, limiter.Wrap(func(w http.ResponseWriter, req *http.Request) {
+			serveSearch(archive, baseURL, requestPrefix(req), w, req)
+		}))
+		handleFunc(mux, "/sync/", timeout, limiter.Wrap(func(w http.ResponseWriter, req *http.Request) {
+			serveSync(archive, w, req)
+		}))
+		handleFunc(mux, "/sync", timeout, limiter.Wrap(func(w http.ResponseWriter, req *http.Request) {
+			serveSync(archive, w, req)
+		}))
+	}
+	if activityPub != nil {
+		// WebFinger lives at the host root, whatever the prefix
+		handleFunc(mux, "/.well-known/webfinger", statusTimeout,
+			activityPub.ServeWebFinger)
+		handleFunc(mux, "/ap/areas/", statusTimeout,
+			func(w http.ResponseWriter, req *http.Request) {
+				activityPub.ServeActor(w, req)
+			})
+	}
+	handleFunc(mux, "/status", statusTimeout, func(w http.ResponseWriter, req *http.Request) {
+		serveStatus(cache, archive, w, req)
+	})
+	if *serveIngestToken != "" {
+		handleFunc(mux, "/ingest", timeout, func(w http.ResponseWriter, req *http.Request) {
+			serveIngest(cache, *serveIngestToken, w, req)
+		})
+	}
+	handleFunc(mux, "/healthz", statusTimeout, func(w http.ResponseWriter, req *http.Request) {
+		serveHealth(archive, w, req)
+	})
+	handleFunc(mux, "/readyz", statusTimeout, func(w http.ResponseWriter, req *http.Request) {
+		serveReady(cache, *serveReadyMaxAge, w, req)
 	})
-	mux.HandleFunc(prefix+"/areas/", serveForecast)
-	fmt.Printf("serving on %s\n", addr)
-	return http.ListenAndServe(addr, httpgzip.NewHandler(mux))
+	slog.Info("serving", "addr", addr)
+	security := SecurityHeaders{
+		ContentSecurityPolicy: *serveCSP,
+		FrameOptions:          *serveFrameOptions,
+		ReferrerPolicy:        *serveReferrerPolicy,
+	}
+	// Ingestion checks its own token, and logins must reach the provider
+	// callback
+	handler := requireAuth(areaMap.Redirect(mux), siteAuth, "/healthz",
+		"/ingest", "/auth/")
+	handler = securityHandler(recoverHandler(handler), security)
+	handler = compressHandler(handler, encodings, "/admin/events", "/events")
+	handler = prefixHandler(handler, prefix, *serveTrustProxy)
+	err = runServer(ctx, addr,
+		requestIDHandler(accessLogHandler(handler, *serveAccessLog)),
+		*serveShutdownTimeout, tlsConf)
+	if archive != nil {
+		archive.Close()
+	}
+	if saveErr := bandwidth.Save(); err == nil {
+		err = saveErr
+	}
+	return err
 }
 
 var (
@@ -282,7 +833,13 @@ var (
 
 func parseFn() error {
 	forecastId := *parseId
-	text, err := renderForecast(forecastId)
+	upstream, err := newForecastSource()
+	if err != nil {
+		return err
+	}
+	cache := NewForecastCache(context.Background(), upstream, 0, 0,
+		upstreamBandwidth)
+	text, err := renderForecast(cache, forecastId)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// signalContext returns a context cancelled on SIGINT or SIGTERM.
+func signalContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt,
+		syscall.SIGTERM)
+}
+
+type shutdownKey struct{}
+
+// shuttingDown returns a channel closed when the server of a request context
+// starts shutting down, so long-lived streams end and let in-flight requests
+// drain. It is nil, blocking forever, outside runServer.
+func shuttingDown(ctx context.Context) <-chan struct{} {
+	done, _ := ctx.Value(shutdownKey{}).(<-chan struct{})
+	return done
+}
+
+// runServer serves handler on addr, or on the socket passed by systemd socket
+// activation, over HTTPS if tlsConf is set, until ctx is cancelled, then stops
+// accepting connections and waits up to timeout for in-flight requests.
+func runServer(ctx context.Context, addr string, handler http.Handler,
+	timeout time.Duration, tlsConf *TLSConfig) error {
+
+	ln, err := listen(addr)
+	if err != nil {
+		return err
+	}
+	streams, stopStreams := context.WithCancel(context.Background())
+	defer stopStreams()
+	server := &http.Server{
+		Addr:    addr,
+		Handler: handler,
+		// Shutdown does not cancel request contexts
+		BaseContext: func(net.Listener) context.Context {
+			return context.WithValue(context.Background(), shutdownKey{},
+				streams.Done())
+		},
+	}
+	server.RegisterOnShutdown(stopStreams)
+	done := make(chan error, 1)
+	go func() {
+		done <- tlsConf.Serve(server, ln)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+	slog.Info("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err = server.Shutdown(shutdownCtx)
+	if err == context.DeadlineExceeded {
+		server.Close()
+		return fmt.Errorf("in-flight requests did not complete within %s",
+			timeout)
+	}
+	return err
+}
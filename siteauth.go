@@ -0,0 +1,116 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// basicCredentials authenticates requests bearing a single user and password
+// with HTTP basic authentication.
+type basicCredentials struct {
+	user     string
+	password string
+}
+
+func (c basicCredentials) Authenticate(req *http.Request) (Identity, bool) {
+	user, password, ok := req.BasicAuth()
+	if !ok {
+		return Identity{}, false
+	}
+	// Compare both so a wrong user takes as long as a wrong password
+	userOk := subtle.ConstantTimeCompare([]byte(user), []byte(c.user)) == 1
+	passwordOk := subtle.ConstantTimeCompare([]byte(password),
+		[]byte(c.password)) == 1
+	if !userOk || !passwordOk {
+		return Identity{}, false
+	}
+	return Identity{Name: c.user}, true
+}
+
+func (c basicCredentials) Challenge(w http.ResponseWriter, req *http.Request) {
+	challengeBasic(w)
+}
+
+// bearerToken authenticates requests bearing the token in their
+// Authorization header.
+type bearerToken string
+
+func (t bearerToken) Authenticate(req *http.Request) (Identity, bool) {
+	auth := req.Header.Get("Authorization")
+	if subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+t)) != 1 {
+		return Identity{}, false
+	}
+	return Identity{Name: "token"}, true
+}
+
+func (t bearerToken) Challenge(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="metmar"`)
+	w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+	w.WriteHeader(401)
+	fmt.Fprintf(w, "error: authentication required\n")
+}
+
+// challengeBasic replies with a 401 asking for basic authentication.
+func challengeBasic(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="metmar"`)
+	w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+	w.WriteHeader(401)
+	fmt.Fprintf(w, "error: authentication required\n")
+}
+
+// newSiteAuth returns the authenticator restricting a private deployment to
+// clients bearing the "user:password" basic credentials or the bearer token,
+// or nil if both are empty.
+func newSiteAuth(basic, token string) (Authenticator, error) {
+	chain := authChain{}
+	if basic != "" {
+		parts := strings.SplitN(basic, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, configError("--auth-basic must be user:password")
+		}
+		chain = append(chain, basicCredentials{parts[0], parts[1]})
+	}
+	if token != "" {
+		chain = append(chain, bearerToken(token))
+	}
+	if len(chain) == 0 {
+		return nil, nil
+	}
+	return chain, nil
+}
+
+// requireAuth challenges requests to h not authenticated by auth, except the
+// exempt paths, or the paths below exempt ones ending with a slash. It
+// returns h if auth is nil.
+func requireAuth(h http.Handler, auth Authenticator,
+	exempt ...string) http.Handler {
+
+	if auth == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for _, e := range exempt {
+			if req.URL.Path == e ||
+				strings.HasSuffix(e, "/") && strings.HasPrefix(req.URL.Path, e) {
+				h.ServeHTTP(w, req)
+				return
+			}
+		}
+		if _, ok := auth.Authenticate(req); !ok {
+			auth.Challenge(w, req)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+var (
+	serveAuthBasic = serveCmd.Flag("auth-basic",
+		"user:password basic credentials required by every page except "+
+			"/healthz").Envar("METMAR_AUTH_BASIC").String()
+	serveAuthToken = serveCmd.Flag("auth-token",
+		"bearer token required by every page except /healthz, accepted "+
+			"along --auth-basic").Envar("METMAR_AUTH_TOKEN").String()
+)
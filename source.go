@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pmezard/metmar/meteofrance"
+	"github.com/pmezard/metmar/nws"
+)
+
+// ForecastSource fetches the bulletins of the areas of an upstream service.
+// Bulletins of every source are converted to meteofrance.Bulletin, so the
+// cache, archive, feeds and notifiers handle them alike.
+type ForecastSource interface {
+	// Areas returns the identifiers of the fetched areas, in display order.
+	Areas() []string
+	// URL returns the upstream URL of the bulletin of area, for logs.
+	URL(area string) string
+	// Publisher returns the name and home page of the service issuing the
+	// bulletins, to credit it.
+	Publisher() (name, url string)
+	// Fetch returns the bulletin of area. Network failures are ErrUpstream
+	// errors, unexpected content ErrParse ones.
+	Fetch(ctx context.Context, area string) (*meteofrance.Bulletin, error)
+}
+
+// meteoFranceSource fetches Meteo France coastal areas, and the --rade and
+// --plage bulletins.
+type meteoFranceSource struct {
+	areas map[string]upstreamArea
+	ids   []string
+}
+
+func newMeteoFranceSource() (*meteoFranceSource, error) {
+	areas, err := upstreamAreas()
+	if err != nil {
+		return nil, err
+	}
+	s := &meteoFranceSource{areas: map[string]upstreamArea{}}
+	for _, area := range areas {
+		s.areas[area.Id] = area
+		s.ids = append(s.ids, area.Id)
+	}
+	return s, nil
+}
+
+func (s *meteoFranceSource) Areas() []string {
+	return s.ids
+}
+
+func (s *meteoFranceSource) URL(area string) string {
+	return s.areas[area].URL()
+}
+
+func (s *meteoFranceSource) Publisher() (string, string) {
+	return "Météo-France", "https://meteofrance.com"
+}
+
+func (s *meteoFranceSource) Fetch(ctx context.Context, id string) (
+	*meteofrance.Bulletin, error) {
+
+	area, ok := s.areas[id]
+	if !ok {
+		return nil, notFoundError("unknown area: %s", id)
+	}
+	reports, err := fetchReports(ctx, area)
+	if err != nil {
+		return nil, err
+	}
+	b, err := area.parse(reports)
+	return b, kindError(ErrParse, err)
+}
+
+// nwsSource fetches National Weather Service marine zone forecasts, its
+// areas are the lowercase zone identifiers.
+type nwsSource struct {
+	client *nws.Client
+	zones  []string
+}
+
+func newNWSSource(zones []string) (*nwsSource, error) {
+	// Bytes are accounted in upstreamBandwidth
+	client := nws.NewClient(&http.Client{
+		Transport: &countingTransport{},
+	})
+	client.URL = *nwsURL
+	s := &nwsSource{client: client}
+	for _, zone := range zones {
+		if !nws.ValidZone(zone) {
+			return nil, configError("invalid NWS marine zone: %q", zone)
+		}
+		s.zones = append(s.zones, strings.ToLower(zone))
+	}
+	if len(s.zones) == 0 {
+		return nil, configError("--nws-zone is required with --upstream nws")
+	}
+	return s, nil
+}
+
+func (s *nwsSource) Areas() []string {
+	return s.zones
+}
+
+func (s *nwsSource) URL(area string) string {
+	return s.client.ZoneURL(area)
+}
+
+func (s *nwsSource) Publisher() (string, string) {
+	return "National Weather Service", "https://www.weather.gov"
+}
+
+func (s *nwsSource) Fetch(ctx context.Context, area string) (
+	*meteofrance.Bulletin, error) {
+
+	data, err := s.client.Fetch(ctx, area)
+	if err != nil {
+		return nil, kindError(ErrUpstream, err)
+	}
+	if *recordDir != "" {
+		err := recordResponse(*recordDir, area, s.URL(area), data,
+			time.Now())
+		if err != nil {
+			ctxLogger(ctx).Error("recording area", "area", area, "error", err)
+		}
+	}
+	f, err := nws.Parse(data)
+	if err != nil {
+		return nil, kindError(ErrParse, err)
+	}
+	return nwsBulletin(f), nil
+}
+
+// nwsBulletin converts a zone forecast to a bulletin, headlines becoming
+// its special bulletin.
+func nwsBulletin(f *nws.Forecast) *meteofrance.Bulletin {
+	b := &meteofrance.Bulletin{
+		Title:   f.Title,
+		Header:  f.Synopsis,
+		Special: strings.Join(f.Headlines, "\n"),
+		Units: meteofrance.Units{
+			Wind:       "kt",
+			Visibility: "nm",
+			Text:       "Winds in knots, waves and seas in feet.",
+		},
+		Issued:  f.Issued,
+		Expires: f.Expires,
+		Footer:  fmt.Sprintf("National Weather Service, zone %s.", f.Zone),
+	}
+	for _, p := range f.Periods {
+		b.Sections = append(b.Sections, meteofrance.Section{
+			Title: p.Name,
+			Text:  p.Text,
+		})
+	}
+	return b
+}
+
+// newForecastSource returns the --upstream source.
+func newForecastSource() (ForecastSource, error) {
+	switch *upstreamKind {
+	case "nws":
+		return newNWSSource(*nwsZones)
+	default:
+		return newMeteoFranceSource()
+	}
+}
+
+var (
+	upstreamKind = app.Flag("upstream",
+		"forecast source, meteofrance or nws").Default("meteofrance").
+		Enum("meteofrance", "nws")
+	nwsZones = app.Flag("nws-zone",
+		"National Weather Service marine zone to fetch with --upstream nws, "+
+			"like ANZ335, can be repeated").Strings()
+	nwsURL = app.Flag("nws-url",
+		"National Weather Service zone forecast URL format, taking the zone "+
+			"directory, coastal or offshore, its two letters prefix and the "+
+			"zone").Default(nws.DefaultURL).String()
+)
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Archives are reconciled in two steps: the puller compares per-area digests
+// of revision identifiers and hashes, then lists revisions of differing
+// areas only and downloads the missing ones.
+
+type syncRevision struct {
+	Id   string `json:"id"`
+	Hash string `json:"hash"`
+}
+
+// areaDigest summarizes the revisions of an area.
+func areaDigest(revisions []Revision) string {
+	h := sha256.New()
+	for _, rev := range revisions {
+		fmt.Fprintf(h, "%s %s\n", rev.Id(), rev.Hash)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func writeJSON(w http.ResponseWriter, data interface{}) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+		w.WriteHeader(500)
+		fmt.Fprintf(w, "error: %s\n", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(payload)
+}
+
+// serveSync exposes the archive to pulling instances:
+//
+//	/sync              area digests
+//	/sync/AREA         area revisions with their hashes
+//	/sync/AREA/REV     revision content
+func serveSync(archive *Archive, w http.ResponseWriter, req *http.Request) {
+	p := strings.Trim(strings.TrimPrefix(req.URL.Path, "/sync"), "/")
+	parts := strings.Split(p, "/")
+	switch {
+	case p == "":
+		digests := map[string]string{}
+		for _, area := range archive.Areas() {
+			digests[area] = areaDigest(archive.Revisions(area))
+		}
+		writeJSON(w, digests)
+	case len(parts) == 1:
+		revisions := []syncRevision{}
+		for _, rev := range archive.Revisions(parts[0]) {
+			revisions = append(revisions, syncRevision{rev.Id(), rev.Hash})
+		}
+		writeJSON(w, revisions)
+	case len(parts) == 2:
+		rev, ok := archive.Revision(parts[0], parts[1])
+		if !ok {
+			writeNotFound(w, "revision "+parts[1]+" of area "+parts[0])
+			return
+		}
+		content, err := archive.Read(rev)
+		w.Header().Set("Content-Type", "text/plain;charset=utf-8")
+		if err != nil {
+			w.WriteHeader(500)
+			fmt.Fprintf(w, "error: %s\n", err)
+			return
+		}
+		w.Write([]byte(content))
+	default:
+		writeNotFound(w, req.URL.Path)
+	}
+}
+
+func syncGet(client *http.Client, url string, data interface{}) ([]byte, error) {
+	rsp, err := client.Get(url)
+	if err != nil {
+		return nil, kindError(ErrUpstream, err)
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode != http.StatusOK {
+		return nil, upstreamError("got %d fetching %s", rsp.StatusCode, url)
+	}
+	body, err := ioutil.ReadAll(rsp.Body)
+	if err != nil || data == nil {
+		return body, kindError(ErrUpstream, err)
+	}
+	return body, kindError(ErrParse, json.Unmarshal(body, data))
+}
+
+// pullArchive copies revisions of the archive served at url missing from
+// archive. It returns the number of imported revisions.
+func pullArchive(client *http.Client, url string, archive *Archive) (int, error) {
+	url = strings.TrimSuffix(url, "/") + "/sync"
+	digests := map[string]string{}
+	_, err := syncGet(client, url, &digests)
+	if err != nil {
+		return 0, err
+	}
+	imported := 0
+	for area, digest := range digests {
+		local := archive.Revisions(area)
+		if areaDigest(local) == digest {
+			continue
+		}
+		known := map[string]string{}
+		for _, rev := range local {
+			known[rev.Id()] = rev.Hash
+		}
+		remote := []syncRevision{}
+		_, err := syncGet(client, url+"/"+area, &remote)
+		if err != nil {
+			return imported, err
+		}
+		for _, r := range remote {
+			if _, ok := known[r.Id]; ok {
+				continue
+			}
+			t, err := time.Parse(archiveTimeFormat, r.Id)
+			if err != nil {
+				return imported, fmt.Errorf("invalid revision %q of area %s",
+					r.Id, area)
+			}
+			content, err := syncGet(client, url+"/"+area+"/"+r.Id, nil)
+			if err != nil {
+				return imported, err
+			}
+			if hashReport(string(content)) != r.Hash {
+				return imported, fmt.Errorf("revision %s of area %s does not "+
+					"match its hash", r.Id, area)
+			}
+			ok, err := archive.Import(area, t, string(content))
+			if err != nil {
+				return imported, err
+			}
+			if ok {
+				imported++
+			}
+		}
+	}
+	return imported, nil
+}
+
+var (
+	syncCmd = app.Command("sync",
+		"pull archive revisions missing locally from another instance")
+	syncURL = syncCmd.Arg("url",
+		"URL of the remote instance, including its prefix").Required().String()
+	syncArchive = syncCmd.Flag("archive",
+		"local archive directory").Required().String()
+	syncTimeout = syncCmd.Flag("timeout",
+		"maximum duration of every remote request").Default("1m").Duration()
+)
+
+func syncFn() error {
+	archive, err := OpenArchive(*syncArchive)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: *syncTimeout}
+	n, err := pullArchive(client, *syncURL, archive)
+	fmt.Printf("imported %d revisions\n", n)
+	return err
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"html/template"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	texttemplate "text/template"
+)
+
+var (
+	//go:embed templates/*.html templates/*.txt
+	embeddedTemplates embed.FS
+
+	// textTemplate renders forecasts as text, see formatText
+	textTemplate = defaultTextTemplate()
+)
+
+// loadTemplate parses the name template from dir, or the embedded default
+// if dir is empty or lacks it. It also returns the template source.
+func loadTemplate(dir, name string) (*template.Template, string, error) {
+	var data []byte
+	var err error
+	if dir != "" {
+		data, err = ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, "", err
+		}
+	}
+	if dir == "" || err != nil {
+		data, err = embeddedTemplates.ReadFile("templates/" + name)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	source := string(data)
+	t, err := template.New(name).Parse(source)
+	return t, source, err
+}
+
+func defaultTextTemplate() *texttemplate.Template {
+	data, err := embeddedTemplates.ReadFile("templates/bulletin.txt")
+	if err != nil {
+		panic(err)
+	}
+	return texttemplate.Must(texttemplate.New("bulletin.txt").Parse(
+		string(data)))
+}
+
+// loadTextTemplate replaces the text template with --text-template, if set.
+func loadTextTemplate() error {
+	if *textTemplatePath == "" {
+		return nil
+	}
+	data, err := ioutil.ReadFile(*textTemplatePath)
+	if err != nil {
+		return configError("cannot read text template: %s", err)
+	}
+	t, err := texttemplate.New(filepath.Base(*textTemplatePath)).
+		Parse(string(data))
+	if err != nil {
+		return configError("cannot parse text template: %s", err)
+	}
+	// Fail now rather than on every bulletin
+	err = t.Execute(ioutil.Discard, &Forecast{
+		Sections: []ForecastSection{{Title: "Title", Text: "Text"}},
+	})
+	if err != nil {
+		return configError("cannot render text template: %s", err)
+	}
+	textTemplate = t
+	return nil
+}
+
+// executeTextTemplate renders f with the text template, or the default one if
+// it fails.
+func executeTextTemplate(f *Forecast) string {
+	w := &bytes.Buffer{}
+	err := textTemplate.Execute(w, f)
+	if err != nil {
+		slog.Error("rendering text template", "area", f.Id, "error", err)
+		w.Reset()
+		defaultTextTemplate().Execute(w, f)
+	}
+	return w.String()
+}
+
+// ForecastSection is the bulletin of one échéance, like "Ce soir".
+type ForecastSection struct {
+	Title string
+	Text  string
+}
+
+// splitForecast splits a forecast content into its introduction, holding the
+// title and headers, and the sections introduced by "# " lines. The special
+// bulletin and the title are removed from the introduction.
+func splitForecast(f Forecast) (string, []ForecastSection) {
+	intro := []string{}
+	sections := []ForecastSection{}
+	var current *ForecastSection
+	lines := []string{}
+	flush := func() {
+		text := strings.TrimSpace(strings.Join(lines, "\n"))
+		if current == nil {
+			intro = append(intro, text)
+		} else {
+			current.Text = text
+			sections = append(sections, *current)
+		}
+		lines = nil
+	}
+	for _, line := range strings.Split(f.Content, "\n") {
+		if strings.HasPrefix(line, "# ") {
+			flush()
+			current = &ForecastSection{
+				Title: strings.TrimSpace(strings.TrimPrefix(line, "# ")),
+			}
+			continue
+		}
+		lines = append(lines, line)
+	}
+	flush()
+	text := strings.TrimPrefix(strings.Join(intro, "\n"), f.Title)
+	if special := strings.TrimSpace(f.Special); special != "" {
+		text = strings.Replace(text, special, "", 1)
+	}
+	return strings.TrimSpace(text), sections
+}
+
+var (
+	textTemplatePath = app.Flag("text-template",
+		"text/template file rendering the Forecast structure as the text "+
+			"bulletin served, archived and notified").String()
+	serveTemplates = serveCmd.Flag("templates",
+		"directory of index.html and area.html templates overriding the default ones").
+		String()
+)
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"time"
+)
+
+// Tides are predicted from harmonic constants, as published by hydrographic
+// offices: the height at t is the port mean level plus, for every
+// constituent, f·A·cos(V(t) + u - G), where A and G are the constituent
+// amplitude and Greenwich phase lag, V its astronomical argument and f, u
+// its nodal corrections.
+
+// tideConstituent describes a constituent by its Doodson numbers, applied
+// to the mean lunar time and to the mean longitudes of the moon, sun, lunar
+// perigee, lunar node and perihelion, plus a phase offset in degrees.
+type tideConstituent struct {
+	doodson [6]float64
+	offset  float64
+	// nodal returns f and u, in degrees, for the lunar node longitude n
+	nodal func(n float64) (float64, float64)
+}
+
+func nodalNone(n float64) (float64, float64) {
+	return 1, 0
+}
+
+func nodalM2(n float64) (float64, float64) {
+	return 1 - 0.037*cosDeg(n), -2.1 * sinDeg(n)
+}
+
+func nodalK1(n float64) (float64, float64) {
+	return 1.006 + 0.115*cosDeg(n), -8.9 * sinDeg(n)
+}
+
+func nodalO1(n float64) (float64, float64) {
+	return 1.009 + 0.187*cosDeg(n), 10.8 * sinDeg(n)
+}
+
+func nodalK2(n float64) (float64, float64) {
+	return 1.024 + 0.286*cosDeg(n), -17.7 * sinDeg(n)
+}
+
+func nodalM4(n float64) (float64, float64) {
+	f, u := nodalM2(n)
+	return f * f, 2 * u
+}
+
+var (
+	tideConstituents = map[string]tideConstituent{
+		"M2":  {[6]float64{2, 0, 0, 0, 0, 0}, 0, nodalM2},
+		"S2":  {[6]float64{2, 2, -2, 0, 0, 0}, 0, nodalNone},
+		"N2":  {[6]float64{2, -1, 0, 1, 0, 0}, 0, nodalM2},
+		"K2":  {[6]float64{2, 2, 0, 0, 0, 0}, 0, nodalK2},
+		"K1":  {[6]float64{1, 1, 0, 0, 0, 0}, -90, nodalK1},
+		"O1":  {[6]float64{1, -1, 0, 0, 0, 0}, 90, nodalO1},
+		"P1":  {[6]float64{1, 1, -2, 0, 0, 0}, 90, nodalNone},
+		"Q1":  {[6]float64{1, -2, 0, 1, 0, 0}, 90, nodalO1},
+		"M4":  {[6]float64{4, 0, 0, 0, 0, 0}, 0, nodalM4},
+		"MS4": {[6]float64{4, 2, -2, 0, 0, 0}, 0, nodalM2},
+	}
+)
+
+func cosDeg(d float64) float64 {
+	return math.Cos(d * math.Pi / 180)
+}
+
+func sinDeg(d float64) float64 {
+	return math.Sin(d * math.Pi / 180)
+}
+
+// astronomicalArguments returns the mean lunar time and the mean longitudes
+// of the moon, sun, lunar perigee, lunar node and perihelion at t, in
+// degrees.
+func astronomicalArguments(t time.Time) [6]float64 {
+	t = t.UTC()
+	j2000 := time.Date(2000, 1, 1, 12, 0, 0, 0, time.UTC)
+	c := t.Sub(j2000).Hours() / (24 * 36525)
+	s := 218.3164 + 481267.8812*c
+	h := 280.4661 + 36000.7698*c
+	p := 83.3535 + 4069.0137*c
+	n := 125.0445 - 1934.1363*c
+	p1 := 282.9384 + 1.7195*c
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	tau := 180 + 15*t.Sub(midnight).Hours() + h - s
+	// The node argument is -N in Doodson's convention
+	return [6]float64{tau, s, h, p, -n, p1}
+}
+
+// TideHarmonic is the amplitude, in meters, and Greenwich phase lag, in
+// degrees, of a constituent at a port.
+type TideHarmonic struct {
+	Amplitude float64 `json:"amplitude"`
+	Phase     float64 `json:"phase"`
+}
+
+// TidePort holds the harmonic constants of a port.
+type TidePort struct {
+	// Mean level above chart datum, in meters
+	MeanLevel float64 `json:"mean_level"`
+	// Unit height computing tide coefficients, in meters, like 3.05 for
+	// Brest. Zero if the port does not define coefficients.
+	Unit         float64                 `json:"unit"`
+	Constituents map[string]TideHarmonic `json:"constituents"`
+}
+
+// Height returns the predicted water height above chart datum at t.
+func (p *TidePort) Height(t time.Time) float64 {
+	args := astronomicalArguments(t)
+	node := -args[4]
+	height := p.MeanLevel
+	for name, c := range p.Constituents {
+		k := tideConstituents[name]
+		v := k.offset
+		for i, d := range k.doodson {
+			v += d * args[i]
+		}
+		f, u := k.nodal(node)
+		height += f * c.Amplitude * cosDeg(v+u-c.Phase)
+	}
+	return height
+}
+
+// TideEvent is a high or low water.
+type TideEvent struct {
+	Time time.Time `json:"time"`
+	// "high" or "low"
+	Type string `json:"type"`
+	// Meters above chart datum
+	Height float64 `json:"height"`
+}
+
+// predictTides returns the high and low waters of port in [from, to).
+func predictTides(port *TidePort, from, to time.Time) []TideEvent {
+	const step = time.Minute
+	events := []TideEvent{}
+	prev := port.Height(from.Add(-step))
+	cur := port.Height(from)
+	for t := from; t.Before(to); t = t.Add(step) {
+		next := port.Height(t.Add(step))
+		kind := ""
+		if cur > prev && cur >= next {
+			kind = "high"
+		} else if cur < prev && cur <= next {
+			kind = "low"
+		}
+		if kind != "" {
+			events = append(events, TideEvent{
+				Time:   t,
+				Type:   kind,
+				Height: math.Round(cur*100) / 100,
+			})
+		}
+		prev, cur = cur, next
+	}
+	return events
+}
+
+// TideDay lists the tides of a day at the port of an area.
+type TideDay struct {
+	Port string `json:"port"`
+	// Day in the tide time zone, like 2023-11-02
+	Date   string      `json:"date"`
+	Events []TideEvent `json:"events"`
+	// Coefficients of the day high waters, from 20 to 120
+	Coefficients []int `json:"coefficients,omitempty"`
+}
+
+// Tides predicts tides at the port of every mapped area.
+type Tides struct {
+	// Port defining coefficients, which apply to every port
+	Coefficients string               `json:"coefficients"`
+	Ports        map[string]*TidePort `json:"ports"`
+	// Port names by area identifier
+	Areas    map[string]string `json:"areas"`
+	location *time.Location
+}
+
+var (
+	// tideTable adds tides to area pages, if not nil
+	tideTable *Tides
+)
+
+// LoadTides reads harmonic constants and the port of every area from a JSON
+// file. Days start at midnight in the zone time zone.
+func LoadTides(path, zone string) (*Tides, error) {
+	location, err := time.LoadLocation(zone)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	t := &Tides{}
+	err = json.Unmarshal(data, t)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	t.location = location
+	for name, port := range t.Ports {
+		if len(port.Constituents) == 0 {
+			return nil, fmt.Errorf("%s: port %s has no constituents", path, name)
+		}
+		for c := range port.Constituents {
+			if _, ok := tideConstituents[c]; !ok {
+				return nil, fmt.Errorf("%s: port %s: unsupported constituent: %s",
+					path, name, c)
+			}
+		}
+	}
+	for area, name := range t.Areas {
+		if _, ok := t.Ports[name]; !ok {
+			return nil, fmt.Errorf("%s: area %s: unknown port: %s", path, area,
+				name)
+		}
+	}
+	if t.Coefficients != "" {
+		port, ok := t.Ports[t.Coefficients]
+		if !ok || port.Unit <= 0 {
+			return nil, fmt.Errorf("%s: coefficient port %s must define a unit",
+				path, t.Coefficients)
+		}
+	}
+	return t, nil
+}
+
+// Day returns the tides of the day of now at the port of area, or nil if the
+// area has none.
+func (t *Tides) Day(area string, now time.Time) *TideDay {
+	if t == nil {
+		return nil
+	}
+	name, ok := t.Areas[area]
+	if !ok {
+		return nil
+	}
+	now = now.In(t.location)
+	from := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0,
+		t.location)
+	to := from.AddDate(0, 0, 1)
+	day := &TideDay{
+		Port:   name,
+		Date:   from.Format("2006-01-02"),
+		Events: predictTides(t.Ports[name], from, to),
+	}
+	if ref, ok := t.Ports[t.Coefficients]; ok {
+		for _, e := range predictTides(ref, from, to) {
+			if e.Type != "high" {
+				continue
+			}
+			c := int(math.Round(100 * (e.Height - ref.MeanLevel) / ref.Unit))
+			day.Coefficients = append(day.Coefficients, c)
+		}
+	}
+	return day
+}
+
+var (
+	serveTides = serveCmd.Flag("tides",
+		"JSON file of port harmonic constants and the port of every area, "+
+			"adding tides to area pages").String()
+	serveTideZone = serveCmd.Flag("tide-zone",
+		"time zone of tide times, --timezone if empty").String()
+)
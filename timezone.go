@@ -0,0 +1,36 @@
+package main
+
+import (
+	"time"
+)
+
+var (
+	// localZone is the --timezone location, loaded by dispatch. Bulletin
+	// production times and archive names are UTC, but forecasts saved by
+	// other tools are named after local times, and gale warning years and
+	// days are counted in local time.
+	localZone = time.UTC
+
+	timezone = app.Flag("timezone",
+		"time zone of saved forecast names, days and JSON timestamps, "+
+			"and default of the other zone flags").
+		Default("Europe/Paris").String()
+)
+
+// loadTimezone sets localZone from --timezone.
+func loadTimezone() error {
+	location, err := time.LoadLocation(*timezone)
+	if err != nil {
+		return configError("invalid time zone %q: %s", *timezone, err)
+	}
+	localZone = location
+	return nil
+}
+
+// zoneOrDefault returns zone, or --timezone if it is empty.
+func zoneOrDefault(zone string) string {
+	if zone == "" {
+		return *timezone
+	}
+	return zone
+}
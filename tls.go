@@ -0,0 +1,84 @@
+package main
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"net"
+	"net/http"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// TLSConfig describes how a server is exposed over HTTPS, either with a
+// static certificate or with certificates obtained from Let's Encrypt.
+type TLSConfig struct {
+	Cert string
+	Key  string
+	// Domains for which certificates are requested, enables autocert
+	Domains []string
+	// Directory caching obtained certificates
+	Cache string
+	// Address answering ACME HTTP-01 challenges
+	ChallengeAddr string
+}
+
+// NewTLSConfig validates TLS settings and returns nil if HTTPS is disabled.
+func NewTLSConfig(cert, key string, domains []string, cache,
+	challengeAddr string) (*TLSConfig, error) {
+
+	if (cert == "") != (key == "") {
+		return nil, configError("--tls-cert and --tls-key must be set together")
+	}
+	if cert != "" && len(domains) > 0 {
+		return nil, configError("--autocert cannot be combined with --tls-cert")
+	}
+	if cert == "" && len(domains) == 0 {
+		return nil, nil
+	}
+	return &TLSConfig{
+		Cert:          cert,
+		Key:           key,
+		Domains:       domains,
+		Cache:         cache,
+		ChallengeAddr: challengeAddr,
+	}, nil
+}
+
+// Serve runs server on ln over HTTPS, or plain HTTP when c is nil.
+func (c *TLSConfig) Serve(server *http.Server, ln net.Listener) error {
+	if c == nil {
+		return server.Serve(ln)
+	}
+	if c.Cert != "" {
+		return server.ServeTLS(ln, c.Cert, c.Key)
+	}
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(c.Domains...),
+		Cache:      autocert.DirCache(c.Cache),
+	}
+	// Answers challenges and redirects everything else to HTTPS
+	go func() {
+		err := http.ListenAndServe(c.ChallengeAddr, m.HTTPHandler(nil))
+		if err != nil {
+			slog.Error("serving ACME challenges", "error", err)
+		}
+	}()
+	server.TLSConfig = m.TLSConfig()
+	server.TLSConfig.MinVersion = tls.VersionTLS12
+	return server.ServeTLS(ln, "", "")
+}
+
+var (
+	serveTLSCert = serveCmd.Flag("tls-cert",
+		"serve HTTPS with this PEM certificate file").String()
+	serveTLSKey = serveCmd.Flag("tls-key",
+		"PEM private key of --tls-cert").String()
+	serveAutocert = serveCmd.Flag("autocert",
+		"serve HTTPS with Let's Encrypt certificates for this domain, can be repeated").
+		Strings()
+	serveAutocertCache = serveCmd.Flag("autocert-cache",
+		"directory caching Let's Encrypt certificates").Default("autocert").String()
+	serveAutocertHTTP = serveCmd.Flag("autocert-http",
+		"address answering Let's Encrypt challenges").Default(":80").String()
+)
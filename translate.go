@@ -0,0 +1,308 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Bulletins are published in French. The English rendering replaces the
+// standard marine vocabulary with its usual translation, word by word for the
+// rest, which is enough to read the wind, sea state and visibility.
+
+// glossary maps French marine terms, in lower case, to English.
+var glossary = map[string]string{
+	// Beaufort scale
+	"calme":                           "calm",
+	"très légère brise":               "light air",
+	"légère brise":                    "light breeze",
+	"petite brise":                    "gentle breeze",
+	"jolie brise":                     "moderate breeze",
+	"bonne brise":                     "fresh breeze",
+	"vent frais":                      "strong breeze",
+	"grand frais":                     "near gale",
+	"coup de vent":                    "gale",
+	"fort coup de vent":               "strong gale",
+	"tempête":                         "storm",
+	"violente tempête":                "violent storm",
+	"ouragan":                         "hurricane",
+	"avis de grand frais":             "near gale warning",
+	"avis de coup de vent":            "gale warning",
+	"avis de tempête":                 "storm warning",
+	"pas d'avis en cours":             "no warning in force",
+	"bulletin météorologique spécial": "special weather bulletin",
+	// Sea state
+	"mer calme":       "calm sea",
+	"mer belle":       "smooth sea",
+	"mer peu agitée":  "slight sea",
+	"mer agitée":      "moderate sea",
+	"mer forte":       "rough sea",
+	"mer très forte":  "very rough sea",
+	"mer grosse":      "high sea",
+	"mer très grosse": "very high sea",
+	"mer énorme":      "phenomenal sea",
+	"peu agitée":      "slight",
+	"agitée":          "moderate",
+	"très forte":      "very rough",
+	"très grosse":     "very high",
+	"houle":           "swell",
+	"mer du vent":     "wind sea",
+	// Directions
+	"nord":                  "north",
+	"sud":                   "south",
+	"ouest":                 "west",
+	"nord-est":              "northeast",
+	"nord-ouest":            "northwest",
+	"sud-est":               "southeast",
+	"sud-ouest":             "southwest",
+	"secteur":               "sector",
+	"de secteur nord":       "northerly",
+	"de secteur sud":        "southerly",
+	"de secteur est":        "easterly",
+	"de secteur ouest":      "westerly",
+	"de secteur nord-est":   "northeasterly",
+	"de secteur nord-ouest": "northwesterly",
+	"de secteur sud-est":    "southeasterly",
+	"de secteur sud-ouest":  "southwesterly",
+	"secteur est":           "east sector",
+	"d'est":                 "easterly",
+	"vers l'est":            "eastwards",
+	"vers l'ouest":          "westwards",
+	"vers le nord":          "northwards",
+	"vers le sud":           "southwards",
+	"s'orientant":           "becoming",
+	"revenant":              "backing",
+	"virant":                "veering",
+	// Evolution
+	"mollissant":     "decreasing",
+	"faiblissant":    "decreasing",
+	"fraîchissant":   "increasing",
+	"se renforçant":  "strengthening",
+	"en baisse":      "decreasing",
+	"en hausse":      "increasing",
+	"temporairement": "temporarily",
+	"parfois":        "at times",
+	"localement":     "locally",
+	"d'abord":        "at first",
+	"puis":           "then",
+	"ensuite":        "later",
+	"rafales":        "gusts",
+	"sous grains":    "in squalls",
+	"grains":         "squalls",
+	"vent":           "wind",
+	// Weather and visibility
+	"beau temps":          "fair",
+	"averses":             "showers",
+	"pluie":               "rain",
+	"pluies":              "rain",
+	"bruine":              "drizzle",
+	"orages":              "thunderstorms",
+	"orageux":             "thundery",
+	"brume":               "mist",
+	"brouillard":          "fog",
+	"bancs de brouillard": "fog patches",
+	"nuageux":             "cloudy",
+	"couvert":             "overcast",
+	"éclaircies":          "bright spells",
+	"visibilité":          "visibility",
+	"bonne":               "good",
+	"médiocre":            "moderate",
+	"mauvaise":            "poor",
+	"très mauvaise":       "very poor",
+	"bonne à médiocre":    "good to moderate",
+	"médiocre à mauvaise": "moderate to poor",
+	// Synoptic situation
+	"situation générale": "general situation",
+	"dépression":         "low",
+	"anticyclone":        "high",
+	"front froid":        "cold front",
+	"front chaud":        "warm front",
+	"thalweg":            "trough",
+	"se comblant":        "filling",
+	"se creusant":        "deepening",
+	"se décalant":        "moving",
+	"se déplaçant":       "moving",
+	"évoluant":           "moving",
+	"centrée":            "centred",
+	// Times
+	"aujourd'hui":      "today",
+	"demain":           "tomorrow",
+	"ce soir":          "this evening",
+	"cette nuit":       "tonight",
+	"matin":            "morning",
+	"après-midi":       "afternoon",
+	"soir":             "evening",
+	"nuit":             "night",
+	"en début de nuit": "early in the night",
+	"en fin de nuit":   "late in the night",
+	"en cours de nuit": "during the night",
+	"en soirée":        "in the evening",
+	"en journée":       "during the day",
+	"lundi":            "Monday",
+	"mardi":            "Tuesday",
+	"mercredi":         "Wednesday",
+	"jeudi":            "Thursday",
+	"vendredi":         "Friday",
+	"samedi":           "Saturday",
+	"dimanche":         "Sunday",
+	"heure légale":     "local time",
+	"heures":           "hours",
+	// Units and headers
+	"nœuds":            "knots",
+	"noeuds":           "knots",
+	"milles":           "miles",
+	"mètres":           "metres",
+	"bulletin côte":    "coastal bulletin",
+	"bulletin large":   "offshore bulletin",
+	"émis le":          "issued on",
+	"valable jusqu'au": "valid until",
+	"et":               "and",
+	"ou":               "or",
+	"de":               "of",
+	"sur":              "over",
+	"avec":             "with",
+}
+
+var (
+	// glossaryTerms lists glossary keys by decreasing length so the longest
+	// term wins
+	glossaryTerms = sortedGlossary()
+	// "5 à 6" ranges
+	reRangeTo = regexp.MustCompile(`(\d)\s+à\s+(\d)`)
+	// "Est" is a direction when followed by a force, a verb otherwise
+	reEastForce = regexp.MustCompile(`(^|[^\pL'-])(?i:est)(\s+\d)`)
+)
+
+func sortedGlossary() []string {
+	terms := []string{}
+	for k := range glossary {
+		terms = append(terms, k)
+	}
+	sort.Slice(terms, func(i, j int) bool {
+		if len(terms[i]) != len(terms[j]) {
+			return len(terms[i]) > len(terms[j])
+		}
+		return terms[i] < terms[j]
+	})
+	return terms
+}
+
+// isWordRune tells whether r belongs to a word, apostrophes and hyphens
+// joining words like "d'est" or "nord-ouest".
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || r == '\'' || r == '-'
+}
+
+// matchCase returns s with the case of the source term: upper case, or
+// capitalized.
+func matchCase(term, s string) string {
+	if strings.ToUpper(term) == term && strings.ToLower(term) != term {
+		return strings.ToUpper(s)
+	}
+	r, _ := utf8.DecodeRuneInString(term)
+	if unicode.IsUpper(r) {
+		first, n := utf8.DecodeRuneInString(s)
+		return string(unicode.ToUpper(first)) + s[n:]
+	}
+	return s
+}
+
+// translateText translates the glossary terms of French text to English,
+// leaving unknown words unchanged.
+func translateText(text string) string {
+	text = strings.Replace(text, "’", "'", -1)
+	text = reRangeTo.ReplaceAllString(text, "$1 to $2")
+	text = reEastForce.ReplaceAllString(text, "${1}East$2")
+	w := &strings.Builder{}
+	lower := strings.ToLower(text)
+	if len(lower) != len(text) {
+		// Lower casing changed byte offsets, give up on the glossary
+		return text
+	}
+	prev := rune(0)
+	for i := 0; i < len(text); {
+		if !isWordRune(prev) {
+			for _, term := range glossaryTerms {
+				if !strings.HasPrefix(lower[i:], term) {
+					continue
+				}
+				next, _ := utf8.DecodeRuneInString(text[i+len(term):])
+				if i+len(term) < len(text) && isWordRune(next) {
+					continue
+				}
+				w.WriteString(matchCase(text[i:i+len(term)], glossary[term]))
+				i += len(term)
+				prev, _ = utf8.DecodeLastRuneInString(text[:i])
+				break
+			}
+		}
+		if i >= len(text) {
+			break
+		}
+		r, n := utf8.DecodeRuneInString(text[i:])
+		w.WriteString(text[i : i+n])
+		prev = r
+		i += n
+	}
+	return w.String()
+}
+
+// translateForecast returns f with its text translated to English. The
+// structured parts are translated when known, and the content rendered
+// again from them.
+func translateForecast(f Forecast) Forecast {
+	f.Title = translateText(f.Title)
+	f.Header = translateText(f.Header)
+	f.Footer = translateText(f.Footer)
+	f.Special = translateText(f.Special)
+	if f.Sections == nil {
+		f.Content = translateText(f.Content)
+		return f
+	}
+	sections := []ForecastSection{}
+	for _, s := range f.Sections {
+		sections = append(sections, ForecastSection{
+			Title: translateText(s.Title),
+			Text:  translateText(s.Text),
+		})
+	}
+	f.Sections = sections
+	f.Content = formatText(&f)
+	return f
+}
+
+// requestLanguage returns the bulletin language requested by the "lang" query
+// parameter, or the one of fr and en with the highest quality in
+// Accept-Language, the first listed on ties. It defaults to French.
+func requestLanguage(req *http.Request) (string, error) {
+	if lang := req.URL.Query().Get("lang"); lang != "" {
+		if lang != "fr" && lang != "en" {
+			return "", fmt.Errorf("unknown language: %q", lang)
+		}
+		return lang, nil
+	}
+	best, bestQ := "fr", 0.0
+	for _, part := range strings.Split(req.Header.Get("Accept-Language"), ",") {
+		params := strings.Split(part, ";")
+		tag := strings.TrimSpace(params[0])
+		tag = strings.ToLower(strings.Split(tag, "-")[0])
+		q := 1.0
+		for _, p := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+			if len(kv) == 2 && kv[0] == "q" {
+				if v, err := strconv.ParseFloat(kv[1], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if (tag == "fr" || tag == "en") && q > bestQ {
+			best, bestQ = tag, q
+		}
+	}
+	return best, nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pmezard/metmar/meteofrance"
+)
+
+// Units selects the units of wind speeds and distances converted from
+// bulletin texts in structured output.
+type Units struct {
+	// Wind speed unit: kt, ms or kmh
+	Wind string
+	// Distance unit: nm or km
+	Distance string
+}
+
+var (
+	// windFactors convert knots to wind units
+	windFactors = map[string]float64{
+		"kt":  1,
+		"ms":  0.514444,
+		"kmh": 1.852,
+	}
+	// distanceFactors convert nautical miles to distance units
+	distanceFactors = map[string]float64{
+		"nm": 1,
+		"km": 1.852,
+	}
+	// beaufortKnots are the lower bounds in knots of Beaufort forces 0 to 12,
+	// followed by an upper bound for force 12
+	beaufortKnots = []float64{0, 1, 4, 7, 11, 17, 22, 28, 34, 41, 48, 56, 64, 64}
+
+	reSpeeds = regexp.MustCompile(
+		`(?i)\b(\d{1,3})(?:\s*(?:à|a|-)\s*(\d{1,3}))?\s*(nœuds|noeuds|kt|km/h)\b`)
+	// Distances also match km/h speeds, as Go regexps have no lookahead
+	reDistances = regexp.MustCompile(
+		`(?i)\b(\d{1,3}(?:[.,]\d+)?)(?:\s*(?:à|a|-)\s*(\d{1,3}(?:[.,]\d+)?))?\s*(milles?|km/h|km)\b`)
+	// Numbers of wind and visibility sentences, followed by their unit if
+	// any
+	reWindValues = regexp.MustCompile(
+		`(?i)\bvents?\b[^.\d]*?\b(\d{1,3})(?:\s*(?:à|a|-)\s*(\d{1,3}))?(\s*(?:nœuds|noeuds|kt|km/h))?`)
+	reVisibilityValues = regexp.MustCompile(
+		`(?i)\bvisibilit[ée]s?[^.\d]*?\b(\d{1,3}(?:[.,]\d+)?)(?:\s*(?:à|a|-)\s*(\d{1,3}(?:[.,]\d+)?))?(\s*(?:milles?|km)\b)?`)
+)
+
+// parseUnits returns the units selected by the "wind" and "distance" query
+// parameters, defaulting to --wind-unit and --distance-unit.
+func parseUnits(req *http.Request) (Units, error) {
+	units := Units{
+		Wind:     *serveWindUnit,
+		Distance: *serveDistanceUnit,
+	}
+	if s := req.URL.Query().Get("wind"); s != "" {
+		units.Wind = s
+	}
+	if s := req.URL.Query().Get("distance"); s != "" {
+		units.Distance = s
+	}
+	if _, ok := windFactors[units.Wind]; !ok {
+		return units, fmt.Errorf("unknown wind unit: %q", units.Wind)
+	}
+	if _, ok := distanceFactors[units.Distance]; !ok {
+		return units, fmt.Errorf("unknown distance unit: %q", units.Distance)
+	}
+	return units, nil
+}
+
+// Measure is a wind speed or distance mentioned by a bulletin, converted to
+// the requested unit.
+type Measure struct {
+	// Original French text
+	Text string  `json:"text"`
+	Kind string  `json:"kind"`
+	Min  float64 `json:"min"`
+	Max  float64 `json:"max"`
+	Unit string  `json:"unit"`
+}
+
+// parseRange parses a decimal range, max being optional.
+func parseRange(min, max string) (float64, float64, error) {
+	lo, err := strconv.ParseFloat(strings.Replace(min, ",", ".", 1), 64)
+	if err != nil || max == "" {
+		return lo, lo, err
+	}
+	hi, err := strconv.ParseFloat(strings.Replace(max, ",", ".", 1), 64)
+	return lo, hi, err
+}
+
+// newMeasure converts the [lo, hi] range with factor.
+func newMeasure(text, kind, unit string, factor, lo, hi float64) Measure {
+	return Measure{
+		Text: text,
+		Kind: kind,
+		Min:  math.Round(lo*factor*10) / 10,
+		Max:  math.Round(hi*factor*10) / 10,
+		Unit: unit,
+	}
+}
+
+// convertMeasures extracts wind speeds and distances from text, converted to
+// units. Speeds and distances are read in the unit they mention. Otherwise,
+// wind forces are read on the Beaufort scale unless source, the bulletin
+// units, tells another scale, and numbers following "vent" or "visibilité"
+// are read in the source wind or visibility unit when it tells one.
+func convertMeasures(text string, source meteofrance.Units,
+	units Units) []Measure {
+
+	measures := []Measure{}
+	wind := windFactors[units.Wind]
+	if source.Wind == "" || source.Wind == "beaufort" {
+		for _, m := range reWindForce.FindAllStringSubmatch(text, -1) {
+			lo, hi, err := parseRange(m[1], m[2])
+			if err != nil || lo > hi || hi > 12 {
+				continue
+			}
+			// A force covers speeds up to the next force lower bound
+			max := math.Max(beaufortKnots[int(hi)+1]-1, beaufortKnots[int(hi)])
+			measures = append(measures, newMeasure(m[0], "wind", units.Wind,
+				wind, beaufortKnots[int(lo)], max))
+		}
+	}
+	for _, m := range reSpeeds.FindAllStringSubmatch(text, -1) {
+		lo, hi, err := parseRange(m[1], m[2])
+		if err == nil {
+			measures = append(measures, newMeasure(m[0], "wind", units.Wind,
+				wind/windFactors[speedUnit(m[3])], lo, hi))
+		}
+	}
+	if from, ok := windFactors[source.Wind]; ok {
+		for _, m := range reWindValues.FindAllStringSubmatch(text, -1) {
+			if m[3] != "" || strings.Contains(strings.ToLower(m[0]), "force") {
+				// Read with its unit above, or a Beaufort force anyway
+				continue
+			}
+			lo, hi, err := parseRange(m[1], m[2])
+			if err == nil {
+				measures = append(measures, newMeasure(m[0], "wind",
+					units.Wind, wind/from, lo, hi))
+			}
+		}
+	}
+	distance := distanceFactors[units.Distance]
+	for _, m := range reDistances.FindAllStringSubmatch(text, -1) {
+		lo, hi, err := parseRange(m[1], m[2])
+		if err == nil && strings.ToLower(m[3]) != "km/h" {
+			measures = append(measures, newMeasure(m[0], "distance",
+				units.Distance, distance/distanceFactors[distanceUnit(m[3])],
+				lo, hi))
+		}
+	}
+	if from, ok := distanceFactors[source.Visibility]; ok {
+		for _, m := range reVisibilityValues.FindAllStringSubmatch(text, -1) {
+			if m[3] != "" {
+				continue
+			}
+			lo, hi, err := parseRange(m[1], m[2])
+			if err == nil {
+				measures = append(measures, newMeasure(m[0], "distance",
+					units.Distance, distance/from, lo, hi))
+			}
+		}
+	}
+	return measures
+}
+
+// speedUnit returns the wind unit of a speed unit mentioned by a bulletin.
+func speedUnit(s string) string {
+	if strings.ToLower(s) == "km/h" {
+		return "kmh"
+	}
+	return "kt"
+}
+
+// distanceUnit returns the distance unit of a distance unit mentioned by a
+// bulletin.
+func distanceUnit(s string) string {
+	if strings.ToLower(s) == "km" {
+		return "km"
+	}
+	return "nm"
+}
+
+var (
+	serveWindUnit = serveCmd.Flag("wind-unit",
+		"default wind speed unit of JSON bulletins: kt, ms or kmh").
+		Default("kt").Enum("kt", "ms", "kmh")
+	serveDistanceUnit = serveCmd.Flag("distance-unit",
+		"default distance unit of JSON bulletins: nm or km").
+		Default("nm").Enum("nm", "km")
+)
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// NotificationPrefs selects the bulletins notified to a user and how.
+type NotificationPrefs struct {
+	// Notified areas, none if empty
+	Areas []string `json:"areas"`
+	// Email address, empty to disable
+	Email string `json:"email"`
+	// ntfy topic, empty to disable
+	Ntfy string `json:"ntfy"`
+	// Zero notifies every changed bulletin, otherwise only new special
+	// bulletins of this severity or more, see BMS.Severity
+	MinSeverity int `json:"min_severity"`
+	// Notifications are not sent between QuietStart and QuietEnd, formatted
+	// as HH:MM, unless they are empty
+	QuietStart string `json:"quiet_start"`
+	QuietEnd   string `json:"quiet_end"`
+}
+
+// UserData holds per-user settings.
+type UserData struct {
+	// Favorite area identifiers
+	Favorites     []string          `json:"favorites"`
+	Notifications NotificationPrefs `json:"notifications"`
+}
+
+// UserStore persists UserData of every user in a JSON file.
+type UserStore struct {
+	lock  sync.Mutex
+	path  string
+	users map[string]*UserData
+}
+
+func OpenUserStore(path string) (*UserStore, error) {
+	s := &UserStore{
+		path:  path,
+		users: map[string]*UserData{},
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return s, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(data, &s.users)
+	return s, err
+}
+
+func copyUserData(d *UserData) UserData {
+	c := *d
+	c.Favorites = append([]string(nil), d.Favorites...)
+	c.Notifications.Areas = append([]string(nil), d.Notifications.Areas...)
+	return c
+}
+
+// Get returns a copy of the user data, empty if unknown.
+func (s *UserStore) Get(name string) UserData {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if d := s.users[name]; d != nil {
+		return copyUserData(d)
+	}
+	return UserData{}
+}
+
+// All returns a copy of every user data, by user name.
+func (s *UserStore) All() map[string]UserData {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	all := map[string]UserData{}
+	for name, d := range s.users {
+		all[name] = copyUserData(d)
+	}
+	return all
+}
+
+// Update applies fn to the user data and saves the store.
+func (s *UserStore) Update(name string, fn func(d *UserData)) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	d := s.users[name]
+	if d == nil {
+		d = &UserData{}
+		s.users[name] = d
+	}
+	fn(d)
+	data, err := json.MarshalIndent(s.users, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(s.path+".tmp", data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(s.path+".tmp", s.path)
+}
+
+var (
+	serveUserData = serveCmd.Flag("user-data",
+		"file persisting user favorites and settings").
+		Default("userdata.json").String()
+)
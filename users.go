@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Identity is an authenticated user.
+type Identity struct {
+	Name string
+	// Groups of the user, granting admin access with --admin-group
+	Groups []string
+}
+
+// Authenticator identifies the user sending requests.
+type Authenticator interface {
+	// Authenticate returns the user authenticated by req.
+	Authenticate(req *http.Request) (Identity, bool)
+	// Challenge replies to unauthenticated requests, asking for credentials.
+	Challenge(w http.ResponseWriter, req *http.Request)
+}
+
+// authChain accepts users authenticated by any of its authenticators, and
+// asks for the credentials of the first one.
+type authChain []Authenticator
+
+func (c authChain) Authenticate(req *http.Request) (Identity, bool) {
+	for _, a := range c {
+		if id, ok := a.Authenticate(req); ok {
+			return id, true
+		}
+	}
+	return Identity{}, false
+}
+
+func (c authChain) Challenge(w http.ResponseWriter, req *http.Request) {
+	c[0].Challenge(w, req)
+}
+
+// Users authenticates requests with HTTP basic authentication against a file
+// of "name:hash" lines, where the hash is a bcrypt one, as printed by:
+//
+//	htpasswd -nbB name password
+//
+// or the hex SHA-256 of the password, as printed by:
+//
+//	printf %s password | sha256sum
+//
+// Lines may end with a colon and a comma separated list of groups, like
+// "name:sha256hex:admins,crew".
+type Users struct {
+	hashes map[string]string
+	groups map[string][]string
+}
+
+func LoadUsers(path string) (*Users, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	u := &Users{
+		hashes: map[string]string{},
+		groups: map[string][]string{},
+	}
+	scanner := bufio.NewScanner(fp)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) < 2 || parts[0] == "" {
+			return nil, fmt.Errorf("%s:%d: invalid user entry", path, n)
+		}
+		hash := parts[1]
+		if isBcrypt(hash) {
+			if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid bcrypt hash: %s",
+					path, n, err)
+			}
+		} else if len(hash) == 64 {
+			hash = strings.ToLower(hash)
+		} else {
+			return nil, fmt.Errorf("%s:%d: invalid user entry", path, n)
+		}
+		u.hashes[parts[0]] = hash
+		if len(parts) == 3 && parts[2] != "" {
+			u.groups[parts[0]] = strings.Split(parts[2], ",")
+		}
+	}
+	return u, scanner.Err()
+}
+
+// Authenticate returns the user authenticated by req.
+func (u *Users) Authenticate(req *http.Request) (Identity, bool) {
+	name, password, ok := req.BasicAuth()
+	if !ok {
+		return Identity{}, false
+	}
+	expected, ok := u.hashes[name]
+	if !ok {
+		// Compare anyway so unknown users take as long as known ones
+		expected = strings.Repeat("0", 64)
+	}
+	match := false
+	if isBcrypt(expected) {
+		match = bcrypt.CompareHashAndPassword([]byte(expected),
+			[]byte(password)) == nil
+	} else {
+		h := sha256.Sum256([]byte(password))
+		match = subtle.ConstantTimeCompare([]byte(hex.EncodeToString(h[:])),
+			[]byte(expected)) == 1
+	}
+	if !ok || !match {
+		return Identity{}, false
+	}
+	return Identity{Name: name, Groups: u.groups[name]}, true
+}
+
+// isBcrypt tells whether hash is a bcrypt one, like "$2y$05$...".
+func isBcrypt(hash string) bool {
+	return strings.HasPrefix(hash, "$2")
+}
+
+// Challenge replies with a 401 asking for basic authentication.
+func (u *Users) Challenge(w http.ResponseWriter, req *http.Request) {
+	challengeBasic(w)
+}
+
+// requireIdentity returns the authenticated user, or challenges the client
+// and returns false.
+func requireIdentity(auth Authenticator, w http.ResponseWriter,
+	req *http.Request) (Identity, bool) {
+
+	id, ok := auth.Authenticate(req)
+	if !ok {
+		auth.Challenge(w, req)
+		return Identity{}, false
+	}
+	return id, true
+}
+
+// requireUser returns the name of the authenticated user, or challenges the
+// client and returns false.
+func requireUser(auth Authenticator, w http.ResponseWriter, req *http.Request) (
+	string, bool) {
+
+	id, ok := requireIdentity(auth, w, req)
+	return id.Name, ok
+}
+
+var (
+	serveUsers = serveCmd.Flag("users",
+		"file of name:hash lines, bcrypt or sha256(password) hashes, "+
+			"enabling user features").
+		String()
+)
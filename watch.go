@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+var (
+	watchCmd = app.Command("watch",
+		"poll areas and print new bulletin editions, or pipe them to a command")
+	watchAreas = watchCmd.Flag("area",
+		"area to watch, can be repeated, all by default").Strings()
+	watchRefresh = watchCmd.Flag("refresh",
+		"delay between upstream fetches").Default("10m").Duration()
+	watchExec = watchCmd.Flag("exec",
+		"shell command receiving every new bulletin on stdin, with METMAR_AREA and METMAR_TITLE set").
+		String()
+	watchInitial = watchCmd.Flag("initial",
+		"also output current bulletins at startup").Bool()
+)
+
+// outputBulletin prints f to stdout or pipes it to command.
+func outputBulletin(f Forecast, command string) error {
+	if command == "" {
+		fmt.Printf("==> %s (%s) <==\n%s\n\n", f.Title, f.Id, f.Content)
+		return nil
+	}
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdin = strings.NewReader(f.Content)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(),
+		"METMAR_AREA="+f.Id,
+		"METMAR_TITLE="+f.Title)
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("running command for area %s: %s", f.Id, err)
+	}
+	return nil
+}
+
+// watchChanges outputs forecasts of selected areas whose content hash
+// changed. Areas seen for the first time are output only if initial is set.
+func watchChanges(forecasts []Forecast, areas map[string]bool,
+	hashes map[string]string, initial bool, command string) error {
+
+	for _, f := range forecasts {
+		if len(areas) > 0 && !areas[f.Id] {
+			continue
+		}
+		h := hashReport(f.Content)
+		prev, seen := hashes[f.Id]
+		if seen && prev == h {
+			continue
+		}
+		if seen || initial {
+			err := outputBulletin(f, command)
+			if err != nil {
+				return err
+			}
+		}
+		hashes[f.Id] = h
+	}
+	return nil
+}
+
+func watchFn() error {
+	areas := map[string]bool{}
+	for _, a := range *watchAreas {
+		areas[a] = true
+	}
+	upstream, err := newForecastSource()
+	if err != nil {
+		return err
+	}
+	ctx, stop := signalContext()
+	defer stop()
+	hashes := map[string]string{}
+	initial := *watchInitial
+	for {
+		forecasts, err := fetchForecasts(ctx, upstream)
+		if err == nil {
+			err = watchChanges(forecasts, areas, hashes, initial, *watchExec)
+			initial = true
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			slog.Error("watching forecasts", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(*watchRefresh):
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// WebhookNotifier posts new special bulletins as JSON GaleEvent, or gale
+// archive anomalies as JSON GaleAnomaly, to a URL.
+type WebhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func NewWebhookNotifier(url string) *WebhookNotifier {
+	return &WebhookNotifier{
+		url:    url,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// postJSON posts data to url. Webhook URLs often embed secrets, so errors
+// only mention their host.
+func postJSON(client *http.Client, url string, data []byte) error {
+	rsp, err := client.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return checkPushResponse(rsp, err, "webhook")
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode < 200 || rsp.StatusCode >= 300 {
+		return fmt.Errorf("got %d posting to %s", rsp.StatusCode,
+			urlHost(url))
+	}
+	return nil
+}
+
+func (n *WebhookNotifier) Name() string {
+	return "webhook " + urlHost(n.url)
+}
+
+func (n *WebhookNotifier) Notify(notif Notification) error {
+	if notif.Anomaly != nil {
+		data, err := json.Marshal(notif.Anomaly)
+		if err != nil {
+			return err
+		}
+		return postJSON(n.client, n.url, data)
+	}
+	if notif.Event == nil {
+		return nil
+	}
+	data, err := json.Marshal(notif.Event)
+	if err != nil {
+		return err
+	}
+	return postJSON(n.client, n.url, data)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	reLinkHeader = regexp.MustCompile(`<([^>]*)>\s*;[^,]*rel="?[^",]*\bwebmention\b`)
+	reLinkTag    = regexp.MustCompile(`(?is)<(?:link|a)\b[^>]*>`)
+	reRelAttr    = regexp.MustCompile(`(?is)\brel\s*=\s*["']?([^"'>]*)`)
+	reHrefAttr   = regexp.MustCompile(`(?is)\bhref\s*=\s*["']([^"']*)["']`)
+)
+
+// discoverWebmention returns the Webmention endpoint advertised by target,
+// either in a Link header or a link or a element with a webmention rel.
+func discoverWebmention(client *http.Client, target string) (string, error) {
+	base, err := url.Parse(target)
+	if err != nil {
+		return "", err
+	}
+	rsp, err := client.Get(target)
+	if err != nil {
+		return "", err
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode < 200 || rsp.StatusCode >= 300 {
+		return "", fmt.Errorf("got %d fetching %s", rsp.StatusCode, target)
+	}
+	endpoint := ""
+	for _, link := range rsp.Header["Link"] {
+		if m := reLinkHeader.FindStringSubmatch(link); m != nil {
+			endpoint = m[1]
+			break
+		}
+	}
+	if endpoint == "" && strings.Contains(rsp.Header.Get("Content-Type"), "html") {
+		body, err := io.ReadAll(io.LimitReader(rsp.Body, 1<<20))
+		if err != nil {
+			return "", err
+		}
+		for _, tag := range reLinkTag.FindAllString(string(body), -1) {
+			rel := reRelAttr.FindStringSubmatch(tag)
+			href := reHrefAttr.FindStringSubmatch(tag)
+			if rel == nil || href == nil {
+				continue
+			}
+			for _, r := range strings.Fields(rel[1]) {
+				if strings.EqualFold(r, "webmention") {
+					endpoint = href[1]
+					break
+				}
+			}
+			if endpoint != "" {
+				break
+			}
+		}
+	}
+	if endpoint == "" {
+		return "", fmt.Errorf("no webmention endpoint found at %s", target)
+	}
+	u, err := base.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+// WebmentionNotifier sends a Webmention to target for every archived
+// bulletin revision, whose h-entry page is the source.
+type WebmentionNotifier struct {
+	baseURL string
+	target  string
+	client  *http.Client
+}
+
+// NewWebmentionNotifier returns a notifier mentioning target. baseURL is the
+// public URL of the server, including its prefix.
+func NewWebmentionNotifier(baseURL, target string) *WebmentionNotifier {
+	return &WebmentionNotifier{
+		baseURL: baseURL,
+		target:  target,
+		client:  &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (n *WebmentionNotifier) Name() string {
+	return "webmention " + n.target
+}
+
+func (n *WebmentionNotifier) Notify(notif Notification) error {
+	if notif.Revision == nil {
+		return nil
+	}
+	endpoint, err := discoverWebmention(n.client, n.target)
+	if err != nil {
+		return err
+	}
+	source := n.baseURL + revisionPath("", *notif.Revision)
+	rsp, err := n.client.PostForm(endpoint, url.Values{
+		"source": {source},
+		"target": {n.target},
+	})
+	if err != nil {
+		return err
+	}
+	rsp.Body.Close()
+	if rsp.StatusCode < 200 || rsp.StatusCode >= 300 {
+		return fmt.Errorf("got %d sending webmention to %s", rsp.StatusCode,
+			endpoint)
+	}
+	return nil
+}